@@ -45,6 +45,13 @@ type BlocksCleanerConfig struct {
 	ShardingStrategy                   string
 	CompactionStrategy                 string
 	BlockRanges                        []int64
+	BucketIndexCompression             bucketindex.CompressionConfig
+	BucketIndexSummaryEnabled          bool
+	BucketIndexCountBlockFiles         bool
+	BucketIndexExcludeEmptyBlocks      bool
+	BucketIndexMaxConcurrentWrites     int
+	BucketIndexDriftCheckInterval      time.Duration
+	BucketIndexDriftCheckMaxBlocks     int
 }
 
 type BlocksCleaner struct {
@@ -61,10 +68,16 @@ type BlocksCleaner struct {
 	// Keep track of the last owned users.
 	lastOwnedUsers []string
 
+	// Keep track of the last owned active users, whose bucket index drift is checked.
+	lastActiveUsers []string
+
 	cleanerVisitMarkerTimeout            time.Duration
 	cleanerVisitMarkerFileUpdateInterval time.Duration
 	compactionVisitMarkerTimeout         time.Duration
 
+	// Optional limit of the concurrent bucket index writes across all the tenants. Nil if disabled.
+	indexWriteLimiter *bucketindex.WriteLimiter
+
 	// Metrics.
 	runsStarted                       *prometheus.CounterVec
 	runsCompleted                     *prometheus.CounterVec
@@ -79,7 +92,15 @@ type BlocksCleaner struct {
 	tenantBlocksMarkedForDelete       *prometheus.GaugeVec
 	tenantBlocksMarkedForNoCompaction *prometheus.GaugeVec
 	tenantPartialBlocks               *prometheus.GaugeVec
+	tenantEmptyBlocks                 *prometheus.GaugeVec
+	tenantShadowedBlocks              *prometheus.GaugeVec
+	tenantOverlappingBlocks           *prometheus.GaugeVec
 	tenantBucketIndexLastUpdate       *prometheus.GaugeVec
+	tenantBucketIndexDriftBlocks      *prometheus.GaugeVec
+	unknownDeletionMarkVersions       prometheus.Counter
+	updaterListDuration               *prometheus.HistogramVec
+	updaterMetaFetchDuration          prometheus.Histogram
+	updaterMarksFetchDuration         prometheus.Histogram
 	tenantBlocksCleanedTotal          *prometheus.CounterVec
 	tenantCleanDuration               *prometheus.GaugeVec
 	remainingPlannedCompactions       *prometheus.GaugeVec
@@ -116,6 +137,14 @@ func NewBlocksCleaner(
 		}, commonLabels)
 	}
 
+	var tenantOverlappingBlocks *prometheus.GaugeVec
+	if cfg.CompactionStrategy != util.CompactionStrategyPartitioning {
+		tenantOverlappingBlocks = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_overlapping_blocks",
+			Help: "Total number of compacted blocks not marked for deletion whose time range overlaps another one in the bucket index. Not available with partitioning compaction strategy",
+		}, commonLabels)
+	}
+
 	c := &BlocksCleaner{
 		cfg:                                  cfg,
 		bucketClient:                         bucketClient,
@@ -179,10 +208,41 @@ func NewBlocksCleaner(
 			Name: "cortex_bucket_blocks_partials_count",
 			Help: "Total number of partial blocks.",
 		}, commonLabels),
+		tenantEmptyBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_empty_blocks",
+			Help: "Total number of blocks without samples in the bucket, including the ones excluded from the bucket index.",
+		}, commonLabels),
+		tenantShadowedBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_shadowed_blocks",
+			Help: "Total number of blocks not marked for deletion in the bucket index which have been fully compacted into another block not marked for deletion, so that their samples are double counted by the queries.",
+		}, commonLabels),
 		tenantBucketIndexLastUpdate: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
 			Name: "cortex_bucket_index_last_successful_update_timestamp_seconds",
 			Help: "Timestamp of the last successful update of a tenant's bucket index.",
 		}, commonLabels),
+		tenantBucketIndexDriftBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_drift_blocks",
+			Help: "Difference between the number of blocks listed in the bucket and the number of blocks in the bucket index, as of the last drift check. Only available if the bucket index drift check is enabled.",
+		}, commonLabels),
+		unknownDeletionMarkVersions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_unknown_deletion_mark_versions_total",
+			Help: "Total number of block deletion marks skipped while updating the bucket index because of an unknown version.",
+		}),
+		updaterListDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cortex_bucket_index_updater_list_duration_seconds",
+			Help:    "Duration of the listing of the blocks or the block deletion marks while updating the bucket index, by phase.",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+		}, []string{"phase"}),
+		updaterMetaFetchDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_bucket_index_updater_meta_fetch_duration_seconds",
+			Help:    "Duration of fetching the meta.json of the new blocks while updating the bucket index.",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+		}),
+		updaterMarksFetchDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_bucket_index_updater_marks_fetch_duration_seconds",
+			Help:    "Duration of fetching the new block deletion marks while updating the bucket index.",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+		}),
 		tenantBlocksCleanedTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "cortex_bucket_blocks_cleaned_total",
 			Help: "Total number of blocks deleted for a tenant.",
@@ -191,6 +251,7 @@ func NewBlocksCleaner(
 			Name: "cortex_bucket_clean_duration_seconds",
 			Help: "Duration of cleaner runtime for a tenant in seconds",
 		}, commonLabels),
+		tenantOverlappingBlocks:     tenantOverlappingBlocks,
 		remainingPlannedCompactions: remainingPlannedCompactions,
 		inProgressCompactions:       inProgressCompactions,
 		oldestPartitionGroupOffset:  oldestPartitionGroupOffset,
@@ -200,6 +261,10 @@ func NewBlocksCleaner(
 		}, []string{"user_status"}),
 	}
 
+	if cfg.BucketIndexMaxConcurrentWrites > 0 {
+		c.indexWriteLimiter = bucketindex.NewWriteLimiter(cfg.BucketIndexMaxConcurrentWrites, reg)
+	}
+
 	c.Service = services.NewBasicService(c.starting, c.loop, nil)
 
 	return c
@@ -221,6 +286,7 @@ func (c *BlocksCleaner) starting(ctx context.Context) error {
 		c.runsFailed.WithLabelValues(activeStatus).Inc()
 		return nil
 	}
+	c.lastActiveUsers = activeUsers
 	err = c.cleanUpActiveUsers(ctx, activeUsers, true)
 	c.checkRunError(activeStatus, err)
 	err = c.cleanDeletedUsers(ctx, deletedUsers)
@@ -253,6 +319,22 @@ func (c *BlocksCleaner) loop(ctx context.Context) error {
 		}()
 	}
 
+	var (
+		driftChan   chan *cleanerJob
+		driftTicker <-chan time.Time
+	)
+	if c.cfg.BucketIndexDriftCheckInterval > 0 {
+		driftChan = make(chan *cleanerJob)
+		defer close(driftChan)
+		go func() {
+			c.runBucketIndexDriftWorker(ctx, driftChan)
+		}()
+
+		dt := time.NewTicker(c.cfg.BucketIndexDriftCheckInterval)
+		defer dt.Stop()
+		driftTicker = dt.C
+	}
+
 	for {
 		select {
 		case <-t.C:
@@ -263,6 +345,7 @@ func (c *BlocksCleaner) loop(ctx context.Context) error {
 				c.runsFailed.WithLabelValues(activeStatus).Inc()
 				continue
 			}
+			c.lastActiveUsers = activeUsers
 			cleanJobTimestamp := time.Now().Unix()
 
 			select {
@@ -296,6 +379,16 @@ func (c *BlocksCleaner) loop(ctx context.Context) error {
 				}
 			}
 
+		case <-driftTicker:
+			select {
+			case driftChan <- &cleanerJob{
+				users:     c.lastActiveUsers,
+				timestamp: time.Now().Unix(),
+			}:
+			default:
+				level.Warn(c.logger).Log("msg", "unable to push bucket index drift check job to driftChan, the previous check is still running")
+			}
+
 		case <-ctx.Done():
 			return nil
 		}
@@ -330,6 +423,47 @@ func (c *BlocksCleaner) runEmitPartitionMetricsWorker(ctx context.Context, jobCh
 	}
 }
 
+func (c *BlocksCleaner) runBucketIndexDriftWorker(ctx context.Context, jobChan <-chan *cleanerJob) {
+	for job := range jobChan {
+		err := concurrency.ForEachUser(ctx, job.users, c.cfg.CleanupConcurrency, func(ctx context.Context, userID string) error {
+			c.checkBucketIndexDrift(ctx, util_log.WithUserID(userID, c.logger), userID)
+			return nil
+		})
+
+		if err != nil {
+			level.Error(c.logger).Log("msg", "bucket index drift check failed", "err", err.Error())
+		}
+	}
+}
+
+// checkBucketIndexDrift compares the number of blocks in the tenant's bucket index with the number
+// of blocks listed in the storage, and tracks the difference in the drift metric.
+func (c *BlocksCleaner) checkBucketIndexDrift(ctx context.Context, userLogger log.Logger, userID string) {
+	idx, err := bucketindex.ReadIndex(ctx, c.bucketClient, userID, c.cfgProvider, userLogger)
+	if errors.Is(err, bucketindex.ErrIndexNotFound) {
+		// The index hasn't been written yet.
+		c.tenantBucketIndexDriftBlocks.DeleteLabelValues(userID)
+		return
+	}
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to read bucket index to check its drift", "err", err)
+		return
+	}
+
+	drift, err := bucketindex.BlocksDrift(ctx, c.bucketClient, userID, c.cfgProvider, idx, c.cfg.BucketIndexDriftCheckMaxBlocks)
+	if errors.Is(err, bucketindex.ErrDriftCheckTooManyBlocks) {
+		level.Debug(userLogger).Log("msg", "skipped bucket index drift check", "err", err)
+		c.tenantBucketIndexDriftBlocks.DeleteLabelValues(userID)
+		return
+	}
+	if err != nil {
+		level.Warn(userLogger).Log("msg", "failed to check bucket index drift", "err", err)
+		return
+	}
+
+	c.tenantBucketIndexDriftBlocks.WithLabelValues(userID).Set(float64(drift))
+}
+
 func (c *BlocksCleaner) runActiveUserCleanup(ctx context.Context, jobChan <-chan *cleanerJob) {
 	for job := range jobChan {
 		if job.timestamp < time.Now().Add(-c.cfg.CleanupInterval).Unix() {
@@ -423,7 +557,13 @@ func (c *BlocksCleaner) scanUsers(ctx context.Context) ([]string, []string, erro
 			c.tenantBlocksMarkedForDelete.DeleteLabelValues(userID)
 			c.tenantBlocksMarkedForNoCompaction.DeleteLabelValues(userID)
 			c.tenantPartialBlocks.DeleteLabelValues(userID)
+			c.tenantEmptyBlocks.DeleteLabelValues(userID)
+			c.tenantShadowedBlocks.DeleteLabelValues(userID)
 			c.tenantBucketIndexLastUpdate.DeleteLabelValues(userID)
+			c.tenantBucketIndexDriftBlocks.DeleteLabelValues(userID)
+			if c.tenantOverlappingBlocks != nil {
+				c.tenantOverlappingBlocks.DeleteLabelValues(userID)
+			}
 			if c.cfg.ShardingStrategy == util.ShardingStrategyShuffle {
 				c.remainingPlannedCompactions.DeleteLabelValues(userID)
 				if c.cfg.CompactionStrategy == util.CompactionStrategyPartitioning {
@@ -474,6 +614,7 @@ func (c *BlocksCleaner) deleteUserMarkedForDeletion(ctx context.Context, userLog
 		return err
 	}
 	c.tenantBucketIndexLastUpdate.DeleteLabelValues(userID)
+	c.tenantBucketIndexDriftBlocks.DeleteLabelValues(userID)
 
 	var blocksToDelete []interface{}
 	err := userBucket.Iter(ctx, "", func(name string) error {
@@ -530,6 +671,11 @@ func (c *BlocksCleaner) deleteUserMarkedForDeletion(ctx context.Context, userLog
 	c.tenantBlocksMarkedForDelete.DeleteLabelValues(userID)
 	c.tenantBlocksMarkedForNoCompaction.DeleteLabelValues(userID)
 	c.tenantPartialBlocks.DeleteLabelValues(userID)
+	c.tenantEmptyBlocks.DeleteLabelValues(userID)
+	c.tenantShadowedBlocks.DeleteLabelValues(userID)
+	if c.tenantOverlappingBlocks != nil {
+		c.tenantOverlappingBlocks.DeleteLabelValues(userID)
+	}
 
 	if deletedBlocks.Load() > 0 {
 		level.Info(userLogger).Log("msg", "deleted blocks for tenant marked for deletion", "deletedBlocks", deletedBlocks.Load())
@@ -680,12 +826,21 @@ func (c *BlocksCleaner) cleanUser(ctx context.Context, userLogger log.Logger, us
 
 	// Generate an updated in-memory version of the bucket index.
 	begin = time.Now()
-	w := bucketindex.NewUpdater(c.bucketClient, userID, c.cfgProvider, c.logger)
+	w := bucketindex.NewUpdater(c.bucketClient, userID, c.cfgProvider, c.logger).
+		WithUnknownDeletionMarkVersionsCounter(c.unknownDeletionMarkVersions).
+		WithPhaseDurationHistograms(c.updaterListDuration.WithLabelValues("blocks"), c.updaterListDuration.WithLabelValues("marks"), c.updaterMetaFetchDuration, c.updaterMarksFetchDuration).
+		WithEmptyBlocksGauge(c.tenantEmptyBlocks.WithLabelValues(userID))
 
 	parquetEnabled := c.cfgProvider.ParquetConverterEnabled(userID)
 	if parquetEnabled {
 		w.EnableParquet()
 	}
+	if c.cfg.BucketIndexCountBlockFiles {
+		w.WithBlockFilesCount()
+	}
+	if c.cfg.BucketIndexExcludeEmptyBlocks {
+		w.WithEmptyBlocksExcluded()
+	}
 
 	idx, partials, totalBlocksBlocksMarkedForNoCompaction, err := w.UpdateIndex(ctx, idx)
 	if err != nil {
@@ -694,6 +849,13 @@ func (c *BlocksCleaner) cleanUser(ctx context.Context, userLogger log.Logger, us
 	}
 	level.Info(userLogger).Log("msg", "finish updating index", "duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds())
 
+	// The blocks without samples excluded from the index are subject to the retention too. They're marked
+	// for deletion by this update, and deleted by a following one once the deletion delay elapsed.
+	if excluded := w.ExcludedEmptyBlocks(); len(excluded) > 0 {
+		retention := c.cfgProvider.CompactorBlocksRetentionPeriod(userID)
+		c.applyUserRetentionPeriod(ctx, &bucketindex.Index{Blocks: excluded, BlockDeletionMarks: idx.BlockDeletionMarks}, retention, userBucket, userLogger, userID)
+	}
+
 	// Delete blocks marked for deletion. We iterate over a copy of deletion marks because
 	// we'll need to manipulate the index (removing blocks which get deleted).
 	begin = time.Now()
@@ -744,16 +906,35 @@ func (c *BlocksCleaner) cleanUser(ctx context.Context, userLogger log.Logger, us
 			return err
 		}
 		bucketIndexDeleted = true
+		c.tenantBucketIndexLastUpdate.WithLabelValues(userID).SetToCurrentTime()
 	} else {
 		// Upload the updated index to the storage.
 		begin = time.Now()
-		if err := bucketindex.WriteIndex(ctx, c.bucketClient, userID, c.cfgProvider, idx); err != nil {
+		if err := c.writeIndex(ctx, userID, idx); err != nil {
 			return err
 		}
+		// Track the last successful write, so that a stuck updater can be detected for the tenant.
+		c.tenantBucketIndexLastUpdate.WithLabelValues(userID).SetToCurrentTime()
 		level.Info(userLogger).Log("msg", "finish writing new index", "duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds())
 	}
 	c.updateBucketMetrics(userID, parquetEnabled, idx, float64(len(partials)), float64(totalBlocksBlocksMarkedForNoCompaction))
 
+	// Shadowed blocks are only reported, so that the cleanup of the compacted blocks can be verified.
+	shadowed := idx.FindShadowedBlocks()
+	if len(shadowed) > 0 {
+		level.Warn(userLogger).Log("msg", "found blocks not marked for deletion in the bucket index which have been compacted into another block", "blocks", shadowed)
+	}
+	c.tenantShadowedBlocks.WithLabelValues(userID).Set(float64(len(shadowed)))
+
+	// Overlapping blocks are only reported, since they require an operator to investigate them.
+	if c.tenantOverlappingBlocks != nil {
+		overlapping := bucketindex.DetectOverlappingBlocks(idx)
+		if len(overlapping) > 0 {
+			level.Warn(userLogger).Log("msg", "found compacted blocks with overlapping time ranges in the bucket index", "blocks", bucketindex.Blocks(overlapping).String())
+		}
+		c.tenantOverlappingBlocks.WithLabelValues(userID).Set(float64(len(overlapping)))
+	}
+
 	if c.cfg.ShardingStrategy == util.ShardingStrategyShuffle && c.cfg.CompactionStrategy == util.CompactionStrategyPartitioning {
 		begin = time.Now()
 		c.cleanPartitionedGroupInfo(ctx, userBucket, userLogger, userID)
@@ -762,12 +943,30 @@ func (c *BlocksCleaner) cleanUser(ctx context.Context, userLogger log.Logger, us
 	return nil
 }
 
+// writeIndex writes the bucket index of the input tenant, along with its summary if enabled, within
+// the limit of the concurrent bucket index writes, if any.
+func (c *BlocksCleaner) writeIndex(ctx context.Context, userID string, idx *bucketindex.Index) error {
+	write := func() error {
+		if err := bucketindex.WriteIndexWithCompression(ctx, c.bucketClient, userID, c.cfgProvider, idx, c.cfg.BucketIndexCompression); err != nil {
+			return err
+		}
+		if c.cfg.BucketIndexSummaryEnabled {
+			return bucketindex.WriteIndexSummary(ctx, c.bucketClient, userID, c.cfgProvider, idx)
+		}
+		return nil
+	}
+
+	if c.indexWriteLimiter == nil {
+		return write()
+	}
+	return c.indexWriteLimiter.Write(ctx, write)
+}
+
 func (c *BlocksCleaner) updateBucketMetrics(userID string, parquetEnabled bool, idx *bucketindex.Index, partials, totalBlocksBlocksMarkedForNoCompaction float64) {
 	c.tenantBlocks.WithLabelValues(userID).Set(float64(len(idx.Blocks)))
 	c.tenantBlocksMarkedForDelete.WithLabelValues(userID).Set(float64(len(idx.BlockDeletionMarks)))
 	c.tenantBlocksMarkedForNoCompaction.WithLabelValues(userID).Set(totalBlocksBlocksMarkedForNoCompaction)
 	c.tenantPartialBlocks.WithLabelValues(userID).Set(float64(partials))
-	c.tenantBucketIndexLastUpdate.WithLabelValues(userID).SetToCurrentTime()
 	if parquetEnabled {
 		c.tenantParquetBlocks.WithLabelValues(userID).Set(float64(len(idx.ParquetBlocks())))
 		remainingBlocksToConvert := 0
@@ -1,8 +1,11 @@
 package compactor
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"path"
 	"strings"
@@ -512,6 +515,280 @@ func TestBlocksCleaner_ShouldRebuildBucketIndexOnCorruptedOne(t *testing.T) {
 	require.Equal(t, bucketindex.Ok, s.Status)
 }
 
+func TestBlocksCleaner_ShouldUpdateBucketIndexLastUpdateOnlyOnSuccessfulWrite(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = bucketindex.BucketWithGlobalMarkers(bkt)
+
+	ctx := context.Background()
+	mbucket := &cortex_testutil.MockBucketFailure{
+		Bucket: bkt,
+		UploadFailures: map[string]error{
+			path.Join(userID, bucketindex.IndexCompressedFilename): errors.New("mocked upload failure"),
+		},
+	}
+	createTSDBBlock(t, bkt, userID, 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:      12 * time.Hour,
+		CleanupInterval:    time.Minute,
+		CleanupConcurrency: 1,
+		BlockRanges:        (&tsdb.DurationList{2 * time.Hour, 12 * time.Hour, 24 * time.Hour}).ToMilliseconds(),
+	}
+
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+		Strategy: tsdb.UserScanStrategyList,
+	}, bkt, logger, reg)
+	require.NoError(t, err)
+	cfgProvider := newMockConfigProvider()
+	blocksMarkedForDeletion := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: blocksMarkedForDeletionName,
+		Help: blocksMarkedForDeletionHelp,
+	}, append(commonLabels, reasonLabelName))
+	dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+	cleaner := NewBlocksCleaner(cfg, mbucket, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+	// The bucket index write fails, so the last update timestamp should not be tracked.
+	userLogger := util_log.WithUserID(userID, cleaner.logger)
+	userBucket := bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+	require.Error(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+	assert.Equal(t, 0, prom_testutil.CollectAndCount(cleaner.tenantBucketIndexLastUpdate))
+
+	// The bucket index write succeeds.
+	cleaner.bucketClient = bkt
+	userBucket = bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+	assert.Equal(t, 1, prom_testutil.CollectAndCount(cleaner.tenantBucketIndexLastUpdate))
+	assert.Greater(t, prom_testutil.ToFloat64(cleaner.tenantBucketIndexLastUpdate.WithLabelValues(userID)), float64(0))
+}
+
+func TestBlocksCleaner_ShouldWriteBucketIndexSummaryIfEnabled(t *testing.T) {
+	const userID = "user-1"
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+			bkt = bucketindex.BucketWithGlobalMarkers(bkt)
+
+			ctx := context.Background()
+			blockID := createTSDBBlock(t, bkt, userID, 10, 20, nil)
+
+			cfg := BlocksCleanerConfig{
+				DeletionDelay:             12 * time.Hour,
+				CleanupInterval:           time.Minute,
+				CleanupConcurrency:        1,
+				BlockRanges:               (&tsdb.DurationList{2 * time.Hour, 12 * time.Hour, 24 * time.Hour}).ToMilliseconds(),
+				BucketIndexSummaryEnabled: enabled,
+			}
+
+			logger := log.NewNopLogger()
+			reg := prometheus.NewRegistry()
+			scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+				Strategy: tsdb.UserScanStrategyList,
+			}, bkt, logger, reg)
+			require.NoError(t, err)
+			cfgProvider := newMockConfigProvider()
+			blocksMarkedForDeletion := prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: blocksMarkedForDeletionName,
+				Help: blocksMarkedForDeletionHelp,
+			}, append(commonLabels, reasonLabelName))
+			dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+			cleaner := NewBlocksCleaner(cfg, bkt, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+			userLogger := util_log.WithUserID(userID, cleaner.logger)
+			userBucket := bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+			require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+
+			summary, err := bucketindex.ReadIndexSummary(ctx, bkt, userID, logger)
+			if !enabled {
+				require.ErrorIs(t, err, bucketindex.ErrIndexSummaryNotFound)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, []bucketindex.BlockSummary{{ID: blockID, MinTime: 10, MaxTime: 20}}, summary.Blocks)
+		})
+	}
+}
+
+func TestBlocksCleaner_ShouldTrackOverlappingBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = bucketindex.BucketWithGlobalMarkers(bkt)
+
+	ctx := context.Background()
+
+	// Two compacted blocks covering the same time range, and a not compacted one overlapping them.
+	for _, compactionLevel := range []int{2, 3} {
+		id := ulid.MustNew(ulid.Now(), rand.Reader)
+		meta := fmt.Sprintf(`{"ulid":"%s","minTime":10,"maxTime":20,"version":1,"compaction":{"level":%d}}`, id, compactionLevel)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, id.String(), block.MetaFilename), strings.NewReader(meta)))
+	}
+	createTSDBBlock(t, bkt, userID, 10, 20, nil)
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:      12 * time.Hour,
+		CleanupInterval:    time.Minute,
+		CleanupConcurrency: 1,
+		BlockRanges:        (&tsdb.DurationList{2 * time.Hour, 12 * time.Hour, 24 * time.Hour}).ToMilliseconds(),
+	}
+
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+		Strategy: tsdb.UserScanStrategyList,
+	}, bkt, logger, reg)
+	require.NoError(t, err)
+	cfgProvider := newMockConfigProvider()
+	blocksMarkedForDeletion := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: blocksMarkedForDeletionName,
+		Help: blocksMarkedForDeletionHelp,
+	}, append(commonLabels, reasonLabelName))
+	dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+	userLogger := util_log.WithUserID(userID, cleaner.logger)
+	userBucket := bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+
+	assert.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_bucket_index_overlapping_blocks Total number of compacted blocks not marked for deletion whose time range overlaps another one in the bucket index. Not available with partitioning compaction strategy
+		# TYPE cortex_bucket_index_overlapping_blocks gauge
+		cortex_bucket_index_overlapping_blocks{user="user-1"} 2
+	`), "cortex_bucket_index_overlapping_blocks"))
+}
+
+func TestBlocksCleaner_ShouldTrackShadowedBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = bucketindex.BucketWithGlobalMarkers(bkt)
+
+	ctx := context.Background()
+
+	// A compacted block whose sources haven't been marked for deletion.
+	source1 := createTSDBBlock(t, bkt, userID, 10, 20, nil)
+	source2 := createTSDBBlock(t, bkt, userID, 20, 30, nil)
+	compacted := ulid.MustNew(ulid.Now(), rand.Reader)
+	meta := fmt.Sprintf(`{"ulid":"%s","minTime":10,"maxTime":30,"version":1,"compaction":{"level":2,"sources":["%s","%s"]}}`, compacted, source1, source2)
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, compacted.String(), block.MetaFilename), strings.NewReader(meta)))
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:      12 * time.Hour,
+		CleanupInterval:    time.Minute,
+		CleanupConcurrency: 1,
+		BlockRanges:        (&tsdb.DurationList{2 * time.Hour, 12 * time.Hour, 24 * time.Hour}).ToMilliseconds(),
+	}
+
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+		Strategy: tsdb.UserScanStrategyList,
+	}, bkt, logger, reg)
+	require.NoError(t, err)
+	cfgProvider := newMockConfigProvider()
+	blocksMarkedForDeletion := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: blocksMarkedForDeletionName,
+		Help: blocksMarkedForDeletionHelp,
+	}, append(commonLabels, reasonLabelName))
+	dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+	userLogger := util_log.WithUserID(userID, cleaner.logger)
+	userBucket := bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+
+	assert.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_bucket_index_shadowed_blocks Total number of blocks not marked for deletion in the bucket index which have been fully compacted into another block not marked for deletion, so that their samples are double counted by the queries.
+		# TYPE cortex_bucket_index_shadowed_blocks gauge
+		cortex_bucket_index_shadowed_blocks{user="user-1"} 2
+	`), "cortex_bucket_index_shadowed_blocks"))
+
+	// Once the sources are marked for deletion, they're not shadowed anymore.
+	for _, id := range []ulid.ULID{source1, source2} {
+		require.NoError(t, block.MarkForDeletion(ctx, logger, userBucket, id, "compacted", prometheus.NewCounter(prometheus.CounterOpts{})))
+	}
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+
+	assert.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_bucket_index_shadowed_blocks Total number of blocks not marked for deletion in the bucket index which have been fully compacted into another block not marked for deletion, so that their samples are double counted by the queries.
+		# TYPE cortex_bucket_index_shadowed_blocks gauge
+		cortex_bucket_index_shadowed_blocks{user="user-1"} 0
+	`), "cortex_bucket_index_shadowed_blocks"))
+}
+
+func TestBlocksCleaner_ShouldTrackBucketIndexDrift(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = bucketindex.BucketWithGlobalMarkers(bkt)
+
+	ctx := context.Background()
+
+	block1 := createTSDBBlock(t, bkt, userID, 10, 20, nil)
+	createTSDBBlock(t, bkt, userID, 20, 30, nil)
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:                  12 * time.Hour,
+		CleanupInterval:                time.Minute,
+		CleanupConcurrency:             1,
+		BlockRanges:                    (&tsdb.DurationList{2 * time.Hour, 12 * time.Hour, 24 * time.Hour}).ToMilliseconds(),
+		BucketIndexDriftCheckInterval:  time.Minute,
+		BucketIndexDriftCheckMaxBlocks: 10,
+	}
+
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+		Strategy: tsdb.UserScanStrategyList,
+	}, bkt, logger, reg)
+	require.NoError(t, err)
+	cfgProvider := newMockConfigProvider()
+	blocksMarkedForDeletion := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: blocksMarkedForDeletionName,
+		Help: blocksMarkedForDeletionHelp,
+	}, append(commonLabels, reasonLabelName))
+	dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+	cleaner := NewBlocksCleaner(cfg, bkt, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+	userLogger := util_log.WithUserID(userID, cleaner.logger)
+	userBucket := bucket.NewUserBucketClient(userID, cleaner.bucketClient, cleaner.cfgProvider)
+
+	// No drift is tracked until the bucket index has been written.
+	cleaner.checkBucketIndexDrift(ctx, userLogger, userID)
+	assert.Equal(t, 0, prom_testutil.CollectAndCount(cleaner.tenantBucketIndexDriftBlocks))
+
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+	cleaner.checkBucketIndexDrift(ctx, userLogger, userID)
+	assert.Equal(t, float64(0), prom_testutil.ToFloat64(cleaner.tenantBucketIndexDriftBlocks.WithLabelValues(userID)))
+
+	// Blocks uploaded after the last bucket index update.
+	createTSDBBlock(t, bkt, userID, 30, 40, nil)
+	createTSDBBlock(t, bkt, userID, 40, 50, nil)
+	cleaner.checkBucketIndexDrift(ctx, userLogger, userID)
+	assert.Equal(t, float64(2), prom_testutil.ToFloat64(cleaner.tenantBucketIndexDriftBlocks.WithLabelValues(userID)))
+
+	// A block deleted from the storage while it's still in the bucket index.
+	require.NoError(t, cleaner.cleanUser(ctx, userLogger, userBucket, userID, false))
+	require.NoError(t, block.Delete(ctx, logger, userBucket, block1))
+	cleaner.checkBucketIndexDrift(ctx, userLogger, userID)
+	assert.Equal(t, float64(-1), prom_testutil.ToFloat64(cleaner.tenantBucketIndexDriftBlocks.WithLabelValues(userID)))
+
+	// The drift is not checked if the tenant has more blocks than the max.
+	cleaner.cfg.BucketIndexDriftCheckMaxBlocks = 2
+	cleaner.checkBucketIndexDrift(ctx, userLogger, userID)
+	assert.Equal(t, 0, prom_testutil.CollectAndCount(cleaner.tenantBucketIndexDriftBlocks))
+}
+
 func TestBlocksCleaner_ShouldRemoveMetricsForTenantsNotBelongingAnymoreToTheShard(t *testing.T) {
 	bucketClient, _ := cortex_testutil.PrepareFilesystemBucket(t)
 	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
@@ -885,6 +1162,69 @@ func TestBlocksCleaner_ShouldRemoveBlocksOutsideRetentionPeriod(t *testing.T) {
 	}
 }
 
+func TestBlocksCleaner_ShouldApplyRetentionToExcludedEmptyBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bucketClient, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
+
+	ts := func(hours int) int64 {
+		return time.Now().Add(time.Duration(hours)*time.Hour).Unix() * 1000
+	}
+
+	// Mock a block with samples, and two blocks with series but without samples, one of them
+	// outside the retention period.
+	block1 := cortex_testutil.MockStorageBlock(t, bucketClient, userID, ts(-10), ts(-8))
+	var emptyBlocks []ulid.ULID
+	for _, hours := range []int{-10, -3} {
+		meta := cortex_testutil.MockStorageBlock(t, bucketClient, userID, ts(hours), ts(hours+2))
+		meta.Stats.NumSeries = 1
+		content, err := json.Marshal(meta)
+		require.NoError(t, err)
+		require.NoError(t, bucketClient.Upload(ctx, path.Join(userID, meta.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+		emptyBlocks = append(emptyBlocks, meta.ULID)
+	}
+
+	cfg := BlocksCleanerConfig{
+		DeletionDelay:                 time.Hour,
+		CleanupInterval:               time.Minute,
+		CleanupConcurrency:            1,
+		BucketIndexExcludeEmptyBlocks: true,
+	}
+
+	logger := log.NewNopLogger()
+	reg := prometheus.NewPedanticRegistry()
+	scanner, err := users.NewScanner(tsdb.UsersScannerConfig{
+		Strategy: tsdb.UserScanStrategyList,
+	}, bucketClient, logger, reg)
+	require.NoError(t, err)
+	cfgProvider := newMockConfigProvider()
+	cfgProvider.userRetentionPeriods[userID] = 5 * time.Hour
+	blocksMarkedForDeletion := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: blocksMarkedForDeletionName,
+		Help: blocksMarkedForDeletionHelp,
+	}, append(commonLabels, reasonLabelName))
+	dummyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{}, []string{"test"})
+
+	cleaner := NewBlocksCleaner(cfg, bucketClient, scanner, 60*time.Second, cfgProvider, logger, "test-cleaner", reg, time.Minute, 30*time.Second, blocksMarkedForDeletion, dummyGaugeVec)
+
+	// The first run builds the index, without the empty blocks, and applies the retention to them.
+	userBucket := bucket.NewUserBucketClient(userID, bucketClient, cfgProvider)
+	require.NoError(t, cleaner.cleanUser(ctx, logger, userBucket, userID, true))
+
+	idx, err := bucketindex.ReadIndex(ctx, bucketClient, userID, cfgProvider, logger)
+	require.NoError(t, err)
+	assert.Equal(t, []ulid.ULID{block1.ULID}, idx.Blocks.GetULIDs())
+
+	for i, expectMarked := range []bool{true, false} {
+		exists, err := userBucket.Exists(ctx, path.Join(emptyBlocks[i].String(), metadata.DeletionMarkFilename))
+		require.NoError(t, err)
+		assert.Equal(t, expectMarked, exists, "block %s", emptyBlocks[i])
+	}
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(blocksMarkedForDeletion.WithLabelValues(userID, reasonValueRetention)))
+}
+
 func TestBlocksCleaner_CleanPartitionedGroupInfo(t *testing.T) {
 	bucketClient, _ := cortex_testutil.PrepareFilesystemBucket(t)
 	bucketClient = bucketindex.BucketWithGlobalMarkers(bucketClient)
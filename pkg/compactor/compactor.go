@@ -271,6 +271,26 @@ type Config struct {
 	// Whether the migration of block deletion marks to the global markers location is enabled.
 	BlockDeletionMarksMigrationEnabled bool `yaml:"block_deletion_marks_migration_enabled"`
 
+	// Compression of the bucket index written by the blocks cleaner.
+	BucketIndexCompression bucketindex.CompressionConfig `yaml:"bucket_index_compression"`
+
+	// Whether the blocks cleaner writes the bucket index summary alongside the bucket index.
+	BucketIndexSummaryEnabled bool `yaml:"bucket_index_summary_enabled"`
+
+	// Whether the blocks cleaner counts the files of the blocks added to the bucket index.
+	BucketIndexCountBlockFiles bool `yaml:"bucket_index_count_block_files"`
+
+	// Whether the blocks cleaner excludes the blocks without samples from the bucket index.
+	BucketIndexExcludeEmptyBlocks bool `yaml:"bucket_index_exclude_empty_blocks"`
+
+	// Max number of bucket indexes concurrently written by the blocks cleaner, across all the tenants.
+	BucketIndexMaxConcurrentWrites int `yaml:"bucket_index_max_concurrent_writes"`
+
+	// Interval of the check of the drift between the blocks in the bucket and in the bucket index,
+	// and max number of blocks listed by each check.
+	BucketIndexDriftCheckInterval  time.Duration `yaml:"bucket_index_drift_check_interval"`
+	BucketIndexDriftCheckMaxBlocks int           `yaml:"bucket_index_drift_check_max_blocks"`
+
 	EnabledTenants  flagext.StringSliceCSV `yaml:"enabled_tenants"`
 	DisabledTenants flagext.StringSliceCSV `yaml:"disabled_tenants"`
 
@@ -331,6 +351,13 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 		"If not 0, blocks will be marked for deletion and compactor component will permanently delete blocks marked for deletion from the bucket. "+
 		"If 0, blocks will be deleted straight away. Note that deleting blocks immediately can cause query failures.")
 	f.DurationVar(&cfg.TenantCleanupDelay, "compactor.tenant-cleanup-delay", 6*time.Hour, "For tenants marked for deletion, this is time between deleting of last block, and doing final cleanup (marker files, debug files) of the tenant.")
+	cfg.BucketIndexCompression.RegisterFlagsWithPrefix(f, "compactor.bucket-index-compression.")
+	f.BoolVar(&cfg.BucketIndexSummaryEnabled, "compactor.bucket-index-summary-enabled", false, "[Experimental] When enabled, the blocks cleaner writes a bucket-index-summary.bin file alongside the bucket index, listing only the ID and time range of each block in a compact binary format, so that it can be read instead of the whole bucket index to find the tenants with blocks in a time range.")
+	f.BoolVar(&cfg.BucketIndexCountBlockFiles, "compactor.bucket-index-count-block-files", false, "[Experimental] When enabled, the blocks cleaner counts the objects stored under the location of each block added to the bucket index, and stores the count in the index, eg. to spot the blocks missing chunks files. It requires an additional listing of each new block location, which may be costly for tenants with many blocks.")
+	f.BoolVar(&cfg.BucketIndexExcludeEmptyBlocks, "compactor.bucket-index-exclude-empty-blocks", false, "[Experimental] When enabled, the blocks cleaner doesn't add the blocks without samples, according to their meta.json stats, to the bucket index, so that they're not queried. The blocks whose meta.json has no stats are not considered empty. The excluded blocks are still deleted by the retention.")
+	f.IntVar(&cfg.BucketIndexMaxConcurrentWrites, "compactor.bucket-index-max-concurrent-writes", 0, "[Experimental] Max number of bucket indexes concurrently written to the storage by the blocks cleaner, across all tenants, to smooth the write load on the object storage and avoid being throttled when the indexes of many tenants are written at the same time. The writes exceeding the limit wait for a free slot. It applies in addition to -compactor.cleanup-concurrency, and is only useful if lower than it. 0 to disable.")
+	f.DurationVar(&cfg.BucketIndexDriftCheckInterval, "compactor.bucket-index-drift-check-interval", 0, "[Experimental] How frequently the blocks cleaner compares the number of blocks in the bucket index of each owned tenant with the number of blocks listed in the storage, and exports the difference as the cortex_bucket_index_drift_blocks metric. A drift other than 0 may indicate that the bucket index updates are behind. Partial blocks are counted in the storage but not in the bucket index. 0 to disable.")
+	f.IntVar(&cfg.BucketIndexDriftCheckMaxBlocks, "compactor.bucket-index-drift-check-max-blocks", 10000, "[Experimental] Max number of blocks listed in the storage by each bucket index drift check of a tenant, to bound its cost. The drift of the tenants with more blocks is not checked.")
 	f.BoolVar(&cfg.BlockDeletionMarksMigrationEnabled, "compactor.block-deletion-marks-migration-enabled", false, "When enabled, at compactor startup the bucket will be scanned and all found deletion marks inside the block location will be copied to the markers global location too. This option can (and should) be safely disabled as soon as the compactor has successfully run at least once.")
 	f.BoolVar(&cfg.SkipBlocksWithOutOfOrderChunksEnabled, "compactor.skip-blocks-with-out-of-order-chunks-enabled", false, "When enabled, mark blocks containing index with out-of-order chunks for no compact instead of halting the compaction.")
 	f.IntVar(&cfg.BlockFilesConcurrency, "compactor.block-files-concurrency", 10, "Number of goroutines to use when fetching/uploading block files from object storage.")
@@ -385,6 +412,10 @@ func (cfg *Config) Validate(limits validation.Limits) error {
 		return errInvalidCompactionStrategyPartitioning
 	}
 
+	if err := cfg.BucketIndexCompression.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -753,6 +784,13 @@ func (c *Compactor) starting(ctx context.Context) error {
 		ShardingStrategy:                   c.compactorCfg.ShardingStrategy,
 		CompactionStrategy:                 c.compactorCfg.CompactionStrategy,
 		BlockRanges:                        c.compactorCfg.BlockRanges.ToMilliseconds(),
+		BucketIndexCompression:             c.compactorCfg.BucketIndexCompression,
+		BucketIndexSummaryEnabled:          c.compactorCfg.BucketIndexSummaryEnabled,
+		BucketIndexCountBlockFiles:         c.compactorCfg.BucketIndexCountBlockFiles,
+		BucketIndexExcludeEmptyBlocks:      c.compactorCfg.BucketIndexExcludeEmptyBlocks,
+		BucketIndexMaxConcurrentWrites:     c.compactorCfg.BucketIndexMaxConcurrentWrites,
+		BucketIndexDriftCheckInterval:      c.compactorCfg.BucketIndexDriftCheckInterval,
+		BucketIndexDriftCheckMaxBlocks:     c.compactorCfg.BucketIndexDriftCheckMaxBlocks,
 	}, cleanerBucketClient, cleanerUsersScanner, c.compactorCfg.CompactionVisitMarkerTimeout, c.limits, c.parentLogger, cleanerRingLifecyclerID, c.registerer, c.compactorCfg.CleanerVisitMarkerTimeout, c.compactorCfg.CleanerVisitMarkerFileUpdateInterval,
 		c.compactorMetrics.syncerBlocksMarkedForDeletion, c.compactorMetrics.remainingPlannedCompactions)
 
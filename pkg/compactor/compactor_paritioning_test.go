@@ -885,6 +885,8 @@ func TestPartitionCompactor_ShouldNotCompactBlocksForUsersMarkedForDeletion(t *t
 	bucketClient.MockDelete("user-1/01DTVP434PA9VFXSW2JKB3392D/meta.json", nil)
 	bucketClient.MockDelete("user-1/01DTVP434PA9VFXSW2JKB3392D/index", nil)
 	bucketClient.MockDelete("user-1/bucket-index.json.gz", nil)
+	bucketClient.MockDelete("user-1/bucket-index-summary.bin", nil)
+	bucketClient.MockDelete("user-1/bucket-index-delta.json", nil)
 	bucketClient.MockDelete("user-1/bucket-index-sync-status.json", nil)
 	bucketClient.MockGet("user-1/partitioned-groups/"+partitionedGroupID1+".json", "", nil)
 	bucketClient.MockUpload("user-1/partitioned-groups/"+partitionedGroupID1+".json", nil)
@@ -143,6 +143,14 @@ func TestConfig_Validate(t *testing.T) {
 			initLimits: func(_ *validation.Limits) {},
 			expected:   errInvalidTenantShardSize.Error(),
 		},
+		"should fail with bucket index compression small index threshold greater than the large one": {
+			setup: func(cfg *Config) {
+				cfg.BucketIndexCompression.SmallIndexMaxBytes = 2048
+				cfg.BucketIndexCompression.LargeIndexMinBytes = 1024
+			},
+			initLimits: func(_ *validation.Limits) {},
+			expected:   "invalid bucket index compression thresholds, small_index_max_bytes must be lower than large_index_min_bytes",
+		},
 	}
 
 	for testName, testData := range tests {
@@ -838,6 +846,8 @@ func TestCompactor_ShouldNotCompactBlocksForUsersMarkedForDeletion(t *testing.T)
 	bucketClient.MockDelete("user-1/01DTVP434PA9VFXSW2JKB3392D/meta.json", nil)
 	bucketClient.MockDelete("user-1/01DTVP434PA9VFXSW2JKB3392D/index", nil)
 	bucketClient.MockDelete("user-1/bucket-index.json.gz", nil)
+	bucketClient.MockDelete("user-1/bucket-index-summary.bin", nil)
+	bucketClient.MockDelete("user-1/bucket-index-delta.json", nil)
 	bucketClient.MockDelete("user-1/bucket-index-sync-status.json", nil)
 
 	c, _, tsdbPlanner, logs, registry := prepare(t, cfg, bucketClient, nil)
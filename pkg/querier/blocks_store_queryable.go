@@ -195,10 +195,16 @@ func NewBlocksStoreQueryableFromConfig(querierCfg Config, gatewayCfg storegatewa
 	if storageCfg.BucketStore.BucketIndex.Enabled {
 		finder = NewBucketIndexBlocksFinder(BucketIndexBlocksFinderConfig{
 			IndexLoader: bucketindex.LoaderConfig{
-				CheckInterval:         time.Minute,
-				UpdateOnStaleInterval: storageCfg.BucketStore.SyncInterval,
-				UpdateOnErrorInterval: storageCfg.BucketStore.BucketIndex.UpdateOnErrorInterval,
-				IdleTimeout:           storageCfg.BucketStore.BucketIndex.IdleTimeout,
+				CheckInterval:          time.Minute,
+				UpdateOnStaleInterval:  storageCfg.BucketStore.SyncInterval,
+				UpdateOnErrorInterval:  storageCfg.BucketStore.BucketIndex.UpdateOnErrorInterval,
+				IdleTimeout:            storageCfg.BucketStore.BucketIndex.IdleTimeout,
+				CoalesceReads:          storageCfg.BucketStore.BucketIndex.CoalesceReads,
+				HedgeDelay:             storageCfg.BucketStore.BucketIndex.HedgeDelay,
+				MaxHedges:              storageCfg.BucketStore.BucketIndex.MaxHedges,
+				CircuitBreakerFailures: storageCfg.BucketStore.BucketIndex.CircuitBreakerFailures,
+				CircuitBreakerCooldown: storageCfg.BucketStore.BucketIndex.CircuitBreakerCooldown,
+				IndexReadTimeout:       storageCfg.BucketStore.BucketIndex.ReadTimeout,
 			},
 			MaxStalePeriod:           storageCfg.BucketStore.BucketIndex.MaxStalePeriod,
 			IgnoreDeletionMarksDelay: storageCfg.BucketStore.IgnoreDeletionMarksDelay,
@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
+)
+
+const (
+	attributesCacheOpAttributes = "attributes"
+	attributesCacheOpExists     = "exists"
+)
+
+// AttributesCacheBucketClient is a wrapper around an objstore.Bucket caching the results of the
+// Attributes and Exists calls for a short TTL, so that the repeated checks of the same objects, eg.
+// the freshness checks of a hot tenant bucket index, don't each hit the object storage. Only the
+// successful calls are cached.
+//
+// The cached objects are invalidated on upload and deletion through the client. Objects written
+// through other clients can be served stale within the TTL.
+type AttributesCacheBucketClient struct {
+	objstore.Bucket
+
+	// The cache is shared by the copies returned by WithExpectedErrs.
+	cache *attributesCache
+}
+
+type attributesCache struct {
+	entries *expirable.LRU[string, cachedAttributes]
+
+	// writes is incremented before and after each write, so that the attributes read concurrently
+	// with a write are not cached, since they may be the ones from before the write.
+	writes atomic.Uint64
+
+	requests *prometheus.CounterVec
+	hits     *prometheus.CounterVec
+}
+
+type cachedAttributes struct {
+	exists bool
+
+	// attrs is only set if the attributes have been read, which implies the object exists.
+	attrs *objstore.ObjectAttributes
+}
+
+// NewAttributesCacheBucketClient makes a new AttributesCacheBucketClient, caching the attributes of
+// up to maxEntries objects for the input TTL.
+func NewAttributesCacheBucketClient(bucket objstore.Bucket, ttl time.Duration, maxEntries int, reg prometheus.Registerer) *AttributesCacheBucketClient {
+	c := &attributesCache{
+		entries: expirable.NewLRU[string, cachedAttributes](maxEntries, nil, ttl),
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_attributes_cache_requests_total",
+			Help: "Total number of object attributes and existence checks requested to the bucket attributes cache.",
+		}, []string{"op"}),
+		hits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_attributes_cache_hits_total",
+			Help: "Total number of object attributes and existence checks served by the bucket attributes cache.",
+		}, []string{"op"}),
+	}
+
+	// Initialise the metrics, so that the hit rate can be computed before the first hit.
+	for _, op := range []string{attributesCacheOpAttributes, attributesCacheOpExists} {
+		c.requests.WithLabelValues(op)
+		c.hits.WithLabelValues(op)
+	}
+
+	return &AttributesCacheBucketClient{Bucket: bucket, cache: c}
+}
+
+// Attributes implements objstore.Bucket.
+func (b *AttributesCacheBucketClient) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.cache.requests.WithLabelValues(attributesCacheOpAttributes).Inc()
+	if cached, ok := b.cache.entries.Get(name); ok && cached.attrs != nil {
+		b.cache.hits.WithLabelValues(attributesCacheOpAttributes).Inc()
+		return *cached.attrs, nil
+	}
+
+	writes := b.cache.writes.Load()
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+
+	b.cache.add(name, cachedAttributes{exists: true, attrs: &attrs}, writes)
+	return attrs, nil
+}
+
+// Exists implements objstore.Bucket.
+func (b *AttributesCacheBucketClient) Exists(ctx context.Context, name string) (bool, error) {
+	b.cache.requests.WithLabelValues(attributesCacheOpExists).Inc()
+	if cached, ok := b.cache.entries.Get(name); ok {
+		b.cache.hits.WithLabelValues(attributesCacheOpExists).Inc()
+		return cached.exists, nil
+	}
+
+	writes := b.cache.writes.Load()
+	exists, err := b.Bucket.Exists(ctx, name)
+	if err != nil {
+		return exists, err
+	}
+
+	b.cache.add(name, cachedAttributes{exists: exists}, writes)
+	return exists, nil
+}
+
+// Upload implements objstore.Bucket.
+func (b *AttributesCacheBucketClient) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.cache.invalidate(name)
+	defer b.cache.invalidate(name)
+
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+// Delete implements objstore.Bucket.
+func (b *AttributesCacheBucketClient) Delete(ctx context.Context, name string) error {
+	b.cache.invalidate(name)
+	defer b.cache.invalidate(name)
+
+	return b.Bucket.Delete(ctx, name)
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (b *AttributesCacheBucketClient) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.Bucket.(objstore.InstrumentedBucket); ok {
+		// Make a copy, but replace bucket with instrumented one.
+		return &AttributesCacheBucketClient{Bucket: ib.WithExpectedErrs(fn), cache: b.cache}
+	}
+
+	return b
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucketReader.
+func (b *AttributesCacheBucketClient) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(fn)
+}
+
+// add caches the input attributes read once the input number of writes was done, unless other
+// writes have been done in the meanwhile. An existing entry is merged, so that the attributes
+// aren't lost by a subsequent existence check.
+func (c *attributesCache) add(name string, entry cachedAttributes, writes uint64) {
+	if c.writes.Load() != writes {
+		return
+	}
+
+	if cached, ok := c.entries.Peek(name); ok && entry.attrs == nil && entry.exists && cached.exists {
+		return
+	}
+	c.entries.Add(name, entry)
+}
+
+func (c *attributesCache) invalidate(name string) {
+	c.writes.Inc()
+	c.entries.Remove(name)
+}
@@ -0,0 +1,143 @@
+package bucket
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
+)
+
+func TestAttributesCacheBucketClient(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(ttl time.Duration, maxEntries int) (*countingAttributesBucket, *AttributesCacheBucketClient) {
+		backend := &countingAttributesBucket{Bucket: objstore.NewInMemBucket()}
+		return backend, NewAttributesCacheBucketClient(objstore.WithNoopInstr(backend), ttl, maxEntries, prometheus.NewPedanticRegistry())
+	}
+
+	t.Run("should serve the repeated checks from the cache", func(t *testing.T) {
+		backend, c := setup(time.Minute, 10)
+		require.NoError(t, c.Upload(ctx, "object", strings.NewReader("content")))
+
+		for i := 0; i < 3; i++ {
+			attrs, err := c.Attributes(ctx, "object")
+			require.NoError(t, err)
+			assert.Equal(t, int64(len("content")), attrs.Size)
+
+			exists, err := c.Exists(ctx, "object")
+			require.NoError(t, err)
+			assert.True(t, exists)
+		}
+
+		// The existence is known from the cached attributes.
+		assert.Equal(t, int32(1), backend.attributesCalls.Load())
+		assert.Equal(t, int32(0), backend.existsCalls.Load())
+
+		assert.Equal(t, float64(3), testutil.ToFloat64(c.cache.requests.WithLabelValues(attributesCacheOpAttributes)))
+		assert.Equal(t, float64(2), testutil.ToFloat64(c.cache.hits.WithLabelValues(attributesCacheOpAttributes)))
+		assert.Equal(t, float64(3), testutil.ToFloat64(c.cache.hits.WithLabelValues(attributesCacheOpExists)))
+	})
+
+	t.Run("should cache the objects not found by the existence checks", func(t *testing.T) {
+		backend, c := setup(time.Minute, 10)
+
+		for i := 0; i < 2; i++ {
+			exists, err := c.Exists(ctx, "object")
+			require.NoError(t, err)
+			assert.False(t, exists)
+
+			_, err = c.Attributes(ctx, "object")
+			require.True(t, c.IsObjNotFoundErr(err))
+		}
+
+		// The failed attributes reads are not cached.
+		assert.Equal(t, int32(1), backend.existsCalls.Load())
+		assert.Equal(t, int32(2), backend.attributesCalls.Load())
+	})
+
+	t.Run("should invalidate the cached objects on upload and delete", func(t *testing.T) {
+		_, c := setup(time.Minute, 10)
+
+		exists, err := c.Exists(ctx, "object")
+		require.NoError(t, err)
+		require.False(t, exists)
+
+		require.NoError(t, c.Upload(ctx, "object", strings.NewReader("content")))
+		exists, err = c.Exists(ctx, "object")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		require.NoError(t, c.Upload(ctx, "object", strings.NewReader("updated content")))
+		attrs, err := c.Attributes(ctx, "object")
+		require.NoError(t, err)
+		require.Equal(t, int64(len("updated content")), attrs.Size)
+
+		require.NoError(t, c.Delete(ctx, "object"))
+		exists, err = c.Exists(ctx, "object")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("should share the cache with the clients with expected errors", func(t *testing.T) {
+		backend, c := setup(time.Minute, 10)
+		require.NoError(t, c.Upload(ctx, "object", strings.NewReader("content")))
+
+		_, err := c.Attributes(ctx, "object")
+		require.NoError(t, err)
+		_, err = c.WithExpectedErrs(c.IsObjNotFoundErr).Attributes(ctx, "object")
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), backend.attributesCalls.Load())
+
+		// Writes through the copies invalidate the shared cache.
+		require.NoError(t, c.WithExpectedErrs(c.IsObjNotFoundErr).Delete(ctx, "object"))
+		_, err = c.Attributes(ctx, "object")
+		require.True(t, c.IsObjNotFoundErr(err))
+	})
+
+	t.Run("should expire the cached objects", func(t *testing.T) {
+		backend, c := setup(10*time.Millisecond, 10)
+		require.NoError(t, c.Upload(ctx, "object", strings.NewReader("content")))
+
+		_, err := c.Attributes(ctx, "object")
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, err := c.Attributes(ctx, "object")
+			return err == nil && backend.attributesCalls.Load() == 2
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("should bound the number of cached objects", func(t *testing.T) {
+		backend, c := setup(time.Minute, 1)
+
+		for _, name := range []string{"object-1", "object-2", "object-1"} {
+			_, err := c.Exists(ctx, name)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int32(3), backend.existsCalls.Load())
+	})
+}
+
+// countingAttributesBucket counts the Attributes and Exists calls.
+type countingAttributesBucket struct {
+	objstore.Bucket
+
+	attributesCalls atomic.Int32
+	existsCalls     atomic.Int32
+}
+
+func (b *countingAttributesBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.attributesCalls.Inc()
+	return b.Bucket.Attributes(ctx, name)
+}
+
+func (b *countingAttributesBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.existsCalls.Inc()
+	return b.Bucket.Exists(ctx, name)
+}
@@ -2,10 +2,13 @@ package bucket
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/minio/minio-go/v7"
 	"github.com/thanos-io/objstore"
 	"go.uber.org/atomic"
 
@@ -49,3 +52,13 @@ func ListPrefixes(ctx context.Context, bkt objstore.Bucket, prefix string, logge
 	})
 	return keys, err
 }
+
+// IsThrottledErr returns whether the error has been returned by the object storage because the
+// request rate is too high (eg. S3 503 SlowDown). Only S3 throttling responses are detected.
+func IsThrottledErr(err error) bool {
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return s3Err.Code == "SlowDown" || s3Err.StatusCode == http.StatusServiceUnavailable || s3Err.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
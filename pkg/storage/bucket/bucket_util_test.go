@@ -2,11 +2,14 @@ package bucket
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"testing"
 
 	"github.com/go-kit/log"
+	"github.com/minio/minio-go/v7"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/objstore"
@@ -47,3 +50,37 @@ func TestDeletePrefixConcurrent(t *testing.T) {
 	assert.Equal(t, 4+n, del)
 	assert.Equal(t, 2, len(mem.Objects()))
 }
+
+func TestIsThrottledErr(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"generic error": {
+			err:      errors.New("generic error"),
+			expected: false,
+		},
+		"S3 not found error": {
+			err:      minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound},
+			expected: false,
+		},
+		"S3 SlowDown error": {
+			err:      minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable},
+			expected: true,
+		},
+		"S3 service unavailable error": {
+			err:      minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable},
+			expected: true,
+		},
+		"wrapped S3 SlowDown error": {
+			err:      fmt.Errorf("get object: %w", minio.ErrorResponse{Code: "SlowDown"}),
+			expected: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, IsThrottledErr(testData.err))
+		})
+	}
+}
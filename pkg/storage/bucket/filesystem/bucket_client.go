@@ -1,11 +1,125 @@
 package filesystem
 
 import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/objstore/providers/filesystem"
 )
 
 // NewBucketClient creates a new filesystem bucket client
 func NewBucketClient(cfg Config) (objstore.Bucket, error) {
-	return filesystem.NewBucket(cfg.Directory)
+	bkt, err := filesystem.NewBucket(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bucket resolves the directory to an absolute path, so the uploads are done in the same one.
+	rootDir, err := filepath.Abs(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicUploadBucket{Bucket: bkt, rootDir: rootDir}, nil
+}
+
+// tmpFileInfix is the infix of the names of the temporary files the objects are uploaded to,
+// which are named "." + <object file name> + tmpFileInfix + <random suffix>.
+const tmpFileInfix = ".tmp-"
+
+// atomicUploadBucket uploads the objects to a temporary file which is then renamed, so that
+// readers observe either the previous or the new content of an object, like on the object
+// storages, and never a partially written one. The temporary files left by the uploads
+// interrupted by a crash are not listed.
+type atomicUploadBucket struct {
+	*filesystem.Bucket
+
+	rootDir string
+}
+
+func (b *atomicUploadBucket) Upload(ctx context.Context, name string, r io.Reader) (err error) {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	file := filepath.Join(b.rootDir, name)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	// The temporary file is created in the same directory, to be renamed within the same filesystem.
+	tmp, err := createTempFile(filepath.Dir(file), "."+filepath.Base(file)+tmpFileInfix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return errors.Wrapf(err, "copy to %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Keep the mode of the object being overwritten, like the upload truncating the existing file did.
+	if info, err := os.Stat(file); err == nil {
+		if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (b *atomicUploadBucket) Iter(ctx context.Context, dir string, f func(string) error, opts ...objstore.IterOption) error {
+	return b.Bucket.Iter(ctx, dir, func(name string) error {
+		if isTempFile(name) {
+			return nil
+		}
+		return f(name)
+	}, opts...)
+}
+
+func (b *atomicUploadBucket) IterWithAttributes(ctx context.Context, dir string, f func(attrs objstore.IterObjectAttributes) error, opts ...objstore.IterOption) error {
+	return b.Bucket.IterWithAttributes(ctx, dir, func(attrs objstore.IterObjectAttributes) error {
+		if isTempFile(attrs.Name) {
+			return nil
+		}
+		return f(attrs)
+	}, opts...)
+}
+
+// createTempFile creates a new file in the input directory, named with the input prefix followed by a
+// random suffix. Unlike os.CreateTemp, the file is created with the same mode as os.Create, ie. 0666
+// before the umask.
+func createTempFile(dir, prefix string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// isTempFile returns whether the input object name is the one of a temporary file an object is uploaded to.
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.Contains(base, tmpFileInfix) && !strings.HasSuffix(name, objstore.DirDelim)
 }
@@ -0,0 +1,122 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+)
+
+func TestBucketClient_Upload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	bkt, err := NewBucketClient(Config{Directory: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, bkt.Upload(ctx, "user-1/object", strings.NewReader("first")))
+	assertObjectContent(t, bkt, "user-1/object", "first")
+
+	require.NoError(t, bkt.Upload(ctx, "user-1/object", strings.NewReader("second")))
+	assertObjectContent(t, bkt, "user-1/object", "second")
+
+	// A failed upload keeps the previous content, and doesn't leave the temporary file.
+	err = bkt.Upload(ctx, "user-1/object", io.MultiReader(strings.NewReader("partial"), &failingReader{}))
+	require.ErrorContains(t, err, "mocked read failure")
+	assertObjectContent(t, bkt, "user-1/object", "second")
+
+	entries, err := os.ReadDir(filepath.Join(dir, "user-1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "object", entries[0].Name())
+
+	// A canceled upload doesn't create the object.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, bkt.Upload(canceledCtx, "user-1/other", strings.NewReader("content")), context.Canceled)
+
+	exists, err := bkt.Exists(ctx, "user-1/other")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestBucketClient_Upload_ShouldCreateTheObjectsWithTheDefaultModeOrKeepTheExistingOne(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	bkt, err := NewBucketClient(Config{Directory: dir})
+	require.NoError(t, err)
+
+	// The objects are created like os.Create does, so with the umask applied.
+	reference, err := os.Create(filepath.Join(dir, "reference"))
+	require.NoError(t, err)
+	require.NoError(t, reference.Close())
+	expected, err := os.Stat(reference.Name())
+	require.NoError(t, err)
+
+	require.NoError(t, bkt.Upload(ctx, "user-1/object", strings.NewReader("first")))
+	actual, err := os.Stat(filepath.Join(dir, "user-1", "object"))
+	require.NoError(t, err)
+	assert.Equal(t, expected.Mode().Perm(), actual.Mode().Perm())
+
+	// The mode of an overwritten object is kept.
+	require.NoError(t, os.Chmod(filepath.Join(dir, "user-1", "object"), 0600))
+	require.NoError(t, bkt.Upload(ctx, "user-1/object", strings.NewReader("second")))
+	actual, err = os.Stat(filepath.Join(dir, "user-1", "object"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), actual.Mode().Perm())
+}
+
+func TestBucketClient_Iter_ShouldNotListTheTemporaryFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	bkt, err := NewBucketClient(Config{Directory: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, bkt.Upload(ctx, "user-1/object", strings.NewReader("content")))
+
+	// Simulate the temporary file left by an upload interrupted by a crash.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user-1", ".other.tmp-123"), []byte("partial"), 0666))
+
+	for _, opts := range [][]objstore.IterOption{nil, {objstore.WithRecursiveIter()}} {
+		var names []string
+		require.NoError(t, bkt.Iter(ctx, "user-1/", func(name string) error {
+			names = append(names, name)
+			return nil
+		}, opts...))
+		assert.Equal(t, []string{"user-1/object"}, names)
+
+		names = nil
+		require.NoError(t, bkt.IterWithAttributes(ctx, "user-1/", func(attrs objstore.IterObjectAttributes) error {
+			names = append(names, attrs.Name)
+			return nil
+		}, opts...))
+		assert.Equal(t, []string{"user-1/object"}, names)
+	}
+}
+
+func assertObjectContent(t *testing.T, bkt objstore.BucketReader, name, expected string) {
+	r, err := bkt.Get(context.Background(), name)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var actual bytes.Buffer
+	_, err = actual.ReadFrom(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual.String())
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("mocked read failure")
+}
@@ -52,17 +52,31 @@ func (b *SSEBucketClient) Close() error {
 
 // Upload the contents of the reader as an object into the bucket.
 func (b *SSEBucketClient) Upload(ctx context.Context, name string, r io.Reader) error {
-	if sse, err := b.getCustomS3SSEConfig(); err != nil {
+	ctx, err := ContextWithSSEConfig(ctx, b.userID, b.cfgProvider)
+	if err != nil {
 		return err
-	} else if sse != nil {
-		// If the underlying bucket client is not S3 and a custom S3 SSE config has been
-		// provided, the config option will be ignored.
-		ctx = s3.ContextWithSSEConfig(ctx, sse)
 	}
 
 	return b.bucket.Upload(ctx, name, r)
 }
 
+// ContextWithSSEConfig returns a context carrying the custom S3 SSE config of the input user, if any,
+// to be honored by the S3 operations writing objects, eg. the uploads and the server-side copies. The
+// cfgProvider can be nil.
+func ContextWithSSEConfig(ctx context.Context, userID string, cfgProvider TenantConfigProvider) (context.Context, error) {
+	sse, err := getCustomS3SSEConfig(userID, cfgProvider)
+	if err != nil {
+		return ctx, err
+	}
+	if sse == nil {
+		return ctx, nil
+	}
+
+	// If the underlying bucket client is not S3 and a custom S3 SSE config has been
+	// provided, the config option will be ignored.
+	return s3.ContextWithSSEConfig(ctx, sse), nil
+}
+
 // Delete implements objstore.Bucket.
 func (b *SSEBucketClient) Delete(ctx context.Context, name string) error {
 	return b.bucket.Delete(ctx, name)
@@ -73,26 +87,26 @@ func (b *SSEBucketClient) Name() string {
 	return b.bucket.Name()
 }
 
-func (b *SSEBucketClient) getCustomS3SSEConfig() (encrypt.ServerSide, error) {
-	if b.cfgProvider == nil {
+func getCustomS3SSEConfig(userID string, cfgProvider TenantConfigProvider) (encrypt.ServerSide, error) {
+	if cfgProvider == nil {
 		return nil, nil
 	}
 
 	// No S3 SSE override if the type override hasn't been provided.
-	sseType := b.cfgProvider.S3SSEType(b.userID)
+	sseType := cfgProvider.S3SSEType(userID)
 	if sseType == "" {
 		return nil, nil
 	}
 
 	cfg := cortex_s3.SSEConfig{
 		Type:                 sseType,
-		KMSKeyID:             b.cfgProvider.S3SSEKMSKeyID(b.userID),
-		KMSEncryptionContext: b.cfgProvider.S3SSEKMSEncryptionContext(b.userID),
+		KMSKeyID:             cfgProvider.S3SSEKMSKeyID(userID),
+		KMSEncryptionContext: cfgProvider.S3SSEKMSEncryptionContext(userID),
 	}
 
 	sse, err := cfg.BuildMinioConfig()
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to customise S3 SSE config for tenant %s", b.userID)
+		return nil, errors.Wrapf(err, "unable to customise S3 SSE config for tenant %s", userID)
 	}
 
 	return sse, nil
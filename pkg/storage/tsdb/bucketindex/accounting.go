@@ -0,0 +1,92 @@
+package bucketindex
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	BytesOpRead  = "read"
+	BytesOpWrite = "write"
+)
+
+type bytesAccountantCtxKey struct{}
+
+// BytesAccountant is notified of the compressed bucket index bytes transferred from and to the
+// object storage, eg. to attribute the object storage bandwidth to tenants.
+type BytesAccountant interface {
+	// AddIndexBytes is called with BytesOpRead once a read bucket index reader has been closed, and
+	// with BytesOpWrite once a bucket index has been successfully uploaded. The bytes of a retried
+	// upload are reported once, and the bytes of a failed upload are not reported.
+	AddIndexBytes(userID, op string, bytes int64)
+}
+
+// ContextWithBytesAccountant returns a context whose bucket index reads and writes are reported
+// to the input accountant.
+func ContextWithBytesAccountant(ctx context.Context, accountant BytesAccountant) context.Context {
+	return context.WithValue(ctx, bytesAccountantCtxKey{}, accountant)
+}
+
+// bytesAccountantFromContext returns the accountant of the context, or nil if there's none.
+func bytesAccountantFromContext(ctx context.Context) BytesAccountant {
+	accountant, _ := ctx.Value(bytesAccountantCtxKey{}).(BytesAccountant)
+	return accountant
+}
+
+type bytesTransferredCounter struct {
+	bytes   *prometheus.CounterVec
+	perUser bool
+}
+
+// NewBytesTransferredCounter returns a BytesAccountant tracking the transferred bytes in the
+// cortex_bucket_index_bytes_transferred_total metric. The user label is only added if perUser
+// is true, since it has the cardinality of the number of tenants.
+func NewBytesTransferredCounter(reg prometheus.Registerer, perUser bool) BytesAccountant {
+	labels := []string{"op"}
+	if perUser {
+		labels = []string{"user", "op"}
+	}
+
+	return &bytesTransferredCounter{
+		bytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_bytes_transferred_total",
+			Help: "Total number of compressed bucket index bytes read from and written to the object storage.",
+		}, labels),
+		perUser: perUser,
+	}
+}
+
+func (c *bytesTransferredCounter) AddIndexBytes(userID, op string, bytes int64) {
+	if c.perUser {
+		c.bytes.WithLabelValues(userID, op).Add(float64(bytes))
+		return
+	}
+	c.bytes.WithLabelValues(op).Add(float64(bytes))
+}
+
+// accountingReader counts the bytes read and reports them to the accountant once closed.
+type accountingReader struct {
+	io.ReadCloser
+
+	accountant BytesAccountant
+	userID     string
+	bytes      int64
+	closed     bool
+}
+
+func (r *accountingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *accountingReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.accountant.AddIndexBytes(r.userID, BytesOpRead, r.bytes)
+	}
+	return r.ReadCloser.Close()
+}
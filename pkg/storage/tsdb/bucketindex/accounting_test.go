@@ -0,0 +1,125 @@
+package bucketindex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket/s3"
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestBytesTransferredCounter(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	t.Run("should track the bytes per user", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		reg := prometheus.NewPedanticRegistry()
+		ctx := ContextWithBytesAccountant(ctx, NewBytesTransferredCounter(reg, true))
+
+		require.NoError(t, WriteIndex(ctx, bkt, "user-1", nil, idx))
+		require.NoError(t, WriteIndex(ctx, bkt, "user-2", nil, idx))
+		_, err := ReadIndex(ctx, bkt, "user-1", nil, logger)
+		require.NoError(t, err)
+
+		attrs, err := bkt.Attributes(ctx, path.Join("user-1", IndexCompressedFilename))
+		require.NoError(t, err)
+		size := attrs.Size
+
+		assert.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_bucket_index_bytes_transferred_total Total number of compressed bucket index bytes read from and written to the object storage.
+			# TYPE cortex_bucket_index_bytes_transferred_total counter
+			cortex_bucket_index_bytes_transferred_total{op="read",user="user-1"} `+strconv.FormatInt(size, 10)+`
+			cortex_bucket_index_bytes_transferred_total{op="write",user="user-1"} `+strconv.FormatInt(size, 10)+`
+			cortex_bucket_index_bytes_transferred_total{op="write",user="user-2"} `+strconv.FormatInt(size, 10)+`
+		`)))
+	})
+
+	t.Run("should track the bytes without the user label", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		reg := prometheus.NewPedanticRegistry()
+		ctx := ContextWithBytesAccountant(ctx, NewBytesTransferredCounter(reg, false))
+
+		require.NoError(t, WriteIndex(ctx, bkt, "user-1", nil, idx))
+		require.NoError(t, WriteIndex(ctx, bkt, "user-2", nil, idx))
+
+		attrs, err := bkt.Attributes(ctx, path.Join("user-1", IndexCompressedFilename))
+		require.NoError(t, err)
+
+		assert.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_bucket_index_bytes_transferred_total Total number of compressed bucket index bytes read from and written to the object storage.
+			# TYPE cortex_bucket_index_bytes_transferred_total counter
+			cortex_bucket_index_bytes_transferred_total{op="write"} `+strconv.FormatInt(2*attrs.Size, 10)+`
+		`)))
+	})
+
+	t.Run("should report the bytes of a retried upload once", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		flaky := &flakyUploadBucket{Bucket: bkt}
+		flaky.failures.Store(2)
+		retryingBkt, err := s3.NewBucketWithRetries(flaky, 5, 0, 0, logger)
+		require.NoError(t, err)
+
+		reg := prometheus.NewPedanticRegistry()
+		counter := NewBytesTransferredCounter(reg, true)
+		ctx := ContextWithBytesAccountant(ctx, counter)
+
+		require.NoError(t, WriteIndex(ctx, retryingBkt, "user-1", nil, idx))
+		require.Equal(t, int32(3), flaky.uploadCalls.Load())
+
+		attrs, err := bkt.Attributes(ctx, path.Join("user-1", IndexCompressedFilename))
+		require.NoError(t, err)
+		assert.Equal(t, float64(attrs.Size), prom_testutil.ToFloat64(counter.(*bytesTransferredCounter).bytes.WithLabelValues("user-1", BytesOpWrite)))
+	})
+
+	t.Run("should not report the bytes of a failed upload", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		failing := &cortex_testutil.MockBucketFailure{
+			Bucket:         bkt,
+			UploadFailures: map[string]error{"user-1": errors.New("mocked upload failure")},
+		}
+
+		reg := prometheus.NewPedanticRegistry()
+		ctx := ContextWithBytesAccountant(ctx, NewBytesTransferredCounter(reg, true))
+
+		require.Error(t, WriteIndex(ctx, failing, "user-1", nil, idx))
+		assert.Equal(t, 0, prom_testutil.CollectAndCount(reg, "cortex_bucket_index_bytes_transferred_total"))
+	})
+}
+
+// flakyUploadBucket fails the configured number of uploads after having read the whole content.
+type flakyUploadBucket struct {
+	objstore.Bucket
+
+	failures    atomic.Int32
+	uploadCalls atomic.Int32
+}
+
+func (b *flakyUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.uploadCalls.Inc()
+	if b.failures.Dec() >= 0 {
+		_, _ = io.Copy(io.Discard, r)
+		return errors.New("mocked upload failure")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
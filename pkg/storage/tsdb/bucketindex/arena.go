@@ -0,0 +1,96 @@
+package bucketindex
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/log"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+// IndexArena holds the memory used to decode a bucket index with ReadIndexInto, so that it can be
+// reused across reads instead of being allocated for each read: the buffer of the decompressed
+// content, and the blocks and block deletion marks, which are decoded in place into the ones of the
+// previous read.
+//
+// The arena owns the index returned by ReadIndexInto, and everything it references: the index, its
+// blocks and its deletion marks are overwritten by the next read into the same arena, or by Reset.
+// The caller must not retain any of them, eg. the blocks returned by BlocksOverlapping, once the
+// arena is reused, and must not use the same arena for concurrent reads. It's meant for tight loops
+// reading indexes which are processed and dropped before the next read; cache the indexes read with
+// ReadIndex instead.
+type IndexArena struct {
+	index  Index
+	buf    []byte
+	blocks Blocks
+	marks  BlockDeletionMarks
+}
+
+// NewIndexArena returns an empty IndexArena, which grows to the size of the largest index read into it.
+func NewIndexArena() *IndexArena {
+	return &IndexArena{}
+}
+
+// Reset clears the index read into the arena, keeping the memory for the next read.
+func (a *IndexArena) Reset() {
+	// The blocks and marks beyond the length are the ones of older reads, which are decoded into too.
+	for _, b := range a.blocks[:cap(a.blocks)] {
+		if b != nil {
+			*b = Block{}
+		}
+	}
+	for _, m := range a.marks[:cap(a.marks)] {
+		if m != nil {
+			*m = BlockDeletionMark{}
+		}
+	}
+
+	a.index = Index{Blocks: a.blocks[:0], BlockDeletionMarks: a.marks[:0]}
+}
+
+// ReadIndexInto reads, parses and returns a bucket index from the bucket like ReadIndex, but decodes
+// it into the input arena, which is reset first, to avoid allocating the index for each read. The
+// returned index is owned by the arena: see IndexArena for the constraints on its lifecycle.
+func ReadIndexInto(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, arena *IndexArena) (*Index, error) {
+	arena.Reset()
+
+	buf, err := readDecompressedIndex(ctx, bkt, userID, cfgProvider, logger, arena.buf)
+	arena.buf = buf
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := readIndexVersion(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIndexVersion(version); err != nil {
+		return nil, err
+	}
+	if version > IndexVersion1 {
+		// Only the first format version can be decoded in place.
+		return ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	}
+
+	// The slices are reused up to their capacity, including the blocks and marks they point to. They're
+	// reallocated if the index has more blocks or marks, or set to nil if the index has none.
+	err = json.Unmarshal(buf, &arena.index)
+	if arena.index.Blocks != nil {
+		arena.blocks = arena.index.Blocks
+	}
+	if arena.index.BlockDeletionMarks != nil {
+		arena.marks = arena.index.BlockDeletionMarks
+	}
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	index := &arena.index
+	if err := index.checkTenantReferences(userID); err != nil {
+		return nil, err
+	}
+
+	foldIndexDelta(ctx, bkt, userID, index, logger)
+	return index, nil
+}
@@ -0,0 +1,66 @@
+package bucketindex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/parquet"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestReadIndexInto(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	large := &Index{
+		Version: IndexVersion1,
+		Blocks: Blocks{
+			{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, Labels: map[string]string{"region": "eu"}, Parquet: &parquet.ConverterMarkMeta{Version: 1}},
+			{ID: ulid.MustNew(2, nil), MinTime: 20, MaxTime: 30, SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2},
+			{ID: ulid.MustNew(3, nil), MinTime: 30, MaxTime: 40},
+		},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: ulid.MustNew(1, nil), DeletionTime: 100}},
+		UpdatedAt:          1000,
+	}
+	small := &Index{
+		Version:            IndexVersion1,
+		Blocks:             Blocks{{ID: ulid.MustNew(4, nil), MinTime: 40, MaxTime: 50}},
+		BlockDeletionMarks: BlockDeletionMarks{},
+		UpdatedAt:          2000,
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, "user-1", nil, large))
+	require.NoError(t, WriteIndex(ctx, bkt, "user-2", nil, small))
+	require.NoError(t, WriteIndex(ctx, bkt, "user-3", nil, &Index{Version: IndexVersion1}))
+
+	arena := NewIndexArena()
+
+	actual, err := ReadIndexInto(ctx, bkt, "user-1", nil, logger, arena)
+	require.NoError(t, err)
+	assert.Equal(t, large, actual)
+	firstBlock := actual.Blocks[0]
+
+	// The blocks of the previous read are reused, without leaking their fields into the new index.
+	actual, err = ReadIndexInto(ctx, bkt, "user-2", nil, logger, arena)
+	require.NoError(t, err)
+	assert.Equal(t, small, actual)
+	assert.Same(t, firstBlock, actual.Blocks[0])
+
+	// An index without blocks doesn't drop the memory of the arena.
+	actual, err = ReadIndexInto(ctx, bkt, "user-3", nil, logger, arena)
+	require.NoError(t, err)
+	assert.Empty(t, actual.Blocks)
+
+	actual, err = ReadIndexInto(ctx, bkt, "user-1", nil, logger, arena)
+	require.NoError(t, err)
+	assert.Equal(t, large, actual)
+	assert.Same(t, firstBlock, actual.Blocks[0])
+
+	_, err = ReadIndexInto(ctx, bkt, "user-4", nil, logger, arena)
+	require.ErrorIs(t, err, ErrIndexNotFound)
+}
@@ -0,0 +1,41 @@
+package bucketindex
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CollectBlockMetrics registers gauges exporting the min and max time of the most recent maxBlocks
+// blocks of the index, eg. to debug which blocks of a tenant are being queried from a dashboard.
+//
+// Each exported block is a series labelled by its ID, so the number of series grows with maxBlocks
+// and every new block replaces an old one: keep maxBlocks low and collect the metrics on demand, since
+// exporting them periodically for all the tenants can cause a cardinality explosion. No block is
+// exported if maxBlocks is not positive.
+//
+// The gauges are a snapshot of the index, and are not updated if the index changes after the call.
+func (idx *Index) CollectBlockMetrics(reg prometheus.Registerer, user string, maxBlocks int) error {
+	minTime := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_bucket_block_mintime_seconds",
+		Help: "Min time of a block of the bucket index, in seconds since the epoch.",
+	}, []string{"user", "block"})
+	maxTime := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cortex_bucket_block_maxtime_seconds",
+		Help: "Max time (exclusive) of a block of the bucket index, in seconds since the epoch.",
+	}, []string{"user", "block"})
+
+	blocks := idx.BlocksByRecency()
+	blocks = blocks[:min(len(blocks), max(maxBlocks, 0))]
+
+	for _, b := range blocks {
+		minTime.WithLabelValues(user, b.ID.String()).Set(float64(b.MinTime) / 1000)
+		maxTime.WithLabelValues(user, b.ID.String()).Set(float64(b.MaxTime) / 1000)
+	}
+
+	for _, c := range []prometheus.Collector{minTime, maxTime} {
+		if err := reg.Register(c); err != nil {
+			return errors.Wrap(err, "register bucket index block metrics")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package bucketindex
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex_CollectBlockMetrics(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: 0, MaxTime: 10000},
+			{ID: block2, MinTime: 10000, MaxTime: 20000},
+			{ID: block3, MinTime: 20000, MaxTime: 30500},
+		},
+	}
+
+	t.Run("should export the most recent blocks", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		require.NoError(t, idx.CollectBlockMetrics(reg, "user-1", 2))
+
+		assert.NoError(t, testutil.GatherAndCompare(reg, bytes.NewBufferString(fmt.Sprintf(`
+			# HELP cortex_bucket_block_mintime_seconds Min time of a block of the bucket index, in seconds since the epoch.
+			# TYPE cortex_bucket_block_mintime_seconds gauge
+			cortex_bucket_block_mintime_seconds{block="%[1]s",user="user-1"} 20
+			cortex_bucket_block_mintime_seconds{block="%[2]s",user="user-1"} 10
+			# HELP cortex_bucket_block_maxtime_seconds Max time (exclusive) of a block of the bucket index, in seconds since the epoch.
+			# TYPE cortex_bucket_block_maxtime_seconds gauge
+			cortex_bucket_block_maxtime_seconds{block="%[1]s",user="user-1"} 30.5
+			cortex_bucket_block_maxtime_seconds{block="%[2]s",user="user-1"} 20
+		`, block3.String(), block2.String()))))
+	})
+
+	t.Run("should export no block if the max number of blocks is not positive", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		require.NoError(t, idx.CollectBlockMetrics(reg, "user-1", 0))
+
+		count, err := testutil.GatherAndCount(reg)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("should fail if the metrics are already registered", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		require.NoError(t, idx.CollectBlockMetrics(reg, "user-1", 1))
+		require.Error(t, idx.CollectBlockMetrics(reg, "user-2", 1))
+	})
+}
@@ -0,0 +1,150 @@
+package bucketindex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// readCircuitBreakers are per-tenant circuit breakers of the bucket index reads. Once the index of a
+// tenant failed to be read for the configured number of consecutive times, eg. because it's corrupted
+// or too large to be read within the timeout, the breaker of the tenant opens and the following reads
+// fail immediately with the last read error, until the cooldown expires. Then a single read is let
+// through: the breaker closes if it succeeds, and opens again otherwise. It isolates the failures of
+// a tenant index from the other tenants, which would otherwise share the resources wasted reading it.
+type readCircuitBreakers struct {
+	failures int
+	cooldown time.Duration
+
+	mtx     sync.Mutex
+	tenants map[string]*readCircuitBreaker
+
+	open           *prometheus.GaugeVec
+	shortCircuited prometheus.Counter
+}
+
+type readCircuitBreaker struct {
+	consecutiveFailures int
+	lastErr             error
+
+	// The breaker is open until this time, if the consecutive failures reached the threshold.
+	openUntil time.Time
+
+	// Whether the single read let through once the cooldown expired is in progress.
+	probing bool
+}
+
+func newReadCircuitBreakers(failures int, cooldown time.Duration, reg prometheus.Registerer) *readCircuitBreakers {
+	return &readCircuitBreakers{
+		failures: failures,
+		cooldown: cooldown,
+		tenants:  map[string]*readCircuitBreaker{},
+		open: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_read_circuit_breaker_open",
+			Help: "Whether the circuit breaker of the bucket index reads of a tenant is open (1) or half-open, letting a single read through once the cooldown expired (0). Tenants whose breaker is closed are not exported.",
+		}, []string{"user"}),
+		shortCircuited: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_read_circuit_breaker_short_circuits_total",
+			Help: "Total number of bucket index reads failed without reading the index because the circuit breaker of the tenant was open.",
+		}),
+	}
+}
+
+// read calls the input function to read the index of the input tenant, unless the tenant breaker is open,
+// in which case the last read error is returned. The circuit breakers are disabled if b is nil.
+func (b *readCircuitBreakers) read(userID string, read func() (*Index, error)) (*Index, error) {
+	if b == nil {
+		return read()
+	}
+
+	probe, err := b.allow(userID, time.Now())
+	if err != nil {
+		b.shortCircuited.Inc()
+		return nil, err
+	}
+
+	idx, err := read()
+	b.record(userID, probe, err, time.Now())
+	return idx, err
+}
+
+// allow returns nil if a read of the index of the input tenant is allowed, or the last read error if the
+// tenant breaker is open. It returns whether the allowed read is the single one let through by an open
+// breaker whose cooldown expired.
+func (b *readCircuitBreakers) allow(userID string, now time.Time) (bool, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	breaker := b.tenants[userID]
+	if breaker == nil || breaker.consecutiveFailures < b.failures {
+		return false, nil
+	}
+	if breaker.probing || now.Before(breaker.openUntil) {
+		return false, breaker.lastErr
+	}
+
+	// Half-open: let a single read through, keeping the other ones short-circuited until it completes.
+	breaker.probing = true
+	b.open.WithLabelValues(userID).Set(0)
+	return true, nil
+}
+
+// record records the outcome of a read of the index of the input tenant, probe being whether it's the read
+// let through by allow once the cooldown expired.
+func (b *readCircuitBreakers) record(userID string, probe bool, err error, now time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	// A read canceled or timed out by its caller is neither a failure nor a success of the index read, while
+	// the read timeout of the index is reported as ErrIndexReadTimeout. If it was the probe, the next read
+	// probes the index instead, without waiting for another cooldown.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if breaker := b.tenants[userID]; probe && breaker != nil {
+			breaker.probing = false
+			b.open.WithLabelValues(userID).Set(1)
+		}
+		return
+	}
+
+	// A missing index is a legit case, eg. a tenant whose blocks haven't been uploaded yet.
+	if err == nil || errors.Is(err, ErrIndexNotFound) {
+		if _, ok := b.tenants[userID]; ok {
+			delete(b.tenants, userID)
+			b.open.DeleteLabelValues(userID)
+		}
+		return
+	}
+
+	breaker := b.tenants[userID]
+	if breaker == nil {
+		breaker = &readCircuitBreaker{}
+		b.tenants[userID] = breaker
+	}
+
+	breaker.consecutiveFailures++
+	breaker.lastErr = err
+	if probe {
+		breaker.probing = false
+	}
+	if breaker.consecutiveFailures >= b.failures {
+		breaker.openUntil = now.Add(b.cooldown)
+		b.open.WithLabelValues(userID).Set(1)
+	}
+}
+
+// forget removes the breaker of the input tenant, eg. once its index is offloaded.
+func (b *readCircuitBreakers) forget(userID string) {
+	if b == nil {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.tenants, userID)
+	b.open.DeleteLabelValues(userID)
+}
@@ -0,0 +1,83 @@
+package bucketindex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCircuitBreakers(t *testing.T) {
+	const user = "user-1"
+
+	storageErr := errors.New("mocked storage failure")
+	failingRead := func(err error) func() (*Index, error) {
+		return func() (*Index, error) { return nil, err }
+	}
+
+	t.Run("should not count the reads canceled or timed out by the caller as failures", func(t *testing.T) {
+		b := newReadCircuitBreakers(2, time.Hour, prometheus.NewRegistry())
+
+		for _, err := range []error{context.Canceled, context.DeadlineExceeded, errors.Wrap(context.DeadlineExceeded, "get index")} {
+			_, actualErr := b.read(user, failingRead(err))
+			require.Equal(t, err, actualErr)
+		}
+		assert.Empty(t, b.tenants)
+
+		// The read timeout of the index and the storage failures are failures.
+		_, err := b.read(user, failingRead(ErrIndexReadTimeout))
+		require.Equal(t, ErrIndexReadTimeout, err)
+		_, err = b.read(user, failingRead(storageErr))
+		require.Equal(t, storageErr, err)
+
+		_, err = b.read(user, func() (*Index, error) {
+			require.Fail(t, "the read should be short-circuited")
+			return nil, nil
+		})
+		require.Equal(t, storageErr, err)
+	})
+
+	t.Run("should let the next read probe the index if the probe is canceled", func(t *testing.T) {
+		b := newReadCircuitBreakers(1, time.Hour, prometheus.NewRegistry())
+
+		_, err := b.read(user, failingRead(storageErr))
+		require.Equal(t, storageErr, err)
+		b.tenants[user].openUntil = time.Now().Add(-time.Second)
+
+		// The other reads are short-circuited while the probe is in progress.
+		_, err = b.read(user, func() (*Index, error) {
+			_, err := b.read(user, failingRead(nil))
+			require.Equal(t, storageErr, err)
+
+			return nil, context.Canceled
+		})
+		require.Equal(t, context.Canceled, err)
+
+		// The canceled probe doesn't open the breaker for another cooldown.
+		idx := &Index{}
+		actual, err := b.read(user, func() (*Index, error) { return idx, nil })
+		require.NoError(t, err)
+		assert.Same(t, idx, actual)
+		assert.Empty(t, b.tenants)
+	})
+
+	t.Run("should open the breaker for another cooldown if the probe fails", func(t *testing.T) {
+		b := newReadCircuitBreakers(1, time.Hour, prometheus.NewRegistry())
+
+		_, err := b.read(user, failingRead(storageErr))
+		require.Equal(t, storageErr, err)
+		b.tenants[user].openUntil = time.Now().Add(-time.Second)
+
+		_, err = b.read(user, failingRead(ErrIndexReadTimeout))
+		require.Equal(t, ErrIndexReadTimeout, err)
+		assert.False(t, b.tenants[user].probing)
+		assert.True(t, b.tenants[user].openUntil.After(time.Now()))
+
+		_, err = b.read(user, failingRead(nil))
+		require.Equal(t, ErrIndexReadTimeout, err)
+	})
+}
@@ -0,0 +1,68 @@
+package bucketindex
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+)
+
+const (
+	defaultSmallIndexMaxBytes = 1024 * 1024
+	defaultLargeIndexMinBytes = 16 * 1024 * 1024
+)
+
+var (
+	errInvalidSmallIndexMaxBytes    = errors.New("invalid bucket index compression small_index_max_bytes, must be greater than or equal to 0")
+	errInvalidLargeIndexMinBytes    = errors.New("invalid bucket index compression large_index_min_bytes, must be greater than or equal to 0")
+	errInvalidCompressionThresholds = errors.New("invalid bucket index compression thresholds, small_index_max_bytes must be lower than large_index_min_bytes")
+)
+
+// CompressionConfig configures the gzip compression level of the bucket index, which is chosen
+// based on the size of the uncompressed index. Large indexes are compressed with the fastest level,
+// because CPU time dominates, while small indexes are compressed with the best level, because the
+// size matters more. Indexes in between are compressed with the default level.
+type CompressionConfig struct {
+	// SmallIndexMaxBytes is the maximum size of an index compressed with the best level. 0 to disable.
+	SmallIndexMaxBytes int `yaml:"small_index_max_bytes"`
+
+	// LargeIndexMinBytes is the minimum size of an index compressed with the fastest level. 0 to disable.
+	LargeIndexMinBytes int `yaml:"large_index_min_bytes"`
+}
+
+// DefaultCompressionConfig returns the compression config used by WriteIndex.
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		SmallIndexMaxBytes: defaultSmallIndexMaxBytes,
+		LargeIndexMinBytes: defaultLargeIndexMinBytes,
+	}
+}
+
+func (cfg *CompressionConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.IntVar(&cfg.SmallIndexMaxBytes, prefix+"small-index-max-bytes", defaultSmallIndexMaxBytes, "Bucket indexes up to this uncompressed size are compressed with the best gzip compression level. 0 to disable.")
+	f.IntVar(&cfg.LargeIndexMinBytes, prefix+"large-index-min-bytes", defaultLargeIndexMinBytes, "Bucket indexes of at least this uncompressed size are compressed with the fastest gzip compression level. Indexes between the small and large thresholds are compressed with the default level. 0 to disable.")
+}
+
+func (cfg *CompressionConfig) Validate() error {
+	if cfg.SmallIndexMaxBytes < 0 {
+		return errInvalidSmallIndexMaxBytes
+	}
+	if cfg.LargeIndexMinBytes < 0 {
+		return errInvalidLargeIndexMinBytes
+	}
+	if cfg.SmallIndexMaxBytes > 0 && cfg.LargeIndexMinBytes > 0 && cfg.SmallIndexMaxBytes >= cfg.LargeIndexMinBytes {
+		return errInvalidCompressionThresholds
+	}
+	return nil
+}
+
+// level returns the gzip compression level for an uncompressed index of the input size.
+func (cfg CompressionConfig) level(size int) int {
+	switch {
+	case cfg.LargeIndexMinBytes > 0 && size >= cfg.LargeIndexMinBytes:
+		return gzip.BestSpeed
+	case cfg.SmallIndexMaxBytes > 0 && size <= cfg.SmallIndexMaxBytes:
+		return gzip.BestCompression
+	default:
+		return gzip.DefaultCompression
+	}
+}
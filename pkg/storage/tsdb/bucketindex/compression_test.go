@@ -0,0 +1,146 @@
+package bucketindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionConfig_Validate(t *testing.T) {
+	tests := map[string]struct {
+		cfg      CompressionConfig
+		expected error
+	}{
+		"default config": {
+			cfg:      DefaultCompressionConfig(),
+			expected: nil,
+		},
+		"both thresholds disabled": {
+			cfg:      CompressionConfig{},
+			expected: nil,
+		},
+		"only large index threshold enabled": {
+			cfg:      CompressionConfig{LargeIndexMinBytes: 1024},
+			expected: nil,
+		},
+		"negative small index threshold": {
+			cfg:      CompressionConfig{SmallIndexMaxBytes: -1},
+			expected: errInvalidSmallIndexMaxBytes,
+		},
+		"negative large index threshold": {
+			cfg:      CompressionConfig{LargeIndexMinBytes: -1},
+			expected: errInvalidLargeIndexMinBytes,
+		},
+		"small index threshold equal to the large one": {
+			cfg:      CompressionConfig{SmallIndexMaxBytes: 1024, LargeIndexMinBytes: 1024},
+			expected: errInvalidCompressionThresholds,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, testData.cfg.Validate())
+		})
+	}
+}
+
+func TestCompressionConfig_Level(t *testing.T) {
+	cfg := CompressionConfig{SmallIndexMaxBytes: 100, LargeIndexMinBytes: 1000}
+
+	assert.Equal(t, gzip.BestCompression, cfg.level(0))
+	assert.Equal(t, gzip.BestCompression, cfg.level(100))
+	assert.Equal(t, gzip.DefaultCompression, cfg.level(101))
+	assert.Equal(t, gzip.DefaultCompression, cfg.level(999))
+	assert.Equal(t, gzip.BestSpeed, cfg.level(1000))
+
+	// Disabled thresholds fall back to the default level.
+	assert.Equal(t, gzip.DefaultCompression, CompressionConfig{}.level(0))
+	assert.Equal(t, gzip.DefaultCompression, CompressionConfig{}.level(1000))
+}
+
+func TestEncodeIndex_ShouldBeDecodableWithAnyCompressionLevel(t *testing.T) {
+	idx := mockIndexForCompression(100)
+
+	for testName, cfg := range map[string]CompressionConfig{
+		"best compression": {SmallIndexMaxBytes: 1024 * 1024},
+		"best speed":       {LargeIndexMinBytes: 1},
+		"default":          {},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			content, err := encodeIndex(idx, cfg)
+			require.NoError(t, err)
+
+			gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+			require.NoError(t, err)
+			decoded, err := io.ReadAll(gzipReader)
+			require.NoError(t, err)
+
+			actual := &Index{}
+			require.NoError(t, json.Unmarshal(decoded, actual))
+			assert.Equal(t, idx, actual)
+		})
+	}
+}
+
+func BenchmarkEncodeIndex(b *testing.B) {
+	configs := []struct {
+		name string
+		cfg  CompressionConfig
+	}{
+		{name: "best speed", cfg: CompressionConfig{LargeIndexMinBytes: 1}},
+		{name: "default", cfg: CompressionConfig{}},
+		{name: "best compression", cfg: CompressionConfig{SmallIndexMaxBytes: 1024 * 1024 * 1024}},
+		{name: "adaptive", cfg: DefaultCompressionConfig()},
+	}
+
+	for _, numBlocks := range []int{1000, 10000, 100000} {
+		idx := mockIndexForCompression(numBlocks)
+
+		for _, c := range configs {
+			b.Run(fmt.Sprintf("blocks=%d, compression=%s", numBlocks, c.name), func(b *testing.B) {
+				var content []byte
+				for n := 0; n < b.N; n++ {
+					var err error
+					content, err = encodeIndex(idx, c.cfg)
+					require.NoError(b, err)
+				}
+
+				b.ReportMetric(float64(len(content)), "compressed_bytes")
+			})
+		}
+	}
+}
+
+func mockIndexForCompression(numBlocks int) *Index {
+	idx := &Index{Version: IndexVersion1, UpdatedAt: 1}
+
+	for i := 0; i < numBlocks; i++ {
+		minT := int64(i) * 7200000
+		idx.Blocks = append(idx.Blocks, &Block{
+			ID:             ulid.MustNew(uint64(minT), rand.Reader),
+			MinTime:        minT,
+			MaxTime:        minT + 7200000,
+			SegmentsFormat: SegmentsFormat1Based6Digits,
+			SegmentsNum:    i%10 + 1,
+			SizeBytes:      int64(i) * 1024,
+			UploadedAt:     int64(i),
+		})
+
+		if i%10 == 0 {
+			idx.BlockDeletionMarks = append(idx.BlockDeletionMarks, &BlockDeletionMark{
+				ID:           idx.Blocks[i].ID,
+				DeletionTime: int64(i),
+			})
+		}
+	}
+
+	return idx
+}
@@ -0,0 +1,192 @@
+package bucketindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	cortex_errors "github.com/cortexproject/cortex/pkg/util/errors"
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+const (
+	// IndexDeltaFilename is the filename of the bucket index delta, holding the block deletion marks
+	// appended to the bucket index since it has been written.
+	IndexDeltaFilename = "bucket-index-delta.json"
+
+	// IndexDeltaVersion1 is the current supported version of the bucket index delta.
+	IndexDeltaVersion1 = 1
+)
+
+var ErrIndexDeltaCorrupted = errors.New("bucket index delta corrupted")
+
+// IndexDelta holds the block deletion marks appended to a bucket index without rewriting it.
+type IndexDelta struct {
+	// Version of the delta format.
+	Version int `json:"version"`
+
+	// List of the block deletion marks appended to the index, in the order they've been appended.
+	BlockDeletionMarks BlockDeletionMarks `json:"block_deletion_marks"`
+}
+
+// AppendDeletionMark appends the input block deletion mark to the delta of the bucket index of the input
+// tenant, so that the mark is visible to the readers of the index without rewriting the whole index,
+// which is costly for the tenants with many blocks. The mark is appended once, whatever the number of
+// calls.
+//
+// The delta is only folded into the index by the functions reading it if the index has been written with DeltasEnabled,
+// and is expected to be periodically compacted back into the index, see CompactIndexDelta. The delta is
+// updated with a read-modify-write, so the appends must not be concurrent, like the writes of the index.
+func AppendDeletionMark(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, mark *BlockDeletionMark, logger log.Logger) error {
+	delta, err := readIndexDelta(ctx, bkt, userID, logger)
+	if err != nil {
+		return err
+	}
+	if delta == nil {
+		delta = &IndexDelta{Version: IndexDeltaVersion1}
+	}
+
+	for _, m := range delta.BlockDeletionMarks {
+		if m.ID == mark.ID {
+			return nil
+		}
+	}
+	delta.BlockDeletionMarks = append(delta.BlockDeletionMarks, mark)
+
+	content, err := json.Marshal(delta)
+	if err != nil {
+		return errors.Wrap(err, "marshal bucket index delta")
+	}
+
+	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+	if err := userBkt.Upload(ctx, IndexDeltaFilename, bytes.NewReader(content)); err != nil {
+		return errors.Wrap(err, "upload bucket index delta")
+	}
+	return nil
+}
+
+// CompactIndexDelta folds the delta of the bucket index of the input tenant into the index, writes the
+// index and deletes the delta, so that the delta doesn't grow indefinitely. It's meant to be called
+// periodically by the writer of the index. No error is returned if the index does not exist.
+//
+// The marks appended between the read of the index and the deletion of the delta are lost, so the marks
+// must be appended once their deletion marker has been uploaded: they're still added to the index by
+// the next index update, which discovers the deletion markers from the storage.
+func CompactIndexDelta(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) error {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if errors.Is(err, ErrIndexNotFound) {
+		return DeleteIndexDelta(ctx, bkt, userID, cfgProvider)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := WriteIndex(ctx, bkt, userID, cfgProvider, idx); err != nil {
+		return err
+	}
+	return DeleteIndexDelta(ctx, bkt, userID, cfgProvider)
+}
+
+// DeleteIndexDelta deletes the bucket index delta from the storage. No error is returned if the delta
+// does not exist.
+func DeleteIndexDelta(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider) error {
+	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+
+	err := userBkt.Delete(ctx, IndexDeltaFilename)
+	if err != nil && !userBkt.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete bucket index delta")
+	}
+	return nil
+}
+
+// foldIndexDelta adds the deletion marks of the delta of the bucket index of the input tenant to the input
+// index, if the index has DeltasEnabled. It's called by all the functions reading the index. The marks of
+// the delta are also added to the index by its next update, which discovers them from the storage, so a
+// delta failing to be read only delays them: the error is logged and doesn't fail the read.
+func foldIndexDelta(ctx context.Context, bkt BucketReader, userID string, index *Index, logger log.Logger) {
+	if !index.DeltasEnabled {
+		return
+	}
+
+	delta, err := readIndexDelta(ctx, bkt, userID, logger)
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to read bucket index delta, ignoring it", "user", userID, "err", err)
+		return
+	}
+	if delta != nil {
+		index.applyDelta(delta)
+	}
+}
+
+// readIndexDelta reads the bucket index delta from the bucket. It returns nil if the delta doesn't exist.
+func readIndexDelta(ctx context.Context, bkt BucketReader, userID string, logger log.Logger) (*IndexDelta, error) {
+	var getter BucketReader = bkt
+	if ib, ok := bkt.(objstore.InstrumentedBucketReader); ok {
+		getter = ib.ReaderWithExpectedErrs(tsdb.IsOneOfTheExpectedErrors(bkt.IsAccessDeniedErr, bkt.IsObjNotFoundErr))
+	}
+
+	reader, err := getter.Get(ctx, path.Join(userID, IndexDeltaFilename))
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, nil
+		}
+
+		if bkt.IsAccessDeniedErr(err) {
+			return nil, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+		}
+
+		return nil, errors.Wrap(err, "read bucket index delta")
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index delta reader")
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bucket index delta")
+	}
+
+	delta := &IndexDelta{}
+	if err := json.Unmarshal(content, delta); err != nil {
+		return nil, ErrIndexDeltaCorrupted
+	}
+	if delta.Version != IndexDeltaVersion1 {
+		return nil, errors.Wrapf(ErrIndexVersionUnsupported, "delta version %d", delta.Version)
+	}
+
+	return delta, nil
+}
+
+// applyDelta adds the deletion marks of the input delta to the index. The marks of the blocks which are
+// not in the index, or are already marked for deletion, are skipped, so that applying a delta more than
+// once, eg. to an index which has been updated since, is harmless.
+func (idx *Index) applyDelta(delta *IndexDelta) {
+	known := make(map[ulid.ULID]struct{}, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		known[b.ID] = struct{}{}
+	}
+
+	marked := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		marked[m.ID] = struct{}{}
+	}
+
+	for _, m := range delta.BlockDeletionMarks {
+		_, isKnown := known[m.ID]
+		_, isMarked := marked[m.ID]
+		if !isKnown || isMarked {
+			continue
+		}
+
+		idx.BlockDeletionMarks = append(idx.BlockDeletionMarks, m)
+		marked[m.ID] = struct{}{}
+	}
+}
@@ -0,0 +1,195 @@
+package bucketindex
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestAppendDeletionMark_ShouldBeFoldedIntoTheIndexOnRead(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	unknown := ulid.MustNew(4, nil)
+
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version:            IndexVersion1,
+		DeltasEnabled:      true,
+		Blocks:             Blocks{{ID: block1}, {ID: block2}, {ID: block3}},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: block1, DeletionTime: 10}},
+	}))
+
+	// Append a mark twice, and marks for blocks already marked or not in the index.
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block2, DeletionTime: 20}, logger))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block2, DeletionTime: 30}, logger))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block1, DeletionTime: 40}, logger))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: unknown, DeletionTime: 50}, logger))
+
+	delta, err := readIndexDelta(ctx, bkt, userID, logger)
+	require.NoError(t, err)
+	assert.Equal(t, BlockDeletionMarks{
+		{ID: block2, DeletionTime: 20},
+		{ID: block1, DeletionTime: 40},
+		{ID: unknown, DeletionTime: 50},
+	}, delta.BlockDeletionMarks)
+
+	idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, BlockDeletionMarks{
+		{ID: block1, DeletionTime: 10},
+		{ID: block2, DeletionTime: 20},
+	}, idx.BlockDeletionMarks)
+}
+
+func TestReadIndexFunctions_ShouldFoldTheDelta(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	block1 := ulid.MustNew(1, nil)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version:       IndexVersion1,
+		DeltasEnabled: true,
+		Blocks:        Blocks{{ID: block1}},
+	}))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block1, DeletionTime: 10}, logger))
+
+	expected := BlockDeletionMarks{{ID: block1, DeletionTime: 10}}
+	readers := map[string]func() (*Index, error){
+		"ReadIndex": func() (*Index, error) {
+			return ReadIndex(ctx, bkt, userID, nil, logger)
+		},
+		"ReadIndexWithBuffer": func() (*Index, error) {
+			idx, _, err := ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, nil)
+			return idx, err
+		},
+		"ReadIndexRaw": func() (*Index, error) {
+			idx, _, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+			return idx, err
+		},
+		"ReadIndexShard": func() (*Index, error) {
+			return ReadIndexShard(ctx, bkt, userID, nil, logger, 0, 1)
+		},
+		"ReadIndexBestEffort": func() (*Index, error) {
+			idx, _, err := ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+			return idx, err
+		},
+		"ReadIndexInto": func() (*Index, error) {
+			return ReadIndexInto(ctx, bkt, userID, nil, logger, NewIndexArena())
+		},
+	}
+
+	for name, read := range readers {
+		t.Run(name, func(t *testing.T) {
+			idx, err := read()
+			require.NoError(t, err)
+			assert.Equal(t, expected, idx.BlockDeletionMarks)
+		})
+	}
+}
+
+func TestReadIndex_ShouldIgnoreTheDeltaIfNotEnabled(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	block1 := ulid.MustNew(1, nil)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version: IndexVersion1,
+		Blocks:  Blocks{{ID: block1}},
+	}))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block1, DeletionTime: 10}, logger))
+
+	idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Empty(t, idx.BlockDeletionMarks)
+}
+
+func TestReadIndex_ShouldIgnoreACorruptedDelta(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	block1 := ulid.MustNew(1, nil)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version:       IndexVersion1,
+		DeltasEnabled: true,
+		Blocks:        Blocks{{ID: block1}},
+	}))
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexDeltaFilename), bytes.NewReader([]byte("invalid!}"))))
+
+	_, err := readIndexDelta(ctx, bkt, userID, logger)
+	require.ErrorIs(t, err, ErrIndexDeltaCorrupted)
+
+	idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, Blocks{{ID: block1}}, idx.Blocks)
+	assert.Empty(t, idx.BlockDeletionMarks)
+}
+
+func TestCompactIndexDelta(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	// No error is expected if neither the index nor the delta exist.
+	require.NoError(t, CompactIndexDelta(ctx, bkt, userID, nil, logger))
+
+	block1 := ulid.MustNew(1, nil)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version:       IndexVersion1,
+		DeltasEnabled: true,
+		Blocks:        Blocks{{ID: block1}},
+	}))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: block1, DeletionTime: 10}, logger))
+
+	require.NoError(t, CompactIndexDelta(ctx, bkt, userID, nil, logger))
+
+	exists, err := bkt.Exists(ctx, path.Join(userID, IndexDeltaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// The mark has been written to the index itself.
+	idx, _, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.True(t, idx.DeltasEnabled)
+	assert.Equal(t, BlockDeletionMarks{{ID: block1, DeletionTime: 10}}, idx.BlockDeletionMarks)
+}
+
+func TestDeleteIndex_ShouldDeleteTheDelta(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, DeltasEnabled: true}))
+	require.NoError(t, AppendDeletionMark(ctx, bkt, userID, nil, &BlockDeletionMark{ID: ulid.MustNew(1, nil)}, logger))
+
+	require.NoError(t, DeleteIndex(ctx, bkt, userID, nil))
+	exists, err := bkt.Exists(ctx, path.Join(userID, IndexDeltaFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
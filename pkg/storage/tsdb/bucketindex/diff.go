@@ -0,0 +1,151 @@
+package bucketindex
+
+import (
+	"context"
+	"path"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/store/cache/cachekey"
+)
+
+// IndexDiff holds the differences between two versions of a bucket index.
+type IndexDiff struct {
+	AddedBlocks          Blocks
+	RemovedBlocks        Blocks
+	AddedDeletionMarks   BlockDeletionMarks
+	RemovedDeletionMarks BlockDeletionMarks
+}
+
+// IsEmpty returns whether the two compared indexes contain the same blocks and deletion marks.
+func (d *IndexDiff) IsEmpty() bool {
+	return len(d.AddedBlocks) == 0 && len(d.RemovedBlocks) == 0 && len(d.AddedDeletionMarks) == 0 && len(d.RemovedDeletionMarks) == 0
+}
+
+// DiffIndex returns the blocks and deletion marks added and removed in the new index compared
+// to the old one. Both indexes can be nil, in which case they're considered empty.
+func DiffIndex(old, updated *Index) *IndexDiff {
+	if old == nil {
+		old = &Index{}
+	}
+	if updated == nil {
+		updated = &Index{}
+	}
+
+	diff := &IndexDiff{}
+
+	oldBlocks := make(map[ulid.ULID]struct{}, len(old.Blocks))
+	for _, b := range old.Blocks {
+		oldBlocks[b.ID] = struct{}{}
+	}
+	for _, b := range updated.Blocks {
+		if _, ok := oldBlocks[b.ID]; ok {
+			delete(oldBlocks, b.ID)
+			continue
+		}
+		diff.AddedBlocks = append(diff.AddedBlocks, b)
+	}
+	for _, b := range old.Blocks {
+		if _, ok := oldBlocks[b.ID]; ok {
+			diff.RemovedBlocks = append(diff.RemovedBlocks, b)
+		}
+	}
+
+	oldMarks := make(map[ulid.ULID]struct{}, len(old.BlockDeletionMarks))
+	for _, m := range old.BlockDeletionMarks {
+		oldMarks[m.ID] = struct{}{}
+	}
+	for _, m := range updated.BlockDeletionMarks {
+		if _, ok := oldMarks[m.ID]; ok {
+			delete(oldMarks, m.ID)
+			continue
+		}
+		diff.AddedDeletionMarks = append(diff.AddedDeletionMarks, m)
+	}
+	for _, m := range old.BlockDeletionMarks {
+		if _, ok := oldMarks[m.ID]; ok {
+			diff.RemovedDeletionMarks = append(diff.RemovedDeletionMarks, m)
+		}
+	}
+
+	return diff
+}
+
+// IndexComparison holds the differences between the bucket indexes of two tenants, eg. the
+// copies of a tenant in two storages.
+type IndexComparison struct {
+	BlocksOnlyInA        Blocks
+	BlocksOnlyInB        Blocks
+	DeletionMarksOnlyInA BlockDeletionMarks
+	DeletionMarksOnlyInB BlockDeletionMarks
+}
+
+// IsEmpty returns whether the two compared indexes contain the same blocks and deletion marks.
+func (c IndexComparison) IsEmpty() bool {
+	return len(c.BlocksOnlyInA) == 0 && len(c.BlocksOnlyInB) == 0 && len(c.DeletionMarksOnlyInA) == 0 && len(c.DeletionMarksOnlyInB) == 0
+}
+
+// CompareIndexes reads the bucket index of userA from bktA and the one of userB from bktB, and
+// returns the blocks and deletion marks found only in one of them. The buckets can be of different
+// types, so it can be used to validate the migration of a tenant from a storage to another one.
+// It fails if any of the two bucket indexes can't be read.
+func CompareIndexes(ctx context.Context, bktA BucketReader, userA string, bktB BucketReader, userB string, logger log.Logger) (IndexComparison, error) {
+	idxA, err := ReadIndex(ctx, bktA, userA, nil, logger)
+	if err != nil {
+		return IndexComparison{}, errors.Wrapf(err, "read bucket index of user %s from bucket A", userA)
+	}
+
+	idxB, err := ReadIndex(ctx, bktB, userB, nil, logger)
+	if err != nil {
+		return IndexComparison{}, errors.Wrapf(err, "read bucket index of user %s from bucket B", userB)
+	}
+
+	diff := DiffIndex(idxA, idxB)
+	return IndexComparison{
+		BlocksOnlyInA:        diff.RemovedBlocks,
+		BlocksOnlyInB:        diff.AddedBlocks,
+		DeletionMarksOnlyInA: diff.RemovedDeletionMarks,
+		DeletionMarksOnlyInB: diff.AddedDeletionMarks,
+	}, nil
+}
+
+// CacheInvalidator is implemented by caches supporting the invalidation of cached items.
+type CacheInvalidator interface {
+	Invalidate(ctx context.Context, keys []string)
+}
+
+// BlockMetadataCacheKeys returns the keys under which the caching bucket stores the metadata
+// of the input block.
+func BlockMetadataCacheKeys(userID string, blockID ulid.ULID) []string {
+	metaFile := path.Join(userID, blockID.String(), block.MetaFilename)
+	deletionMarkFile := path.Join(userID, blockID.String(), metadata.DeletionMarkFilename)
+	indexFile := path.Join(userID, blockID.String(), block.IndexFilename)
+
+	return []string{
+		cachekey.BucketCacheKey{Verb: cachekey.ContentVerb, Name: metaFile}.String(),
+		cachekey.BucketCacheKey{Verb: cachekey.ExistsVerb, Name: metaFile}.String(),
+		cachekey.BucketCacheKey{Verb: cachekey.AttributesVerb, Name: metaFile}.String(),
+		cachekey.BucketCacheKey{Verb: cachekey.ContentVerb, Name: deletionMarkFile}.String(),
+		cachekey.BucketCacheKey{Verb: cachekey.ExistsVerb, Name: deletionMarkFile}.String(),
+		cachekey.BucketCacheKey{Verb: cachekey.AttributesVerb, Name: indexFile}.String(),
+	}
+}
+
+// InvalidateRemovedBlocks invalidates the cached metadata of the blocks removed from the index,
+// so that they don't linger in the cache until their TTL expires. It returns the invalidated keys.
+func InvalidateRemovedBlocks(ctx context.Context, userID string, diff *IndexDiff, invalidator CacheInvalidator) []string {
+	if diff == nil || len(diff.RemovedBlocks) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(diff.RemovedBlocks)*6)
+	for _, b := range diff.RemovedBlocks {
+		keys = append(keys, BlockMetadataCacheKeys(userID, b.ID)...)
+	}
+
+	invalidator.Invalidate(ctx, keys)
+	return keys
+}
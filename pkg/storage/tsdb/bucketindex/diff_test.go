@@ -0,0 +1,153 @@
+package bucketindex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestDiffIndex(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	tests := map[string]struct {
+		old, updated *Index
+		expected     *IndexDiff
+	}{
+		"both indexes nil": {
+			expected: &IndexDiff{},
+		},
+		"old index nil": {
+			updated: &Index{
+				Blocks:             Blocks{{ID: block1}},
+				BlockDeletionMarks: BlockDeletionMarks{{ID: block1}},
+			},
+			expected: &IndexDiff{
+				AddedBlocks:        Blocks{{ID: block1}},
+				AddedDeletionMarks: BlockDeletionMarks{{ID: block1}},
+			},
+		},
+		"same content": {
+			old:      &Index{Blocks: Blocks{{ID: block1}, {ID: block2}}},
+			updated:  &Index{Blocks: Blocks{{ID: block2}, {ID: block1}}},
+			expected: &IndexDiff{},
+		},
+		"added and removed blocks and deletion marks": {
+			old: &Index{
+				Blocks:             Blocks{{ID: block1}, {ID: block2}},
+				BlockDeletionMarks: BlockDeletionMarks{{ID: block1}},
+			},
+			updated: &Index{
+				Blocks:             Blocks{{ID: block2}, {ID: block3}},
+				BlockDeletionMarks: BlockDeletionMarks{{ID: block2}},
+			},
+			expected: &IndexDiff{
+				AddedBlocks:          Blocks{{ID: block3}},
+				RemovedBlocks:        Blocks{{ID: block1}},
+				AddedDeletionMarks:   BlockDeletionMarks{{ID: block2}},
+				RemovedDeletionMarks: BlockDeletionMarks{{ID: block1}},
+			},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			diff := DiffIndex(testData.old, testData.updated)
+			assert.Equal(t, testData.expected, diff)
+			assert.Equal(t, testData.expected.IsEmpty(), diff.IsEmpty())
+		})
+	}
+}
+
+func TestCompareIndexes(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	bktA, _ := testutil.PrepareFilesystemBucket(t)
+	bktB, _ := testutil.PrepareFilesystemBucket(t)
+
+	require.NoError(t, WriteIndex(ctx, bktA, "user-a", nil, &Index{
+		Version:            IndexVersion1,
+		Blocks:             Blocks{{ID: block1, MinTime: 10, MaxTime: 20}, {ID: block2, MinTime: 20, MaxTime: 30}},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: block1, DeletionTime: 100}},
+	}))
+
+	t.Run("identical indexes", func(t *testing.T) {
+		require.NoError(t, WriteIndex(ctx, bktB, "user-b", nil, &Index{
+			Version:            IndexVersion1,
+			Blocks:             Blocks{{ID: block2, MinTime: 20, MaxTime: 30}, {ID: block1, MinTime: 10, MaxTime: 20}},
+			BlockDeletionMarks: BlockDeletionMarks{{ID: block1, DeletionTime: 100}},
+		}))
+
+		comparison, err := CompareIndexes(ctx, bktA, "user-a", bktB, "user-b", logger)
+		require.NoError(t, err)
+		assert.True(t, comparison.IsEmpty())
+	})
+
+	t.Run("different indexes", func(t *testing.T) {
+		require.NoError(t, WriteIndex(ctx, bktB, "user-b", nil, &Index{
+			Version:            IndexVersion1,
+			Blocks:             Blocks{{ID: block2, MinTime: 20, MaxTime: 30}, {ID: block3, MinTime: 30, MaxTime: 40}},
+			BlockDeletionMarks: BlockDeletionMarks{{ID: block2, DeletionTime: 200}},
+		}))
+
+		comparison, err := CompareIndexes(ctx, bktA, "user-a", bktB, "user-b", logger)
+		require.NoError(t, err)
+		assert.False(t, comparison.IsEmpty())
+		assert.Equal(t, IndexComparison{
+			BlocksOnlyInA:        Blocks{{ID: block1, MinTime: 10, MaxTime: 20}},
+			BlocksOnlyInB:        Blocks{{ID: block3, MinTime: 30, MaxTime: 40}},
+			DeletionMarksOnlyInA: BlockDeletionMarks{{ID: block1, DeletionTime: 100}},
+			DeletionMarksOnlyInB: BlockDeletionMarks{{ID: block2, DeletionTime: 200}},
+		}, comparison)
+	})
+
+	t.Run("missing index", func(t *testing.T) {
+		_, err := CompareIndexes(ctx, bktA, "user-a", bktB, "user-c", logger)
+		require.ErrorIs(t, err, ErrIndexNotFound)
+	})
+}
+
+func TestInvalidateRemovedBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	ctx := context.Background()
+
+	t.Run("should not invalidate anything if no block has been removed", func(t *testing.T) {
+		invalidator := &mockCacheInvalidator{}
+		diff := DiffIndex(&Index{Blocks: Blocks{{ID: block1}}}, &Index{Blocks: Blocks{{ID: block1}, {ID: block2}}})
+
+		assert.Empty(t, InvalidateRemovedBlocks(ctx, userID, diff, invalidator))
+		assert.Empty(t, invalidator.keys)
+	})
+
+	t.Run("should invalidate the metadata of removed blocks", func(t *testing.T) {
+		invalidator := &mockCacheInvalidator{}
+		diff := DiffIndex(&Index{Blocks: Blocks{{ID: block1}, {ID: block2}}}, &Index{Blocks: Blocks{{ID: block2}}})
+
+		keys := InvalidateRemovedBlocks(ctx, userID, diff, invalidator)
+		assert.Equal(t, BlockMetadataCacheKeys(userID, block1), keys)
+		assert.Equal(t, keys, invalidator.keys)
+		assert.Contains(t, keys, "content:user-1/"+block1.String()+"/meta.json")
+	})
+}
+
+type mockCacheInvalidator struct {
+	keys []string
+}
+
+func (m *mockCacheInvalidator) Invalidate(_ context.Context, keys []string) {
+	m.keys = append(m.keys, keys...)
+}
@@ -0,0 +1,52 @@
+package bucketindex
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+var ErrDriftCheckTooManyBlocks = errors.New("too many blocks in the bucket to check the bucket index drift")
+
+// errMaxBlocksReached is used to stop the listing of the blocks once the max is reached.
+var errMaxBlocksReached = errors.New("max number of blocks reached")
+
+// BlocksDrift returns the signed difference between the number of blocks in the tenant's bucket
+// and in the input index: it's positive if the index lacks blocks, eg. because the updater is
+// behind, and negative if the index references blocks which don't exist anymore. Partial blocks
+// are counted in the bucket while they're excluded from the index.
+//
+// The cost of the check is bounded by listing at most maxBlocks blocks: ErrDriftCheckTooManyBlocks
+// is returned if the bucket contains more.
+func BlocksDrift(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, idx *Index, maxBlocks int) (int, error) {
+	numBlocks, err := countBlocks(ctx, bkt, userID, cfgProvider, maxBlocks)
+	if errors.Is(err, errMaxBlocksReached) {
+		return 0, ErrDriftCheckTooManyBlocks
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return numBlocks - len(idx.Blocks), nil
+}
+
+// countBlocks returns the number of blocks in the tenant's bucket, without fetching their meta.json.
+// errMaxBlocksReached is returned if there are more than maxBlocks blocks.
+func countBlocks(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, maxBlocks int) (int, error) {
+	numBlocks := 0
+	err := bucket.NewUserBucketClient(userID, bkt, cfgProvider).Iter(ctx, "", func(name string) error {
+		if _, ok := block.IsBlockDir(name); ok {
+			numBlocks++
+		}
+		if numBlocks > maxBlocks {
+			return errMaxBlocksReached
+		}
+		return nil
+	})
+
+	return numBlocks, err
+}
@@ -0,0 +1,67 @@
+package bucketindex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestBlocksDrift(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	testutil.MockStorageBlock(t, bkt, userID, 30, 40)
+
+	tests := map[string]struct {
+		idx           *Index
+		maxBlocks     int
+		expectedDrift int
+		expectedErr   error
+	}{
+		"index in sync with the bucket": {
+			idx:       &Index{Blocks: Blocks{{ID: block1.ULID}, {ID: block2.ULID}, {ID: ulid.MustNew(3, nil)}}},
+			maxBlocks: 10,
+		},
+		"index lacking blocks": {
+			idx:           &Index{Blocks: Blocks{{ID: block1.ULID}}},
+			maxBlocks:     10,
+			expectedDrift: 2,
+		},
+		"index with more blocks than the bucket": {
+			idx:           &Index{Blocks: Blocks{{ID: block1.ULID}, {ID: block2.ULID}, {ID: ulid.MustNew(3, nil)}, {ID: ulid.MustNew(4, nil)}}},
+			maxBlocks:     10,
+			expectedDrift: -1,
+		},
+		"bucket with exactly the max number of blocks": {
+			idx:       &Index{Blocks: Blocks{{ID: block1.ULID}, {ID: block2.ULID}, {ID: ulid.MustNew(3, nil)}}},
+			maxBlocks: 3,
+		},
+		"bucket with more blocks than the max": {
+			idx:         &Index{},
+			maxBlocks:   2,
+			expectedErr: ErrDriftCheckTooManyBlocks,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			drift, err := BlocksDrift(ctx, bkt, userID, nil, testData.idx, testData.maxBlocks)
+			if testData.expectedErr != nil {
+				require.ErrorIs(t, err, testData.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedDrift, drift)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package bucketindex
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// hedgedBucket is a bucket hedging the Get requests: if a request doesn't return within the hedge
+// delay, another concurrent request is issued, up to the max number of hedges, and the response of
+// the first successful request is returned, canceling the other ones. It cuts the tail latency of
+// the bucket index reads against object storages with occasional slow responses, at the cost of
+// extra requests. A failure is only returned once all the in-flight requests have failed.
+type hedgedBucket struct {
+	objstore.Bucket
+
+	delay     time.Duration
+	maxHedges int
+
+	hedges    prometheus.Counter
+	hedgesWon prometheus.Counter
+}
+
+func newHedgedBucket(bkt objstore.Bucket, delay time.Duration, maxHedges int, reg prometheus.Registerer) *hedgedBucket {
+	return &hedgedBucket{
+		Bucket:    bkt,
+		delay:     delay,
+		maxHedges: maxHedges,
+		hedges: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_hedged_reads_total",
+			Help: "Total number of hedged bucket index reads issued because a read didn't complete within the hedge delay.",
+		}),
+		hedgesWon: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_hedged_reads_won_total",
+			Help: "Total number of hedged bucket index reads which completed before the read they've been issued for.",
+		}),
+	}
+}
+
+type hedgedGetResult struct {
+	attempt int
+	reader  io.ReadCloser
+	err     error
+}
+
+func (b *hedgedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	// Buffered so that the losers never block, even once the winner has been returned.
+	results := make(chan hedgedGetResult, b.maxHedges+1)
+	cancels := make([]context.CancelFunc, 0, b.maxHedges+1)
+
+	start := func() {
+		attempt := len(cancels)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+
+		go func() {
+			reader, err := b.Bucket.Get(attemptCtx, name)
+			results <- hedgedGetResult{attempt: attempt, reader: reader, err: err}
+		}()
+	}
+
+	start()
+	inflight := 1
+
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			b.hedges.Inc()
+			start()
+			inflight++
+
+			if len(cancels) <= b.maxHedges {
+				timer.Reset(b.delay)
+			}
+
+		case res := <-results:
+			inflight--
+
+			if res.err != nil {
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				if inflight == 0 {
+					cancelAll(cancels)
+					return nil, firstErr
+				}
+				continue
+			}
+
+			if res.attempt > 0 {
+				b.hedgesWon.Inc()
+			}
+
+			// Cancel the losers, and close the readers of the ones which have already succeeded.
+			for attempt, cancel := range cancels {
+				if attempt != res.attempt {
+					cancel()
+				}
+			}
+			go func(inflight int) {
+				for ; inflight > 0; inflight-- {
+					if loser := <-results; loser.err == nil {
+						_ = loser.reader.Close()
+					}
+				}
+			}(inflight)
+
+			return &cancelOnCloseReader{ReadCloser: res.reader, cancel: cancels[res.attempt]}, nil
+		}
+	}
+}
+
+// withBucket returns a copy of the hedged bucket wrapping the input bucket, sharing the metrics.
+func (b *hedgedBucket) withBucket(bkt objstore.Bucket) *hedgedBucket {
+	res := &hedgedBucket{}
+	*res = *b
+	res.Bucket = bkt
+	return res
+}
+
+func (b *hedgedBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.Bucket.(objstore.InstrumentedBucket); ok {
+		// Make a copy, but replace bucket with instrumented one.
+		return b.withBucket(ib.WithExpectedErrs(expectedFunc))
+	}
+
+	return b
+}
+
+func (b *hedgedBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(expectedFunc)
+}
+
+func cancelAll(cancels []context.CancelFunc) {
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// cancelOnCloseReader cancels the context of the request which returned the reader once closed,
+// since the request context must not be canceled while the content is being read.
+type cancelOnCloseReader struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnCloseReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,177 @@
+package bucketindex
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestHedgedBucket_Get(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	tests := map[string]struct {
+		maxHedges         int
+		blockingAttempts  int
+		expectedCalls     int32
+		expectedHedges    float64
+		expectedHedgesWon float64
+	}{
+		"should not hedge a read completing within the delay": {
+			maxHedges:     2,
+			expectedCalls: 1,
+		},
+		"should use the hedged read if it completes first": {
+			maxHedges:         2,
+			blockingAttempts:  1,
+			expectedCalls:     2,
+			expectedHedges:    1,
+			expectedHedgesWon: 1,
+		},
+		"should issue up to the max number of hedges": {
+			maxHedges:         2,
+			blockingAttempts:  2,
+			expectedCalls:     3,
+			expectedHedges:    2,
+			expectedHedgesWon: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			bkt, _ := testutil.PrepareFilesystemBucket(t)
+			require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+			slow := &blockingGetBucket{Bucket: bkt, blockingAttempts: testData.blockingAttempts}
+			reg := prometheus.NewPedanticRegistry()
+			hedged := newHedgedBucket(slow, 10*time.Millisecond, testData.maxHedges, reg)
+
+			actual, err := ReadIndex(ctx, hedged, userID, nil, log.NewNopLogger())
+			require.NoError(t, err)
+			assert.Equal(t, idx, actual)
+
+			// The losers should have been canceled.
+			slow.wg.Wait()
+			assert.Equal(t, testData.expectedCalls, slow.calls.Load())
+			assert.Equal(t, int32(testData.blockingAttempts), slow.canceled.Load())
+
+			assert.Equal(t, testData.expectedHedges, prom_testutil.ToFloat64(hedged.hedges))
+			assert.Equal(t, testData.expectedHedgesWon, prom_testutil.ToFloat64(hedged.hedgesWon))
+		})
+	}
+
+	t.Run("should not issue more than the max number of hedges if all the reads are slow", func(t *testing.T) {
+		bkt, _ := testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		slow := &blockingGetBucket{Bucket: bkt, delay: 100 * time.Millisecond}
+		hedged := newHedgedBucket(slow, 10*time.Millisecond, 2, prometheus.NewPedanticRegistry())
+
+		actual, err := ReadIndex(ctx, hedged, userID, nil, log.NewNopLogger())
+		require.NoError(t, err)
+		assert.Equal(t, idx, actual)
+
+		slow.wg.Wait()
+		assert.Equal(t, int32(3), slow.calls.Load())
+		assert.Equal(t, float64(2), prom_testutil.ToFloat64(hedged.hedges))
+	})
+
+	t.Run("should return a failure without hedging if no other read is in-flight", func(t *testing.T) {
+		bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+		slow := &blockingGetBucket{Bucket: bkt}
+		hedged := newHedgedBucket(slow, time.Minute, 2, prometheus.NewPedanticRegistry())
+
+		_, err := ReadIndex(ctx, hedged, userID, nil, log.NewNopLogger())
+		require.ErrorIs(t, err, ErrIndexNotFound)
+		assert.Equal(t, int32(1), slow.calls.Load())
+		assert.Equal(t, float64(0), prom_testutil.ToFloat64(hedged.hedges))
+	})
+}
+
+func TestLoader_ShouldHedgeSlowReads(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+	slow := &blockingGetBucket{Bucket: bkt, blockingAttempts: 1, blockingName: path.Join(userID, IndexCompressedFilename)}
+	reg := prometheus.NewPedanticRegistry()
+	loader := NewLoader(LoaderConfig{
+		CheckInterval:         time.Minute,
+		UpdateOnStaleInterval: time.Hour,
+		UpdateOnErrorInterval: time.Minute,
+		IdleTimeout:           time.Hour,
+		HedgeDelay:            10 * time.Millisecond,
+		MaxHedges:             1,
+	}, slow, nil, log.NewNopLogger(), reg)
+
+	actual, _, err := loader.GetIndex(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, idx, actual)
+
+	slow.wg.Wait()
+	assert.Equal(t, int32(1), slow.canceled.Load())
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(loader.hedging.hedgesWon))
+}
+
+// blockingGetBucket blocks the first Get requests until they're canceled, and delays the other ones.
+type blockingGetBucket struct {
+	objstore.Bucket
+
+	blockingAttempts int
+	blockingName     string
+	delay            time.Duration
+
+	wg       sync.WaitGroup
+	calls    atomic.Int32
+	canceled atomic.Int32
+}
+
+func (b *blockingGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if b.blockingName != "" && name != b.blockingName {
+		return b.Bucket.Get(ctx, name)
+	}
+
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	if int(b.calls.Inc()) <= b.blockingAttempts {
+		<-ctx.Done()
+		b.canceled.Inc()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return b.Bucket.Get(ctx, name)
+}
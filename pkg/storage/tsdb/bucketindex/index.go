@@ -1,13 +1,20 @@
 package bucketindex
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"math/bits"
 	"path/filepath"
 	"slices"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -43,12 +50,50 @@ type Index struct {
 	// UpdatedAt is a unix timestamp (seconds precision) of when the index has been updated
 	// (written in the storage) the last time.
 	UpdatedAt int64 `json:"updated_at"`
+
+	// UpdateJitterSeed is derived from the tenant ID and used to stagger the index updates of
+	// different tenants. It's zero if the index has been written before it was introduced.
+	UpdateJitterSeed uint32 `json:"update_jitter_seed,omitempty"`
+
+	// DeltasEnabled is true if block deletion marks may be appended to the index delta once the index
+	// has been written, see AppendDeletionMark, so that the functions reading the index fold them into
+	// it. The delta is not read for the other indexes, which would otherwise pay an extra request for
+	// each read. The compactor doesn't write indexes with deltas enabled: the deltas are only available
+	// to the tools writing the bucket index through this package.
+	DeltasEnabled bool `json:"deltas_enabled,omitempty"`
 }
 
 func (idx *Index) GetUpdatedAt() time.Time {
 	return time.Unix(idx.UpdatedAt, 0)
 }
 
+// NextUpdateHint returns how long after UpdatedAt the index should be updated next. Updates are
+// scheduled every interval, at a per-tenant offset within the interval derived from the jitter
+// seed, so that the updates of different tenants are spread over the interval deterministically.
+// The returned duration is greater than 0 and at most interval.
+func (idx *Index) NextUpdateHint(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+
+	// The offset is the seed scaled from [0, 2^32) to [0, interval).
+	hi, _ := bits.Mul64(uint64(idx.UpdateJitterSeed)<<32, uint64(interval))
+	offset := int64(hi)
+
+	// Time elapsed since the last slot before the update.
+	elapsed := (idx.GetUpdatedAt().UnixNano() - offset) % int64(interval)
+	if elapsed < 0 {
+		elapsed += int64(interval)
+	}
+
+	return interval - time.Duration(elapsed)
+}
+
+// UpdateJitterSeed returns the jitter seed of the index of the input tenant.
+func UpdateJitterSeed(userID string) uint32 {
+	return uint32(xxhash.Sum64String(userID) >> 32)
+}
+
 // RemoveBlock removes block and its deletion mark (if any) from index.
 func (idx *Index) RemoveBlock(id ulid.ULID) {
 	for i := 0; i < len(idx.Blocks); i++ {
@@ -93,6 +138,489 @@ func (idx *Index) NonParquetBlocks() []*Block {
 	return blocks
 }
 
+// BlocksForShard returns the blocks belonging to the input shard, when the index blocks are
+// partitioned in shardCount shards. Blocks are assigned to shards hashing their ID, consistently
+// with the blocks sharding used by the store-gateway, so the partitioning is deterministic.
+func (idx *Index) BlocksForShard(shardID, shardCount int) []*Block {
+	if shardCount <= 1 {
+		return idx.Blocks
+	}
+
+	blocks := make([]*Block, 0, len(idx.Blocks)/shardCount+1)
+	if shardID < 0 || shardID >= shardCount {
+		return blocks
+	}
+
+	for _, b := range idx.Blocks {
+		if blockShard(b.ID, shardCount) == shardID {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// BlockChunks splits the index blocks in n contiguous chunks, eg. to process them with n parallel
+// workers. The chunks sizes differ by at most one block, the first chunks being the larger ones.
+// Fewer chunks are returned if the index has less than n blocks, so that no chunk is empty, and no
+// chunk is returned if n is not positive.
+func (idx *Index) BlockChunks(n int) [][]*Block {
+	n = min(n, len(idx.Blocks))
+	if n <= 0 {
+		return nil
+	}
+
+	chunks := make([][]*Block, 0, n)
+	size, remainder := len(idx.Blocks)/n, len(idx.Blocks)%n
+
+	for start := 0; start < len(idx.Blocks); {
+		end := start + size
+		if len(chunks) < remainder {
+			end++
+		}
+		chunks = append(chunks, idx.Blocks[start:end:end])
+		start = end
+	}
+	return chunks
+}
+
+// BlocksCreatedAfter returns the blocks created strictly after the input time. The creation time is
+// decoded from the block ID, so no block metadata is required.
+func (idx *Index) BlocksCreatedAfter(t time.Time) []*Block {
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if ulid.Time(b.ID.Time()).After(t) {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// BlocksByRecency returns the blocks sorted by max time, newest first, eg. to load first the blocks
+// most likely to be queried. Blocks with the same max time are sorted by ID, newest first, so that the
+// order is deterministic. The index blocks are not reordered.
+func (idx *Index) BlocksByRecency() []*Block {
+	blocks := slices.Clone(idx.Blocks)
+	slices.SortFunc(blocks, func(a, b *Block) int {
+		if c := cmp.Compare(b.MaxTime, a.MaxTime); c != 0 {
+			return c
+		}
+		return b.ID.Compare(a.ID)
+	})
+	return blocks
+}
+
+// BlocksOlderThan returns the blocks not marked for deletion whose samples are all older than the
+// retention period, which are the candidates for deletion by the retention enforcement. Since block
+// intervals are half-open, a block whose MaxTime equals now minus retention is returned.
+func (idx *Index) BlocksOlderThan(retention time.Duration, now time.Time) []*Block {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	threshold := now.Add(-retention).UnixMilli()
+
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; !ok && b.MaxTime <= threshold {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// NoCompactBlocks returns the blocks marked for no compaction.
+func (idx *Index) NoCompactBlocks() []*Block {
+	blocks := make([]*Block, 0)
+	for _, b := range idx.Blocks {
+		if b.NoCompact {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// BlocksSuperseding returns the blocks which have been compacted from the input block, according
+// to their sources. A block may be superseded by several blocks, eg. when the compactor splits
+// the blocks by shard.
+func (idx *Index) BlocksSuperseding(id ulid.ULID) []*Block {
+	var blocks []*Block
+	for _, b := range idx.Blocks {
+		if slices.Contains(b.Sources, id) {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// FindShadowedBlocks returns the IDs of the blocks not marked for deletion which have been fully
+// compacted into another block of the index not marked for deletion either, according to their
+// sources. Both blocks are queried, so the samples of the shadowed blocks get double counted until
+// they're deleted. It's expected right after a compaction, until the compactor marks the source
+// blocks for deletion, but blocks shadowed for longer are the sign of a failed cleanup.
+//
+// A block is shadowed by another one if its own sources, or the block itself if it hasn't been
+// compacted, are all sources of the other block. The blocks compacted from the same sources, eg. the
+// partitions of a partitioned compaction, don't shadow each other.
+func (idx *Index) FindShadowedBlocks() []ulid.ULID {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	// The sources of the blocks not marked for deletion, and the blocks compacted from each source.
+	sources := map[ulid.ULID]map[ulid.ULID]struct{}{}
+	descendants := map[ulid.ULID][]ulid.ULID{}
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; ok || len(b.Sources) == 0 {
+			continue
+		}
+
+		sources[b.ID] = make(map[ulid.ULID]struct{}, len(b.Sources))
+		for _, id := range b.Sources {
+			sources[b.ID][id] = struct{}{}
+			descendants[id] = append(descendants[id], b.ID)
+		}
+	}
+
+	var shadowed []ulid.ULID
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; ok {
+			continue
+		}
+
+		lineage := b.Sources
+		if len(lineage) == 0 {
+			lineage = []ulid.ULID{b.ID}
+		}
+
+		// The blocks shadowing b have been compacted from all its sources, so they're among the ones
+		// compacted from the first one. They must have more sources than b if it has been compacted too.
+		for _, candidate := range descendants[lineage[0]] {
+			if candidate == b.ID || (len(b.Sources) > 0 && len(sources[candidate]) <= len(b.Sources)) {
+				continue
+			}
+			if containsAllSources(sources[candidate], lineage) {
+				shadowed = append(shadowed, b.ID)
+				break
+			}
+		}
+	}
+	return shadowed
+}
+
+func containsAllSources(sources map[ulid.ULID]struct{}, ids []ulid.ULID) bool {
+	for _, id := range ids {
+		if _, ok := sources[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CompactionGraphDOT returns the compaction lineage of the index blocks as a graph in the GraphViz DOT
+// language, with an edge from each source to the blocks compacted from it, eg. to be rendered by an
+// admin page when investigating compaction issues. Each block is labeled with its compaction level.
+// The blocks marked for deletion are dashed, and the sources missing from the index, eg. because
+// already deleted, are dotted.
+//
+// The sources are the original blocks shipped by the ingesters, so a block compacted more than once
+// is linked to them rather than to the blocks it has directly replaced.
+func (idx *Index) CompactionGraphDOT() string {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	known := make(map[ulid.ULID]struct{}, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		known[b.ID] = struct{}{}
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("digraph compaction {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=box];\n")
+
+	for _, b := range idx.Blocks {
+		style := ""
+		if _, ok := deleted[b.ID]; ok {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&sb, "  %q [label=\"%s\\nlevel %d\"%s];\n", b.ID.String(), b.ID.String(), b.CompactionLevel, style)
+	}
+
+	missing := map[ulid.ULID]struct{}{}
+	for _, b := range idx.Blocks {
+		for _, id := range b.Sources {
+			if _, ok := known[id]; ok {
+				continue
+			}
+			if _, ok := missing[id]; !ok {
+				missing[id] = struct{}{}
+				fmt.Fprintf(&sb, "  %q [style=dotted];\n", id.String())
+			}
+		}
+	}
+
+	for _, b := range idx.Blocks {
+		for _, id := range b.Sources {
+			fmt.Fprintf(&sb, "  %q -> %q;\n", id.String(), b.ID.String())
+		}
+	}
+
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// checkTenantReferences returns ErrIndexCrossTenantReference if a block of the index belongs to
+// another tenant than the input one.
+func (idx *Index) checkTenantReferences(userID string) error {
+	for _, b := range idx.Blocks {
+		if err := b.checkTenant(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlocksMatchingLabels returns the blocks whose external labels match all the input matchers.
+// Labels missing from a block are matched as empty, consistently with the series matching.
+func (idx *Index) BlocksMatchingLabels(matchers []*labels.Matcher) []*Block {
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if b.MatchesLabels(matchers) {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// BlocksOverlapping returns the blocks containing samples within the provided range.
+// Input minT and maxT are both inclusive.
+func (idx *Index) BlocksOverlapping(minT, maxT int64) []*Block {
+	// NOTE: the block ID timestamp is the block creation time, which doesn't bound the samples
+	// time range (eg. compacted or backfilled blocks), so it can't be used to pre-filter blocks here.
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if b.Within(minT, maxT) {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// BlocksOverlappingRanges returns the blocks containing samples within any of the provided ranges,
+// eg. the disjoint ranges of a query sharded by time, in the index order and each block once. Blocks
+// marked for deletion are skipped if excludeDeleted is true. The ranges MaxTime is exclusive.
+func (idx *Index) BlocksOverlappingRanges(ranges []TimeRange, excludeDeleted bool) []*Block {
+	var deleted map[ulid.ULID]struct{}
+	if excludeDeleted {
+		deleted = make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+		for _, m := range idx.BlockDeletionMarks {
+			deleted[m.ID] = struct{}{}
+		}
+	}
+
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; ok {
+			continue
+		}
+
+		for _, r := range ranges {
+			if b.Within(r.MinTime, r.MaxTime-1) {
+				blocks = append(blocks, b)
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// QueryCostEstimate holds an upfront estimate of the blocks a query will touch.
+type QueryCostEstimate struct {
+	// BlocksTouched is the number of blocks overlapping the query time range.
+	BlocksTouched int
+
+	// ApproxBytes is the total size of the blocks overlapping the query time range.
+	// Blocks with an unknown size are not accounted.
+	ApproxBytes int64
+}
+
+// EstimateQueryCost returns an estimate of the cost of a query over the provided range, based on
+// the blocks not marked for deletion overlapping it. Input minT and maxT are both inclusive.
+func (idx *Index) EstimateQueryCost(minT, maxT int64) QueryCostEstimate {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	estimate := QueryCostEstimate{}
+	for _, b := range idx.BlocksOverlapping(minT, maxT) {
+		if _, ok := deleted[b.ID]; ok {
+			continue
+		}
+
+		estimate.BlocksTouched++
+		estimate.ApproxBytes += b.SizeBytes
+	}
+	return estimate
+}
+
+// MaxChunkSizeForRange returns the max size in bytes of a chunk of the blocks overlapping the provided
+// range, eg. to pre-size the buffers decoding the chunks of a query, according to the meta.json index
+// stats of the blocks. It returns 0 if unknown, eg. if the index stats of the blocks are missing. Input
+// minT and maxT are both inclusive.
+func (idx *Index) MaxChunkSizeForRange(minT, maxT int64) int64 {
+	maxSize := int64(0)
+	for _, b := range idx.BlocksOverlapping(minT, maxT) {
+		maxSize = max(maxSize, b.ChunkMaxSize)
+	}
+	return maxSize
+}
+
+// IndexStats holds a summary of the blocks of a bucket index.
+type IndexStats struct {
+	// Blocks is the number of blocks in the index, including the ones marked for deletion.
+	Blocks int
+
+	// MinTime and MaxTime are the time range covered by the blocks (millis precision). They're
+	// zero if the index has no blocks.
+	MinTime int64
+	MaxTime int64
+
+	// SizeBytes is the total size of the blocks. Blocks with an unknown size are not accounted.
+	SizeBytes int64
+
+	// UpdatedAt is a unix timestamp (seconds precision) of when the index has been updated.
+	UpdatedAt int64
+}
+
+// Stats returns a summary of the index blocks.
+func (idx *Index) Stats() IndexStats {
+	stats := IndexStats{Blocks: len(idx.Blocks), UpdatedAt: idx.UpdatedAt}
+	for i, b := range idx.Blocks {
+		if i == 0 || b.MinTime < stats.MinTime {
+			stats.MinTime = b.MinTime
+		}
+		if i == 0 || b.MaxTime > stats.MaxTime {
+			stats.MaxTime = b.MaxTime
+		}
+		stats.SizeBytes += b.SizeBytes
+	}
+	return stats
+}
+
+// MaxShippingLag returns the max time elapsed between the end of the time range of a block and the
+// completion of its upload, among the blocks which haven't been compacted, eg. to detect ingesters
+// shipping their blocks late. The compacted blocks are uploaded by the compactor long after their
+// time range ended, so they're not accounted, like the blocks whose upload time is unknown. It's
+// zero if there are no such blocks.
+func (idx *Index) MaxShippingLag() time.Duration {
+	maxLag := time.Duration(0)
+	for _, b := range idx.Blocks {
+		if b.IsCompacted() || b.UploadedAt <= 0 {
+			continue
+		}
+		maxLag = max(maxLag, b.GetUploadedAt().Sub(time.UnixMilli(b.MaxTime)))
+	}
+	return maxLag
+}
+
+// DetectOverlappingBlocks returns the compacted blocks not marked for deletion whose time range
+// overlaps the time range of at least another one of them, sorted by MinTime. Overlapping compacted
+// blocks usually contain duplicated samples, eg. left behind by concurrent compactions, so they're
+// returned for an operator to inspect them but never deleted.
+//
+// Blocks not compacted yet are ignored, since the blocks uploaded by ingesters are expected to
+// overlap until they get compacted. Blocks produced by the partitioning compaction strategy overlap
+// by design, so the result is not meaningful for tenants compacted with it.
+func DetectOverlappingBlocks(idx *Index) []*Block {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	candidates := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; !ok && b.IsCompacted() {
+			candidates = append(candidates, b)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].MinTime != candidates[j].MinTime {
+			return candidates[i].MinTime < candidates[j].MinTime
+		}
+		return candidates[i].ID.Compare(candidates[j].ID) < 0
+	})
+
+	overlapping := make([]bool, len(candidates))
+	for i, b := range candidates {
+		// NOTE: Block intervals are half-open: [MinTime, MaxTime).
+		for j := i + 1; j < len(candidates) && candidates[j].MinTime < b.MaxTime; j++ {
+			overlapping[i] = true
+			overlapping[j] = true
+		}
+	}
+
+	var out []*Block
+	for i, b := range candidates {
+		if overlapping[i] {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// TimeRange is a time range in milliseconds. MinTime is inclusive and MaxTime is exclusive.
+type TimeRange struct {
+	MinTime int64
+	MaxTime int64
+}
+
+// CoverageGaps returns the time ranges longer than maxGap between the first and the last block not
+// marked for deletion which are not covered by any of them, sorted by time. A gap usually means the
+// blocks of that time range failed to be ingested or shipped.
+func (idx *Index) CoverageGaps(maxGap time.Duration) []TimeRange {
+	deleted := make(map[ulid.ULID]struct{}, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		deleted[m.ID] = struct{}{}
+	}
+
+	blocks := make([]*Block, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		if _, ok := deleted[b.ID]; !ok {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].MinTime < blocks[j].MinTime
+	})
+
+	var gaps []TimeRange
+
+	// NOTE: Block intervals are half-open: [MinTime, MaxTime). Blocks may overlap, so the
+	// coverage extends up to the highest MaxTime seen so far.
+	coveredUntil := blocks[0].MaxTime
+	for _, b := range blocks[1:] {
+		if b.MinTime-coveredUntil > maxGap.Milliseconds() {
+			gaps = append(gaps, TimeRange{MinTime: coveredUntil, MaxTime: b.MinTime})
+		}
+		coveredUntil = max(coveredUntil, b.MaxTime)
+	}
+	return gaps
+}
+
+func blockShard(id ulid.ULID, shardCount int) int {
+	return int(cortex_tsdb.HashBlockID(id) % uint32(shardCount))
+}
+
 // Block holds the information about a block in the index.
 type Block struct {
 	// Block ID.
@@ -113,10 +641,60 @@ type Block struct {
 	SeriesMaxSize int64 `json:"series_max_size,omitempty"`
 	ChunkMaxSize  int64 `json:"chunk_max_size,omitempty"`
 
+	// SizeBytes is the total size in bytes of the block files, as reported in the meta.json.
+	// It's zero if the size is unknown.
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+
+	// CompactionLevel is the compaction level of the block, as reported in the meta.json.
+	// Level 1 blocks have been shipped by ingesters and not compacted yet. It's zero if unknown.
+	CompactionLevel int `json:"compaction_level,omitempty"`
+
+	// Sources are the IDs of the blocks the block has been compacted from, as reported in the
+	// meta.json compaction sources. The compactor tracks the original level 1 blocks, so the
+	// sources of a block compacted more than once are not the blocks it has directly replaced.
+	// It's empty for blocks which haven't been compacted, eg. the ones shipped by ingesters.
+	Sources []ulid.ULID `json:"sources,omitempty"`
+
+	// NumSeries is the number of series in the block, as reported in the meta.json stats.
+	// It's zero if unknown.
+	NumSeries uint64 `json:"num_series,omitempty"`
+
+	// NumSamples is the number of samples in the block, as reported in the meta.json stats.
+	// It's zero if unknown.
+	NumSamples uint64 `json:"num_samples,omitempty"`
+
+	// Empty is true if the block has no samples, as reported in the meta.json stats. It's false if
+	// the stats are missing, since they can't be told apart from all-zero stats. It's stored explicitly
+	// since NumSamples is zero for the blocks added before it was tracked too.
+	Empty bool `json:"empty,omitempty"`
+
+	// CompactorShard is the ID of the compactor shard which produced the block, as reported
+	// in the meta.json external labels. It's empty if unknown.
+	CompactorShard string `json:"compactor_shard,omitempty"`
+
+	// ChunkFormatVersion is the TSDB format version of the block, as reported in the meta.json
+	// version, which determines the format of the chunks and so the decoder to read them with.
+	// It's zero for blocks added to the index before the version was tracked, use
+	// GetChunkFormatVersion to get the version with the default applied.
+	ChunkFormatVersion int `json:"chunk_format_version,omitempty"`
+
+	// Labels are the block external labels, as reported in the meta.json. They're stored
+	// for each block, so the index size grows with the number of external labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// NumFiles is the number of objects stored under the block location, including the markers stored
+	// in it, as listed when the block has been added to the index. It's zero if the objects haven't
+	// been counted, since counting them requires listing the block location.
+	NumFiles int `json:"num_files,omitempty"`
+
 	// UploadedAt is a unix timestamp (seconds precision) of when the block has been completed to be uploaded
 	// to the storage.
 	UploadedAt int64 `json:"uploaded_at"`
 
+	// NoCompact is true if the block has been marked for no compaction, so that it's excluded from
+	// compaction. It's based on the global no-compact marker of the block.
+	NoCompact bool `json:"no_compact,omitempty"`
+
 	// Parquet metadata if exists. If doesn't exist it will be nil.
 	Parquet *parquet.ConverterMarkMeta `json:"parquet,omitempty"`
 }
@@ -128,6 +706,41 @@ func (m *Block) Within(minT, maxT int64) bool {
 	return m.MinTime <= maxT && minT < m.MaxTime
 }
 
+// MatchesLabels returns whether the block external labels match all the input matchers.
+func (m *Block) MatchesLabels(matchers []*labels.Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(m.Labels[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTenant returns ErrIndexCrossTenantReference if the block tenant external label is another
+// tenant than the input one. The block ID can't reference a path outside of the tenant prefix,
+// since it's decoded as a ULID, while blocks without the tenant label are considered the tenant's.
+func (m *Block) checkTenant(userID string) error {
+	if tenant := m.Labels[cortex_tsdb.TenantIDExternalLabel]; tenant != "" && tenant != userID {
+		return errors.Wrapf(ErrIndexCrossTenantReference, "block %s belongs to tenant %s", m.ID, tenant)
+	}
+	return nil
+}
+
+// IsCompacted returns whether the block has been produced by the compactor, and so it's
+// unlikely to be compacted away soon. Blocks with an unknown compaction level are not compacted.
+func (m *Block) IsCompacted() bool {
+	return m.CompactionLevel > 1
+}
+
+// GetChunkFormatVersion returns the chunk format version of the block, defaulting to the first
+// TSDB format version if unknown, since it's the only version blocks have been written with so far.
+func (m *Block) GetChunkFormatVersion() int {
+	if m.ChunkFormatVersion == 0 {
+		return metadata.TSDBVersion1
+	}
+	return m.ChunkFormatVersion
+}
+
 func (m *Block) GetUploadedAt() time.Time {
 	return time.Unix(m.UploadedAt, 0)
 }
@@ -141,7 +754,7 @@ func (m *Block) ThanosMeta(userID string) *metadata.Meta {
 			ULID:    m.ID,
 			MinTime: m.MinTime,
 			MaxTime: m.MaxTime,
-			Version: metadata.TSDBVersion1,
+			Version: m.GetChunkFormatVersion(),
 		},
 		Thanos: metadata.Thanos{
 			Version: metadata.ThanosVersion1,
@@ -178,14 +791,44 @@ func BlockFromThanosMeta(meta metadata.Meta) *Block {
 	segmentsFormat, segmentsNum := detectBlockSegmentsFormat(meta)
 
 	return &Block{
-		ID:             meta.ULID,
-		MinTime:        meta.MinTime,
-		MaxTime:        meta.MaxTime,
-		SegmentsFormat: segmentsFormat,
-		SegmentsNum:    segmentsNum,
-		SeriesMaxSize:  meta.Thanos.IndexStats.SeriesMaxSize,
-		ChunkMaxSize:   meta.Thanos.IndexStats.ChunkMaxSize,
+		ID:              meta.ULID,
+		MinTime:         meta.MinTime,
+		MaxTime:         meta.MaxTime,
+		SegmentsFormat:  segmentsFormat,
+		SegmentsNum:     segmentsNum,
+		SeriesMaxSize:   meta.Thanos.IndexStats.SeriesMaxSize,
+		ChunkMaxSize:    meta.Thanos.IndexStats.ChunkMaxSize,
+		SizeBytes:       blockSizeBytes(meta),
+		CompactionLevel: meta.Compaction.Level,
+		Sources:         blockSources(meta),
+		NumSeries:       meta.Stats.NumSeries,
+		NumSamples:      meta.Stats.NumSamples,
+		Empty:           meta.Stats.NumSamples == 0 && meta.Stats != (tsdb.BlockStats{}),
+		CompactorShard:  meta.Thanos.Labels[cortex_tsdb.CompactorShardIDExternalLabel],
+		Labels:          maps.Clone(meta.Thanos.Labels),
+
+		ChunkFormatVersion: meta.Version,
+	}
+}
+
+// blockSources returns the compaction sources of the block, excluding the block itself, which is
+// the only source of a block which hasn't been compacted.
+func blockSources(meta metadata.Meta) []ulid.ULID {
+	var sources []ulid.ULID
+	for _, id := range meta.Compaction.Sources {
+		if id != meta.ULID {
+			sources = append(sources, id)
+		}
+	}
+	return sources
+}
+
+func blockSizeBytes(meta metadata.Meta) int64 {
+	size := int64(0)
+	for _, f := range meta.Thanos.Files {
+		size += f.SizeBytes
 	}
+	return size
 }
 
 func detectBlockSegmentsFormat(meta metadata.Meta) (string, int) {
@@ -1,14 +1,21 @@
 package bucketindex
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 
 	"github.com/cortexproject/cortex/pkg/storage/parquet"
+	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
 )
 
 func TestIndex_RemoveBlock(t *testing.T) {
@@ -203,6 +210,170 @@ func TestBlockFromThanosMeta(t *testing.T) {
 				SegmentsNum:    3,
 			},
 		},
+		"meta.json with Files and sizes": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:    blockID,
+					MinTime: 10,
+					MaxTime: 20,
+				},
+				Thanos: metadata.Thanos{
+					Files: []metadata.File{
+						{RelPath: "index", SizeBytes: 100},
+						{RelPath: "chunks/000001", SizeBytes: 1000},
+						{RelPath: "meta.json"},
+					},
+				},
+			},
+			expected: Block{
+				ID:             blockID,
+				MinTime:        10,
+				MaxTime:        20,
+				SegmentsFormat: SegmentsFormat1Based6Digits,
+				SegmentsNum:    1,
+				SizeBytes:      1100,
+			},
+		},
+		"meta.json of a level 1 block": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:       blockID,
+					MinTime:    10,
+					MaxTime:    20,
+					Compaction: tsdb.BlockMetaCompaction{Level: 1},
+				},
+			},
+			expected: Block{
+				ID:              blockID,
+				MinTime:         10,
+				MaxTime:         20,
+				CompactionLevel: 1,
+			},
+		},
+		"meta.json of a compacted block": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:       blockID,
+					MinTime:    10,
+					MaxTime:    20,
+					Compaction: tsdb.BlockMetaCompaction{Level: 3},
+				},
+			},
+			expected: Block{
+				ID:              blockID,
+				MinTime:         10,
+				MaxTime:         20,
+				CompactionLevel: 3,
+			},
+		},
+		"meta.json of a block shipped by an ingester": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:       blockID,
+					MinTime:    10,
+					MaxTime:    20,
+					Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{blockID}},
+				},
+			},
+			expected: Block{
+				ID:              blockID,
+				MinTime:         10,
+				MaxTime:         20,
+				CompactionLevel: 1,
+			},
+		},
+		"meta.json of a block compacted from other blocks": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:       blockID,
+					MinTime:    10,
+					MaxTime:    20,
+					Compaction: tsdb.BlockMetaCompaction{Level: 2, Sources: []ulid.ULID{ulid.MustNew(2, nil), ulid.MustNew(3, nil)}},
+				},
+			},
+			expected: Block{
+				ID:              blockID,
+				MinTime:         10,
+				MaxTime:         20,
+				CompactionLevel: 2,
+				Sources:         []ulid.ULID{ulid.MustNew(2, nil), ulid.MustNew(3, nil)},
+			},
+		},
+		"meta.json with Stats": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:    blockID,
+					MinTime: 10,
+					MaxTime: 20,
+					Stats:   tsdb.BlockStats{NumSeries: 1234, NumSamples: 5678},
+				},
+			},
+			expected: Block{
+				ID:         blockID,
+				MinTime:    10,
+				MaxTime:    20,
+				NumSeries:  1234,
+				NumSamples: 5678,
+			},
+		},
+		"meta.json with Stats without samples": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:    blockID,
+					MinTime: 10,
+					MaxTime: 20,
+					Stats:   tsdb.BlockStats{NumSeries: 1234},
+				},
+			},
+			expected: Block{
+				ID:        blockID,
+				MinTime:   10,
+				MaxTime:   20,
+				NumSeries: 1234,
+				Empty:     true,
+			},
+		},
+		"meta.json with version": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:    blockID,
+					MinTime: 10,
+					MaxTime: 20,
+					Version: metadata.TSDBVersion1,
+				},
+			},
+			expected: Block{
+				ID:                 blockID,
+				MinTime:            10,
+				MaxTime:            20,
+				ChunkFormatVersion: metadata.TSDBVersion1,
+			},
+		},
+		"meta.json with compactor shard label": {
+			meta: metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{
+					ULID:    blockID,
+					MinTime: 10,
+					MaxTime: 20,
+				},
+				Thanos: metadata.Thanos{
+					Labels: map[string]string{
+						cortex_tsdb.TenantIDExternalLabel:         "user-1",
+						cortex_tsdb.CompactorShardIDExternalLabel: "3_of_8",
+					},
+				},
+			},
+			expected: Block{
+				ID:             blockID,
+				MinTime:        10,
+				MaxTime:        20,
+				CompactorShard: "3_of_8",
+				Labels: map[string]string{
+					cortex_tsdb.TenantIDExternalLabel:         "user-1",
+					cortex_tsdb.CompactorShardIDExternalLabel: "3_of_8",
+				},
+			},
+		},
 		"meta.json with Files and Index Stats": {
 			meta: metadata.Meta{
 				BlockMeta: tsdb.BlockMeta{
@@ -243,6 +414,379 @@ func TestBlockFromThanosMeta(t *testing.T) {
 	}
 }
 
+func TestBlock_NumSeriesSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, NumSeries: 1234}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"num_series":1234`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("unknown number of series", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "num_series")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, uint64(0), actual.NumSeries)
+	})
+}
+
+func TestBlock_ChunkMaxSizeSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, ChunkMaxSize: 4096}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"chunk_max_size":4096`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("unknown chunk max size", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "chunk_max_size")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, int64(0), actual.ChunkMaxSize)
+	})
+}
+
+func TestBlock_CompactorShardSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, CompactorShard: "3_of_8"}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"compactor_shard":"3_of_8"`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("unknown compactor shard", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "compactor_shard")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, "", actual.CompactorShard)
+	})
+}
+
+func TestBlock_SourcesSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, Sources: []ulid.ULID{ulid.MustNew(2, nil), ulid.MustNew(3, nil)}}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"sources":["`+ulid.MustNew(2, nil).String()+`","`+ulid.MustNew(3, nil).String()+`"]`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("no sources", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "sources")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Empty(t, actual.Sources)
+	})
+}
+
+func TestBlock_NoCompactSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, NoCompact: true}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"no_compact":true`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("not marked for no compaction", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "no_compact")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.False(t, actual.NoCompact)
+	})
+}
+
+func TestBlock_ChunkFormatVersionSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, ChunkFormatVersion: 2}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"chunk_format_version":2`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+		assert.Equal(t, 2, actual.GetChunkFormatVersion())
+		assert.Equal(t, 2, actual.ThanosMeta("user-1").Version)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		// Blocks indexed before the version was tracked don't have the field.
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal([]byte(`{"block_id":"`+blockID.String()+`","min_time":10,"max_time":20}`), actual))
+		assert.Zero(t, actual.ChunkFormatVersion)
+		assert.Equal(t, metadata.TSDBVersion1, actual.GetChunkFormatVersion())
+		assert.Equal(t, metadata.TSDBVersion1, actual.ThanosMeta("user-1").Version)
+	})
+}
+
+func TestIndex_BlocksSuperseding(t *testing.T) {
+	source1 := ulid.MustNew(1, nil)
+	source2 := ulid.MustNew(2, nil)
+	source3 := ulid.MustNew(3, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: source3, MinTime: 20, MaxTime: 30, CompactionLevel: 1},
+			{ID: ulid.MustNew(4, nil), MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+			{ID: ulid.MustNew(5, nil), MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1}},
+		},
+	}
+
+	assert.Equal(t, []ulid.ULID{ulid.MustNew(4, nil), ulid.MustNew(5, nil)}, Blocks(idx.BlocksSuperseding(source1)).GetULIDs())
+	assert.Equal(t, []ulid.ULID{ulid.MustNew(4, nil)}, Blocks(idx.BlocksSuperseding(source2)).GetULIDs())
+	assert.Empty(t, idx.BlocksSuperseding(source3))
+}
+
+func TestIndex_FindShadowedBlocks(t *testing.T) {
+	source1 := ulid.MustNew(1, nil)
+	source2 := ulid.MustNew(2, nil)
+	source3 := ulid.MustNew(3, nil)
+	source4 := ulid.MustNew(4, nil)
+	compacted12 := ulid.MustNew(5, nil)
+	compacted34 := ulid.MustNew(6, nil)
+	compacted1234 := ulid.MustNew(7, nil)
+
+	tests := map[string]struct {
+		blocks   Blocks
+		marks    BlockDeletionMarks
+		expected []ulid.ULID
+	}{
+		"no blocks": {},
+		"sources marked for deletion after the compaction": {
+			blocks: Blocks{
+				{ID: source1, MinTime: 0, MaxTime: 10, CompactionLevel: 1},
+				{ID: source2, MinTime: 10, MaxTime: 20, CompactionLevel: 1},
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+			},
+			marks: BlockDeletionMarks{{ID: source1}, {ID: source2}},
+		},
+		"sources not marked for deletion after the compaction": {
+			blocks: Blocks{
+				{ID: source1, MinTime: 0, MaxTime: 10, CompactionLevel: 1},
+				{ID: source2, MinTime: 10, MaxTime: 20, CompactionLevel: 1},
+				{ID: source3, MinTime: 20, MaxTime: 30, CompactionLevel: 1},
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+			},
+			marks:    BlockDeletionMarks{{ID: source2}},
+			expected: []ulid.ULID{source1},
+		},
+		"compacted block marked for deletion": {
+			blocks: Blocks{
+				{ID: source1, MinTime: 0, MaxTime: 10, CompactionLevel: 1},
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+			},
+			marks: BlockDeletionMarks{{ID: compacted12}},
+		},
+		"compacted blocks shadowed by a block compacted at a higher level": {
+			blocks: Blocks{
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+				{ID: compacted34, MinTime: 20, MaxTime: 40, CompactionLevel: 2, Sources: []ulid.ULID{source3, source4}},
+				{ID: compacted1234, MinTime: 0, MaxTime: 40, CompactionLevel: 3, Sources: []ulid.ULID{source1, source2, source3, source4}},
+			},
+			marks:    BlockDeletionMarks{{ID: compacted34}},
+			expected: []ulid.ULID{compacted12},
+		},
+		"partitions compacted from the same sources": {
+			blocks: Blocks{
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+				{ID: compacted34, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+			},
+		},
+		"compacted block only partially superseded": {
+			blocks: Blocks{
+				{ID: compacted12, MinTime: 0, MaxTime: 20, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+				{ID: compacted1234, MinTime: 10, MaxTime: 40, CompactionLevel: 3, Sources: []ulid.ULID{source2, source3, source4}},
+			},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			idx := &Index{Blocks: testData.blocks, BlockDeletionMarks: testData.marks}
+			assert.Equal(t, testData.expected, idx.FindShadowedBlocks())
+		})
+	}
+}
+
+func TestIndex_CompactionGraphDOT(t *testing.T) {
+	source1 := ulid.MustNew(1, nil)
+	source2 := ulid.MustNew(2, nil)
+	source3 := ulid.MustNew(3, nil)
+	compacted12 := ulid.MustNew(4, nil)
+	compacted123 := ulid.MustNew(5, nil)
+
+	t.Run("empty index", func(t *testing.T) {
+		idx := &Index{}
+		assert.Equal(t, "digraph compaction {\n  rankdir=LR;\n  node [shape=box];\n}\n", idx.CompactionGraphDOT())
+	})
+
+	t.Run("compaction lineage", func(t *testing.T) {
+		idx := &Index{
+			Blocks: Blocks{
+				{ID: source2, CompactionLevel: 1},
+				{ID: source3, CompactionLevel: 1},
+				{ID: compacted12, CompactionLevel: 2, Sources: []ulid.ULID{source1, source2}},
+				{ID: compacted123, CompactionLevel: 3, Sources: []ulid.ULID{source1, source2, source3}},
+			},
+			BlockDeletionMarks: BlockDeletionMarks{{ID: compacted12}},
+		}
+
+		expected := "digraph compaction {\n" +
+			"  rankdir=LR;\n" +
+			"  node [shape=box];\n" +
+			"  \"" + source2.String() + "\" [label=\"" + source2.String() + "\\nlevel 1\"];\n" +
+			"  \"" + source3.String() + "\" [label=\"" + source3.String() + "\\nlevel 1\"];\n" +
+			"  \"" + compacted12.String() + "\" [label=\"" + compacted12.String() + "\\nlevel 2\", style=dashed];\n" +
+			"  \"" + compacted123.String() + "\" [label=\"" + compacted123.String() + "\\nlevel 3\"];\n" +
+			"  \"" + source1.String() + "\" [style=dotted];\n" +
+			"  \"" + source1.String() + "\" -> \"" + compacted12.String() + "\";\n" +
+			"  \"" + source2.String() + "\" -> \"" + compacted12.String() + "\";\n" +
+			"  \"" + source1.String() + "\" -> \"" + compacted123.String() + "\";\n" +
+			"  \"" + source2.String() + "\" -> \"" + compacted123.String() + "\";\n" +
+			"  \"" + source3.String() + "\" -> \"" + compacted123.String() + "\";\n" +
+			"}\n"
+
+		assert.Equal(t, expected, idx.CompactionGraphDOT())
+	})
+}
+
+func TestBlock_LabelsSerialization(t *testing.T) {
+	blockID := ulid.MustNew(1, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, Labels: map[string]string{cortex_tsdb.TenantIDExternalLabel: "user-1"}}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"labels":{"__org_id__":"user-1"}`)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("round trip with many labels", func(t *testing.T) {
+		expected := &Block{ID: blockID, MinTime: 10, MaxTime: 20, Labels: map[string]string{}}
+		for i := 0; i < 100; i++ {
+			expected.Labels[fmt.Sprintf("label_%d", i)] = fmt.Sprintf("value_%d", i)
+		}
+
+		content, err := json.Marshal(expected)
+		require.NoError(t, err)
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("no labels", func(t *testing.T) {
+		content, err := json.Marshal(&Block{ID: blockID, MinTime: 10, MaxTime: 20})
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "labels")
+
+		actual := &Block{}
+		require.NoError(t, json.Unmarshal(content, actual))
+		assert.Nil(t, actual.Labels)
+	})
+}
+
+func TestIndex_BlocksMatchingLabels(t *testing.T) {
+	block1 := &Block{ID: ulid.MustNew(1, nil), Labels: map[string]string{"region": "eu", "zone": "a"}}
+	block2 := &Block{ID: ulid.MustNew(2, nil), Labels: map[string]string{"region": "us", "zone": "a"}}
+	block3 := &Block{ID: ulid.MustNew(3, nil)}
+	idx := &Index{Blocks: Blocks{block1, block2, block3}}
+
+	tests := map[string]struct {
+		matchers []*labels.Matcher
+		expected []*Block
+	}{
+		"no matchers": {
+			expected: []*Block{block1, block2, block3},
+		},
+		"equal matcher": {
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "region", "eu")},
+			expected: []*Block{block1},
+		},
+		"multiple matchers": {
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "zone", "a"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "region", "eu"),
+			},
+			expected: []*Block{block2},
+		},
+		"regexp matcher": {
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "region", "eu|us")},
+			expected: []*Block{block1, block2},
+		},
+		"matcher on a missing label matches empty": {
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "region", "")},
+			expected: []*Block{block3},
+		},
+		"no block matching": {
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "region", "ap")},
+			expected: []*Block{},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, idx.BlocksMatchingLabels(testData.matchers))
+		})
+	}
+}
+
 func TestBlock_Within(t *testing.T) {
 	tests := []struct {
 		block    *Block
@@ -288,6 +832,24 @@ func TestBlock_Within(t *testing.T) {
 	}
 }
 
+func TestBlock_IsCompacted(t *testing.T) {
+	tests := map[string]struct {
+		level    int
+		expected bool
+	}{
+		"unknown level": {level: 0, expected: false},
+		"level 1":       {level: 1, expected: false},
+		"level 2":       {level: 2, expected: true},
+		"level 4":       {level: 4, expected: true},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, (&Block{CompactionLevel: testData.level}).IsCompacted())
+		})
+	}
+}
+
 func TestBlock_ThanosMeta(t *testing.T) {
 	blockID := ulid.MustNew(1, nil)
 	userID := "user-1"
@@ -469,3 +1031,597 @@ func TestIndex_ParquetBlocks(t *testing.T) {
 		})
 	}
 }
+
+func TestIndex_BlocksForShard(t *testing.T) {
+	const (
+		numBlocks  = 1000
+		shardCount = 4
+	)
+
+	idx := &Index{}
+	for i := 0; i < numBlocks; i++ {
+		idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(uint64(i), rand.Reader), MinTime: int64(i), MaxTime: int64(i + 1)})
+	}
+
+	var all []ulid.ULID
+	for shardID := 0; shardID < shardCount; shardID++ {
+		blocks := idx.BlocksForShard(shardID, shardCount)
+
+		// The split should be roughly even.
+		assert.InDelta(t, numBlocks/shardCount, len(blocks), numBlocks/shardCount*0.2)
+
+		// The split should be deterministic.
+		assert.Equal(t, blocks, idx.BlocksForShard(shardID, shardCount))
+
+		for _, b := range blocks {
+			all = append(all, b.ID)
+		}
+	}
+
+	// Each block should belong to exactly one shard.
+	assert.ElementsMatch(t, idx.Blocks.GetULIDs(), all)
+
+	// Without sharding, all blocks are returned.
+	assert.Equal(t, []*Block(idx.Blocks), idx.BlocksForShard(0, 1))
+
+	// Out of range shards contain no blocks.
+	assert.Empty(t, idx.BlocksForShard(shardCount, shardCount))
+}
+
+func TestIndex_BlockChunks(t *testing.T) {
+	idx := &Index{}
+	for i := 0; i < 10; i++ {
+		idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(uint64(i), nil), MinTime: int64(i), MaxTime: int64(i + 1)})
+	}
+
+	tests := map[string]struct {
+		n             int
+		expectedSizes []int
+	}{
+		"single chunk": {
+			n:             1,
+			expectedSizes: []int{10},
+		},
+		"evenly divisible": {
+			n:             5,
+			expectedSizes: []int{2, 2, 2, 2, 2},
+		},
+		"not evenly divisible": {
+			n:             4,
+			expectedSizes: []int{3, 3, 2, 2},
+		},
+		"more chunks than blocks": {
+			n:             20,
+			expectedSizes: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		},
+		"no chunks": {
+			n: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			chunks := idx.BlockChunks(testData.n)
+
+			var sizes []int
+			var all []*Block
+			for _, chunk := range chunks {
+				sizes = append(sizes, len(chunk))
+				all = append(all, chunk...)
+			}
+			assert.Equal(t, testData.expectedSizes, sizes)
+
+			// The chunks are contiguous, and cover all the blocks in order.
+			if testData.n > 0 {
+				assert.Equal(t, []*Block(idx.Blocks), all)
+			}
+		})
+	}
+
+	// An empty index has no chunks.
+	assert.Empty(t, (&Index{}).BlockChunks(4))
+}
+
+func TestIndex_Stats(t *testing.T) {
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: ulid.MustNew(1, nil), MinTime: 20, MaxTime: 30, SizeBytes: 100},
+			{ID: ulid.MustNew(2, nil), MinTime: 10, MaxTime: 20, SizeBytes: 200},
+			{ID: ulid.MustNew(3, nil), MinTime: 15, MaxTime: 25},
+		},
+		UpdatedAt: 1000,
+	}
+	assert.Equal(t, IndexStats{Blocks: 3, MinTime: 10, MaxTime: 30, SizeBytes: 300, UpdatedAt: 1000}, idx.Stats())
+
+	// An empty index covers no time range.
+	assert.Equal(t, IndexStats{UpdatedAt: 1000}, (&Index{UpdatedAt: 1000}).Stats())
+}
+
+func TestIndex_MaxShippingLag(t *testing.T) {
+	tests := map[string]struct {
+		blocks   Blocks
+		expected time.Duration
+	}{
+		"no blocks": {},
+		"blocks shipped by the ingesters": {
+			blocks: Blocks{
+				{ID: ulid.MustNew(1, nil), MaxTime: 10_000, CompactionLevel: 1, UploadedAt: 70},
+				{ID: ulid.MustNew(2, nil), MaxTime: 20_000, CompactionLevel: 1, UploadedAt: 140},
+				{ID: ulid.MustNew(3, nil), MaxTime: 30_000, CompactionLevel: 1, UploadedAt: 40},
+			},
+			expected: 2 * time.Minute,
+		},
+		"compacted blocks and blocks with an unknown upload time": {
+			blocks: Blocks{
+				{ID: ulid.MustNew(1, nil), MaxTime: 10_000, CompactionLevel: 1, UploadedAt: 70},
+				{ID: ulid.MustNew(2, nil), MaxTime: 20_000, CompactionLevel: 3, UploadedAt: 3600},
+				{ID: ulid.MustNew(3, nil), MaxTime: 30_000, CompactionLevel: 1},
+			},
+			expected: time.Minute,
+		},
+		"blocks uploaded before the end of their time range": {
+			blocks: Blocks{
+				{ID: ulid.MustNew(1, nil), MaxTime: 10_000, CompactionLevel: 1, UploadedAt: 5},
+			},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			idx := &Index{Blocks: testData.blocks}
+			assert.Equal(t, testData.expected, idx.MaxShippingLag())
+		})
+	}
+}
+
+func TestIndex_BlocksCreatedAfter(t *testing.T) {
+	cutoff := time.UnixMilli(1000)
+
+	block1 := ulid.MustNew(999, rand.Reader)
+	block2 := ulid.MustNew(1000, rand.Reader)
+	block3 := ulid.MustNew(1001, rand.Reader)
+	block4 := ulid.MustNew(2000, rand.Reader)
+
+	idx := &Index{
+		Blocks: Blocks{{ID: block1}, {ID: block2}, {ID: block3}, {ID: block4}},
+	}
+
+	blocks := Blocks(idx.BlocksCreatedAfter(cutoff))
+	assert.Equal(t, []ulid.ULID{block3, block4}, blocks.GetULIDs())
+
+	assert.Len(t, idx.BlocksCreatedAfter(time.UnixMilli(0)), 4)
+	assert.Empty(t, idx.BlocksCreatedAfter(time.UnixMilli(2000)))
+	assert.Empty(t, (&Index{}).BlocksCreatedAfter(cutoff))
+}
+
+func TestIndex_BlocksByRecency(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: 0, MaxTime: 30},
+			{ID: block2, MinTime: 10, MaxTime: 20},
+			{ID: block3, MinTime: 20, MaxTime: 30},
+			{ID: block4, MinTime: 0, MaxTime: 10},
+		},
+	}
+
+	// Blocks with the same max time are sorted by ID, newest first.
+	blocks := Blocks(idx.BlocksByRecency())
+	assert.Equal(t, []ulid.ULID{block3, block1, block2, block4}, blocks.GetULIDs())
+
+	// The index blocks are not reordered.
+	assert.Equal(t, []ulid.ULID{block1, block2, block3, block4}, idx.Blocks.GetULIDs())
+
+	assert.Empty(t, (&Index{}).BlocksByRecency())
+}
+
+func TestIndex_BlocksOverlapping(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: 10, MaxTime: 20},
+			{ID: block2, MinTime: 20, MaxTime: 30},
+			{ID: block3, MinTime: 30, MaxTime: 40},
+		},
+	}
+
+	tests := map[string]struct {
+		minT, maxT int64
+		expected   []ulid.ULID
+	}{
+		"range before all blocks":                                   {minT: 0, maxT: 9, expected: []ulid.ULID{}},
+		"range after all blocks":                                    {minT: 40, maxT: 50, expected: []ulid.ULID{}},
+		"range within one block":                                    {minT: 21, maxT: 25, expected: []ulid.ULID{block2}},
+		"range with inclusive boundary matching the block min time": {minT: 0, maxT: 10, expected: []ulid.ULID{block1}},
+		"range spanning multiple blocks":                            {minT: 15, maxT: 35, expected: []ulid.ULID{block1, block2, block3}},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, Blocks(idx.BlocksOverlapping(testData.minT, testData.maxT)).GetULIDs())
+		})
+	}
+}
+
+func TestIndex_BlocksOverlappingRanges(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: 10, MaxTime: 20},
+			{ID: block2, MinTime: 20, MaxTime: 30},
+			{ID: block3, MinTime: 30, MaxTime: 40},
+			{ID: block4, MinTime: 0, MaxTime: 50},
+		},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: block2}},
+	}
+
+	tests := map[string]struct {
+		ranges         []TimeRange
+		excludeDeleted bool
+		expected       []ulid.ULID
+	}{
+		"no ranges": {
+			ranges:   nil,
+			expected: []ulid.ULID{},
+		},
+		"disjoint ranges": {
+			ranges:   []TimeRange{{MinTime: 12, MaxTime: 15}, {MinTime: 32, MaxTime: 35}},
+			expected: []ulid.ULID{block1, block3, block4},
+		},
+		"overlapping ranges": {
+			ranges:   []TimeRange{{MinTime: 12, MaxTime: 25}, {MinTime: 22, MaxTime: 28}},
+			expected: []ulid.ULID{block1, block2, block4},
+		},
+		"ranges with exclusive max time matching the block min time": {
+			ranges:   []TimeRange{{MinTime: 5, MaxTime: 10}, {MinTime: 50, MaxTime: 60}},
+			expected: []ulid.ULID{block4},
+		},
+		"ranges outside all blocks": {
+			ranges:   []TimeRange{{MinTime: 50, MaxTime: 60}, {MinTime: 70, MaxTime: 80}},
+			expected: []ulid.ULID{},
+		},
+		"disjoint ranges excluding the blocks marked for deletion": {
+			ranges:         []TimeRange{{MinTime: 12, MaxTime: 15}, {MinTime: 22, MaxTime: 35}},
+			excludeDeleted: true,
+			expected:       []ulid.ULID{block1, block3, block4},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, Blocks(idx.BlocksOverlappingRanges(testData.ranges, testData.excludeDeleted)).GetULIDs())
+		})
+	}
+}
+
+func TestIndex_MaxChunkSizeForRange(t *testing.T) {
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, ChunkMaxSize: 1000},
+			{ID: ulid.MustNew(2, nil), MinTime: 20, MaxTime: 30, ChunkMaxSize: 3000},
+			{ID: ulid.MustNew(3, nil), MinTime: 30, MaxTime: 40},
+		},
+	}
+
+	tests := map[string]struct {
+		minT, maxT int64
+		expected   int64
+	}{
+		"range before all blocks":                  {minT: 0, maxT: 9, expected: 0},
+		"range within one block":                   {minT: 11, maxT: 15, expected: 1000},
+		"range spanning multiple blocks":           {minT: 15, maxT: 35, expected: 3000},
+		"range within a block with unknown chunks": {minT: 31, maxT: 35, expected: 0},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, idx.MaxChunkSizeForRange(testData.minT, testData.maxT))
+		})
+	}
+}
+
+func TestIndex_EstimateQueryCost(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: 10, MaxTime: 20, SizeBytes: 100},
+			{ID: block2, MinTime: 20, MaxTime: 30, SizeBytes: 200},
+			{ID: block3, MinTime: 20, MaxTime: 30, SizeBytes: 400},
+			{ID: block4, MinTime: 30, MaxTime: 40},
+		},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: block3}},
+	}
+
+	tests := map[string]struct {
+		minT, maxT int64
+		expected   QueryCostEstimate
+	}{
+		"range not overlapping any block": {
+			minT: 40, maxT: 50,
+			expected: QueryCostEstimate{},
+		},
+		"range overlapping a block marked for deletion": {
+			minT: 21, maxT: 25,
+			expected: QueryCostEstimate{BlocksTouched: 1, ApproxBytes: 200},
+		},
+		"range overlapping a block with unknown size": {
+			minT: 15, maxT: 35,
+			expected: QueryCostEstimate{BlocksTouched: 3, ApproxBytes: 300},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, idx.EstimateQueryCost(testData.minT, testData.maxT))
+		})
+	}
+}
+
+func TestDetectOverlappingBlocks(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+	block5 := ulid.MustNew(5, nil)
+	block6 := ulid.MustNew(6, nil)
+
+	tests := map[string]struct {
+		idx      *Index
+		expected []ulid.ULID
+	}{
+		"empty index": {
+			idx:      &Index{},
+			expected: nil,
+		},
+		"adjacent blocks": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 10, MaxTime: 20, CompactionLevel: 2},
+				{ID: block2, MinTime: 20, MaxTime: 30, CompactionLevel: 2},
+			}},
+			expected: nil,
+		},
+		"blocks with identical time ranges": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block3, MinTime: 20, MaxTime: 30, CompactionLevel: 2},
+				{ID: block1, MinTime: 10, MaxTime: 20, CompactionLevel: 2},
+				{ID: block2, MinTime: 20, MaxTime: 30, CompactionLevel: 3},
+			}},
+			expected: []ulid.ULID{block2, block3},
+		},
+		"block overlapping multiple blocks": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 0, MaxTime: 100, CompactionLevel: 3},
+				{ID: block2, MinTime: 10, MaxTime: 20, CompactionLevel: 2},
+				{ID: block3, MinTime: 20, MaxTime: 30, CompactionLevel: 2},
+				{ID: block4, MinTime: 100, MaxTime: 200, CompactionLevel: 3},
+			}},
+			expected: []ulid.ULID{block1, block2, block3},
+		},
+		"blocks marked for deletion and not compacted blocks are ignored": {
+			idx: &Index{
+				Blocks: Blocks{
+					{ID: block1, MinTime: 10, MaxTime: 20, CompactionLevel: 2},
+					{ID: block2, MinTime: 10, MaxTime: 20, CompactionLevel: 2},
+					{ID: block3, MinTime: 20, MaxTime: 30, CompactionLevel: 1},
+					{ID: block4, MinTime: 20, MaxTime: 30, CompactionLevel: 1},
+					{ID: block5, MinTime: 20, MaxTime: 30, CompactionLevel: 2},
+					{ID: block6, MinTime: 25, MaxTime: 30},
+				},
+				BlockDeletionMarks: BlockDeletionMarks{{ID: block2}},
+			},
+			expected: nil,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var actual []ulid.ULID
+			for _, b := range DetectOverlappingBlocks(testData.idx) {
+				actual = append(actual, b.ID)
+			}
+			assert.Equal(t, testData.expected, actual)
+		})
+	}
+}
+
+func TestIndex_BlocksOlderThan(t *testing.T) {
+	now := time.Unix(1000, 0)
+	threshold := now.Add(-time.Hour).UnixMilli()
+
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+	block5 := ulid.MustNew(5, nil)
+
+	idx := &Index{
+		Blocks: Blocks{
+			{ID: block1, MinTime: threshold - 20, MaxTime: threshold - 10},
+			{ID: block2, MinTime: threshold - 10, MaxTime: threshold},
+			{ID: block3, MinTime: threshold - 10, MaxTime: threshold + 1},
+			{ID: block4, MinTime: threshold + 10, MaxTime: threshold + 20},
+			{ID: block5, MinTime: threshold - 20, MaxTime: threshold - 10},
+		},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: block5}},
+	}
+
+	tests := map[string]struct {
+		retention time.Duration
+		expected  []ulid.ULID
+	}{
+		"blocks ending exactly at the retention boundary are older": {
+			retention: time.Hour,
+			expected:  []ulid.ULID{block1, block2},
+		},
+		"blocks ending right after the retention boundary are not older": {
+			retention: time.Hour + time.Millisecond,
+			expected:  []ulid.ULID{block1},
+		},
+		"blocks ending right before the retention boundary are older": {
+			retention: time.Hour - time.Millisecond,
+			expected:  []ulid.ULID{block1, block2, block3},
+		},
+		"zero retention returns the blocks ending before now": {
+			retention: 0,
+			expected:  []ulid.ULID{block1, block2, block3, block4},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			actual := []ulid.ULID{}
+			for _, b := range idx.BlocksOlderThan(testData.retention, now) {
+				actual = append(actual, b.ID)
+			}
+			assert.Equal(t, testData.expected, actual)
+		})
+	}
+}
+
+func TestIndex_NextUpdateHint(t *testing.T) {
+	const interval = 15 * time.Minute
+
+	t.Run("should return the same hint for the same tenant", func(t *testing.T) {
+		idx1 := &Index{UpdatedAt: 1000, UpdateJitterSeed: UpdateJitterSeed("user-1")}
+		idx2 := &Index{UpdatedAt: 1000, UpdateJitterSeed: UpdateJitterSeed("user-1")}
+		assert.Equal(t, idx1.NextUpdateHint(interval), idx2.NextUpdateHint(interval))
+	})
+
+	t.Run("should schedule the update at the tenant offset within the interval", func(t *testing.T) {
+		idx := &Index{UpdateJitterSeed: UpdateJitterSeed("user-1")}
+		offset := idx.NextUpdateHint(interval) % interval
+
+		for _, updatedAt := range []int64{0, 1, 60, 899, 900, 1000, 123456} {
+			idx.UpdatedAt = updatedAt
+			hint := idx.NextUpdateHint(interval)
+
+			assert.Greater(t, hint, time.Duration(0))
+			assert.LessOrEqual(t, hint, interval)
+			assert.Equal(t, offset, (time.Duration(updatedAt)*time.Second+hint)%interval)
+		}
+	})
+
+	t.Run("should not add any offset if the seed is zero", func(t *testing.T) {
+		idx := &Index{UpdatedAt: 60}
+		assert.Equal(t, interval-time.Minute, idx.NextUpdateHint(interval))
+
+		idx.UpdatedAt = 0
+		assert.Equal(t, interval, idx.NextUpdateHint(interval))
+	})
+
+	t.Run("should return 0 on invalid interval", func(t *testing.T) {
+		idx := &Index{UpdatedAt: 60, UpdateJitterSeed: UpdateJitterSeed("user-1")}
+		assert.Equal(t, time.Duration(0), idx.NextUpdateHint(0))
+	})
+
+	t.Run("should spread the tenants over the interval", func(t *testing.T) {
+		const (
+			numTenants = 1000
+			numBuckets = 10
+		)
+
+		buckets := make([]int, numBuckets)
+		for i := 0; i < numTenants; i++ {
+			idx := &Index{UpdateJitterSeed: UpdateJitterSeed(fmt.Sprintf("user-%d", i))}
+			offset := idx.NextUpdateHint(interval) % interval
+			buckets[offset*numBuckets/interval]++
+		}
+
+		// Each bucket is expected to get 100 tenants, allow for some variance.
+		for i, count := range buckets {
+			assert.InDelta(t, numTenants/numBuckets, count, 40, "bucket %d", i)
+		}
+	})
+}
+
+func TestIndex_CoverageGaps(t *testing.T) {
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+
+	tests := map[string]struct {
+		idx      *Index
+		maxGap   time.Duration
+		expected []TimeRange
+	}{
+		"empty index": {
+			idx:      &Index{},
+			expected: nil,
+		},
+		"contiguous blocks": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 0, MaxTime: 1000},
+				{ID: block2, MinTime: 1000, MaxTime: 2000},
+				{ID: block3, MinTime: 2000, MaxTime: 3000},
+			}},
+			expected: nil,
+		},
+		"gapped blocks": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block3, MinTime: 5000, MaxTime: 6000},
+				{ID: block1, MinTime: 0, MaxTime: 1000},
+				{ID: block2, MinTime: 2000, MaxTime: 3000},
+			}},
+			expected: []TimeRange{{MinTime: 1000, MaxTime: 2000}, {MinTime: 3000, MaxTime: 5000}},
+		},
+		"gaps not longer than the max gap": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 0, MaxTime: 1000},
+				{ID: block2, MinTime: 2000, MaxTime: 3000},
+				{ID: block3, MinTime: 5000, MaxTime: 6000},
+			}},
+			maxGap:   time.Second,
+			expected: []TimeRange{{MinTime: 3000, MaxTime: 5000}},
+		},
+		"overlapping blocks": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 0, MaxTime: 4000},
+				{ID: block2, MinTime: 1000, MaxTime: 2000},
+				{ID: block3, MinTime: 3000, MaxTime: 5000},
+				{ID: block4, MinTime: 6000, MaxTime: 7000},
+			}},
+			expected: []TimeRange{{MinTime: 5000, MaxTime: 6000}},
+		},
+		"block contained in another block": {
+			idx: &Index{Blocks: Blocks{
+				{ID: block1, MinTime: 0, MaxTime: 5000},
+				{ID: block2, MinTime: 1000, MaxTime: 2000},
+				{ID: block3, MinTime: 5000, MaxTime: 6000},
+			}},
+			expected: nil,
+		},
+		"blocks marked for deletion": {
+			idx: &Index{
+				Blocks: Blocks{
+					{ID: block1, MinTime: 0, MaxTime: 1000},
+					{ID: block2, MinTime: 1000, MaxTime: 2000},
+					{ID: block3, MinTime: 2000, MaxTime: 3000},
+				},
+				BlockDeletionMarks: BlockDeletionMarks{{ID: block2}},
+			},
+			expected: []TimeRange{{MinTime: 1000, MaxTime: 2000}},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, testData.expected, testData.idx.CoverageGaps(testData.maxGap))
+		})
+	}
+}
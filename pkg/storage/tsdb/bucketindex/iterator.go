@@ -0,0 +1,171 @@
+package bucketindex
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+// IndexIterator iterates the blocks of a bucket index, decoding them one at a time while
+// streaming the index from the bucket, so that the whole list of blocks is never held in
+// memory. The block deletion marks are not iterated, so the index delta, which only holds
+// deletion marks, doesn't apply. The iterator must be closed once done.
+//
+//	it, err := NewIndexIterator(ctx, bkt, userID, cfgProvider, logger)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//
+//	for it.Next() {
+//		b := it.Block()
+//		...
+//	}
+//	return it.Err()
+type IndexIterator struct {
+	logger     log.Logger
+	userID     string
+	reader     io.ReadCloser
+	gzipReader *gzip.Reader
+	decoder    *json.Decoder
+
+	current Block
+	done    bool
+	err     error
+}
+
+// NewIndexIterator returns an iterator over the blocks of the bucket index of the provided user.
+// It returns ErrIndexNotFound if the index doesn't exist, ErrIndexVersionUnsupported if the index
+// format version is newer than the first one, and ErrIndexCorrupted if the index can't be decoded up
+// to the beginning of the blocks.
+func NewIndexIterator(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (*IndexIterator, error) {
+	reader, err := getIndexReader(ctx, bkt, userID, cfgProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &IndexIterator{logger: logger, userID: userID, reader: reader}
+
+	it.gzipReader, err = gzip.NewReader(reader)
+	if err != nil {
+		it.Close()
+		return nil, ErrIndexCorrupted
+	}
+	it.decoder = json.NewDecoder(it.gzipReader)
+
+	if err := it.seekBlocks(); errors.Is(err, ErrIndexVersionUnsupported) {
+		it.Close()
+		return nil, err
+	} else if err != nil {
+		it.Close()
+		return nil, ErrIndexCorrupted
+	}
+
+	return it, nil
+}
+
+// seekBlocks consumes the index up to the first block. The iterator is done if the index has no blocks.
+func (it *IndexIterator) seekBlocks() error {
+	d := it.decoder
+	if tok, err := d.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.Errorf("unexpected token %v, expected object", tok)
+	}
+
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key, _ := tok.(string); key {
+		case "blocks":
+		case "version":
+			// The iterator only understands the layout of the first version.
+			var version int
+			if err := d.Decode(&version); err != nil {
+				return err
+			}
+			if version > IndexVersion1 {
+				return errors.Wrapf(ErrIndexVersionUnsupported, "version %d", version)
+			}
+			continue
+		default:
+			if err := d.Decode(&json.RawMessage{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tok, err = d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('['):
+			return nil
+		case nil:
+			// A null array.
+			it.done = true
+			return nil
+		default:
+			return errors.Errorf("unexpected token %v, expected array", tok)
+		}
+	}
+
+	it.done = true
+	return nil
+}
+
+// Next advances the iterator to the next block, returning false once there are no more blocks
+// or an error occurred.
+func (it *IndexIterator) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+
+	if !it.decoder.More() {
+		it.done = true
+		if _, err := it.decoder.Token(); err != nil {
+			it.err = ErrIndexCorrupted
+		}
+		return false
+	}
+
+	it.current = Block{}
+	if err := it.decoder.Decode(&it.current); err != nil {
+		it.err = ErrIndexCorrupted
+		return false
+	}
+	if err := it.current.checkTenant(it.userID); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// Block returns the current block.
+func (it *IndexIterator) Block() Block {
+	return it.current
+}
+
+// Err returns the error occurred while iterating, if any.
+func (it *IndexIterator) Err() error {
+	return it.err
+}
+
+// Close releases the underlying bucket index reader.
+func (it *IndexIterator) Close() {
+	if it.gzipReader != nil {
+		runutil.CloseWithLogOnErr(it.logger, it.gzipReader, "close bucket index gzip reader")
+	}
+	runutil.CloseWithLogOnErr(it.logger, it.reader, "close bucket index reader")
+}
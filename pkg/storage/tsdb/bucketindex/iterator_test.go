@@ -0,0 +1,127 @@
+package bucketindex
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestIndexIterator(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = BucketWithGlobalMarkers(bkt)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	cortex_testutil.MockStorageDeletionMark(t, bkt, userID, cortex_testutil.MockStorageBlock(t, bkt, userID, 30, 40))
+
+	idx, _, _, err := NewUpdater(bkt, userID, nil, logger).UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+	it, err := NewIndexIterator(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	defer it.Close()
+
+	var actual Blocks
+	for it.Next() {
+		b := it.Block()
+		actual = append(actual, &b)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, idx.Blocks, actual)
+
+	// The iterator stays exhausted.
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+}
+
+func TestIndexIterator_ShouldIterateNoBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	for testName, idx := range map[string]*Index{
+		"null blocks":  {Version: IndexVersion1, UpdatedAt: 10},
+		"empty blocks": {Version: IndexVersion1, Blocks: Blocks{}, UpdatedAt: 10},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+			it, err := NewIndexIterator(ctx, bkt, userID, nil, log.NewNopLogger())
+			require.NoError(t, err)
+			defer it.Close()
+
+			assert.False(t, it.Next())
+			assert.NoError(t, it.Err())
+		})
+	}
+}
+
+func TestIndexIterator_ShouldReturnErrorIfIndexDoesNotExist(t *testing.T) {
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	it, err := NewIndexIterator(context.Background(), bkt, "user-1", nil, log.NewNopLogger())
+	require.Equal(t, ErrIndexNotFound, err)
+	require.Nil(t, it)
+}
+
+func TestIndexIterator_ShouldReturnErrorIfIndexIsCorrupted(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	t.Run("not gzipped", func(t *testing.T) {
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), strings.NewReader("invalid!}")))
+
+		it, err := NewIndexIterator(ctx, bkt, userID, nil, log.NewNopLogger())
+		require.Equal(t, ErrIndexCorrupted, err)
+		require.Nil(t, it)
+	})
+
+	t.Run("truncated blocks", func(t *testing.T) {
+		idx := &Index{Version: IndexVersion1}
+		for i := 0; i < 1000; i++ {
+			idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(uint64(i), rand.Reader), MinTime: int64(i * 10), MaxTime: int64((i + 1) * 10)})
+		}
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		// Truncate the index, like an interrupted upload would do.
+		reader, err := bkt.Get(ctx, path.Join(userID, IndexCompressedFilename))
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), bytes.NewReader(content[:len(content)/2])))
+
+		it, err := NewIndexIterator(ctx, bkt, userID, nil, log.NewNopLogger())
+		require.NoError(t, err)
+		defer it.Close()
+
+		// The blocks preceding the truncation point are iterated before failing.
+		count := 0
+		for it.Next() {
+			assert.Equal(t, *idx.Blocks[count], it.Block())
+			count++
+		}
+		require.Equal(t, ErrIndexCorrupted, it.Err())
+		assert.Greater(t, count, 0)
+		assert.Less(t, count, len(idx.Blocks))
+	})
+}
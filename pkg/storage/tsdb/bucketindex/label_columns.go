@@ -0,0 +1,106 @@
+package bucketindex
+
+import (
+	"slices"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LabelColumnView is a column-oriented view of the blocks external labels: for each label name,
+// the values of all the blocks are dictionary encoded, so that a matcher is evaluated once for
+// each distinct value, instead of once for each block.
+type LabelColumnView struct {
+	blocks  []*Block
+	columns map[string]labelColumn
+}
+
+// labelColumn holds the values of a label for all the blocks of a LabelColumnView.
+type labelColumn struct {
+	// Distinct values of the label. The first value is always the empty one, used for the
+	// blocks without the label.
+	values []string
+
+	// Index in values of the value of each block, in the same order of the blocks.
+	refs []uint32
+}
+
+// LabelColumns builds and returns the column-oriented view of the index blocks external labels. The
+// view is owned by the caller, who can keep it to match many sets of matchers against the same blocks
+// with BlocksMatching. It's a snapshot: it doesn't reflect the blocks added, removed or relabeled
+// afterwards, so it must be built again once the index is changed.
+func (idx *Index) LabelColumns() LabelColumnView {
+	// Copy the blocks, since the index ones may be shifted in place, eg. by RemoveBlock.
+	blocks := slices.Clone(idx.Blocks)
+	view := LabelColumnView{
+		blocks:  blocks,
+		columns: map[string]labelColumn{},
+	}
+
+	// Index of each value in the column values, for each label name.
+	dicts := map[string]map[string]uint32{}
+
+	for i, b := range blocks {
+		for name, value := range b.Labels {
+			col, ok := view.columns[name]
+			if !ok {
+				// All the blocks before this one don't have the label.
+				col = labelColumn{values: []string{""}, refs: make([]uint32, len(blocks))}
+				dicts[name] = map[string]uint32{"": 0}
+			}
+
+			ref, ok := dicts[name][value]
+			if !ok {
+				ref = uint32(len(col.values))
+				col.values = append(col.values, value)
+				dicts[name][value] = ref
+			}
+
+			col.refs[i] = ref
+			view.columns[name] = col
+		}
+	}
+
+	return view
+}
+
+// Len returns the number of blocks in the view.
+func (v LabelColumnView) Len() int {
+	return len(v.blocks)
+}
+
+// BlocksMatching returns the blocks whose external labels match all the input matchers.
+// Labels missing from a block are matched as empty, consistently with Block.MatchesLabels.
+func (v LabelColumnView) BlocksMatching(matchers []*labels.Matcher) []*Block {
+	selected := make([]bool, len(v.blocks))
+	for i := range selected {
+		selected[i] = true
+	}
+
+	for _, matcher := range matchers {
+		col, ok := v.columns[matcher.Name]
+		if !ok {
+			// No block has the label.
+			if !matcher.Matches("") {
+				return []*Block{}
+			}
+			continue
+		}
+
+		matching := make([]bool, len(col.values))
+		for ref, value := range col.values {
+			matching[ref] = matcher.Matches(value)
+		}
+
+		for i, ref := range col.refs {
+			selected[i] = selected[i] && matching[ref]
+		}
+	}
+
+	blocks := make([]*Block, 0, len(v.blocks))
+	for i, b := range v.blocks {
+		if selected[i] {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,83 @@
+package bucketindex
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex_LabelColumns(t *testing.T) {
+	block1 := &Block{ID: ulid.MustNew(1, nil), Labels: map[string]string{"region": "eu", "zone": "a"}}
+	block2 := &Block{ID: ulid.MustNew(2, nil), Labels: map[string]string{"region": "us", "zone": "a"}}
+	block3 := &Block{ID: ulid.MustNew(3, nil)}
+	block4 := &Block{ID: ulid.MustNew(4, nil), Labels: map[string]string{"region": "eu"}}
+	idx := &Index{Blocks: Blocks{block1, block2, block3, block4}}
+
+	view := idx.LabelColumns()
+	assert.Equal(t, 4, view.Len())
+	assert.Equal(t, labelColumn{values: []string{"", "eu", "us"}, refs: []uint32{1, 2, 0, 1}}, view.columns["region"])
+	assert.Equal(t, labelColumn{values: []string{"", "a"}, refs: []uint32{1, 1, 0, 0}}, view.columns["zone"])
+
+	// The columnar matching is consistent with the row-wise one.
+	for _, matchers := range [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchEqual, "region", "eu")},
+		{labels.MustNewMatcher(labels.MatchEqual, "zone", "")},
+		{labels.MustNewMatcher(labels.MatchNotRegexp, "region", "u.*")},
+		{labels.MustNewMatcher(labels.MatchEqual, "region", "eu"), labels.MustNewMatcher(labels.MatchEqual, "zone", "a")},
+		{labels.MustNewMatcher(labels.MatchEqual, "unknown", "")},
+		{labels.MustNewMatcher(labels.MatchEqual, "unknown", "value")},
+	} {
+		assert.Equal(t, idx.BlocksMatchingLabels(matchers), view.BlocksMatching(matchers), "matchers: %v", matchers)
+	}
+
+	// The view is a snapshot of the blocks when it's been built.
+	idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(5, nil)})
+	idx.RemoveBlock(block1.ID)
+	assert.Equal(t, 4, view.Len())
+	assert.Equal(t, []*Block{block1, block4}, view.BlocksMatching([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "region", "eu")}))
+	assert.Equal(t, 4, idx.LabelColumns().Len())
+}
+
+func BenchmarkIndex_BlocksMatchingLabels(b *testing.B) {
+	const numBlocks = 10000
+
+	idx := &Index{}
+	for i := 0; i < numBlocks; i++ {
+		idx.Blocks = append(idx.Blocks, &Block{
+			ID: ulid.MustNew(uint64(i), nil),
+			Labels: map[string]string{
+				"__org_id__": "user-1",
+				"region":     fmt.Sprintf("region-%d", i%10),
+				"replica":    fmt.Sprintf("replica-%d", i%3),
+				"shard":      fmt.Sprintf("%d_of_16", i%16+1),
+			},
+		})
+	}
+
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "region", "region-(1|3|5)"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "replica", "replica-0"),
+		labels.MustNewMatcher(labels.MatchRegexp, "shard", ".*_of_16"),
+	}
+	expected := idx.BlocksMatchingLabels(matchers)
+
+	b.Run("row-wise", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			require.Len(b, idx.BlocksMatchingLabels(matchers), len(expected))
+		}
+	})
+
+	b.Run("columnar", func(b *testing.B) {
+		view := idx.LabelColumns()
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			require.Len(b, view.BlocksMatching(matchers), len(expected))
+		}
+	})
+}
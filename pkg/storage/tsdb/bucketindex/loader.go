@@ -12,6 +12,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/thanos-io/objstore"
 	"go.uber.org/atomic"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	"github.com/cortexproject/cortex/pkg/util"
@@ -23,6 +24,11 @@ const (
 	// readIndexTimeout is the maximum allowed time when reading a single bucket index
 	// from the storage. It's hard-coded to a reasonably high value.
 	readIndexTimeout = 15 * time.Second
+
+	// throttledUpdateIntervalFactor is the factor applied to the update on error interval
+	// to back off after the storage throttled the read of a bucket index, to not make the
+	// throttling worse.
+	throttledUpdateIntervalFactor = 5
 )
 
 type LoaderConfig struct {
@@ -30,6 +36,28 @@ type LoaderConfig struct {
 	UpdateOnStaleInterval time.Duration
 	UpdateOnErrorInterval time.Duration
 	IdleTimeout           time.Duration
+
+	// CoalesceReads enables coalescing concurrent loads of the bucket index of the
+	// same tenant into a single read from the storage.
+	CoalesceReads bool
+
+	// HedgeDelay and MaxHedges configure the hedging of the bucket index reads: if a read
+	// doesn't complete within the delay, up to max hedges concurrent reads are issued. Hedging
+	// is disabled if the delay is 0.
+	HedgeDelay time.Duration
+	MaxHedges  int
+
+	// CircuitBreakerFailures and CircuitBreakerCooldown configure the per-tenant circuit breakers of
+	// the bucket index reads: after the configured number of consecutive failures, the reads of the
+	// tenant index fail immediately with the last error until the cooldown expires. The circuit
+	// breakers are disabled if the number of failures is 0.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+
+	// IndexReadTimeout is the maximum time a single read of a bucket index can take, regardless of
+	// the deadline of the query which triggered it. The reads exceeding it fail with ErrIndexReadTimeout.
+	// The timeout is disabled if 0.
+	IndexReadTimeout time.Duration
 }
 
 // Loader is responsible to lazy load bucket indexes and, once loaded for the first time,
@@ -46,11 +74,21 @@ type Loader struct {
 	indexesMx sync.RWMutex
 	indexes   map[string]*cachedIndex
 
+	// Concurrent reads of the same tenant's index, used if reads coalescing is enabled.
+	reads singleflight.Group
+
+	// Hedging of the index reads, nil if hedging is disabled.
+	hedging *hedgedBucket
+
+	// Per-tenant circuit breakers of the index reads, nil if disabled.
+	breakers *readCircuitBreakers
+
 	// Metrics.
-	loadAttempts prometheus.Counter
-	loadFailures prometheus.Counter
-	loadDuration prometheus.Histogram
-	loaded       prometheus.GaugeFunc
+	loadAttempts   prometheus.Counter
+	loadFailures   prometheus.Counter
+	loadDuration   prometheus.Histogram
+	loaded         prometheus.GaugeFunc
+	coalescedLoads prometheus.Counter
 }
 
 // NewLoader makes a new Loader.
@@ -75,6 +113,17 @@ func NewLoader(cfg LoaderConfig, bucketClient objstore.Bucket, cfgProvider bucke
 			Help:    "Duration of the a single bucket index loading operation in seconds.",
 			Buckets: []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.3, 1, 10},
 		}),
+		coalescedLoads: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_coalesced_loads_total",
+			Help: "Total number of bucket index loading attempts which shared the read from the storage with concurrent attempts for the same tenant.",
+		}),
+	}
+
+	if cfg.HedgeDelay > 0 && cfg.MaxHedges > 0 {
+		l.hedging = newHedgedBucket(bucketClient, cfg.HedgeDelay, cfg.MaxHedges, reg)
+	}
+	if cfg.CircuitBreakerFailures > 0 {
+		l.breakers = newReadCircuitBreakers(cfg.CircuitBreakerFailures, cfg.CircuitBreakerCooldown, reg)
 	}
 
 	l.loaded = promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
@@ -115,7 +164,7 @@ func (l *Loader) GetIndex(ctx context.Context, userID string) (*Index, Status, e
 
 	startTime := time.Now()
 	l.loadAttempts.Inc()
-	idx, err := ReadIndex(ctx, l.bkt, userID, l.cfgProvider, l.logger)
+	idx, err := l.readIndex(ctx, userID)
 	if err != nil {
 		// Cache the error, to avoid hammering the object store in case of persistent issues
 		// (eg. corrupted bucket index or not existing).
@@ -128,6 +177,9 @@ func (l *Loader) GetIndex(ctx context.Context, userID string) (*Index, Status, e
 
 		if errors.Is(err, ErrIndexNotFound) {
 			level.Warn(l.logger).Log("msg", "bucket index not found", "user", userID)
+		} else if errors.Is(err, ErrIndexThrottled) {
+			l.loadFailures.Inc()
+			level.Warn(l.logger).Log("msg", "bucket index read throttled by the storage", "user", userID, "err", err)
 		} else if errors.Is(err, bucket.ErrCustomerManagedKeyAccessDenied) {
 			level.Warn(l.logger).Log("msg", "key access denied when reading bucket index", "user", userID)
 		} else {
@@ -149,6 +201,61 @@ func (l *Loader) GetIndex(ctx context.Context, userID string) (*Index, Status, e
 	return idx, ss, nil
 }
 
+// readIndex reads the bucket index of the input user from the storage, unless the user circuit breaker
+// is open. If reads coalescing is enabled, concurrent reads for the same user share a single read and
+// its result.
+func (l *Loader) readIndex(ctx context.Context, userID string) (*Index, error) {
+	ctx = l.withIndexReadTimeout(ctx)
+
+	return l.breakers.read(userID, func() (*Index, error) {
+		return l.readIndexCoalesced(ctx, userID)
+	})
+}
+
+func (l *Loader) readIndexCoalesced(ctx context.Context, userID string) (*Index, error) {
+	if !l.cfg.CoalesceReads {
+		return ReadIndex(ctx, l.indexBucket(), userID, l.cfgProvider, l.logger)
+	}
+
+	results := l.reads.DoChan(userID, func() (interface{}, error) {
+		// The read is shared with other callers, so it must not be canceled if the caller
+		// which started it goes away.
+		readCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readIndexTimeout)
+		defer cancel()
+
+		return ReadIndex(readCtx, l.indexBucket(), userID, l.cfgProvider, l.logger)
+	})
+
+	select {
+	case res := <-results:
+		if res.Shared {
+			l.coalescedLoads.Inc()
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*Index), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// indexBucket returns the bucket to read the bucket index from.
+func (l *Loader) indexBucket() objstore.Bucket {
+	if l.hedging == nil {
+		return l.bkt
+	}
+	return l.hedging.withBucket(l.bkt)
+}
+
+// withIndexReadTimeout returns the input context with the configured index read timeout, if any.
+func (l *Loader) withIndexReadTimeout(ctx context.Context) context.Context {
+	if l.cfg.IndexReadTimeout <= 0 {
+		return ctx
+	}
+	return ContextWithIndexReadTimeout(ctx, l.cfg.IndexReadTimeout)
+}
+
 func (l *Loader) cacheIndex(userID string, idx *Index, ss Status, err error) {
 	if errors.Is(err, context.Canceled) {
 		level.Info(l.logger).Log("msg", "skipping cache bucket index", "err", err)
@@ -198,6 +305,10 @@ func (l *Loader) checkCachedIndexesToUpdateAndDelete() (toUpdate, toDelete []str
 		switch {
 		case now.Sub(entry.getRequestedAt()) >= l.cfg.IdleTimeout:
 			toDelete = append(toDelete, userID)
+		case entry.throttled:
+			if now.Sub(entry.getUpdatedAt()) >= throttledUpdateIntervalFactor*l.cfg.UpdateOnErrorInterval {
+				toUpdate = append(toUpdate, userID)
+			}
 		case isError && now.Sub(entry.getUpdatedAt()) >= l.cfg.UpdateOnErrorInterval:
 			toUpdate = append(toUpdate, userID)
 		case !isError && now.Sub(entry.getUpdatedAt()) >= l.cfg.UpdateOnStaleInterval:
@@ -224,7 +335,20 @@ func (l *Loader) updateCachedIndex(ctx context.Context, userID string) {
 	l.indexes[userID].syncStatus = ss
 	l.indexesMx.Unlock()
 
-	idx, err := ReadIndex(readCtx, l.bkt, userID, l.cfgProvider, l.logger)
+	idx, err := l.breakers.read(userID, func() (*Index, error) {
+		return ReadIndex(l.withIndexReadTimeout(readCtx), l.indexBucket(), userID, l.cfgProvider, l.logger)
+	})
+	if errors.Is(err, ErrIndexThrottled) {
+		l.loadFailures.Inc()
+		level.Warn(l.logger).Log("msg", "bucket index update throttled by the storage, backing off", "user", userID, "err", err)
+
+		// Keep the previously loaded index, if any, and back off before trying again.
+		l.indexesMx.Lock()
+		l.indexes[userID].throttled = true
+		l.indexes[userID].setUpdatedAt(startTime)
+		l.indexesMx.Unlock()
+		return
+	}
 	if err != nil &&
 		!errors.Is(err, ErrIndexNotFound) &&
 		!errors.Is(err, bucket.ErrCustomerManagedKeyAccessDenied) &&
@@ -242,6 +366,7 @@ func (l *Loader) updateCachedIndex(ctx context.Context, userID string) {
 	l.indexesMx.Lock()
 	l.indexes[userID].index = idx
 	l.indexes[userID].err = err
+	l.indexes[userID].throttled = false
 	l.indexes[userID].setUpdatedAt(startTime)
 	l.indexesMx.Unlock()
 }
@@ -251,6 +376,8 @@ func (l *Loader) deleteCachedIndex(userID string) {
 	delete(l.indexes, userID)
 	l.indexesMx.Unlock()
 
+	l.breakers.forget(userID)
+
 	level.Info(l.logger).Log("msg", "unloaded bucket index", "user", userID, "reason", "idle")
 }
 
@@ -274,6 +401,9 @@ type cachedIndex struct {
 	syncStatus Status
 	err        error
 
+	// Whether the last read of the index has been throttled by the storage.
+	throttled bool
+
 	// Unix timestamp (seconds) of when the index has been updated from the storage the last time.
 	updatedAt atomic.Int64
 
@@ -286,6 +416,7 @@ func newCachedIndex(idx *Index, ss Status, err error) *cachedIndex {
 		index:      idx,
 		err:        err,
 		syncStatus: ss,
+		throttled:  errors.Is(err, ErrIndexThrottled),
 	}
 
 	now := time.Now()
@@ -3,18 +3,24 @@ package bucketindex
 import (
 	"bytes"
 	"context"
+	"io"
+	"net/http"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/minio/minio-go/v7"
 	"github.com/oklog/ulid/v2"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
 
@@ -747,6 +753,238 @@ func TestLoader_GetIndex_ShouldCacheKeyDeniedErrors(t *testing.T) {
 	))
 }
 
+func TestLoader_ShouldBackOffOnThrottledReads(t *testing.T) {
+	const user = "user-1"
+
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// Create a bucket index.
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, user, nil, idx))
+
+	mbkt := &cortex_testutil.MockBucketFailure{
+		Bucket:      bkt,
+		GetFailures: map[string]error{},
+	}
+
+	// The loader is not started, so that background updates are triggered manually.
+	cfg := prepareLoaderConfig()
+	loader := NewLoader(cfg, mbkt, nil, log.NewNopLogger(), reg)
+
+	actualIdx, _, err := loader.GetIndex(ctx, user)
+	require.NoError(t, err)
+	assert.Equal(t, idx, actualIdx)
+
+	// Throttle the bucket index reads.
+	mbkt.GetFailures[path.Join(user, IndexCompressedFilename)] = minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}
+
+	// The previously loaded index should be kept on throttled background updates.
+	loader.updateCachedIndex(ctx, user)
+	actualIdx, _, err = loader.GetIndex(ctx, user)
+	require.NoError(t, err)
+	assert.Equal(t, idx, actualIdx)
+
+	// The index should not be updated again until the throttled update interval is reached.
+	loader.indexes[user].setUpdatedAt(time.Now().Add(-2 * cfg.UpdateOnErrorInterval))
+	toUpdate, _ := loader.checkCachedIndexesToUpdateAndDelete()
+	assert.Empty(t, toUpdate)
+
+	loader.indexes[user].setUpdatedAt(time.Now().Add(-throttledUpdateIntervalFactor * cfg.UpdateOnErrorInterval))
+	toUpdate, _ = loader.checkCachedIndexesToUpdateAndDelete()
+	assert.Equal(t, []string{user}, toUpdate)
+
+	// Once the throttling stops, the index should be updated as usual.
+	delete(mbkt.GetFailures, path.Join(user, IndexCompressedFilename))
+	loader.updateCachedIndex(ctx, user)
+	assert.False(t, loader.indexes[user].throttled)
+
+	// A throttled read of an index not loaded yet should return a dedicated error.
+	mbkt.GetFailures[path.Join("user-2", IndexCompressedFilename)] = minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}
+	_, _, err = loader.GetIndex(ctx, "user-2")
+	require.True(t, errors.Is(err, ErrIndexThrottled))
+	assert.True(t, loader.indexes["user-2"].throttled)
+
+	// Ensure metrics have been updated accordingly.
+	assert.NoError(t, testutil.GatherAndCompare(reg, bytes.NewBufferString(`
+		# HELP cortex_bucket_index_load_failures_total Total number of bucket index loading failures.
+		# TYPE cortex_bucket_index_load_failures_total counter
+		cortex_bucket_index_load_failures_total 2
+	`),
+		"cortex_bucket_index_load_failures_total",
+	))
+}
+
+func TestLoader_GetIndex_ShouldCoalesceConcurrentReads(t *testing.T) {
+	const (
+		user       = "user-1"
+		numCallers = 10
+	)
+
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// Create a bucket index.
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, user, nil, idx))
+
+	// Block the reads of the bucket index until all the callers are waiting for it.
+	blockingBkt := &blockingIndexBucket{Bucket: bkt, unblock: make(chan struct{})}
+
+	cfg := prepareLoaderConfig()
+	cfg.CoalesceReads = true
+	loader := NewLoader(cfg, blockingBkt, nil, log.NewNopLogger(), reg)
+
+	wg := sync.WaitGroup{}
+	wg.Add(numCallers)
+	for i := 0; i < numCallers; i++ {
+		go func() {
+			defer wg.Done()
+
+			actualIdx, _, err := loader.GetIndex(ctx, user)
+			assert.NoError(t, err)
+			assert.Equal(t, idx, actualIdx)
+		}()
+	}
+
+	test.Poll(t, time.Second, float64(numCallers), func() interface{} {
+		return testutil.ToFloat64(loader.loadAttempts)
+	})
+	// Give the callers the time to join the in-flight read.
+	time.Sleep(100 * time.Millisecond)
+	close(blockingBkt.unblock)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), blockingBkt.indexGets.Load())
+	assert.Equal(t, float64(numCallers), testutil.ToFloat64(loader.coalescedLoads))
+}
+
+func TestLoader_ShouldShortCircuitReadsOfRepeatedlyFailingIndex(t *testing.T) {
+	const user = "user-1"
+
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// Write a corrupted index.
+	require.NoError(t, bkt.Upload(ctx, path.Join(user, IndexCompressedFilename), strings.NewReader("invalid!}")))
+
+	// Count the reads of the bucket index, without blocking them.
+	countingBkt := &blockingIndexBucket{Bucket: bkt, unblock: make(chan struct{})}
+	close(countingBkt.unblock)
+
+	// The loader is not started, so that background updates are triggered manually.
+	cfg := prepareLoaderConfig()
+	cfg.CircuitBreakerFailures = 2
+	cfg.CircuitBreakerCooldown = time.Hour
+	loader := NewLoader(cfg, countingBkt, nil, log.NewNopLogger(), reg)
+
+	// The breaker opens after 2 consecutive failures.
+	_, _, err := loader.GetIndex(ctx, user)
+	require.Equal(t, ErrIndexCorrupted, err)
+	loader.updateCachedIndex(ctx, user)
+	assert.Equal(t, int32(2), countingBkt.indexGets.Load())
+
+	// The following reads fail immediately with the last error, without reading the index.
+	loader.updateCachedIndex(ctx, user)
+	loader.updateCachedIndex(ctx, user)
+	assert.Equal(t, int32(2), countingBkt.indexGets.Load())
+
+	_, _, err = loader.GetIndex(ctx, user)
+	require.Equal(t, ErrIndexCorrupted, err)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, bytes.NewBufferString(`
+		# HELP cortex_bucket_index_read_circuit_breaker_open Whether the circuit breaker of the bucket index reads of a tenant is open (1) or half-open, letting a single read through once the cooldown expired (0). Tenants whose breaker is closed are not exported.
+		# TYPE cortex_bucket_index_read_circuit_breaker_open gauge
+		cortex_bucket_index_read_circuit_breaker_open{user="user-1"} 1
+		# HELP cortex_bucket_index_read_circuit_breaker_short_circuits_total Total number of bucket index reads failed without reading the index because the circuit breaker of the tenant was open.
+		# TYPE cortex_bucket_index_read_circuit_breaker_short_circuits_total counter
+		cortex_bucket_index_read_circuit_breaker_short_circuits_total 2
+	`),
+		"cortex_bucket_index_read_circuit_breaker_open",
+		"cortex_bucket_index_read_circuit_breaker_short_circuits_total",
+	))
+
+	// The other tenants are not affected.
+	_, _, err = loader.GetIndex(ctx, "user-2")
+	require.Equal(t, ErrIndexNotFound, err)
+	assert.Equal(t, int32(3), countingBkt.indexGets.Load())
+
+	// Once the cooldown expires, the index is read again and the breaker closes on success.
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, user, nil, idx))
+	loader.breakers.tenants[user].openUntil = time.Now().Add(-time.Second)
+
+	loader.updateCachedIndex(ctx, user)
+	assert.Equal(t, int32(4), countingBkt.indexGets.Load())
+
+	actualIdx, _, err := loader.GetIndex(ctx, user)
+	require.NoError(t, err)
+	assert.Equal(t, idx, actualIdx)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, bytes.NewBufferString(`
+		# HELP cortex_bucket_index_read_circuit_breaker_short_circuits_total Total number of bucket index reads failed without reading the index because the circuit breaker of the tenant was open.
+		# TYPE cortex_bucket_index_read_circuit_breaker_short_circuits_total counter
+		cortex_bucket_index_read_circuit_breaker_short_circuits_total 2
+	`),
+		"cortex_bucket_index_read_circuit_breaker_open",
+		"cortex_bucket_index_read_circuit_breaker_short_circuits_total",
+	))
+}
+
+func TestLoader_ShouldFailTheIndexReadsExceedingTheReadTimeout(t *testing.T) {
+	const user = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, user, nil, idx))
+
+	cfg := prepareLoaderConfig()
+	cfg.IndexReadTimeout = 50 * time.Millisecond
+	loader := NewLoader(cfg, &slowGetBucket{Bucket: bkt, getDelay: time.Second}, nil, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+
+	// The query context has no deadline, but the index read should still time out.
+	_, _, err := loader.GetIndex(ctx, user)
+	require.ErrorIs(t, err, ErrIndexReadTimeout)
+	assert.Equal(t, float64(1), testutil.ToFloat64(loader.loadFailures))
+}
+
+// blockingIndexBucket counts the reads of the bucket index and blocks them until unblock is closed.
+type blockingIndexBucket struct {
+	objstore.Bucket
+
+	indexGets atomic.Int32
+	unblock   chan struct{}
+}
+
+func (b *blockingIndexBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) == IndexCompressedFilename {
+		b.indexGets.Inc()
+		<-b.unblock
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
 func prepareLoaderConfig() LoaderConfig {
 	return LoaderConfig{
 		CheckInterval:         time.Minute,
@@ -0,0 +1,218 @@
+package bucketindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"reflect"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+var (
+	ErrIndexConcurrentlyModified = errors.New("bucket index concurrently modified")
+
+	errRewriteChangedNonTimestamps = errors.New("bucket index rewrite must only change the index, blocks and deletion marks timestamps")
+)
+
+// RewriteIndexTimestamps reads the bucket index, transforms it with fn and writes the transformed
+// index back to the storage. fn is allowed to modify the input index in place. If fn returns nil
+// the index is not written.
+//
+// This is an expert-only operation, meant to repair the UpdatedAt, blocks UploadedAt and deletion
+// marks DeletionTime timestamps of an index written with badly skewed clocks. The rewrite fails if
+// fn changes anything else than these timestamps.
+//
+// The stored index is read again right before writing the transformed one, and the write is aborted
+// with ErrIndexConcurrentlyModified if it changed in the meanwhile. The object storage client doesn't
+// support conditional writes, so this check and the write are not atomic: the compactor should not
+// be running for the tenant during the rewrite.
+func RewriteIndexTimestamps(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, fn func(*Index) *Index) error {
+	content, err := readIndexContent(ctx, bkt, userID, logger)
+	if err != nil {
+		return err
+	}
+
+	original, err := decodeIndexContent(content)
+	if err != nil {
+		return err
+	}
+
+	// The transform may modify the index in place, so it gets its own copy.
+	idx, err := decodeIndexContent(content)
+	if err != nil {
+		return err
+	}
+
+	idx = fn(idx)
+	if idx == nil {
+		return nil
+	}
+
+	if !reflect.DeepEqual(withoutTimestamps(original), withoutTimestamps(idx)) {
+		return errRewriteChangedNonTimestamps
+	}
+
+	current, err := readIndexContent(ctx, bkt, userID, logger)
+	if errors.Is(err, ErrIndexNotFound) {
+		return ErrIndexConcurrentlyModified
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, current) {
+		return ErrIndexConcurrentlyModified
+	}
+
+	return WriteIndex(ctx, bkt, userID, cfgProvider, idx)
+}
+
+// UpgradeIndex fills the fields of the bucket index blocks added to the index before the fields were
+// tracked, eg. the compaction level, sources, labels and chunk format version, reading them from the
+// blocks meta.json, and writes the upgraded index back to the storage. It allows to enrich an existing
+// index without rebuilding it from scratch.
+//
+// Only the meta.json of the blocks needing an upgrade are read, and the index is not written if no
+// block has been upgraded, so running it again on an upgraded index is a no-op. Blocks whose meta.json
+// is missing or corrupted are left untouched. It returns the number of upgraded blocks.
+//
+// Like RewriteIndexTimestamps, the write is aborted with ErrIndexConcurrentlyModified if the stored
+// index changed in the meanwhile, and the compactor should not be running for the tenant.
+func UpgradeIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (int, error) {
+	content, err := readIndexContent(ctx, bkt, userID, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	idx, err := decodeIndexContent(content)
+	if err != nil {
+		return 0, err
+	}
+
+	updater := NewUpdater(bkt, userID, cfgProvider, logger)
+	upgraded := 0
+
+	for _, b := range idx.Blocks {
+		if !blockNeedsUpgrade(b) {
+			continue
+		}
+
+		fromMeta, err := updater.updateBlockIndexEntry(ctx, b.ID)
+		if errors.Is(err, ErrBlockMetaNotFound) || errors.Is(err, errBlockMetaKeyAccessDeniedErr) || errors.Is(err, ErrBlockMetaCorrupted) {
+			level.Warn(updater.logger).Log("msg", "skipped upgrading bucket index block with unreadable meta.json", "block", b.ID.String(), "err", err)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		upgradeBlock(b, fromMeta)
+		upgraded++
+	}
+
+	if upgraded == 0 {
+		return 0, nil
+	}
+
+	current, err := readIndexContent(ctx, bkt, userID, logger)
+	if errors.Is(err, ErrIndexNotFound) {
+		return 0, ErrIndexConcurrentlyModified
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(content, current) {
+		return 0, ErrIndexConcurrentlyModified
+	}
+
+	if err := WriteIndex(ctx, bkt, userID, cfgProvider, idx); err != nil {
+		return 0, err
+	}
+	return upgraded, nil
+}
+
+// blockNeedsUpgrade returns whether the input block has been added to the index before its fields
+// read from the meta.json were all tracked. The compaction level and the chunk format version are
+// set in the meta.json of every block, so they're only zero for the blocks added before.
+func blockNeedsUpgrade(b *Block) bool {
+	return b.CompactionLevel == 0 || b.ChunkFormatVersion == 0
+}
+
+// upgradeBlock fills the fields of the input block read from the meta.json with the ones of the
+// input block built from it. The fields not read from the meta.json, eg. the upload time, are kept.
+func upgradeBlock(b, fromMeta *Block) {
+	b.SegmentsFormat = fromMeta.SegmentsFormat
+	b.SegmentsNum = fromMeta.SegmentsNum
+	b.SeriesMaxSize = fromMeta.SeriesMaxSize
+	b.ChunkMaxSize = fromMeta.ChunkMaxSize
+	b.SizeBytes = fromMeta.SizeBytes
+	b.CompactionLevel = fromMeta.CompactionLevel
+	b.Sources = fromMeta.Sources
+	b.NumSeries = fromMeta.NumSeries
+	b.NumSamples = fromMeta.NumSamples
+	b.Empty = fromMeta.Empty
+	b.CompactorShard = fromMeta.CompactorShard
+	b.ChunkFormatVersion = fromMeta.ChunkFormatVersion
+	b.Labels = fromMeta.Labels
+}
+
+// readIndexContent returns the compressed bucket index, as stored in the bucket.
+func readIndexContent(ctx context.Context, bkt BucketReader, userID string, logger log.Logger) ([]byte, error) {
+	reader, err := getIndexReader(ctx, bkt, userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bucket index")
+	}
+
+	return content, nil
+}
+
+// decodeIndexContent decompresses and parses the input compressed bucket index.
+func decodeIndexContent(content []byte) (*Index, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	decompressed, err := io.ReadAll(gzipReader)
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	return decodeIndex(decompressed)
+}
+
+// withoutTimestamps returns a copy of the input index with all the timestamps which can be
+// rewritten by RewriteIndexTimestamps reset.
+func withoutTimestamps(idx *Index) *Index {
+	out := *idx
+	out.UpdatedAt = 0
+
+	out.Blocks = make(Blocks, 0, len(idx.Blocks))
+	for _, b := range idx.Blocks {
+		c := *b
+		c.UploadedAt = 0
+		out.Blocks = append(out.Blocks, &c)
+	}
+
+	out.BlockDeletionMarks = make(BlockDeletionMarks, 0, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		c := *m
+		c.DeletionTime = 0
+		out.BlockDeletionMarks = append(out.BlockDeletionMarks, &c)
+	}
+
+	return &out
+}
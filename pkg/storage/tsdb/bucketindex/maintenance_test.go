@@ -0,0 +1,216 @@
+package bucketindex
+
+import (
+	"context"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"go.uber.org/atomic"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestRewriteIndexTimestamps(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	prepare := func(t *testing.T) (*Index, func() *Index, func(*Index) error) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		bkt = BucketWithGlobalMarkers(bkt)
+		cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+		cortex_testutil.MockStorageDeletionMark(t, bkt, userID, cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30))
+
+		idx, _, _, err := NewUpdater(bkt, userID, nil, logger).UpdateIndex(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		read := func() *Index {
+			actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+			require.NoError(t, err)
+			return actual
+		}
+		// rewrite replaces the index with the input one.
+		rewrite := func(rewritten *Index) error {
+			return RewriteIndexTimestamps(ctx, bkt, userID, nil, logger, func(*Index) *Index {
+				return rewritten
+			})
+		}
+		return idx, read, rewrite
+	}
+
+	t.Run("should write back the rewritten timestamps", func(t *testing.T) {
+		idx, read, rewrite := prepare(t)
+
+		expected := *idx
+		expected.UpdatedAt = 1000
+		expected.Blocks = Blocks{cloneBlock(idx.Blocks[0], 100), cloneBlock(idx.Blocks[1], 200)}
+		expected.BlockDeletionMarks = BlockDeletionMarks{{ID: idx.BlockDeletionMarks[0].ID, DeletionTime: 300}}
+
+		require.NoError(t, rewrite(&expected))
+		assert.Equal(t, &expected, read())
+	})
+
+	t.Run("should not write the index if the transform returns nil", func(t *testing.T) {
+		idx, read, rewrite := prepare(t)
+
+		require.NoError(t, rewrite(nil))
+		assert.Equal(t, idx, read())
+	})
+
+	t.Run("should fail if the transform changes anything else than timestamps", func(t *testing.T) {
+		idx, read, rewrite := prepare(t)
+
+		changed := *idx
+		changed.Blocks = Blocks{idx.Blocks[0]}
+
+		require.Equal(t, errRewriteChangedNonTimestamps, rewrite(&changed))
+		assert.Equal(t, idx, read())
+	})
+}
+
+func TestRewriteIndexTimestamps_ShouldFailIfIndexConcurrentlyModified(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = BucketWithGlobalMarkers(bkt)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+
+	idx, _, _, err := NewUpdater(bkt, userID, nil, logger).UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+	// Simulate the index being updated while it's transformed.
+	concurrent := *idx
+	concurrent.UpdatedAt++
+
+	err = RewriteIndexTimestamps(ctx, bkt, userID, nil, logger, func(rewritten *Index) *Index {
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &concurrent))
+
+		rewritten.UpdatedAt = 1000
+		return rewritten
+	})
+	require.Equal(t, ErrIndexConcurrentlyModified, err)
+
+	actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, &concurrent, actual)
+}
+
+func TestRewriteIndexTimestamps_ShouldReturnErrorIfIndexDoesNotExist(t *testing.T) {
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	err := RewriteIndexTimestamps(context.Background(), bkt, "user-1", nil, log.NewNopLogger(), func(idx *Index) *Index {
+		return idx
+	})
+	require.Equal(t, ErrIndexNotFound, err)
+}
+
+func TestUpgradeIndex(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	block3 := cortex_testutil.MockStorageBlock(t, bkt, userID, 30, 40)
+
+	expected, _, _, err := NewUpdater(bkt, userID, nil, logger).UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+
+	// Simulate an index written before the compaction level and chunk format version were tracked.
+	old := *expected
+	old.Blocks = make(Blocks, 0, len(expected.Blocks))
+	for _, b := range expected.Blocks {
+		c := *b
+		if b.ID != block3.ULID {
+			c.CompactionLevel = 0
+			c.ChunkFormatVersion = 0
+		}
+		old.Blocks = append(old.Blocks, &c)
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &old))
+
+	// The meta.json of a block missing the fields is not readable anymore.
+	require.NoError(t, bkt.Delete(ctx, path.Join(userID, block2.ULID.String(), block.MetaFilename)))
+
+	counting := &metaGetsCountingBucket{Bucket: bkt}
+	upgraded, err := UpgradeIndex(ctx, counting, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 1, upgraded)
+
+	// Only the meta.json of the blocks missing the fields are read.
+	assert.Equal(t, int32(2), counting.metaGets.Load())
+
+	actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	// The blocks are listed in the order of their random IDs.
+	for _, id := range []ulid.ULID{block1.ULID, block3.ULID} {
+		assert.Equal(t, findTestBlock(expected.Blocks, id), findTestBlock(actual.Blocks, id))
+	}
+	assert.Equal(t, findTestBlock(old.Blocks, block2.ULID), findTestBlock(actual.Blocks, block2.ULID))
+	assert.Equal(t, 1, findTestBlock(actual.Blocks, block1.ULID).CompactionLevel)
+	assert.Equal(t, 1, findTestBlock(actual.Blocks, block1.ULID).ChunkFormatVersion)
+	assert.Equal(t, expected.UpdatedAt, actual.UpdatedAt)
+
+	// Upgrading the index again is a no-op, except for the block whose meta.json is not readable.
+	counting.metaGets.Store(0)
+	upgraded, err = UpgradeIndex(ctx, counting, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 0, upgraded)
+	assert.Equal(t, int32(1), counting.metaGets.Load())
+
+	unchanged, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, actual, unchanged)
+}
+
+func TestUpgradeIndex_ShouldReturnErrorIfIndexDoesNotExist(t *testing.T) {
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	_, err := UpgradeIndex(context.Background(), bkt, "user-1", nil, log.NewNopLogger())
+	require.Equal(t, ErrIndexNotFound, err)
+}
+
+func findTestBlock(blocks Blocks, id ulid.ULID) *Block {
+	for _, b := range blocks {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// metaGetsCountingBucket counts the reads of the blocks meta.json.
+type metaGetsCountingBucket struct {
+	objstore.Bucket
+
+	metaGets atomic.Int32
+}
+
+func (b *metaGetsCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) == block.MetaFilename {
+		b.metaGets.Inc()
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func cloneBlock(b *Block, uploadedAt int64) *Block {
+	c := *b
+	c.UploadedAt = uploadedAt
+	return &c
+}
@@ -0,0 +1,128 @@
+package bucketindex
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	cortex_errors "github.com/cortexproject/cortex/pkg/util/errors"
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+const (
+	// readerAtBufferSize is the size of the buffer used when sequentially consuming
+	// an object through ranged reads, in order to keep the number of requests low.
+	readerAtBufferSize = 1024 * 1024
+)
+
+var errRangeReadUnsupported = errors.New("ranged reads not supported by the bucket")
+
+// objectReaderAt implements io.ReaderAt on top of the bucket ranged reads.
+type objectReaderAt struct {
+	ctx  context.Context
+	bkt  objstore.BucketReader
+	name string
+	size int64
+}
+
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if off+length > r.size {
+		length = r.size - off
+	}
+
+	n, err = r.readRange(p[:length], off)
+	if err == nil && n < len(p) {
+		// Short reads must return an error to honor the io.ReaderAt contract.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *objectReaderAt) readRange(p []byte, off int64) (n int, err error) {
+	reader, err := r.bkt.GetRange(r.ctx, r.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer runutil.CloseWithErrCapture(&err, reader, "close bucket index ranged reader")
+
+	return io.ReadFull(reader, p)
+}
+
+// NewIndexReaderAt returns a random access reader over the compressed bucket index of the
+// provided user, along with its size in bytes. Reads are served by the bucket ranged reads.
+func NewIndexReaderAt(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider) (io.ReaderAt, int64, error) {
+	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+	expectedBkt := userBkt.WithExpectedErrs(tsdb.IsOneOfTheExpectedErrors(userBkt.IsAccessDeniedErr, userBkt.IsObjNotFoundErr))
+
+	attrs, err := expectedBkt.Attributes(ctx, IndexCompressedFilename)
+	if err != nil {
+		if userBkt.IsObjNotFoundErr(err) {
+			return nil, 0, ErrIndexNotFound
+		}
+
+		if userBkt.IsAccessDeniedErr(err) {
+			return nil, 0, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+		}
+
+		return nil, 0, errors.Wrap(err, "read bucket index attributes")
+	}
+
+	reader := &objectReaderAt{ctx: ctx, bkt: expectedBkt, name: IndexCompressedFilename, size: attrs.Size}
+
+	// Probe the ranged read support, so that callers can fallback to full reads if not supported.
+	if attrs.Size > 0 {
+		if _, err := reader.ReadAt(make([]byte, 1), 0); err != nil && !errors.Is(err, io.EOF) {
+			if userBkt.IsObjNotFoundErr(err) {
+				return nil, 0, ErrIndexNotFound
+			}
+
+			if userBkt.IsAccessDeniedErr(err) {
+				return nil, 0, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+			}
+
+			return nil, 0, errors.Wrap(errRangeReadUnsupported, err.Error())
+		}
+	}
+
+	return reader, attrs.Size, nil
+}
+
+// ReadIndexAt reads, parses and returns a bucket index from the bucket, like ReadIndex, but fetching
+// the index content through ranged reads. It falls back to ReadIndex if the bucket doesn't support
+// ranged reads.
+func ReadIndexAt(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (*Index, error) {
+	readerAt, size, err := NewIndexReaderAt(ctx, bkt, userID, cfgProvider)
+	if errors.Is(err, errRangeReadUnsupported) {
+		level.Debug(logger).Log("msg", "falling back to full read of the bucket index", "user", userID, "err", err)
+		return ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gzipReader, err := gzip.NewReader(bufio.NewReaderSize(io.NewSectionReader(readerAt, 0, size), readerAtBufferSize))
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	index := &Index{}
+	if err := json.NewDecoder(gzipReader).Decode(index); err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	return index, nil
+}
@@ -0,0 +1,81 @@
+package bucketindex
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestReadIndexAt(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	cortex_testutil.MockStorageDeletionMark(t, bkt, userID, cortex_testutil.MockStorageBlock(t, bkt, userID, 30, 40))
+
+	u := NewUpdater(bkt, userID, nil, logger)
+	expectedIdx, _, _, err := u.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, expectedIdx))
+
+	t.Run("should read the index through ranged reads", func(t *testing.T) {
+		actualIdx, err := ReadIndexAt(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, expectedIdx, actualIdx)
+	})
+
+	t.Run("should fallback to full reads if ranged reads are not supported", func(t *testing.T) {
+		actualIdx, err := ReadIndexAt(ctx, &noRangeReadsBucket{Bucket: bkt}, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, expectedIdx, actualIdx)
+	})
+
+	t.Run("should return error if the index does not exist", func(t *testing.T) {
+		idx, err := ReadIndexAt(ctx, bkt, "user-2", nil, logger)
+		require.Equal(t, ErrIndexNotFound, err)
+		require.Nil(t, idx)
+	})
+
+	t.Run("should allow random access to the index", func(t *testing.T) {
+		readerAt, size, err := NewIndexReaderAt(ctx, bkt, userID, nil)
+		require.NoError(t, err)
+
+		full, err := io.ReadAll(io.NewSectionReader(readerAt, 0, size))
+		require.NoError(t, err)
+		require.Len(t, full, int(size))
+
+		part := make([]byte, 10)
+		n, err := readerAt.ReadAt(part, 5)
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+		require.Equal(t, full[5:15], part)
+
+		// Reading past the end returns what's available and io.EOF.
+		n, err = readerAt.ReadAt(part, size-3)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 3, n)
+	})
+}
+
+type noRangeReadsBucket struct {
+	objstore.Bucket
+}
+
+func (b *noRangeReadsBucket) GetRange(_ context.Context, _ string, _, _ int64) (io.ReadCloser, error) {
+	return nil, errors.New("ranged reads not supported")
+}
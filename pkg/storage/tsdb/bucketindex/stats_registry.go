@@ -0,0 +1,43 @@
+package bucketindex
+
+import (
+	"maps"
+	"sync"
+)
+
+// StatsRegistry keeps the stats of the bucket indexes loaded by a process, by tenant, eg. to summarize
+// the tenants of a store-gateway without reading the indexes from the storage again. The stats of a
+// tenant are replaced each time its index is read, and must be removed once the index is not loaded
+// anymore, so that the registry is bounded by the number of loaded tenants.
+type StatsRegistry struct {
+	mtx   sync.RWMutex
+	stats map[string]IndexStats
+}
+
+func NewStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{stats: map[string]IndexStats{}}
+}
+
+// Update replaces the stats of the input tenant with the ones of the input index.
+func (r *StatsRegistry) Update(userID string, idx *Index) {
+	stats := idx.Stats()
+
+	r.mtx.Lock()
+	r.stats[userID] = stats
+	r.mtx.Unlock()
+}
+
+// Remove removes the stats of the input tenant, eg. because its index has been deleted.
+func (r *StatsRegistry) Remove(userID string) {
+	r.mtx.Lock()
+	delete(r.stats, userID)
+	r.mtx.Unlock()
+}
+
+// AllIndexSummaries returns a snapshot of the stats of all the tenants, by tenant.
+func (r *StatsRegistry) AllIndexSummaries() map[string]IndexStats {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return maps.Clone(r.stats)
+}
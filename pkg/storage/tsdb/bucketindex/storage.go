@@ -1,22 +1,30 @@
 package bucketindex
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"path"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid/v2"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/cortexproject/cortex/pkg/storage/tsdb"
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	cortex_errors "github.com/cortexproject/cortex/pkg/util/errors"
+	"github.com/cortexproject/cortex/pkg/util/multierror"
 	"github.com/cortexproject/cortex/pkg/util/runutil"
 )
 
@@ -36,11 +44,50 @@ const (
 	SyncStatusFile = "bucket-index-sync-status.json"
 	// SyncStatusFileVersion is the current supported version of bucket-index-sync-status.json file.
 	SyncStatusFileVersion = 1
+
+	// sharedIndexCallTimeout is the max time of a bucket index update or build shared by concurrent
+	// readers, see doSharedIndexCall.
+	sharedIndexCallTimeout = 5 * time.Minute
+
+	// indexVersionPrefixSize is the size of the prefix of the bucket index JSON content read to find its
+	// format version, which is written first.
+	indexVersionPrefixSize = 64
 )
 
 var (
 	ErrIndexNotFound  = errors.New("bucket index not found")
 	ErrIndexCorrupted = errors.New("bucket index corrupted")
+	ErrIndexThrottled = errors.New("bucket index read throttled by the storage")
+
+	// ErrIndexReadTimeout is returned when reading a bucket index takes longer than the read timeout
+	// of the context, see ContextWithIndexReadTimeout.
+	ErrIndexReadTimeout = errors.New("bucket index read timed out")
+
+	// ErrIndexVersionUnsupported is returned when reading a bucket index written with a format
+	// version newer than the ones supported, eg. by a newer Cortex version during a rolling upgrade.
+	ErrIndexVersionUnsupported = errors.New("bucket index version unsupported")
+
+	// ErrIndexCrossTenantReference is returned when reading a bucket index listing a block whose tenant
+	// external label is another tenant, eg. because the index is corrupted or has been crafted, so that
+	// a tenant can't be served the blocks of another one.
+	ErrIndexCrossTenantReference = errors.New("bucket index references a block of another tenant")
+
+	// ErrIndexBuildTooLarge is returned when building a missing bucket index on the fly is skipped
+	// because the tenant has more blocks than allowed, see ReadOrBuildIndex.
+	ErrIndexBuildTooLarge = errors.New("too many blocks to build the bucket index on the fly")
+
+	// indexDecoders decode the JSON content of a bucket index, by format version.
+	indexDecoders = map[int]func(content []byte) (*Index, error){
+		IndexVersion1: decodeIndexV1,
+	}
+
+	// freshIndexUpdates guards the updates triggered by ReadFreshIndex, so that concurrent
+	// reads of the same stale index trigger a single update. Keyed by sharedIndexCallKey.
+	freshIndexUpdates singleflight.Group
+
+	// indexBuilds guards the builds triggered by ReadOrBuildIndex, so that concurrent reads of
+	// the same missing index trigger a single build. Keyed by sharedIndexCallKey.
+	indexBuilds singleflight.Group
 
 	UnknownStatus = Status{
 		Version:            SyncStatusFileVersion,
@@ -66,74 +113,811 @@ func (s *Status) GetNonQueryableUntil() time.Time {
 	return time.Unix(s.NonQueryableUntil, 0)
 }
 
-// ReadIndex reads, parses and returns a bucket index from the bucket.
-func ReadIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (*Index, error) {
-	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+// BucketReader is the subset of the object storage client required to read the bucket index, so
+// that read-only clients can be used to read it. Any objstore.Bucket satisfies it.
+type BucketReader interface {
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	IsObjNotFoundErr(err error) bool
+	IsAccessDeniedErr(err error) bool
+}
 
-	// Get the bucket index.
-	reader, err := userBkt.WithExpectedErrs(tsdb.IsOneOfTheExpectedErrors(userBkt.IsAccessDeniedErr, userBkt.IsObjNotFoundErr)).Get(ctx, IndexCompressedFilename)
+type indexReadTimeoutCtxKey struct{}
+
+// ContextWithIndexReadTimeout returns a context whose bucket index reads fail with ErrIndexReadTimeout
+// if they take longer than the input timeout, regardless of the context deadline, so that a slow index
+// read can't consume the whole latency budget of a query.
+func ContextWithIndexReadTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, indexReadTimeoutCtxKey{}, timeout)
+}
+
+// indexReadTimeoutFromContext returns the index read timeout of the context, or 0 if there's none.
+func indexReadTimeoutFromContext(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(indexReadTimeoutCtxKey{}).(time.Duration)
+	return timeout
+}
+
+// ReadIndex reads, parses and returns a bucket index from the bucket, folding its delta into it if
+// the index has DeltasEnabled. The tenant config provider is used to read the index from a full bucket,
+// like the other tenant objects, and can be nil.
+// If the context has an index read timeout, the read fails with ErrIndexReadTimeout once exceeded.
+func ReadIndex(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (_ *Index, returnErr error) {
+	if timeout := indexReadTimeoutFromContext(ctx); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, ErrIndexReadTimeout)
+		defer cancel()
+
+		// The read may fail in several ways once the context is done, eg. as a corrupted index if it's
+		// interrupted while reading the content, so the timeout is detected from the context instead.
+		defer func() {
+			if returnErr != nil && errors.Is(context.Cause(ctx), ErrIndexReadTimeout) {
+				returnErr = ErrIndexReadTimeout
+			}
+		}()
+	}
+
+	reader, err := getIndexReader(ctx, bkt, userID, cfgProvider)
 	if err != nil {
-		if userBkt.IsObjNotFoundErr(err) {
-			return nil, ErrIndexNotFound
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
+
+	// Read all the content.
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+	defer runutil.CloseWithLogOnErr(logger, gzipReader, "close bucket index gzip reader")
+
+	// Deserialize it.
+	index, err := decodeIndexFrom(gzipReader)
+	if err != nil {
+		return nil, err
+	}
+	if err := index.checkTenantReferences(userID); err != nil {
+		return nil, err
+	}
+
+	foldIndexDelta(ctx, bkt, userID, index, logger)
+	return index, nil
+}
+
+// ReadFreshIndex reads, parses and returns a bucket index from the bucket like ReadIndex, but if the
+// index has been updated more than maxAge ago it calls updateFn, which is expected to update the
+// index and return the updated one, and returns the updated index instead. Concurrent reads of the
+// same stale index, in the same bucket, share a single call to updateFn: the updateFn of the first
+// read is called, and the ones of the others are ignored, so updateFn must be equivalent across the
+// concurrent reads. The call is not canceled if the read which made it is.
+func ReadFreshIndex(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, maxAge time.Duration, updateFn func(ctx context.Context) (*Index, error)) (*Index, error) {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	age := time.Since(idx.GetUpdatedAt())
+	if age <= maxAge {
+		return idx, nil
+	}
+
+	level.Info(logger).Log("msg", "bucket index is stale, updating it", "user", userID, "age", age, "max_age", maxAge)
+
+	updated, err := doSharedIndexCall(ctx, &freshIndexUpdates, sharedIndexCallKey(bkt, userID), updateFn)
+	if err != nil {
+		return nil, errors.Wrap(err, "update stale bucket index")
+	}
+
+	return updated, nil
+}
+
+// BuildIndexOptions configures the build of a missing bucket index by ReadOrBuildIndex.
+type BuildIndexOptions struct {
+	// MaxBlocks is the max number of blocks of a tenant whose index is built on the fly. Building
+	// the index fetches the meta.json of each block, so it's not done for tenants with more blocks,
+	// which are not expected to be brand new tenants. 0 to disable.
+	MaxBlocks int
+
+	// Persist enables writing the built index to the storage, so that the next reads find it.
+	Persist bool
+}
+
+// ReadOrBuildIndex reads, parses and returns a bucket index from the bucket like ReadIndex, but if
+// the index doesn't exist, eg. because it has not been written yet for a new tenant, it builds the
+// index from the blocks in the storage and returns it instead. Concurrent reads of the same missing
+// index share a single build. ErrIndexBuildTooLarge is returned if the tenant has more blocks than
+// allowed by the options.
+func ReadOrBuildIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, opts BuildIndexOptions) (*Index, error) {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if !errors.Is(err, ErrIndexNotFound) {
+		return idx, err
+	}
+
+	level.Info(logger).Log("msg", "bucket index not found, building it", "user", userID)
+
+	built, err := doSharedIndexCall(ctx, &indexBuilds, sharedIndexCallKey(bkt, userID), func(ctx context.Context) (*Index, error) {
+		return buildIndex(ctx, bkt, userID, cfgProvider, logger, opts)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "build missing bucket index")
+	}
+
+	return built, nil
+}
+
+// sharedIndexCallKey returns the key of the calls shared by the concurrent readers of a tenant's index
+// in the input bucket, so that the readers of the same tenant in different buckets don't share them.
+// The bucket is identified by its name, so that the readers of the same bucket through different
+// wrappers, eg. created for each read, share the calls too. A bucket without name is identified by
+// its address.
+func sharedIndexCallKey(bkt any, userID string) string {
+	if named, ok := bkt.(interface{ Name() string }); ok {
+		return named.Name() + "/" + userID
+	}
+	return fmt.Sprintf("%p/%s", bkt, userID)
+}
+
+// doSharedIndexCall calls fn once for all the concurrent callers with the same key, and returns its
+// result. The call is not bound to the context of the caller which started it, since it's shared with
+// the other callers, but it times out after sharedIndexCallTimeout. A caller whose context is done
+// stops waiting for the call, without canceling it.
+func doSharedIndexCall(ctx context.Context, group *singleflight.Group, key string, fn func(ctx context.Context) (*Index, error)) (*Index, error) {
+	results := group.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedIndexCallTimeout)
+		defer cancel()
+
+		return fn(sharedCtx)
+	})
+
+	select {
+	case res := <-results:
+		if res.Err != nil {
+			return nil, res.Err
 		}
+		return res.Val.(*Index), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-		if userBkt.IsAccessDeniedErr(err) {
-			return nil, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+// buildIndex builds the bucket index of the input tenant from scratch, and writes it to the storage
+// if enabled. A failure to write the index is logged, but doesn't fail the build.
+func buildIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, opts BuildIndexOptions) (*Index, error) {
+	if opts.MaxBlocks > 0 {
+		// Count the blocks before building the index, since listing them is far cheaper than
+		// fetching their meta.json.
+		_, err := countBlocks(ctx, bkt, userID, cfgProvider, opts.MaxBlocks)
+		if errors.Is(err, errMaxBlocksReached) {
+			return nil, ErrIndexBuildTooLarge
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		return nil, errors.Wrap(err, "read bucket index")
+	idx, _, _, err := NewUpdater(bkt, userID, cfgProvider, logger).UpdateIndex(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Persist {
+		if err := WriteIndex(ctx, bkt, userID, cfgProvider, idx); err != nil {
+			level.Warn(logger).Log("msg", "failed to write the bucket index built on the fly", "user", userID, "err", err)
+		}
+	}
+
+	return idx, nil
+}
+
+// ReadIndexWithBuffer reads, parses and returns a bucket index from the bucket like ReadIndex, but
+// decompresses the index into the provided scratch buffer, which is grown only if needed. The buffer
+// (possibly reallocated) is returned, also on error, so that the caller can reuse it for subsequent
+// reads. The returned index doesn't reference the buffer.
+func ReadIndexWithBuffer(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, buf []byte) (*Index, []byte, error) {
+	buf, err := readDecompressedIndex(ctx, bkt, userID, cfgProvider, logger, buf)
+	if err != nil {
+		return nil, buf, err
+	}
+
+	// Deserialize it.
+	index, err := decodeIndex(buf)
+	if err != nil {
+		return nil, buf, err
+	}
+	if err := index.checkTenantReferences(userID); err != nil {
+		return nil, buf, err
+	}
+
+	foldIndexDelta(ctx, bkt, userID, index, logger)
+	return index, buf, nil
+}
+
+// readDecompressedIndex reads and decompresses the bucket index into the provided buffer, which is grown
+// only if needed. The buffer (possibly reallocated) is returned, also on error.
+func readDecompressedIndex(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, buf []byte) ([]byte, error) {
+	reader, err := getIndexReader(ctx, bkt, userID, cfgProvider)
+	if err != nil {
+		return buf, err
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return buf, ErrIndexCorrupted
+	}
+	defer runutil.CloseWithLogOnErr(logger, gzipReader, "close bucket index gzip reader")
+
+	// Read all the content, reusing the buffer capacity.
+	content := bytes.NewBuffer(buf[:0])
+	_, err = content.ReadFrom(gzipReader)
+	buf = content.Bytes()
+	if err != nil {
+		return buf, ErrIndexCorrupted
+	}
+
+	return buf, nil
+}
+
+// ReadIndexRaw reads, parses and returns a bucket index from the bucket like ReadIndex, and also
+// returns the decompressed JSON content as read from the storage, so that the index can be written
+// elsewhere or compared byte by byte without being marshalled again. The content doesn't include the
+// deletion marks of the index delta, which are only added to the parsed index.
+//
+// Holding both the parsed index and its JSON content takes about twice the memory of the parsed
+// index alone, which is significant for tenants with many blocks. Prefer ReadIndex if the raw
+// content isn't needed.
+func ReadIndexRaw(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (*Index, []byte, error) {
+	idx, content, err := ReadIndexWithBuffer(ctx, bkt, userID, cfgProvider, logger, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return idx, content, nil
+}
+
+// StreamIndexTo copies the bucket index stored in the bucket to the writer, either as stored
+// (gzip compressed) if compressed is true, or decompressed on the fly otherwise, eg. to serve it
+// from an HTTP endpoint. The index is neither parsed nor fully loaded in memory, so its content
+// isn't validated: corrupted content is only detected when decompressing it. Part of the content
+// may have been written when an error is returned.
+func StreamIndexTo(ctx context.Context, bkt BucketReader, userID string, w io.Writer, compressed bool, logger log.Logger) error {
+	reader, err := getIndexReader(ctx, bkt, userID, nil)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
+
+	if compressed {
+		_, err = io.Copy(w, reader)
+		return errors.Wrap(err, "stream bucket index")
+	}
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return ErrIndexCorrupted
+	}
+	defer runutil.CloseWithLogOnErr(logger, gzipReader, "close bucket index gzip reader")
+
+	_, err = io.Copy(w, gzipReader)
+	return errors.Wrap(err, "stream bucket index")
+}
+
+// ReadDeletionMarksSince reads the bucket index from the bucket like ReadIndex, and returns the block
+// deletion marks whose deletion time is not before since, so that the marks can be processed
+// incrementally. Deletion times have seconds precision, so the marks within the same second of since
+// are returned too. Marks without deletion time are always returned, since they can't be filtered.
+func ReadDeletionMarksSince(ctx context.Context, bkt BucketReader, userID string, since time.Time, cfgProvider bucket.TenantConfigProvider, logger log.Logger) ([]*BlockDeletionMark, error) {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := make([]*BlockDeletionMark, 0, len(idx.BlockDeletionMarks))
+	for _, m := range idx.BlockDeletionMarks {
+		if m.DeletionTime == 0 || m.DeletionTime >= since.Unix() {
+			marks = append(marks, m)
+		}
+	}
+
+	return marks, nil
+}
+
+// ReadIndexShard reads a bucket index from the bucket like ReadIndex, but returns only the blocks and
+// the deletion marks belonging to the input shard, when the blocks are partitioned in shardCount shards
+// consistently with Index.BlocksForShard. The blocks are filtered while decoding the index, so that the
+// blocks of the other shards are never held in memory, eg. by the replicas of a sharded store-gateway.
+func ReadIndexShard(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, shardID, shardCount int) (*Index, error) {
+	reader, err := getIndexReader(ctx, bkt, userID, cfgProvider)
+	if err != nil {
+		return nil, err
 	}
 	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
 
-	// Read all the content.
 	gzipReader, err := gzip.NewReader(reader)
 	if err != nil {
 		return nil, ErrIndexCorrupted
 	}
 	defer runutil.CloseWithLogOnErr(logger, gzipReader, "close bucket index gzip reader")
 
-	// Deserialize it.
+	index, err := decodeIndexShard(json.NewDecoder(gzipReader), shardID, shardCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := index.checkTenantReferences(userID); err != nil {
+		return nil, err
+	}
+
+	// The marks of the delta are only added for the blocks of the shard, since they're skipped for the
+	// blocks which are not in the index.
+	foldIndexDelta(ctx, bkt, userID, index, logger)
+	return index, nil
+}
+
+// ReadIndexRedacted reads a bucket index from the bucket like ReadIndex, and then replaces the external
+// labels of each block with the ones returned by redactFn, eg. to strip the labels identifying the tenant
+// before sharing the index for debugging. The redaction is only applied to the returned index, the index
+// stored in the bucket is never modified. The tenant references are checked before the redaction.
+func ReadIndexRedacted(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, redactFn func(labels.Labels) labels.Labels) (*Index, error) {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range idx.Blocks {
+		redacted := redactFn(labels.FromMap(b.Labels))
+		if redacted.IsEmpty() {
+			b.Labels = nil
+			continue
+		}
+		b.Labels = redacted.Map()
+	}
+
+	return idx, nil
+}
+
+// ReadIndexBestEffort reads a bucket index from the bucket like ReadIndex, but if the index is truncated
+// (eg. written by an interrupted updater) it salvages the complete blocks and deletion marks preceding
+// the truncation point instead of returning ErrIndexCorrupted. The returned partial flag is true if
+// the index has been salvaged.
+//
+// A salvaged index is lossy: it may miss any number of blocks and deletion marks. It's a recovery aid
+// and must never be used to take decisions based on the absence of blocks or marks.
+func ReadIndexBestEffort(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) (_ *Index, partial bool, _ error) {
+	reader, err := getIndexReader(ctx, bkt, userID, cfgProvider)
+	if err != nil {
+		return nil, false, err
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index reader")
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, false, ErrIndexCorrupted
+	}
+	defer runutil.CloseWithLogOnErr(logger, gzipReader, "close bucket index gzip reader")
+
+	// A truncated gzip stream returns an error, but the content decompressed so far is still returned.
+	content, readErr := io.ReadAll(gzipReader)
+
+	// The version is written first, so it's known even if the index is truncated.
+	if version, err := readIndexVersion(content); err == nil {
+		if err := checkIndexVersion(version); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if readErr == nil {
+		if index, err := decodeIndex(content); err == nil {
+			foldIndexDelta(ctx, bkt, userID, index, logger)
+			return index, false, nil
+		}
+	}
+
+	index, ok := salvageIndex(content)
+	if !ok {
+		return nil, false, ErrIndexCorrupted
+	}
+	foldIndexDelta(ctx, bkt, userID, index, logger)
+
+	level.Warn(logger).Log("msg", "bucket index is truncated, salvaged a partial and lossy bucket index", "user", userID, "blocks", len(index.Blocks), "block_deletion_marks", len(index.BlockDeletionMarks))
+	return index, true, nil
+}
+
+// salvageIndex decodes the complete blocks and deletion marks of a truncated JSON bucket index.
+// It returns false if not even the beginning of the index can be decoded.
+func salvageIndex(content []byte) (*Index, bool) {
+	d := json.NewDecoder(bytes.NewReader(content))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+
+	index := &Index{}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "blocks":
+			err = decodeArray(d, func() error {
+				b := &Block{}
+				if err := d.Decode(b); err != nil {
+					return err
+				}
+				index.Blocks = append(index.Blocks, b)
+				return nil
+			})
+		case "block_deletion_marks":
+			err = decodeArray(d, func() error {
+				m := &BlockDeletionMark{}
+				if err := d.Decode(m); err != nil {
+					return err
+				}
+				index.BlockDeletionMarks = append(index.BlockDeletionMarks, m)
+				return nil
+			})
+		case "version":
+			err = d.Decode(&index.Version)
+		case "updated_at":
+			err = d.Decode(&index.UpdatedAt)
+		default:
+			err = d.Decode(&json.RawMessage{})
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return index, true
+}
+
+// decodeArray consumes a JSON array calling decodeItem for each item, until the end of the array
+// or the first error.
+func decodeArray(d *json.Decoder, decodeItem func() error) error {
+	if tok, err := d.Token(); err != nil {
+		return err
+	} else if tok == nil {
+		// A null array.
+		return nil
+	} else if tok != json.Delim('[') {
+		return errors.Errorf("unexpected token %v, expected array", tok)
+	}
+
+	for d.More() {
+		if err := decodeItem(); err != nil {
+			return err
+		}
+	}
+
+	_, err := d.Token()
+	return err
+}
+
+// decodeIndexShard decodes a JSON bucket index, keeping only the blocks and deletion marks of the
+// input shard. The other fields are decoded like decodeIndexV1.
+func decodeIndexShard(d *json.Decoder, shardID, shardCount int) (*Index, error) {
+	inShard := func(id ulid.ULID) bool {
+		return shardCount <= 1 || blockShard(id, shardCount) == shardID
+	}
+
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return nil, ErrIndexCorrupted
+	}
+
 	index := &Index{}
-	d := json.NewDecoder(gzipReader)
-	if err := d.Decode(index); err != nil {
+	others := map[string]json.RawMessage{}
+
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, ErrIndexCorrupted
+		}
+
+		switch key, _ := tok.(string); key {
+		case "version":
+			// The version is written first, so the blocks are never decoded with the wrong format.
+			if err := d.Decode(&index.Version); err != nil {
+				return nil, ErrIndexCorrupted
+			}
+			if err := checkIndexVersion(index.Version); err != nil {
+				return nil, err
+			}
+		case "blocks":
+			err = decodeArray(d, func() error {
+				b := &Block{}
+				if err := d.Decode(b); err != nil {
+					return err
+				}
+				if inShard(b.ID) {
+					index.Blocks = append(index.Blocks, b)
+				}
+				return nil
+			})
+		case "block_deletion_marks":
+			err = decodeArray(d, func() error {
+				m := &BlockDeletionMark{}
+				if err := d.Decode(m); err != nil {
+					return err
+				}
+				if inShard(m.ID) {
+					index.BlockDeletionMarks = append(index.BlockDeletionMarks, m)
+				}
+				return nil
+			})
+		default:
+			var value json.RawMessage
+			err = d.Decode(&value)
+			others[key] = value
+		}
+
+		if err != nil {
+			return nil, ErrIndexCorrupted
+		}
+	}
+
+	if _, err := d.Token(); err != nil {
+		return nil, ErrIndexCorrupted
+	}
+
+	// The other fields are small, so they're decoded at once to not miss any of them.
+	content, err := json.Marshal(others)
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+	if err := json.Unmarshal(content, index); err != nil {
 		return nil, ErrIndexCorrupted
 	}
 
 	return index, nil
 }
 
-// WriteIndex uploads the provided index to the storage.
+// getIndexReader returns a reader of the compressed bucket index of the input user. A full bucket is
+// wrapped in the user bucket client built with the input tenant config provider, like for the other
+// tenant objects, while a read-only bucket reader is only given the tenant prefix.
+func getIndexReader(ctx context.Context, bkt BucketReader, userID string, cfgProvider bucket.TenantConfigProvider) (io.ReadCloser, error) {
+	name := path.Join(userID, IndexCompressedFilename)
+	if b, ok := bkt.(objstore.Bucket); ok {
+		bkt, name = bucket.NewUserBucketClient(userID, b, cfgProvider), IndexCompressedFilename
+	}
+
+	var getter BucketReader = bkt
+	if ib, ok := bkt.(objstore.InstrumentedBucketReader); ok {
+		getter = ib.ReaderWithExpectedErrs(tsdb.IsOneOfTheExpectedErrors(bkt.IsAccessDeniedErr, bkt.IsObjNotFoundErr))
+	}
+
+	// Get the bucket index.
+	reader, err := getter.Get(ctx, name)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrIndexNotFound
+		}
+
+		if bkt.IsAccessDeniedErr(err) {
+			return nil, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+		}
+
+		if bucket.IsThrottledErr(err) {
+			return nil, cortex_errors.WithCause(ErrIndexThrottled, err)
+		}
+
+		return nil, errors.Wrap(err, "read bucket index")
+	}
+
+	if accountant := bytesAccountantFromContext(ctx); accountant != nil {
+		reader = &accountingReader{ReadCloser: reader, accountant: accountant, userID: userID}
+	}
+
+	return reader, nil
+}
+
+// WriteIndex uploads the provided index to the storage, compressed with the level chosen by
+// the default compression config.
 func WriteIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, idx *Index) error {
-	bkt = bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+	return WriteIndexWithCompression(ctx, bkt, userID, cfgProvider, idx, DefaultCompressionConfig())
+}
 
+// WriteIndexWithCompression uploads the provided index to the storage, compressed with the level
+// chosen by the provided compression config based on the index size.
+func WriteIndexWithCompression(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, idx *Index, compression CompressionConfig) error {
+	content, err := encodeIndex(idx, compression)
+	if err != nil {
+		return err
+	}
+
+	return uploadIndex(ctx, bkt, userID, cfgProvider, content)
+}
+
+// WriteIndexMultiOptions configures WriteIndexMulti.
+type WriteIndexMultiOptions struct {
+	// Strict makes the write fail if the index can't be written to any of the secondary buckets.
+	// If false, secondary failures are only logged and counted.
+	Strict bool
+
+	// SecondaryFailures is an optional counter incremented for each failed write to a secondary bucket.
+	SecondaryFailures prometheus.Counter
+
+	// Compression configures the compression level of the index. The zero value compresses
+	// any index with the default level.
+	Compression CompressionConfig
+
+	Logger log.Logger
+}
+
+// WriteIndexMulti uploads the provided index to multiple buckets, eg. to mirror it to a secondary region.
+// The first bucket is the primary one: the write fails if the index can't be written to it, in which
+// case secondary buckets are not written.
+func WriteIndexMulti(ctx context.Context, buckets []objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, idx *Index, opts WriteIndexMultiOptions) error {
+	if len(buckets) == 0 {
+		return errors.New("no bucket to write the bucket index to")
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	content, err := encodeIndex(idx, opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := uploadIndex(ctx, buckets[0], userID, cfgProvider, content); err != nil {
+		return err
+	}
+
+	errs := multierror.New()
+	for i, bkt := range buckets[1:] {
+		if err := uploadIndex(ctx, bkt, userID, cfgProvider, content); err != nil {
+			level.Warn(logger).Log("msg", "failed to write bucket index to secondary bucket", "user", userID, "bucket", i+1, "err", err)
+			if opts.SecondaryFailures != nil {
+				opts.SecondaryFailures.Inc()
+			}
+			errs.Add(errors.Wrapf(err, "secondary bucket %d", i+1))
+		}
+	}
+
+	if opts.Strict {
+		return errs.Err()
+	}
+	return nil
+}
+
+// decodeIndex parses the input JSON content of a bucket index, with the decoder of its format version.
+func decodeIndex(content []byte) (*Index, error) {
+	version, err := readIndexVersion(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIndexVersion(version); err != nil {
+		return nil, err
+	}
+
+	// Indexes without a version are decoded as the first version.
+	return indexDecoders[max(version, IndexVersion1)](content)
+}
+
+// decodeIndexFrom parses the JSON content of a bucket index read from the input reader, like decodeIndex.
+// The indexes of the first format version are decoded while reading them, so that the whole JSON content
+// isn't held in memory along with the parsed index. The content of the other versions, and of the indexes
+// whose version isn't written first, is read in full to be decoded.
+func decodeIndexFrom(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+
+	// A shorter prefix is returned along with an error if the content is shorter, or can't be read.
+	prefix, _ := br.Peek(indexVersionPrefixSize)
+	if version, ok := peekIndexVersion(prefix); ok && version <= IndexVersion1 {
+		index := &Index{}
+		if err := json.NewDecoder(br).Decode(index); err != nil {
+			return nil, ErrIndexCorrupted
+		}
+		return index, nil
+	}
+
+	content, err := io.ReadAll(br)
+	if err != nil {
+		return nil, ErrIndexCorrupted
+	}
+	return decodeIndex(content)
+}
+
+// checkIndexVersion returns ErrIndexVersionUnsupported if there's no decoder for the input version.
+func checkIndexVersion(version int) error {
+	if _, ok := indexDecoders[version]; !ok && version > IndexVersion1 {
+		return errors.Wrapf(ErrIndexVersionUnsupported, "version %d", version)
+	}
+	return nil
+}
+
+// readIndexVersion returns the format version of the input JSON content of a bucket index. The version
+// is written first, so it's read without parsing the whole index unless it's been written elsewhere.
+func readIndexVersion(content []byte) (int, error) {
+	if version, ok := peekIndexVersion(content); ok {
+		return version, nil
+	}
+
+	header := struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.Unmarshal(content, &header); err != nil {
+		return 0, ErrIndexCorrupted
+	}
+	return header.Version, nil
+}
+
+// peekIndexVersion returns the format version of a bucket index from the input prefix of its JSON content,
+// and false if the prefix doesn't start with the whole version.
+func peekIndexVersion(prefix []byte) (int, bool) {
+	d := json.NewDecoder(bytes.NewReader(prefix))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return 0, false
+	}
+	if tok, err := d.Token(); err != nil || tok != "version" {
+		return 0, false
+	}
+
+	var version int
+	if err := d.Decode(&version); err != nil {
+		return 0, false
+	}
+
+	// The version number could have been truncated if it ends the prefix.
+	if d.InputOffset() >= int64(len(prefix)) {
+		return 0, false
+	}
+	return version, true
+}
+
+func decodeIndexV1(content []byte) (*Index, error) {
+	index := &Index{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, ErrIndexCorrupted
+	}
+	return index, nil
+}
+
+// encodeIndex marshals and compresses the provided index, with the level chosen by the
+// compression config based on the index size.
+func encodeIndex(idx *Index, compression CompressionConfig) ([]byte, error) {
 	// Marshal the index.
 	content, err := json.Marshal(idx)
 	if err != nil {
-		return errors.Wrap(err, "marshal bucket index")
+		return nil, errors.Wrap(err, "marshal bucket index")
 	}
 
 	// Compress it.
 	var gzipContent bytes.Buffer
-	gzip := gzip.NewWriter(&gzipContent)
+	gzip, err := gzip.NewWriterLevel(&gzipContent, compression.level(len(content)))
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip bucket index writer")
+	}
 	gzip.Name = IndexFilename
 
 	if _, err := gzip.Write(content); err != nil {
-		return errors.Wrap(err, "gzip bucket index")
+		return nil, errors.Wrap(err, "gzip bucket index")
 	}
 	if err := gzip.Close(); err != nil {
-		return errors.Wrap(err, "close gzip bucket index")
+		return nil, errors.Wrap(err, "close gzip bucket index")
 	}
 
+	return gzipContent.Bytes(), nil
+}
+
+func uploadIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, content []byte) error {
 	// Upload the index to the storage.
-	if err := bkt.Upload(ctx, IndexCompressedFilename, bytes.NewReader(gzipContent.Bytes())); err != nil {
+	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+	if err := userBkt.Upload(ctx, IndexCompressedFilename, bytes.NewReader(content)); err != nil {
 		return errors.Wrap(err, "upload bucket index")
 	}
 
+	// The content is reported once it's been uploaded, whatever the number of attempts done by the client.
+	if accountant := bytesAccountantFromContext(ctx); accountant != nil {
+		accountant.AddIndexBytes(userID, BytesOpWrite, int64(len(content)))
+	}
+
 	return nil
 }
 
-// DeleteIndex deletes the bucket index from the storage. No error is returned if the index
-// does not exist.
+// DeleteIndex deletes the bucket index and its summary and delta, if any, from the storage. No error is
+// returned if the index does not exist.
 func DeleteIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider) error {
 	bkt = bucket.NewUserBucketClient(userID, bkt, cfgProvider)
 
@@ -141,6 +925,17 @@ func DeleteIndex(ctx context.Context, bkt objstore.Bucket, userID string, cfgPro
 	if err != nil && !bkt.IsObjNotFoundErr(err) {
 		return errors.Wrap(err, "delete bucket index")
 	}
+
+	// The summary and delta are deleted after the index, so that they can't outlive the index if the
+	// deletion fails.
+	err = bkt.Delete(ctx, IndexSummaryFilename)
+	if err != nil && !bkt.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete bucket index summary")
+	}
+	err = bkt.Delete(ctx, IndexDeltaFilename)
+	if err != nil && !bkt.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete bucket index delta")
+	}
 	return nil
 }
 
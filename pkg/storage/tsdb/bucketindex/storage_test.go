@@ -1,19 +1,41 @@
 package bucketindex
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/minio/minio-go/v7"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/bucket/filesystem"
 	"github.com/cortexproject/cortex/pkg/storage/bucket/s3"
+	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/util/flagext"
 
 	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
 )
@@ -53,6 +75,71 @@ func TestReadIndex_ShouldReturnErrorIfKeyAccessDeniedErr(t *testing.T) {
 	require.Nil(t, idx)
 }
 
+func TestReadIndex_ShouldReturnErrorIfThrottled(t *testing.T) {
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt = &cortex_testutil.MockBucketFailure{
+		Bucket: bkt,
+		GetFailures: map[string]error{
+			path.Join("user-1", "bucket-index.json.gz"): minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable},
+		},
+	}
+	idx, err := ReadIndex(context.Background(), bkt, "user-1", nil, log.NewNopLogger())
+	require.True(t, errors.Is(err, ErrIndexThrottled))
+	require.Nil(t, idx)
+}
+
+func TestReadIndex_ShouldReturnErrorIfReadTimeoutExceeded(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+
+	u := NewUpdater(bkt, userID, nil, logger)
+	expectedIdx, _, _, err := u.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, expectedIdx))
+
+	t.Run("slow get", func(t *testing.T) {
+		slowBkt := &slowGetBucket{Bucket: bkt, getDelay: time.Second}
+
+		idx, err := ReadIndex(ContextWithIndexReadTimeout(ctx, 50*time.Millisecond), slowBkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexReadTimeout)
+		require.Nil(t, idx)
+	})
+
+	t.Run("slow content read", func(t *testing.T) {
+		slowBkt := &slowGetBucket{Bucket: bkt, readDelay: time.Second}
+
+		// The interrupted read of the content should not be reported as a corrupted index.
+		idx, err := ReadIndex(ContextWithIndexReadTimeout(ctx, 50*time.Millisecond), slowBkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexReadTimeout)
+		require.NotErrorIs(t, err, ErrIndexCorrupted)
+		require.Nil(t, idx)
+	})
+
+	t.Run("read completed within the timeout", func(t *testing.T) {
+		slowBkt := &slowGetBucket{Bucket: bkt, getDelay: 10 * time.Millisecond}
+
+		idx, err := ReadIndex(ContextWithIndexReadTimeout(ctx, time.Minute), slowBkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, expectedIdx, idx)
+	})
+
+	t.Run("request context canceled before the timeout", func(t *testing.T) {
+		slowBkt := &slowGetBucket{Bucket: bkt, getDelay: time.Second}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := ReadIndex(ContextWithIndexReadTimeout(reqCtx, time.Minute), slowBkt, userID, nil, logger)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, ErrIndexReadTimeout)
+	})
+}
+
 func TestReadIndex_ShouldReturnTheParsedIndexOnSuccess(t *testing.T) {
 	const userID = "user-1"
 
@@ -79,6 +166,917 @@ func TestReadIndex_ShouldReturnTheParsedIndexOnSuccess(t *testing.T) {
 	assert.Equal(t, expectedIdx, actualIdx)
 }
 
+func TestReadIndex_ShouldRejectCrossTenantReferences(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// The index lists a block of another tenant.
+	ownBlock := &Block{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, Labels: map[string]string{cortex_tsdb.TenantIDExternalLabel: userID}}
+	otherBlock := &Block{ID: ulid.MustNew(2, nil), MinTime: 20, MaxTime: 30, Labels: map[string]string{cortex_tsdb.TenantIDExternalLabel: "user-2"}}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, Blocks: Blocks{ownBlock, otherBlock}}))
+
+	_, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.ErrorIs(t, err, ErrIndexCrossTenantReference)
+
+	_, _, err = ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, nil)
+	require.ErrorIs(t, err, ErrIndexCrossTenantReference)
+
+	it, err := NewIndexIterator(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	defer it.Close()
+
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), ErrIndexCrossTenantReference)
+
+	// Blocks without the tenant label are considered the tenant's.
+	unlabeledBlock := &Block{ID: ulid.MustNew(3, nil), MinTime: 30, MaxTime: 40}
+	expected := &Index{Version: IndexVersion1, Blocks: Blocks{ownBlock, unlabeledBlock}}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, expected))
+
+	actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestReadIndex_ShouldAcceptBucketReader(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	expectedIdx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+	content, err := encodeIndex(expectedIdx, DefaultCompressionConfig())
+	require.NoError(t, err)
+
+	reader := &mockBucketReader{objects: map[string][]byte{
+		path.Join(userID, IndexCompressedFilename): content,
+	}}
+
+	actualIdx, err := ReadIndex(ctx, reader, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, expectedIdx, actualIdx)
+
+	_, err = ReadIndex(ctx, reader, "user-2", nil, logger)
+	require.Equal(t, ErrIndexNotFound, err)
+}
+
+func TestReadFreshIndex(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	prepare := func(t *testing.T, updatedAt time.Time) objstore.Bucket {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, UpdatedAt: updatedAt.Unix()}))
+		return bkt
+	}
+
+	t.Run("should return the index without updating it if fresh", func(t *testing.T) {
+		bkt := prepare(t, time.Now())
+
+		idx, err := ReadFreshIndex(ctx, bkt, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+			t.Fatal("the update function should not be called")
+			return nil, nil
+		})
+		require.NoError(t, err)
+		assert.InDelta(t, time.Now().Unix(), idx.UpdatedAt, 2)
+	})
+
+	t.Run("should return the updated index if stale", func(t *testing.T) {
+		bkt := prepare(t, time.Now().Add(-2*time.Hour))
+		updated := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+
+		idx, err := ReadFreshIndex(ctx, bkt, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+			return updated, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, updated, idx)
+	})
+
+	t.Run("should return error if the update of a stale index fails", func(t *testing.T) {
+		bkt := prepare(t, time.Now().Add(-2*time.Hour))
+		updateErr := errors.New("update failed")
+
+		_, err := ReadFreshIndex(ctx, bkt, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+			return nil, updateErr
+		})
+		require.ErrorIs(t, err, updateErr)
+	})
+
+	t.Run("should update a stale index once on concurrent reads", func(t *testing.T) {
+		const numReaders = 10
+
+		bkt := prepare(t, time.Now().Add(-2*time.Hour))
+		updated := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+
+		var (
+			updates atomic.Int32
+			readers sync.WaitGroup
+			started = make(chan struct{})
+			unblock = make(chan struct{})
+		)
+
+		readers.Add(numReaders)
+		for i := 0; i < numReaders; i++ {
+			go func() {
+				defer readers.Done()
+
+				idx, err := ReadFreshIndex(ctx, bkt, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+					if updates.Inc() == 1 {
+						close(started)
+					}
+					<-unblock
+					return updated, nil
+				})
+				assert.NoError(t, err)
+				assert.Equal(t, updated, idx)
+			}()
+		}
+
+		// Give all the readers the time to wait for the in-flight update.
+		<-started
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+		readers.Wait()
+
+		assert.Equal(t, int32(1), updates.Load())
+	})
+
+	t.Run("should update a stale index once on concurrent reads through different wrappers of the same bucket", func(t *testing.T) {
+		const numReaders = 10
+
+		bkt := prepare(t, time.Now().Add(-2*time.Hour))
+		updated := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+
+		var (
+			updates atomic.Int32
+			readers sync.WaitGroup
+			started = make(chan struct{})
+			unblock = make(chan struct{})
+		)
+
+		readers.Add(numReaders)
+		for i := 0; i < numReaders; i++ {
+			go func() {
+				defer readers.Done()
+
+				// Each reader gets its own wrapper, like when it's created for each read.
+				idx, err := ReadFreshIndex(ctx, objstore.WrapWithMetrics(bkt, nil, "test"), userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+					if updates.Inc() == 1 {
+						close(started)
+					}
+					<-unblock
+					return updated, nil
+				})
+				assert.NoError(t, err)
+				assert.Equal(t, updated, idx)
+			}()
+		}
+
+		// Give all the readers the time to wait for the in-flight update.
+		<-started
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+		readers.Wait()
+
+		assert.Equal(t, int32(1), updates.Load())
+	})
+
+	t.Run("should not share the update of the same tenant's index in different buckets", func(t *testing.T) {
+		bkt1 := prepare(t, time.Now().Add(-2*time.Hour))
+		bkt2 := prepare(t, time.Now().Add(-2*time.Hour))
+
+		var (
+			started = make(chan struct{})
+			unblock = make(chan struct{})
+			done    = make(chan struct{})
+		)
+		go func() {
+			defer close(done)
+			_, err := ReadFreshIndex(ctx, bkt1, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+				close(started)
+				<-unblock
+				return &Index{Version: IndexVersion1}, nil
+			})
+			assert.NoError(t, err)
+		}()
+		<-started
+
+		// The update of the other bucket is not waiting for the in-flight one.
+		updated := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+		idx, err := ReadFreshIndex(ctx, bkt2, userID, nil, logger, time.Hour, func(context.Context) (*Index, error) {
+			return updated, nil
+		})
+		require.NoError(t, err)
+		assert.Same(t, updated, idx)
+
+		close(unblock)
+		<-done
+	})
+}
+
+func TestReadOrBuildIndex(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	prepare := func(t *testing.T) objstore.Bucket {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+		cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+		return bkt
+	}
+
+	t.Run("should return the index without building it if it exists", func(t *testing.T) {
+		bkt := prepare(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, UpdatedAt: 1000}))
+
+		idx, err := ReadOrBuildIndex(ctx, bkt, userID, nil, logger, BuildIndexOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1000), idx.UpdatedAt)
+		assert.Empty(t, idx.Blocks)
+	})
+
+	t.Run("should build the index from the blocks in the storage if not found", func(t *testing.T) {
+		bkt := prepare(t)
+
+		idx, err := ReadOrBuildIndex(ctx, bkt, userID, nil, logger, BuildIndexOptions{MaxBlocks: 2})
+		require.NoError(t, err)
+		assert.Len(t, idx.Blocks, 2)
+
+		// The built index should not have been written.
+		_, err = ReadIndex(ctx, bkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexNotFound)
+	})
+
+	t.Run("should write the built index if enabled", func(t *testing.T) {
+		bkt := prepare(t)
+
+		idx, err := ReadOrBuildIndex(ctx, bkt, userID, nil, logger, BuildIndexOptions{Persist: true})
+		require.NoError(t, err)
+
+		written, err := ReadIndex(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, idx, written)
+	})
+
+	t.Run("should not build the index if the tenant has too many blocks", func(t *testing.T) {
+		bkt := prepare(t)
+
+		_, err := ReadOrBuildIndex(ctx, bkt, userID, nil, logger, BuildIndexOptions{MaxBlocks: 1})
+		require.ErrorIs(t, err, ErrIndexBuildTooLarge)
+	})
+
+	t.Run("should build a missing index once on concurrent reads through different wrappers of the same bucket", func(t *testing.T) {
+		const numReaders = 10
+
+		bkt := &blockingTenantIterBucket{Bucket: prepare(t), userID: userID, started: make(chan struct{}), unblock: make(chan struct{})}
+
+		readers := sync.WaitGroup{}
+		readers.Add(numReaders)
+		for i := 0; i < numReaders; i++ {
+			go func() {
+				defer readers.Done()
+
+				// Each reader gets its own wrapper, like when it's created for each read.
+				idx, err := ReadOrBuildIndex(ctx, objstore.WrapWithMetrics(bkt, nil, "test"), userID, nil, logger, BuildIndexOptions{})
+				assert.NoError(t, err)
+				assert.Len(t, idx.Blocks, 2)
+			}()
+		}
+
+		// Give all the readers the time to wait for the in-flight build.
+		<-bkt.started
+		time.Sleep(100 * time.Millisecond)
+		close(bkt.unblock)
+		readers.Wait()
+
+		// The tenant blocks are listed once per build.
+		assert.Equal(t, int32(1), bkt.tenantIters.Load())
+	})
+}
+
+// blockingTenantIterBucket blocks the listings of the tenant directory until unblock is closed,
+// and counts them.
+type blockingTenantIterBucket struct {
+	objstore.Bucket
+
+	userID      string
+	tenantIters atomic.Int32
+	started     chan struct{}
+	unblock     chan struct{}
+}
+
+func (b *blockingTenantIterBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	if strings.TrimSuffix(dir, "/") == b.userID {
+		if b.tenantIters.Inc() == 1 {
+			close(b.started)
+		}
+		<-b.unblock
+	}
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+func TestSharedIndexCallKey(t *testing.T) {
+	bkt1, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	bkt2, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	assert.Equal(t, sharedIndexCallKey(bkt1, "user-1"), sharedIndexCallKey(bkt1, "user-1"))
+	assert.NotEqual(t, sharedIndexCallKey(bkt1, "user-1"), sharedIndexCallKey(bkt1, "user-2"))
+	assert.NotEqual(t, sharedIndexCallKey(bkt1, "user-1"), sharedIndexCallKey(bkt2, "user-1"))
+
+	// Different wrappers of the same bucket share the calls.
+	assert.Equal(t, sharedIndexCallKey(objstore.WrapWithMetrics(bkt1, nil, "test"), "user-1"), sharedIndexCallKey(objstore.WrapWithMetrics(bkt1, nil, "test"), "user-1"))
+}
+
+func TestDoSharedIndexCall_ShouldNotFailTheWaitersIfTheCallerWhichStartedItIsCanceled(t *testing.T) {
+	var (
+		group    singleflight.Group
+		calls    atomic.Int32
+		expected = &Index{Version: IndexVersion1}
+		started  = make(chan struct{})
+		unblock  = make(chan struct{})
+	)
+
+	call := func(ctx context.Context) (*Index, error) {
+		if calls.Inc() == 1 {
+			close(started)
+		}
+		<-unblock
+		return expected, ctx.Err()
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := doSharedIndexCall(leaderCtx, &group, "key", call)
+		leaderErr <- err
+	}()
+	<-started
+
+	var (
+		waiterIdx *Index
+		waiterErr error
+		waiter    sync.WaitGroup
+	)
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		waiterIdx, waiterErr = doSharedIndexCall(context.Background(), &group, "key", call)
+	}()
+
+	// The caller which started the call stops waiting for it once canceled.
+	cancelLeader()
+	require.ErrorIs(t, <-leaderErr, context.Canceled)
+
+	// Give the waiter the time to wait for the in-flight call.
+	time.Sleep(100 * time.Millisecond)
+	close(unblock)
+	waiter.Wait()
+
+	require.NoError(t, waiterErr)
+	assert.Same(t, expected, waiterIdx)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestReadIndexWithBuffer(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	cortex_testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	cortex_testutil.MockStorageDeletionMark(t, bkt, userID, cortex_testutil.MockStorageBlock(t, bkt, userID, 20, 30))
+
+	// The buffer is returned on error too.
+	buf := make([]byte, 0, 16)
+	idx, buf, err := ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, buf)
+	require.Equal(t, ErrIndexNotFound, err)
+	require.Nil(t, idx)
+	require.Equal(t, 16, cap(buf))
+
+	// Write the index.
+	u := NewUpdater(bkt, userID, nil, logger)
+	expectedIdx, _, _, err := u.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, expectedIdx))
+
+	// The buffer is grown to fit the index.
+	actualIdx, buf, err := ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, buf)
+	require.NoError(t, err)
+	assert.Equal(t, expectedIdx, actualIdx)
+	require.Greater(t, cap(buf), 16)
+
+	// The buffer is reused, and the previously read index doesn't reference it.
+	capacity := cap(buf)
+	actualIdx, buf, err = ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, buf)
+	require.NoError(t, err)
+	assert.Equal(t, expectedIdx, actualIdx)
+	require.Equal(t, capacity, cap(buf))
+
+	// A nil buffer is allowed.
+	actualIdx, _, err = ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, nil)
+	require.NoError(t, err)
+	assert.Equal(t, expectedIdx, actualIdx)
+}
+
+func TestReadDeletionMarksSince(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+	block4 := ulid.MustNew(4, nil)
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{
+		Version: IndexVersion1,
+		Blocks:  Blocks{{ID: block1}, {ID: block2}, {ID: block3}, {ID: block4}},
+		BlockDeletionMarks: BlockDeletionMarks{
+			{ID: block1, DeletionTime: 99},
+			{ID: block2, DeletionTime: 100},
+			{ID: block3, DeletionTime: 101},
+			{ID: block4},
+		},
+		UpdatedAt: time.Now().Unix(),
+	}))
+
+	tests := map[string]struct {
+		since    time.Time
+		expected []ulid.ULID
+	}{
+		"should return all the marks since the beginning of time": {
+			since:    time.Unix(0, 0),
+			expected: []ulid.ULID{block1, block2, block3, block4},
+		},
+		"should include the marks deleted exactly at since": {
+			since:    time.Unix(100, 0),
+			expected: []ulid.ULID{block2, block3, block4},
+		},
+		"should include the marks deleted within the same second of since": {
+			since:    time.Unix(100, int64(500*time.Millisecond)),
+			expected: []ulid.ULID{block2, block3, block4},
+		},
+		"should only return the marks without deletion time once all the marks are older": {
+			since:    time.Unix(102, 0),
+			expected: []ulid.ULID{block4},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			marks, err := ReadDeletionMarksSince(ctx, bkt, userID, testData.since, nil, logger)
+			require.NoError(t, err)
+			assert.Equal(t, testData.expected, BlockDeletionMarks(marks).GetULIDs())
+		})
+	}
+
+	t.Run("should return error if the index doesn't exist", func(t *testing.T) {
+		_, err := ReadDeletionMarksSince(ctx, bkt, "user-2", time.Unix(0, 0), nil, logger)
+		require.Equal(t, ErrIndexNotFound, err)
+	})
+}
+
+func TestReadIndexRaw(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	t.Run("should return the index and its content as stored", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+		// The content is not formatted like the marshalled index.
+		id := ulid.MustNew(1, nil)
+		expectedContent := []byte(`{
+  "version": 1,
+  "blocks": [{"block_id": "` + id.String() + `", "min_time": 10, "max_time": 20}],
+  "updated_at": 100
+}`)
+		uploadIndexContent(t, bkt, userID, string(expectedContent))
+
+		idx, content, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, expectedContent, content)
+		assert.Equal(t, &Index{Version: IndexVersion1, Blocks: Blocks{{ID: id, MinTime: 10, MaxTime: 20}}, UpdatedAt: 100}, idx)
+	})
+
+	t.Run("should return error if the index is corrupted", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), strings.NewReader("invalid!}")))
+
+		idx, content, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+		require.Equal(t, ErrIndexCorrupted, err)
+		assert.Nil(t, idx)
+		assert.Nil(t, content)
+	})
+
+	t.Run("should return error if the index doesn't exist", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+		_, _, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+		require.Equal(t, ErrIndexNotFound, err)
+	})
+}
+
+func TestStreamIndexTo(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	idx := &Index{
+		Version:            IndexVersion1,
+		Blocks:             Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: ulid.MustNew(1, nil), DeletionTime: 30}},
+		UpdatedAt:          time.Now().Unix(),
+	}
+
+	t.Run("should stream the compressed index", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		var buf bytes.Buffer
+		require.NoError(t, StreamIndexTo(ctx, bkt, userID, &buf, true, logger))
+
+		gzipReader, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+		content, err := io.ReadAll(gzipReader)
+		require.NoError(t, err)
+
+		actual, err := decodeIndex(content)
+		require.NoError(t, err)
+		assert.Equal(t, idx, actual)
+	})
+
+	t.Run("should stream the decompressed index", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		var buf bytes.Buffer
+		require.NoError(t, StreamIndexTo(ctx, bkt, userID, &buf, false, logger))
+
+		actual, err := decodeIndex(buf.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, idx, actual)
+	})
+
+	t.Run("should return error if the index doesn't exist", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+		var buf bytes.Buffer
+		require.ErrorIs(t, StreamIndexTo(ctx, bkt, userID, &buf, true, logger), ErrIndexNotFound)
+		assert.Zero(t, buf.Len())
+	})
+
+	t.Run("should return error if the index can't be decompressed", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), strings.NewReader("invalid!}")))
+
+		var buf bytes.Buffer
+		require.ErrorIs(t, StreamIndexTo(ctx, bkt, userID, &buf, false, logger), ErrIndexCorrupted)
+
+		// The content isn't validated if streamed as stored.
+		require.NoError(t, StreamIndexTo(ctx, bkt, userID, &buf, true, logger))
+		assert.Equal(t, "invalid!}", buf.String())
+	})
+}
+
+func TestReadIndex_ShouldDecodeTheIndexBasedOnItsVersion(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	id := ulid.MustNew(1, nil)
+
+	v1Content := `{"version": 1, "blocks": [{"block_id": "` + id.String() + `", "min_time": 10, "max_time": 20}], "updated_at": 100}`
+	v1Index := &Index{Version: IndexVersion1, Blocks: Blocks{{ID: id, MinTime: 10, MaxTime: 20}}, UpdatedAt: 100}
+
+	// A made up format, listing the block IDs only.
+	v2Content := `{"version": 2, "block_ids": ["` + id.String() + `"], "updated_at": 100}`
+	v2Index := &Index{Version: 2, Blocks: Blocks{{ID: id}}, UpdatedAt: 100}
+	decodeIndexV2 := func(content []byte) (*Index, error) {
+		v2 := struct {
+			BlockIDs  []ulid.ULID `json:"block_ids"`
+			UpdatedAt int64       `json:"updated_at"`
+		}{}
+		if err := json.Unmarshal(content, &v2); err != nil {
+			return nil, ErrIndexCorrupted
+		}
+
+		idx := &Index{Version: 2, UpdatedAt: v2.UpdatedAt}
+		for _, id := range v2.BlockIDs {
+			idx.Blocks = append(idx.Blocks, &Block{ID: id})
+		}
+		return idx, nil
+	}
+
+	t.Run("should decode a v1 index", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		uploadIndexContent(t, bkt, userID, v1Content)
+
+		idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, v1Index, idx)
+	})
+
+	t.Run("should decode an index without version as v1", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		uploadIndexContent(t, bkt, userID, `{"updated_at": 100}`)
+
+		idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.Equal(t, &Index{UpdatedAt: 100}, idx)
+	})
+
+	t.Run("should return error on a v2 index read by a v1 reader", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		uploadIndexContent(t, bkt, userID, v2Content)
+
+		_, err := ReadIndex(ctx, bkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexVersionUnsupported)
+		assert.Equal(t, "version 2: bucket index version unsupported", err.Error())
+
+		_, _, err = ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, nil)
+		require.ErrorIs(t, err, ErrIndexVersionUnsupported)
+
+		_, _, err = ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexVersionUnsupported)
+
+		_, err = NewIndexIterator(ctx, bkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexVersionUnsupported)
+	})
+
+	t.Run("should return error on a v2 index whose version isn't written first", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		uploadIndexContent(t, bkt, userID, `{"block_ids": [], "version": 2}`)
+
+		_, err := ReadIndex(ctx, bkt, userID, nil, logger)
+		require.ErrorIs(t, err, ErrIndexVersionUnsupported)
+	})
+
+	t.Run("should decode both v1 and v2 indexes with a v2 reader", func(t *testing.T) {
+		indexDecoders[2] = decodeIndexV2
+		t.Cleanup(func() {
+			delete(indexDecoders, 2)
+		})
+
+		for content, expected := range map[string]*Index{v1Content: v1Index, v2Content: v2Index} {
+			bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+			uploadIndexContent(t, bkt, userID, content)
+
+			idx, err := ReadIndex(ctx, bkt, userID, nil, logger)
+			require.NoError(t, err)
+			assert.Equal(t, expected, idx)
+		}
+	})
+}
+
+func TestPeekIndexVersion(t *testing.T) {
+	tests := map[string]struct {
+		prefix          string
+		expectedVersion int
+		expectedOK      bool
+	}{
+		"version written first":             {prefix: `{"version": 1, "blocks": [`, expectedVersion: 1, expectedOK: true},
+		"version not written first":         {prefix: `{"blocks": [], "version": 1}`},
+		"version truncated by the prefix":   {prefix: `{"version": 1`},
+		"version terminated by the content": {prefix: `{"version": 12}`, expectedVersion: 12, expectedOK: true},
+		"not an object":                     {prefix: `[1]`},
+		"empty":                             {prefix: ``},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			version, ok := peekIndexVersion([]byte(testData.prefix))
+			assert.Equal(t, testData.expectedOK, ok)
+			assert.Equal(t, testData.expectedVersion, version)
+		})
+	}
+}
+
+func TestDecodeIndexFrom_ShouldDecodeAV1IndexWhileReadingIt(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	content := `{"version": 1, "blocks": [{"block_id": "` + id.String() + `", "min_time": 10, "max_time": 20}], "updated_at": 100}`
+
+	// The reader fails after the index content, which would fail the decoding if the content was read in full.
+	idx, err := decodeIndexFrom(io.MultiReader(strings.NewReader(content), iotest.ErrReader(errors.New("read failed"))))
+	require.NoError(t, err)
+	assert.Equal(t, &Index{Version: IndexVersion1, Blocks: Blocks{{ID: id, MinTime: 10, MaxTime: 20}}, UpdatedAt: 100}, idx)
+
+	// The index whose version isn't written first is read in full.
+	_, err = decodeIndexFrom(io.MultiReader(strings.NewReader(`{"updated_at": 100, "version": 1}`), iotest.ErrReader(errors.New("read failed"))))
+	require.ErrorIs(t, err, ErrIndexCorrupted)
+}
+
+// uploadIndexContent uploads the input JSON content as the bucket index of the input user.
+func uploadIndexContent(t *testing.T, bkt objstore.Bucket, userID, content string) {
+	var gzipContent bytes.Buffer
+	w := gzip.NewWriter(&gzipContent)
+	_, err := w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, bkt.Upload(context.Background(), path.Join(userID, IndexCompressedFilename), &gzipContent))
+}
+
+func TestReadIndexRedacted(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	stored := &Index{
+		Version: IndexVersion1,
+		Blocks: Blocks{
+			{ID: block1, MinTime: 10, MaxTime: 20, Labels: map[string]string{cortex_tsdb.TenantIDExternalLabel: userID, "customer": "acme", "region": "eu"}},
+			{ID: block2, MinTime: 20, MaxTime: 30, Labels: map[string]string{"customer": "acme"}},
+		},
+		UpdatedAt: 100,
+	}
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, stored))
+
+	_, storedContent, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+
+	// Strip the labels identifying the tenant.
+	redact := func(lbls labels.Labels) labels.Labels {
+		return labels.NewBuilder(lbls).Del(cortex_tsdb.TenantIDExternalLabel, "customer").Labels()
+	}
+
+	idx, err := ReadIndexRedacted(ctx, bkt, userID, nil, logger, redact)
+	require.NoError(t, err)
+	require.Len(t, idx.Blocks, 2)
+	assert.Equal(t, map[string]string{"region": "eu"}, idx.Blocks[0].Labels)
+	assert.Nil(t, idx.Blocks[1].Labels)
+
+	// The redaction should not affect the stored index.
+	_, actualContent, err := ReadIndexRaw(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, storedContent, actualContent)
+
+	actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.Equal(t, stored, actual)
+
+	// The tenant references should be checked before the redaction.
+	stored.Blocks[0].Labels[cortex_tsdb.TenantIDExternalLabel] = "user-2"
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, stored))
+
+	_, err = ReadIndexRedacted(ctx, bkt, userID, nil, logger, redact)
+	require.ErrorIs(t, err, ErrIndexCrossTenantReference)
+}
+
+func TestReadIndexBestEffort(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	idx := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+	for i := 0; i < 1000; i++ {
+		id := ulid.MustNew(uint64(i), rand.Reader)
+		idx.Blocks = append(idx.Blocks, &Block{ID: id, MinTime: int64(i * 10), MaxTime: int64((i + 1) * 10), UploadedAt: time.Now().Unix()})
+		if i < 100 {
+			idx.BlockDeletionMarks = append(idx.BlockDeletionMarks, &BlockDeletionMark{ID: id, DeletionTime: time.Now().Unix()})
+		}
+	}
+
+	t.Run("should return the full index if not truncated", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		actualIdx, partial, err := ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.False(t, partial)
+		assert.Equal(t, idx, actualIdx)
+	})
+
+	t.Run("should salvage the complete entries of a truncated index", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		// Truncate the index, like an interrupted upload would do.
+		reader, err := bkt.Get(ctx, path.Join(userID, IndexCompressedFilename))
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), bytes.NewReader(content[:len(content)/2])))
+
+		// The default read must not attempt to salvage the index.
+		_, err = ReadIndex(ctx, bkt, userID, nil, logger)
+		require.Equal(t, ErrIndexCorrupted, err)
+
+		actualIdx, partial, err := ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+		require.NoError(t, err)
+		assert.True(t, partial)
+		assert.Equal(t, idx.Version, actualIdx.Version)
+		require.NotEmpty(t, actualIdx.Blocks)
+		require.Less(t, len(actualIdx.Blocks), len(idx.Blocks))
+		assert.Equal(t, idx.Blocks[:len(actualIdx.Blocks)], actualIdx.Blocks)
+		assert.Empty(t, actualIdx.BlockDeletionMarks)
+	})
+
+	t.Run("should return error if the index can't be salvaged", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), strings.NewReader("invalid!}")))
+
+		actualIdx, partial, err := ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+		require.Equal(t, ErrIndexCorrupted, err)
+		assert.False(t, partial)
+		assert.Nil(t, actualIdx)
+	})
+
+	t.Run("should return error if the index doesn't exist", func(t *testing.T) {
+		bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+		_, _, err := ReadIndexBestEffort(ctx, bkt, userID, nil, logger)
+		require.Equal(t, ErrIndexNotFound, err)
+	})
+}
+
+func TestReadIndexShard(t *testing.T) {
+	const (
+		userID     = "user-1"
+		shardCount = 3
+	)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	idx := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix(), UpdateJitterSeed: 123}
+	for i := 0; i < 100; i++ {
+		id := ulid.MustNew(uint64(i), rand.Reader)
+		idx.Blocks = append(idx.Blocks, &Block{ID: id, MinTime: int64(i * 10), MaxTime: int64((i + 1) * 10), UploadedAt: time.Now().Unix()})
+		if i%10 == 0 {
+			idx.BlockDeletionMarks = append(idx.BlockDeletionMarks, &BlockDeletionMark{ID: id, DeletionTime: time.Now().Unix()})
+		}
+	}
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+	var allBlocks []ulid.ULID
+	var allMarks []ulid.ULID
+	for shardID := 0; shardID < shardCount; shardID++ {
+		shardIdx, err := ReadIndexShard(ctx, bkt, userID, nil, logger, shardID, shardCount)
+		require.NoError(t, err)
+
+		// The shard blocks are the same of the in-memory sharding.
+		assert.Equal(t, idx.BlocksForShard(shardID, shardCount), []*Block(shardIdx.Blocks))
+		assert.Equal(t, idx.Version, shardIdx.Version)
+		assert.Equal(t, idx.UpdatedAt, shardIdx.UpdatedAt)
+		assert.Equal(t, idx.UpdateJitterSeed, shardIdx.UpdateJitterSeed)
+
+		allBlocks = append(allBlocks, shardIdx.Blocks.GetULIDs()...)
+		for _, m := range shardIdx.BlockDeletionMarks {
+			assert.Equal(t, shardID, blockShard(m.ID, shardCount))
+			allMarks = append(allMarks, m.ID)
+		}
+	}
+
+	// The union of all the shards is the full index.
+	assert.ElementsMatch(t, idx.Blocks.GetULIDs(), allBlocks)
+	assert.ElementsMatch(t, idx.BlockDeletionMarks.GetULIDs(), allMarks)
+
+	// Without sharding, the full index is returned.
+	fullIdx, err := ReadIndexShard(ctx, bkt, userID, nil, logger, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, idx, fullIdx)
+
+	// Out of range shards contain no blocks.
+	emptyIdx, err := ReadIndexShard(ctx, bkt, userID, nil, logger, shardCount, shardCount)
+	require.NoError(t, err)
+	assert.Empty(t, emptyIdx.Blocks)
+	assert.Empty(t, emptyIdx.BlockDeletionMarks)
+
+	// Errors are returned like ReadIndex.
+	_, err = ReadIndexShard(ctx, bkt, "user-2", nil, logger, 0, shardCount)
+	require.Equal(t, ErrIndexNotFound, err)
+
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, IndexCompressedFilename), strings.NewReader("invalid!}")))
+	_, err = ReadIndexShard(ctx, bkt, userID, nil, logger, 0, shardCount)
+	require.Equal(t, ErrIndexCorrupted, err)
+}
+
 func TestReadIndex_ShouldRetryUpload(t *testing.T) {
 	const userID = "user-1"
 
@@ -101,6 +1099,239 @@ func TestReadIndex_ShouldRetryUpload(t *testing.T) {
 	require.Equal(t, mBucket.UploadCalls.Load(), int32(5))
 }
 
+func TestWriteIndex_ShouldHonorTheTenantSSEConfig(t *testing.T) {
+	const (
+		userID   = "user-1"
+		kmsKeyID = "ABC"
+	)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Start a fake S3 server rejecting the uploads not encrypted with the tenant KMS key.
+	srv := newSSEEnforcingS3Server(kmsKeyID)
+	defer srv.Close()
+
+	s3Bkt, err := s3.NewBucketClient(s3.Config{
+		Endpoint:         srv.Listener.Addr().String(),
+		Region:           "test",
+		BucketName:       "test-bucket",
+		SecretAccessKey:  flagext.Secret{Value: "test"},
+		AccessKeyID:      "test",
+		Insecure:         true,
+		BucketLookupType: s3.BucketPathLookup,
+	}, nil, "test", logger)
+	require.NoError(t, err)
+
+	idx := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix(), Blocks: Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}}}
+
+	// The index should not be written without the tenant SSE config.
+	err = WriteIndex(ctx, s3Bkt, userID, nil, idx)
+	require.Error(t, err)
+	assert.True(t, s3Bkt.IsAccessDeniedErr(errors.Unwrap(err)))
+
+	// The index should be written encrypted with the tenant KMS key.
+	cfgProvider := &mockSSETenantConfigProvider{sseType: s3.SSEKMS, kmsKeyID: kmsKeyID}
+	require.NoError(t, WriteIndex(ctx, s3Bkt, userID, cfgProvider, idx))
+
+	actual, err := ReadIndex(ctx, s3Bkt, userID, cfgProvider, logger)
+	require.NoError(t, err)
+	assert.Equal(t, idx, actual)
+
+	// Once the access to the tenant KMS key has been revoked, the index can't be read anymore.
+	srv.revokeKeyAccess()
+
+	actual, err = ReadIndex(ctx, s3Bkt, userID, cfgProvider, logger)
+	require.True(t, errors.Is(err, bucket.ErrCustomerManagedKeyAccessDenied))
+	require.Nil(t, actual)
+}
+
+func TestWriteIndexMulti(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	idx := &Index{
+		Version:   IndexVersion1,
+		Blocks:    Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	setup := func(t *testing.T) (primary, secondary objstore.Bucket, failingSecondary *cortex_testutil.MockBucketFailure) {
+		primary, _ = cortex_testutil.PrepareFilesystemBucket(t)
+		secondary, _ = cortex_testutil.PrepareFilesystemBucket(t)
+		failing, _ := cortex_testutil.PrepareFilesystemBucket(t)
+		failingSecondary = &cortex_testutil.MockBucketFailure{
+			Bucket:         failing,
+			UploadFailures: map[string]error{userID: errors.New("mocked upload failure")},
+		}
+		return primary, secondary, failingSecondary
+	}
+
+	t.Run("should succeed on secondary failures in best-effort mode", func(t *testing.T) {
+		primary, secondary, failingSecondary := setup(t)
+		failures := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+
+		require.NoError(t, WriteIndexMulti(ctx, []objstore.Bucket{primary, failingSecondary, secondary}, userID, nil, idx, WriteIndexMultiOptions{
+			SecondaryFailures: failures,
+		}))
+		assert.Equal(t, float64(1), prom_testutil.ToFloat64(failures))
+
+		// The index can be read from both the primary and the healthy secondary bucket.
+		for _, bkt := range []objstore.Bucket{primary, secondary} {
+			actualIdx, err := ReadIndex(ctx, bkt, userID, nil, log.NewNopLogger())
+			require.NoError(t, err)
+			assert.Equal(t, idx, actualIdx)
+		}
+	})
+
+	t.Run("should fail on secondary failures in strict mode", func(t *testing.T) {
+		primary, secondary, failingSecondary := setup(t)
+
+		err := WriteIndexMulti(ctx, []objstore.Bucket{primary, failingSecondary, secondary}, userID, nil, idx, WriteIndexMultiOptions{Strict: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "secondary bucket 1")
+
+		// The healthy buckets have been written anyway.
+		for _, bkt := range []objstore.Bucket{primary, secondary} {
+			_, err := ReadIndex(ctx, bkt, userID, nil, log.NewNopLogger())
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("should fail without writing secondaries if the primary fails", func(t *testing.T) {
+		_, secondary, failingPrimary := setup(t)
+
+		require.Error(t, WriteIndexMulti(ctx, []objstore.Bucket{failingPrimary, secondary}, userID, nil, idx, WriteIndexMultiOptions{}))
+
+		_, err := ReadIndex(ctx, secondary, userID, nil, log.NewNopLogger())
+		require.Equal(t, ErrIndexNotFound, err)
+	})
+}
+
+func TestWriteIndex_ShouldAtomicallyReplaceTheIndexOnTheFilesystem(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	t.Run("readers should never observe a partially written index during a concurrent write", func(t *testing.T) {
+		fs, err := filesystem.NewBucketClient(filesystem.Config{Directory: t.TempDir()})
+		require.NoError(t, err)
+		bkt := &slowUploadBucket{Bucket: fs}
+
+		// Random block IDs make the compressed index big enough to be written in many chunks.
+		idx := &Index{Version: IndexVersion1, UpdatedAt: time.Now().Unix()}
+		for i := 0; i < 100; i++ {
+			idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(uint64(i), rand.Reader), MinTime: int64(i), MaxTime: int64(i + 1)})
+		}
+		require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+
+		done := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for r := 0; r < 2; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					actual, err := ReadIndex(ctx, fs, userID, nil, logger)
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Len(t, actual.Blocks, 100)
+				}
+			}()
+		}
+
+		for i := 0; i < 3; i++ {
+			idx.UpdatedAt++
+			require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+		}
+		close(done)
+		wg.Wait()
+
+		// No temporary object should be left.
+		assert.Equal(t, []string{path.Join(userID, IndexCompressedFilename)}, listObjects(t, fs, userID))
+	})
+
+}
+
+func listObjects(t *testing.T, bkt objstore.Bucket, dir string) []string {
+	var names []string
+	require.NoError(t, bkt.Iter(context.Background(), dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	return names
+}
+
+// slowUploadBucket uploads the content in small chunks, so that a partially written object can be observed.
+type slowUploadBucket struct {
+	objstore.Bucket
+}
+
+func (b *slowUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.Bucket.Upload(ctx, name, &slowReader{r: r})
+}
+
+// slowGetBucket delays the Get requests, and the reads of the returned objects content, until the
+// delay expires or the context is done.
+type slowGetBucket struct {
+	objstore.Bucket
+
+	getDelay  time.Duration
+	readDelay time.Duration
+}
+
+func (b *slowGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := sleepWithContext(ctx, b.getDelay); err != nil {
+		return nil, err
+	}
+
+	r, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowContentReader{ReadCloser: r, ctx: ctx, delay: b.readDelay}, nil
+}
+
+type slowContentReader struct {
+	io.ReadCloser
+
+	ctx   context.Context
+	delay time.Duration
+}
+
+func (r *slowContentReader) Read(p []byte) (int, error) {
+	if err := sleepWithContext(r.ctx, r.delay); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type slowReader struct {
+	r io.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	return r.r.Read(p[:min(len(p), 64)])
+}
+
 func BenchmarkReadIndex(b *testing.B) {
 	const (
 		numBlocks             = 1000
@@ -138,12 +1369,32 @@ func BenchmarkReadIndex(b *testing.B) {
 	require.Len(b, idx.Blocks, numBlocks)
 	require.Len(b, idx.BlockDeletionMarks, numBlockDeletionMarks)
 
-	b.ResetTimer()
+	b.Run("ReadIndex", func(b *testing.B) {
+		b.ReportAllocs()
 
-	for n := 0; n < b.N; n++ {
-		_, err := ReadIndex(ctx, bkt, userID, nil, logger)
-		require.NoError(b, err)
-	}
+		for n := 0; n < b.N; n++ {
+			_, err := ReadIndex(ctx, bkt, userID, nil, logger)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("ReadIndexWithBuffer", func(b *testing.B) {
+		var buf []byte
+		for n := 0; n < b.N; n++ {
+			_, buf, err = ReadIndexWithBuffer(ctx, bkt, userID, nil, logger, buf)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("ReadIndexInto", func(b *testing.B) {
+		b.ReportAllocs()
+
+		arena := NewIndexArena()
+		for n := 0; n < b.N; n++ {
+			_, err = ReadIndexInto(ctx, bkt, userID, nil, logger, arena)
+			require.NoError(b, err)
+		}
+	})
 }
 
 func TestDeleteIndex_ShouldNotReturnErrorIfIndexDoesNotExist(t *testing.T) {
@@ -152,3 +1403,149 @@ func TestDeleteIndex_ShouldNotReturnErrorIfIndexDoesNotExist(t *testing.T) {
 
 	assert.NoError(t, DeleteIndex(ctx, bkt, "user-1", nil))
 }
+
+var errMockObjectNotFound = errors.New("object not found")
+
+// mockBucketReader is a read-only bucket serving objects from memory.
+type mockBucketReader struct {
+	objects map[string][]byte
+}
+
+func (m *mockBucketReader) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	content, ok := m.objects[name]
+	if !ok {
+		return nil, errMockObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (m *mockBucketReader) IsObjNotFoundErr(err error) bool {
+	return errors.Is(err, errMockObjectNotFound)
+}
+
+func (m *mockBucketReader) IsAccessDeniedErr(error) bool {
+	return false
+}
+
+type mockSSETenantConfigProvider struct {
+	sseType  string
+	kmsKeyID string
+}
+
+func (m *mockSSETenantConfigProvider) S3SSEType(string) string {
+	return m.sseType
+}
+
+func (m *mockSSETenantConfigProvider) S3SSEKMSKeyID(string) string {
+	return m.kmsKeyID
+}
+
+func (m *mockSSETenantConfigProvider) S3SSEKMSEncryptionContext(string) string {
+	return ""
+}
+
+// sseEnforcingS3Server is a fake S3 server storing the objects in memory, and rejecting the uploads
+// not encrypted with the expected KMS key.
+type sseEnforcingS3Server struct {
+	*httptest.Server
+
+	kmsKeyID string
+
+	mtx           sync.Mutex
+	objects       map[string][]byte
+	keyAccessDeny bool
+}
+
+func newSSEEnforcingS3Server(kmsKeyID string) *sseEnforcingS3Server {
+	s := &sseEnforcingS3Server{kmsKeyID: kmsKeyID, objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *sseEnforcingS3Server) revokeKeyAccess() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keyAccessDeny = true
+}
+
+func (s *sseEnforcingS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("x-amz-server-side-encryption") != "aws:kms" || r.Header.Get("x-amz-server-side-encryption-aws-kms-key-id") != s.kmsKeyID {
+			writeS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+
+		content, err := readS3Payload(r)
+		if err != nil {
+			writeS3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		s.objects[r.URL.Path] = content
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet, http.MethodHead:
+		content, ok := s.objects[r.URL.Path]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if s.keyAccessDeny {
+			writeS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", "\"etag\"")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// readS3Payload reads the payload of an upload request, decoding it if it has been sent in signed chunks.
+func readS3Payload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var (
+		content []byte
+		reader  = bufio.NewReader(r.Body)
+	)
+	for {
+		// Each chunk is prefixed by its hex size, followed by the chunk signature.
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return content, nil
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		content = append(content, chunk[:size]...)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+}
@@ -0,0 +1,178 @@
+package bucketindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"path"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	cortex_errors "github.com/cortexproject/cortex/pkg/util/errors"
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+const (
+	// IndexSummaryFilename is the filename of the bucket index summary, listing the time range of
+	// each block of the bucket index in a fixed-width binary layout.
+	IndexSummaryFilename = "bucket-index-summary.bin"
+
+	// IndexSummaryVersion1 is the current supported version of the bucket index summary.
+	IndexSummaryVersion1 = 1
+
+	// The summary is made of a header, followed by the blocks and a CRC32 (Castagnoli) checksum of
+	// the header and blocks. All the integers are big endian.
+	//
+	// Header: magic (4 bytes), version (4 bytes), index updated at (8 bytes), number of blocks (4 bytes).
+	// Block:  ULID (16 bytes), min time (8 bytes), max time (8 bytes).
+	indexSummaryMagic        = "CBIS"
+	indexSummaryHeaderSize   = 4 + 4 + 8 + 4
+	indexSummaryBlockSize    = 16 + 8 + 8
+	indexSummaryChecksumSize = 4
+)
+
+var (
+	ErrIndexSummaryNotFound  = errors.New("bucket index summary not found")
+	ErrIndexSummaryCorrupted = errors.New("bucket index summary corrupted")
+
+	indexSummaryCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// IndexSummary is a compact summary of a bucket index, listing only the ID and time range of its
+// blocks. It's meant to cheaply decide which tenants have blocks in a time range, without reading
+// and parsing the whole bucket index.
+type IndexSummary struct {
+	// UpdatedAt is a unix timestamp (seconds precision) of when the summarized index was updated.
+	UpdatedAt int64
+
+	Blocks []BlockSummary
+}
+
+// BlockSummary is the summary of a block of the bucket index.
+type BlockSummary struct {
+	ID      ulid.ULID
+	MinTime int64
+	MaxTime int64
+}
+
+// NewIndexSummary returns the summary of the input index.
+func NewIndexSummary(idx *Index) *IndexSummary {
+	s := &IndexSummary{
+		UpdatedAt: idx.UpdatedAt,
+		Blocks:    make([]BlockSummary, 0, len(idx.Blocks)),
+	}
+	for _, b := range idx.Blocks {
+		s.Blocks = append(s.Blocks, BlockSummary{ID: b.ID, MinTime: b.MinTime, MaxTime: b.MaxTime})
+	}
+	return s
+}
+
+// Overlaps returns true if any block of the summary overlaps the input time range. The block max
+// time is exclusive, while the input range is inclusive.
+func (s *IndexSummary) Overlaps(minT, maxT int64) bool {
+	for _, b := range s.Blocks {
+		if b.MinTime <= maxT && minT < b.MaxTime {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteIndexSummary uploads the summary of the provided index to the storage. It's meant to be
+// written alongside the index, and is deleted alongside it by DeleteIndex.
+func WriteIndexSummary(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, idx *Index) error {
+	userBkt := bucket.NewUserBucketClient(userID, bkt, cfgProvider)
+	if err := userBkt.Upload(ctx, IndexSummaryFilename, bytes.NewReader(encodeIndexSummary(NewIndexSummary(idx)))); err != nil {
+		return errors.Wrap(err, "upload bucket index summary")
+	}
+	return nil
+}
+
+// ReadIndexSummary reads and decodes the bucket index summary from the bucket. ErrIndexSummaryNotFound
+// is returned if the summary doesn't exist, eg. because it's not written for the tenant.
+func ReadIndexSummary(ctx context.Context, bkt BucketReader, userID string, logger log.Logger) (*IndexSummary, error) {
+	var getter BucketReader = bkt
+	if ib, ok := bkt.(objstore.InstrumentedBucketReader); ok {
+		getter = ib.ReaderWithExpectedErrs(tsdb.IsOneOfTheExpectedErrors(bkt.IsAccessDeniedErr, bkt.IsObjNotFoundErr))
+	}
+
+	reader, err := getter.Get(ctx, path.Join(userID, IndexSummaryFilename))
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, ErrIndexSummaryNotFound
+		}
+
+		if bkt.IsAccessDeniedErr(err) {
+			return nil, cortex_errors.WithCause(bucket.ErrCustomerManagedKeyAccessDenied, err)
+		}
+
+		return nil, errors.Wrap(err, "read bucket index summary")
+	}
+	defer runutil.CloseWithLogOnErr(logger, reader, "close bucket index summary reader")
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bucket index summary")
+	}
+
+	return decodeIndexSummary(content)
+}
+
+func encodeIndexSummary(s *IndexSummary) []byte {
+	content := make([]byte, 0, indexSummaryHeaderSize+len(s.Blocks)*indexSummaryBlockSize+indexSummaryChecksumSize)
+
+	content = append(content, indexSummaryMagic...)
+	content = binary.BigEndian.AppendUint32(content, IndexSummaryVersion1)
+	content = binary.BigEndian.AppendUint64(content, uint64(s.UpdatedAt))
+	content = binary.BigEndian.AppendUint32(content, uint32(len(s.Blocks)))
+
+	for _, b := range s.Blocks {
+		content = append(content, b.ID[:]...)
+		content = binary.BigEndian.AppendUint64(content, uint64(b.MinTime))
+		content = binary.BigEndian.AppendUint64(content, uint64(b.MaxTime))
+	}
+
+	return binary.BigEndian.AppendUint32(content, crc32.Checksum(content, indexSummaryCastagnoli))
+}
+
+func decodeIndexSummary(content []byte) (*IndexSummary, error) {
+	if len(content) < indexSummaryHeaderSize+indexSummaryChecksumSize || string(content[:4]) != indexSummaryMagic {
+		return nil, ErrIndexSummaryCorrupted
+	}
+
+	if version := binary.BigEndian.Uint32(content[4:]); version != IndexSummaryVersion1 {
+		return nil, errors.Wrapf(ErrIndexVersionUnsupported, "summary version %d", version)
+	}
+
+	numBlocks := int(binary.BigEndian.Uint32(content[16:]))
+	if len(content) != indexSummaryHeaderSize+numBlocks*indexSummaryBlockSize+indexSummaryChecksumSize {
+		return nil, ErrIndexSummaryCorrupted
+	}
+
+	checksumOffset := len(content) - indexSummaryChecksumSize
+	if crc32.Checksum(content[:checksumOffset], indexSummaryCastagnoli) != binary.BigEndian.Uint32(content[checksumOffset:]) {
+		return nil, ErrIndexSummaryCorrupted
+	}
+
+	s := &IndexSummary{
+		UpdatedAt: int64(binary.BigEndian.Uint64(content[8:])),
+		Blocks:    make([]BlockSummary, numBlocks),
+	}
+
+	blocks := content[indexSummaryHeaderSize:checksumOffset]
+	for i := range s.Blocks {
+		b := blocks[i*indexSummaryBlockSize:]
+		copy(s.Blocks[i].ID[:], b[:16])
+		s.Blocks[i].MinTime = int64(binary.BigEndian.Uint64(b[16:]))
+		s.Blocks[i].MaxTime = int64(binary.BigEndian.Uint64(b[24:]))
+	}
+
+	return s, nil
+}
@@ -0,0 +1,127 @@
+package bucketindex
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestIndexSummary_RoundTrip(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	idx := &Index{
+		Version:   IndexVersion1,
+		UpdatedAt: 1000,
+		Blocks: Blocks{
+			{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, SegmentsNum: 3},
+			{ID: ulid.MustNew(2, nil), MinTime: -20, MaxTime: 30, UploadedAt: 100},
+		},
+		BlockDeletionMarks: BlockDeletionMarks{{ID: ulid.MustNew(1, nil), DeletionTime: 500}},
+	}
+
+	_, err := ReadIndexSummary(ctx, bkt, userID, logger)
+	require.ErrorIs(t, err, ErrIndexSummaryNotFound)
+
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+	require.NoError(t, WriteIndexSummary(ctx, bkt, userID, nil, idx))
+
+	summary, err := ReadIndexSummary(ctx, bkt, userID, logger)
+	require.NoError(t, err)
+	assert.Equal(t, &IndexSummary{
+		UpdatedAt: 1000,
+		Blocks: []BlockSummary{
+			{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20},
+			{ID: ulid.MustNew(2, nil), MinTime: -20, MaxTime: 30},
+		},
+	}, summary)
+
+	// The summary should be deleted alongside the index.
+	require.NoError(t, DeleteIndex(ctx, bkt, userID, nil))
+	_, err = ReadIndexSummary(ctx, bkt, userID, logger)
+	require.ErrorIs(t, err, ErrIndexSummaryNotFound)
+}
+
+func TestIndexSummary_Size(t *testing.T) {
+	for _, numBlocks := range []int{0, 1, 1000} {
+		idx := &Index{Version: IndexVersion1}
+		for i := 0; i < numBlocks; i++ {
+			idx.Blocks = append(idx.Blocks, &Block{ID: ulid.MustNew(uint64(i), nil), MinTime: int64(i), MaxTime: int64(i + 1)})
+		}
+
+		// The summary has a fixed size per block, a fraction of the index one.
+		content := encodeIndexSummary(NewIndexSummary(idx))
+		assert.Len(t, content, 24+32*numBlocks)
+
+		decoded, err := decodeIndexSummary(content)
+		require.NoError(t, err)
+		assert.Len(t, decoded.Blocks, numBlocks)
+	}
+}
+
+func TestIndexSummary_ShouldRejectCorruptedContent(t *testing.T) {
+	content := encodeIndexSummary(NewIndexSummary(&Index{
+		Version: IndexVersion1,
+		Blocks:  Blocks{{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20}},
+	}))
+
+	flipped := append([]byte{}, content...)
+	flipped[30] ^= 0xff
+
+	badVersion := append([]byte{}, content...)
+	badVersion[7] = 2
+
+	tests := map[string]struct {
+		content     []byte
+		expectedErr error
+	}{
+		"empty":               {content: nil, expectedErr: ErrIndexSummaryCorrupted},
+		"truncated":           {content: content[:len(content)-1], expectedErr: ErrIndexSummaryCorrupted},
+		"flipped bit":         {content: flipped, expectedErr: ErrIndexSummaryCorrupted},
+		"bad magic":           {content: append([]byte("XXXX"), content[4:]...), expectedErr: ErrIndexSummaryCorrupted},
+		"unsupported version": {content: badVersion, expectedErr: ErrIndexVersionUnsupported},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := decodeIndexSummary(testData.content)
+			require.ErrorIs(t, err, testData.expectedErr)
+		})
+	}
+}
+
+func TestIndexSummary_Overlaps(t *testing.T) {
+	summary := &IndexSummary{Blocks: []BlockSummary{
+		{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20},
+		{ID: ulid.MustNew(2, nil), MinTime: 30, MaxTime: 40},
+	}}
+
+	assert.True(t, summary.Overlaps(0, 10))
+	assert.True(t, summary.Overlaps(15, 35))
+	assert.False(t, summary.Overlaps(20, 29))
+	assert.False(t, summary.Overlaps(40, 50))
+	assert.False(t, (&IndexSummary{}).Overlaps(0, 100))
+}
+
+func TestDeleteIndex_ShouldDeleteTheSummaryWithoutIndex(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+	require.NoError(t, WriteIndexSummary(ctx, bkt, userID, nil, &Index{Version: IndexVersion1}))
+
+	require.NoError(t, DeleteIndex(ctx, bkt, userID, nil))
+	exists, err := bkt.Exists(ctx, path.Join(userID, IndexSummaryFilename))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
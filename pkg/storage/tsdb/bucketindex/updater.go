@@ -11,6 +11,7 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid/v2"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -29,6 +30,8 @@ var (
 	ErrBlockDeletionMarkNotFound  = errors.New("block deletion mark not found")
 	ErrBlockDeletionMarkCorrupted = errors.New("block deletion mark corrupted")
 
+	ErrBlockDeletionMarkUnknownVersion = errors.New("block deletion mark version unknown")
+
 	errBlockMetaKeyAccessDeniedErr = errors.New("block meta file key access denied error")
 )
 
@@ -37,12 +40,40 @@ type Updater struct {
 	bkt            objstore.InstrumentedBucket
 	logger         log.Logger
 	parquetEnabled bool
+
+	userID           string
+	cacheInvalidator CacheInvalidator
+
+	// Whether the objects under the location of the new blocks are counted.
+	countBlockFiles bool
+
+	// Whether the blocks without samples are excluded from the index, and the ones excluded by the
+	// last update.
+	excludeEmptyBlocks  bool
+	excludedEmptyBlocks Blocks
+
+	// Optional gauge tracking the number of blocks without samples found in the storage.
+	emptyBlocks prometheus.Gauge
+
+	// Optional counter tracking deletion marks skipped because of an unknown version.
+	unknownDeletionMarkVersions prometheus.Counter
+
+	// Optional histograms tracking the duration of each phase of the index update.
+	blocksListDuration prometheus.Observer
+	marksListDuration  prometheus.Observer
+	metaFetchDuration  prometheus.Observer
+	marksFetchDuration prometheus.Observer
 }
 
+// deletionMarkVersion0 is the version of the deletion marks written before the version
+// field was introduced. The schema is otherwise the same of metadata.DeletionMarkVersion1.
+const deletionMarkVersion0 = 0
+
 func NewUpdater(bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger) *Updater {
 	return &Updater{
 		bkt:    bucket.NewUserBucketClient(userID, bkt, cfgProvider),
 		logger: util_log.WithUserID(userID, logger),
+		userID: userID,
 	}
 }
 
@@ -51,6 +82,65 @@ func (w *Updater) EnableParquet() *Updater {
 	return w
 }
 
+// WithBlockFilesCount enables counting the objects under the location of each block added to the
+// index, which requires an additional listing per block.
+func (w *Updater) WithBlockFilesCount() *Updater {
+	w.countBlockFiles = true
+	return w
+}
+
+// WithEmptyBlocksExcluded configures the Updater to not add the blocks without samples to the index.
+// Since they're not in the index, their meta.json is read again on each update.
+func (w *Updater) WithEmptyBlocksExcluded() *Updater {
+	w.excludeEmptyBlocks = true
+	return w
+}
+
+// ExcludedEmptyBlocks returns the blocks without samples excluded from the index by the last
+// UpdateIndex, eg. to apply the retention to them too.
+func (w *Updater) ExcludedEmptyBlocks() Blocks {
+	return w.excludedEmptyBlocks
+}
+
+// WithEmptyBlocksGauge configures the gauge set to the number of blocks without samples found in the
+// storage on each update, including the ones excluded from the index.
+func (w *Updater) WithEmptyBlocksGauge(gauge prometheus.Gauge) *Updater {
+	w.emptyBlocks = gauge
+	return w
+}
+
+// WithCacheInvalidator configures the Updater to invalidate the cached metadata of blocks
+// removed from the index on each update.
+func (w *Updater) WithCacheInvalidator(invalidator CacheInvalidator) *Updater {
+	w.cacheInvalidator = invalidator
+	return w
+}
+
+// WithUnknownDeletionMarkVersionsCounter configures the counter incremented for each deletion mark
+// skipped because of an unknown version.
+func (w *Updater) WithUnknownDeletionMarkVersionsCounter(counter prometheus.Counter) *Updater {
+	w.unknownDeletionMarkVersions = counter
+	return w
+}
+
+// WithPhaseDurationHistograms configures the histograms observing the duration of each phase of the
+// index update: the listing of blocks, the listing of deletion marks, the fetching of new blocks
+// meta.json and the fetching of new deletion marks.
+func (w *Updater) WithPhaseDurationHistograms(blocksList, marksList, metaFetch, marksFetch prometheus.Observer) *Updater {
+	w.blocksListDuration = blocksList
+	w.marksListDuration = marksList
+	w.metaFetchDuration = metaFetch
+	w.marksFetchDuration = marksFetch
+	return w
+}
+
+// observeSince observes the time elapsed since start to the input histogram, if configured.
+func observeSince(h prometheus.Observer, start time.Time) {
+	if h != nil {
+		h.Observe(time.Since(start).Seconds())
+	}
+}
+
 // UpdateIndex generates the bucket index and returns it, without storing it to the storage.
 // If the old index is not passed in input, then the bucket index will be generated from scratch.
 func (w *Updater) UpdateIndex(ctx context.Context, old *Index) (*Index, map[ulid.ULID]error, int64, error) {
@@ -65,7 +155,7 @@ func (w *Updater) UpdateIndex(ctx context.Context, old *Index) (*Index, map[ulid
 		oldBlockDeletionMarks = old.BlockDeletionMarks
 	}
 
-	blockDeletionMarks, deletedBlocks, totalBlocksBlocksMarkedForNoCompaction, err := w.updateBlockMarks(ctx, oldBlockDeletionMarks)
+	blockDeletionMarks, deletedBlocks, noCompactBlocks, err := w.updateBlockMarks(ctx, oldBlockDeletionMarks)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -74,18 +164,29 @@ func (w *Updater) UpdateIndex(ctx context.Context, old *Index) (*Index, map[ulid
 	if err != nil {
 		return nil, nil, 0, err
 	}
+	updateNoCompactBlocks(blocks, noCompactBlocks)
 	if w.parquetEnabled {
 		if err := w.updateParquetBlocks(ctx, blocks); err != nil {
 			return nil, nil, 0, err
 		}
 	}
 
-	return &Index{
+	idx := &Index{
 		Version:            IndexVersion1,
 		Blocks:             blocks,
 		BlockDeletionMarks: blockDeletionMarks,
 		UpdatedAt:          time.Now().Unix(),
-	}, partials, totalBlocksBlocksMarkedForNoCompaction, nil
+		UpdateJitterSeed:   UpdateJitterSeed(w.userID),
+		DeltasEnabled:      old != nil && old.DeltasEnabled,
+	}
+
+	if w.cacheInvalidator != nil && old != nil {
+		if keys := InvalidateRemovedBlocks(ctx, w.userID, DiffIndex(old, idx), w.cacheInvalidator); len(keys) > 0 {
+			level.Debug(w.logger).Log("msg", "invalidated cached metadata of blocks removed from the bucket index", "keys", len(keys))
+		}
+	}
+
+	return idx, partials, int64(len(noCompactBlocks)), nil
 }
 
 func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks map[ulid.ULID]struct{}) (blocks []*Block, partials map[ulid.ULID]error, _ error) {
@@ -93,6 +194,7 @@ func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks
 	partials = map[ulid.ULID]error{}
 
 	// Find all blocks in the storage.
+	listStart := time.Now()
 	err := w.bkt.Iter(ctx, "", func(name string) error {
 		if id, ok := block.IsBlockDir(name); ok {
 			discovered[id] = struct{}{}
@@ -102,6 +204,10 @@ func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "list blocks")
 	}
+	observeSince(w.blocksListDuration, listStart)
+
+	numEmpty := 0
+	w.excludedEmptyBlocks = nil
 
 	// Since blocks are immutable, all blocks already existing in the index can just be copied.
 	for _, b := range old {
@@ -112,6 +218,14 @@ func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks
 				level.Warn(w.logger).Log("msg", "skipped block with missing global deletion marker", "block", b.ID.String())
 				continue
 			}
+			if b.Empty {
+				numEmpty++
+				if w.excludeEmptyBlocks {
+					level.Warn(w.logger).Log("msg", "skipped block without samples when updating bucket index", "block", b.ID.String())
+					w.excludedEmptyBlocks = append(w.excludedEmptyBlocks, b)
+					continue
+				}
+			}
 			blocks = append(blocks, b)
 		}
 	}
@@ -119,9 +233,20 @@ func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks
 	// Remaining blocks are new ones and we have to fetch the meta.json for each of them, in order
 	// to find out if their upload has been completed (meta.json is uploaded last) and get the block
 	// information to store in the bucket index.
+	defer observeSince(w.metaFetchDuration, time.Now())
+
 	for id := range discovered {
 		b, err := w.updateBlockIndexEntry(ctx, id)
 		if err == nil {
+			if b.Empty {
+				numEmpty++
+				if w.excludeEmptyBlocks {
+					level.Warn(w.logger).Log("msg", "skipped block without samples when updating bucket index", "block", id.String())
+					w.excludedEmptyBlocks = append(w.excludedEmptyBlocks, b)
+					continue
+				}
+				level.Warn(w.logger).Log("msg", "found block without samples when updating bucket index", "block", id.String())
+			}
 			blocks = append(blocks, b)
 			continue
 		}
@@ -144,6 +269,10 @@ func (w *Updater) updateBlocks(ctx context.Context, old []*Block, deletedBlocks
 		return nil, nil, err
 	}
 
+	if w.emptyBlocks != nil {
+		w.emptyBlocks.Set(float64(numEmpty))
+	}
+
 	return blocks, partials, nil
 }
 
@@ -191,9 +320,28 @@ func (w *Updater) updateBlockIndexEntry(ctx context.Context, id ulid.ULID) (*Blo
 	// the block has completed to be uploaded.
 	block.UploadedAt = attrs.LastModified.Unix()
 
+	if w.countBlockFiles {
+		if block.NumFiles, err = w.countBlockIndexEntryFiles(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
 	return block, nil
 }
 
+// countBlockIndexEntryFiles returns the number of objects under the location of the input block.
+func (w *Updater) countBlockIndexEntryFiles(ctx context.Context, id ulid.ULID) (int, error) {
+	numFiles := 0
+	err := w.bkt.Iter(ctx, id.String(), func(string) error {
+		numFiles++
+		return nil
+	}, objstore.WithRecursiveIter())
+	if err != nil {
+		return 0, errors.Wrapf(err, "list block files: %v", id.String())
+	}
+	return numFiles, nil
+}
+
 func (w *Updater) updateParquetBlockIndexEntry(ctx context.Context, id ulid.ULID, block *Block) error {
 	marker, err := parquet.ReadConverterMark(ctx, id, w.bkt, w.logger)
 	if err != nil {
@@ -211,27 +359,31 @@ func (w *Updater) updateParquetBlockIndexEntry(ctx context.Context, id ulid.ULID
 	return nil
 }
 
-func (w *Updater) updateBlockMarks(ctx context.Context, old []*BlockDeletionMark) ([]*BlockDeletionMark, map[ulid.ULID]struct{}, int64, error) {
+// updateBlockMarks returns the updated deletion marks, the blocks whose deletion mark has been
+// removed and the blocks marked for no compaction.
+func (w *Updater) updateBlockMarks(ctx context.Context, old []*BlockDeletionMark) ([]*BlockDeletionMark, map[ulid.ULID]struct{}, map[ulid.ULID]struct{}, error) {
 	out := make([]*BlockDeletionMark, 0, len(old))
 	deletedBlocks := map[ulid.ULID]struct{}{}
 	discovered := map[ulid.ULID]struct{}{}
-	totalBlocksBlocksMarkedForNoCompaction := int64(0)
+	noCompactBlocks := map[ulid.ULID]struct{}{}
 
 	// Find all markers in the storage.
+	listStart := time.Now()
 	err := w.bkt.Iter(ctx, MarkersPathname+"/", func(name string) error {
 		if blockID, ok := IsBlockDeletionMarkFilename(path.Base(name)); ok {
 			discovered[blockID] = struct{}{}
 		}
 
-		if _, ok := IsBlockNoCompactMarkFilename(path.Base(name)); ok {
-			totalBlocksBlocksMarkedForNoCompaction++
+		if blockID, ok := IsBlockNoCompactMarkFilename(path.Base(name)); ok {
+			noCompactBlocks[blockID] = struct{}{}
 		}
 
 		return nil
 	})
 	if err != nil {
-		return nil, nil, totalBlocksBlocksMarkedForNoCompaction, errors.Wrap(err, "list block deletion marks")
+		return nil, nil, nil, errors.Wrap(err, "list block deletion marks")
 	}
+	observeSince(w.marksListDuration, listStart)
 
 	// Since deletion marks are immutable, all markers already existing in the index can just be copied.
 	for _, m := range old {
@@ -244,6 +396,8 @@ func (w *Updater) updateBlockMarks(ctx context.Context, old []*BlockDeletionMark
 	}
 
 	// Remaining markers are new ones and we have to fetch them.
+	defer observeSince(w.marksFetchDuration, time.Now())
+
 	for id := range discovered {
 		m, err := w.updateBlockDeletionMarkIndexEntry(ctx, id)
 		if errors.Is(err, ErrBlockDeletionMarkNotFound) {
@@ -255,27 +409,65 @@ func (w *Updater) updateBlockMarks(ctx context.Context, old []*BlockDeletionMark
 			level.Error(w.logger).Log("msg", "skipped corrupted block deletion mark when updating bucket index", "block", id.String(), "err", err)
 			continue
 		}
+		if errors.Is(err, ErrBlockDeletionMarkUnknownVersion) {
+			// This could happen during a rolling upgrade, if the mark has been written by a newer version.
+			level.Warn(w.logger).Log("msg", "skipped block deletion mark with unknown version when updating bucket index", "block", id.String(), "err", err)
+			if w.unknownDeletionMarkVersions != nil {
+				w.unknownDeletionMarkVersions.Inc()
+			}
+			continue
+		}
 		if err != nil {
-			return nil, nil, totalBlocksBlocksMarkedForNoCompaction, err
+			return nil, nil, nil, err
 		}
 
 		out = append(out, m)
 	}
 
-	return out, deletedBlocks, totalBlocksBlocksMarkedForNoCompaction, nil
+	return out, deletedBlocks, noCompactBlocks, nil
+}
+
+// updateNoCompactBlocks flags the blocks marked for no compaction, and unflags the ones whose
+// no-compact marker has been removed.
+func updateNoCompactBlocks(blocks []*Block, noCompactBlocks map[ulid.ULID]struct{}) {
+	for _, b := range blocks {
+		_, b.NoCompact = noCompactBlocks[b.ID]
+	}
 }
 
 func (w *Updater) updateBlockDeletionMarkIndexEntry(ctx context.Context, id ulid.ULID) (*BlockDeletionMark, error) {
-	m := metadata.DeletionMark{}
+	markFile := path.Join(id.String(), metadata.DeletionMarkFilename)
 
-	if err := metadata.ReadMarker(ctx, w.logger, w.bkt, id.String(), &m); err != nil {
-		if errors.Is(err, metadata.ErrorMarkerNotFound) {
-			return nil, errors.Wrap(ErrBlockDeletionMarkNotFound, err.Error())
+	// Read the deletion mark without metadata.ReadMarker(), because it fails on any version
+	// other than the latest one, while we want to tolerate the ones we know about.
+	r, err := w.bkt.ReaderWithExpectedErrs(w.bkt.IsObjNotFoundErr).Get(ctx, markFile)
+	if err != nil {
+		if w.bkt.IsObjNotFoundErr(err) {
+			return nil, errors.Wrap(ErrBlockDeletionMarkNotFound, metadata.ErrorMarkerNotFound.Error())
 		}
-		if errors.Is(err, metadata.ErrorUnmarshalMarker) {
-			return nil, errors.Wrap(ErrBlockDeletionMarkCorrupted, err.Error())
+		return nil, errors.Wrapf(err, "get file: %s", markFile)
+	}
+	defer runutil.CloseWithLogOnErr(w.logger, r, "close bucket block deletion mark reader")
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file: %s", markFile)
+	}
+
+	m := metadata.DeletionMark{}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, errors.Wrapf(ErrBlockDeletionMarkCorrupted, "file: %s; err: %v", markFile, err.Error())
+	}
+
+	switch m.Version {
+	case metadata.DeletionMarkVersion1:
+	case deletionMarkVersion0:
+		// Old marks may lack the block ID, which is implied by the mark location.
+		if m.ID == (ulid.ULID{}) {
+			m.ID = id
 		}
-		return nil, err
+	default:
+		return nil, errors.Wrapf(ErrBlockDeletionMarkUnknownVersion, "file: %s; version: %d", markFile, m.Version)
 	}
 
 	return BlockDeletionMarkFromThanosMarker(&m), nil
@@ -14,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -23,6 +24,7 @@ import (
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	"github.com/cortexproject/cortex/pkg/storage/parquet"
+	cortex_tsdb "github.com/cortexproject/cortex/pkg/storage/tsdb"
 	"github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
 )
 
@@ -68,6 +70,32 @@ func TestUpdater_UpdateIndex(t *testing.T) {
 		[]*metadata.DeletionMark{block4Mark})
 }
 
+func TestUpdater_UpdateIndex_ShouldInvalidateRemovedBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+
+	invalidator := &mockCacheInvalidator{}
+	w := NewUpdater(bkt, userID, nil, logger).WithCacheInvalidator(invalidator)
+	returnedIdx, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, invalidator.keys)
+
+	// Hard delete a block and update the index.
+	require.NoError(t, block.Delete(ctx, log.NewNopLogger(), bucket.NewUserBucketClient(userID, bkt, nil), block2.ULID))
+
+	returnedIdx, _, _, err = w.UpdateIndex(ctx, returnedIdx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ulid.ULID{block1.ULID}, returnedIdx.Blocks.GetULIDs())
+	assert.Equal(t, BlockMetadataCacheKeys(userID, block2.ULID), invalidator.keys)
+}
+
 func TestUpdater_UpdateIndex_ShouldSkipPartialBlocks(t *testing.T) {
 	const userID = "user-1"
 
@@ -216,6 +244,315 @@ func TestUpdater_UpdateIndex_ShouldSkipBlocksWithCorruptedMeta(t *testing.T) {
 	assert.Equal(t, nonCompactBlocks, int64(1))
 }
 
+func TestUpdater_UpdateIndex_ShouldTrackBlocksCompactionLevel(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+
+	// Overwrite a block's meta.json to simulate a compacted block.
+	block2.Compaction.Level = 3
+	content, err := json.Marshal(block2)
+	require.NoError(t, err)
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, block2.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+
+	w := NewUpdater(bkt, userID, nil, logger)
+	idx, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	assertBucketIndexEqual(t, idx, bkt, userID,
+		[]tsdb.BlockMeta{block1, block2},
+		[]*metadata.DeletionMark{})
+
+	for _, b := range idx.Blocks {
+		switch b.ID {
+		case block1.ULID:
+			assert.Equal(t, 1, b.CompactionLevel)
+			assert.False(t, b.IsCompacted())
+		case block2.ULID:
+			assert.Equal(t, 3, b.CompactionLevel)
+			assert.True(t, b.IsCompacted())
+		default:
+			t.Fatalf("unexpected block %s", b.ID)
+		}
+	}
+}
+
+func TestUpdater_UpdateIndex_ShouldTrackBlocksUploadTime(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+
+	w := NewUpdater(bkt, userID, nil, logger)
+	idx, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+
+	// The upload time should survive the index round trip.
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+	idx, err = ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+
+	uploadedAt := map[ulid.ULID]int64{}
+	for _, b := range idx.Blocks {
+		uploadedAt[b.ID] = b.UploadedAt
+	}
+	assert.Equal(t, map[ulid.ULID]int64{
+		block1.ULID: getBlockUploadedAt(t, bkt, userID, block1.ULID),
+		block2.ULID: getBlockUploadedAt(t, bkt, userID, block2.ULID),
+	}, uploadedAt)
+
+	// Both blocks are level 1 blocks, so the lag is the max among them.
+	expectedLag := max(
+		time.Unix(uploadedAt[block1.ULID], 0).Sub(time.UnixMilli(block1.MaxTime)),
+		time.Unix(uploadedAt[block2.ULID], 0).Sub(time.UnixMilli(block2.MaxTime)),
+	)
+	assert.Equal(t, expectedLag, idx.MaxShippingLag())
+}
+
+func TestUpdater_UpdateIndex_ShouldCountBlockFilesIfEnabled(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage, made of 2 chunks segments.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+
+	for _, b := range []tsdb.BlockMeta{block1, block2} {
+		meta := metadata.Meta{
+			BlockMeta: b,
+			Thanos: metadata.Thanos{
+				Files: []metadata.File{{RelPath: "chunks/000001"}, {RelPath: "chunks/000002"}, {RelPath: "index"}, {RelPath: "meta.json"}},
+			},
+		}
+		content, err := json.Marshal(meta)
+		require.NoError(t, err)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, b.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, b.ULID.String(), "chunks", "000001"), strings.NewReader("")))
+	}
+
+	// The second chunks segment of the second block is missing.
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, block1.ULID.String(), "chunks", "000002"), strings.NewReader("")))
+
+	idx, _, _, err := NewUpdater(bkt, userID, nil, logger).UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	for _, b := range idx.Blocks {
+		assert.Zero(t, b.NumFiles)
+	}
+
+	idx, _, _, err = NewUpdater(bkt, userID, nil, logger).WithBlockFilesCount().UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+
+	numFiles := map[ulid.ULID]int{}
+	for _, b := range idx.Blocks {
+		numFiles[b.ID] = b.NumFiles
+	}
+	assert.Equal(t, map[ulid.ULID]int{block1.ULID: 4, block2.ULID: 3}, numFiles)
+
+	// The block missing a chunks segment is reported by the validator.
+	unexpected := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	require.NoError(t, ValidateBlocksNumFiles(false, unexpected)(idx))
+	require.ErrorIs(t, ValidateBlocksNumFiles(true, unexpected)(idx), ErrIndexBlockUnexpectedNumFiles)
+	assert.Equal(t, float64(2), prom_testutil.ToFloat64(unexpected))
+}
+
+func TestUpdater_UpdateIndex_ShouldTrackEmptyBlocks(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage: the first one without samples, and the last one without stats,
+	// which isn't considered empty.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block1.Stats.NumSeries = 10
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	block2.Stats.NumSamples = 100
+	block3 := testutil.MockStorageBlock(t, bkt, userID, 30, 40)
+	for _, b := range []tsdb.BlockMeta{block1, block2, block3} {
+		content, err := json.Marshal(metadata.Meta{BlockMeta: b, Thanos: metadata.Thanos{Files: []metadata.File{}}})
+		require.NoError(t, err)
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, b.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+	}
+
+	emptyBlocks := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+	idx, _, _, err := NewUpdater(bkt, userID, nil, logger).WithEmptyBlocksGauge(emptyBlocks).UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	assertBucketIndexEqual(t, idx, bkt, userID, []tsdb.BlockMeta{block1, block2, block3}, []*metadata.DeletionMark{})
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(emptyBlocks))
+
+	// The empty block is reported by the validator, and only removed if the exclusion is enabled.
+	empty := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	require.NoError(t, ValidateEmptyBlocks(false, empty)(idx))
+	require.Len(t, idx.Blocks, 3)
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(empty))
+
+	// The empty block already in the index is excluded on the next update, if enabled.
+	emptyBlocks.Set(0)
+	w := NewUpdater(bkt, userID, nil, logger).WithEmptyBlocksExcluded().WithEmptyBlocksGauge(emptyBlocks)
+	idx, _, _, err = w.UpdateIndex(ctx, idx)
+	require.NoError(t, err)
+	assertBucketIndexEqual(t, idx, bkt, userID, []tsdb.BlockMeta{block2, block3}, []*metadata.DeletionMark{})
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(emptyBlocks))
+	require.Len(t, w.ExcludedEmptyBlocks(), 1)
+	assert.Equal(t, block1.ULID, w.ExcludedEmptyBlocks()[0].ID)
+
+	// The excluded empty block is read again, and still excluded, on the following update.
+	idx, _, _, err = w.UpdateIndex(ctx, idx)
+	require.NoError(t, err)
+	assertBucketIndexEqual(t, idx, bkt, userID, []tsdb.BlockMeta{block2, block3}, []*metadata.DeletionMark{})
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(emptyBlocks))
+	require.Len(t, w.ExcludedEmptyBlocks(), 1)
+	assert.Equal(t, block1.ULID, w.ExcludedEmptyBlocks()[0].ID)
+}
+
+func TestUpdater_UpdateIndex_ShouldTrackBlocksCompactorShard(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+
+	// Overwrite a block's meta.json to simulate a block produced by a compactor shard.
+	content, err := json.Marshal(metadata.Meta{
+		BlockMeta: block2,
+		Thanos: metadata.Thanos{
+			Version: metadata.ThanosVersion1,
+			Labels:  map[string]string{cortex_tsdb.CompactorShardIDExternalLabel: "3_of_8"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, block2.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+
+	w := NewUpdater(bkt, userID, nil, logger)
+	idx, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, idx.Blocks, 2)
+
+	for _, b := range idx.Blocks {
+		switch b.ID {
+		case block1.ULID:
+			assert.Equal(t, "", b.CompactorShard)
+		case block2.ULID:
+			assert.Equal(t, "3_of_8", b.CompactorShard)
+			assert.Equal(t, map[string]string{cortex_tsdb.CompactorShardIDExternalLabel: "3_of_8"}, b.Labels)
+		default:
+			t.Fatalf("unexpected block %s", b.ID)
+		}
+	}
+}
+
+func TestUpdater_UpdateIndex_ShouldTrackBlocksSources(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	block3 := testutil.MockStorageBlock(t, bkt, userID, 10, 30)
+
+	// Overwrite a block's meta.json to simulate a block compacted from the other ones.
+	block3.Compaction.Level = 2
+	block3.Compaction.Sources = []ulid.ULID{block1.ULID, block2.ULID}
+	content, err := json.Marshal(metadata.Meta{BlockMeta: block3, Thanos: metadata.Thanos{Version: metadata.ThanosVersion1}})
+	require.NoError(t, err)
+	require.NoError(t, bkt.Upload(ctx, path.Join(userID, block3.ULID.String(), metadata.MetaFilename), bytes.NewReader(content)))
+
+	w := NewUpdater(bkt, userID, nil, logger)
+	idx, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, idx.Blocks, 3)
+
+	for _, b := range idx.Blocks {
+		switch b.ID {
+		case block1.ULID, block2.ULID:
+			assert.Empty(t, b.Sources)
+			assert.Equal(t, []ulid.ULID{block3.ULID}, Blocks(idx.BlocksSuperseding(b.ID)).GetULIDs())
+		case block3.ULID:
+			assert.Equal(t, []ulid.ULID{block1.ULID, block2.ULID}, b.Sources)
+		default:
+			t.Fatalf("unexpected block %s", b.ID)
+		}
+	}
+
+	// The sources should be preserved when the index is written and read back.
+	require.NoError(t, WriteIndex(ctx, bkt, userID, nil, idx))
+	actual, err := ReadIndex(ctx, bkt, userID, nil, logger)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, idx.Blocks, actual.Blocks)
+}
+
+func TestUpdater_UpdateIndex_ShouldTrackBlocksMarkedForNoCompaction(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	testutil.MockStorageNonCompactionMark(t, bkt, userID, block2)
+
+	w := NewUpdater(bkt, userID, nil, logger)
+	idx, _, noCompactBlocks, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), noCompactBlocks)
+	require.Len(t, idx.Blocks, 2)
+	assert.Equal(t, []ulid.ULID{block2.ULID}, Blocks(idx.NoCompactBlocks()).GetULIDs())
+
+	// Mark the other block for no compaction, and remove the marker of the first one.
+	testutil.MockStorageNonCompactionMark(t, bkt, userID, block1)
+	require.NoError(t, bkt.Delete(ctx, path.Join(userID, block2.ULID.String(), metadata.NoCompactMarkFilename)))
+
+	idx, _, noCompactBlocks, err = w.UpdateIndex(ctx, idx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), noCompactBlocks)
+	assert.Equal(t, []ulid.ULID{block1.ULID}, Blocks(idx.NoCompactBlocks()).GetULIDs())
+
+	// Blocks without the no-compact marker should not be flagged.
+	require.NoError(t, bkt.Delete(ctx, path.Join(userID, block1.ULID.String(), metadata.NoCompactMarkFilename)))
+
+	idx, _, noCompactBlocks, err = w.UpdateIndex(ctx, idx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), noCompactBlocks)
+	assert.Empty(t, idx.NoCompactBlocks())
+}
+
 func TestUpdater_UpdateIndex_ShouldSkipCorruptedDeletionMarks(t *testing.T) {
 	const userID = "user-1"
 
@@ -247,6 +584,82 @@ func TestUpdater_UpdateIndex_ShouldSkipCorruptedDeletionMarks(t *testing.T) {
 	assert.Equal(t, nonCompactBlocks, int64(1))
 }
 
+func TestUpdater_UpdateIndex_ShouldSupportMultipleDeletionMarkVersions(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	block1 := testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	block2 := testutil.MockStorageBlock(t, bkt, userID, 20, 30)
+	block3 := testutil.MockStorageBlock(t, bkt, userID, 30, 40)
+	block4 := testutil.MockStorageBlock(t, bkt, userID, 40, 50)
+
+	fixtures := map[ulid.ULID]string{
+		// Version 0: written before the version field was introduced, without the block ID.
+		block2.ULID: `{"deletion_time":1000}`,
+		// Version 1: the current version.
+		block3.ULID: `{"id":"` + block3.ULID.String() + `","deletion_time":2000,"version":1,"details":"test"}`,
+		// Unknown version.
+		block4.ULID: `{"id":"` + block4.ULID.String() + `","deletion_time":3000,"version":2}`,
+	}
+	for id, content := range fixtures {
+		require.NoError(t, bkt.Upload(ctx, path.Join(userID, id.String(), metadata.DeletionMarkFilename), strings.NewReader(content)))
+	}
+
+	unknownVersions := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	w := NewUpdater(bkt, userID, nil, logger).WithUnknownDeletionMarkVersionsCounter(unknownVersions)
+	idx, partials, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+	assertBucketIndexEqual(t, idx, bkt, userID,
+		[]tsdb.BlockMeta{block1, block2, block3, block4},
+		[]*metadata.DeletionMark{
+			{ID: block2.ULID, DeletionTime: 1000},
+			{ID: block3.ULID, DeletionTime: 2000},
+		})
+	assert.Empty(t, partials)
+	assert.Equal(t, float64(1), prom_testutil.ToFloat64(unknownVersions))
+}
+
+func TestUpdater_UpdateIndex_ShouldObservePhaseDurations(t *testing.T) {
+	const userID = "user-1"
+
+	bkt, _ := testutil.PrepareFilesystemBucket(t)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Mock some blocks in the storage.
+	bkt = BucketWithGlobalMarkers(bkt)
+	testutil.MockStorageBlock(t, bkt, userID, 10, 20)
+	testutil.MockStorageDeletionMark(t, bkt, userID, testutil.MockStorageBlock(t, bkt, userID, 20, 30))
+
+	blocksList := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "blocks_list"})
+	marksList := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "marks_list"})
+	metaFetch := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "meta_fetch"})
+	marksFetch := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "marks_fetch"})
+
+	w := NewUpdater(bkt, userID, nil, logger).WithPhaseDurationHistograms(blocksList, marksList, metaFetch, marksFetch)
+	_, _, _, err := w.UpdateIndex(ctx, nil)
+	require.NoError(t, err)
+
+	// Both the blocks and the deletion marks are listed once.
+	assert.Equal(t, uint64(1), histogramSampleCount(t, blocksList))
+	assert.Equal(t, uint64(1), histogramSampleCount(t, marksList))
+	assert.Equal(t, uint64(1), histogramSampleCount(t, metaFetch))
+	assert.Equal(t, uint64(1), histogramSampleCount(t, marksFetch))
+}
+
+func histogramSampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
 func TestUpdater_UpdateIndex_ShouldSkipBlockMarkedForDeletionWithMissingGlobalMarker(t *testing.T) {
 	const userID = "user-1"
 
@@ -297,6 +710,7 @@ func TestUpdater_UpdateIndex_NoTenantInTheBucket(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, IndexVersion1, idx.Version)
 		assert.InDelta(t, time.Now().Unix(), idx.UpdatedAt, 2)
+		assert.Equal(t, UpdateJitterSeed(userID), idx.UpdateJitterSeed)
 		assert.Len(t, idx.Blocks, 0)
 		assert.Len(t, idx.BlockDeletionMarks, 0)
 		assert.Empty(t, partials)
@@ -456,6 +870,13 @@ func getBlockUploadedAt(t testing.TB, bkt objstore.Bucket, userID string, blockI
 	return attrs.LastModified.Unix()
 }
 
+func isBlockMarkedForNoCompact(t testing.TB, bkt objstore.Bucket, userID string, blockID ulid.ULID) bool {
+	exists, err := bkt.Exists(context.Background(), path.Join(userID, NoCompactMarkFilenameMarkFilepath(blockID)))
+	require.NoError(t, err)
+
+	return exists
+}
+
 func assertBucketIndexEqual(t testing.TB, idx *Index, bkt objstore.Bucket, userID string, expectedBlocks []tsdb.BlockMeta, expectedDeletionMarks []*metadata.DeletionMark) {
 	assert.Equal(t, IndexVersion1, idx.Version)
 	assert.InDelta(t, time.Now().Unix(), idx.UpdatedAt, 2)
@@ -464,10 +885,17 @@ func assertBucketIndexEqual(t testing.TB, idx *Index, bkt objstore.Bucket, userI
 	var expectedBlockEntries []*Block
 	for _, b := range expectedBlocks {
 		expectedBlockEntries = append(expectedBlockEntries, &Block{
-			ID:         b.ULID,
-			MinTime:    b.MinTime,
-			MaxTime:    b.MaxTime,
-			UploadedAt: getBlockUploadedAt(t, bkt, userID, b.ULID),
+			ID:              b.ULID,
+			MinTime:         b.MinTime,
+			MaxTime:         b.MaxTime,
+			CompactionLevel: b.Compaction.Level,
+			NumSeries:       b.Stats.NumSeries,
+			NumSamples:      b.Stats.NumSamples,
+			Empty:           b.Stats.NumSamples == 0 && b.Stats != (tsdb.BlockStats{}),
+			UploadedAt:      getBlockUploadedAt(t, bkt, userID, b.ULID),
+			NoCompact:       isBlockMarkedForNoCompact(t, bkt, userID, b.ULID),
+
+			ChunkFormatVersion: b.Version,
 		})
 	}
 
@@ -493,10 +921,17 @@ func assertBucketIndexEqualWithParquet(t testing.TB, idx *Index, bkt objstore.Bu
 	var expectedBlockEntries []*Block
 	for _, b := range expectedBlocks {
 		block := &Block{
-			ID:         b.ULID,
-			MinTime:    b.MinTime,
-			MaxTime:    b.MaxTime,
-			UploadedAt: getBlockUploadedAt(t, bkt, userID, b.ULID),
+			ID:              b.ULID,
+			MinTime:         b.MinTime,
+			MaxTime:         b.MaxTime,
+			CompactionLevel: b.Compaction.Level,
+			NumSeries:       b.Stats.NumSeries,
+			NumSamples:      b.Stats.NumSamples,
+			Empty:           b.Stats.NumSamples == 0 && b.Stats != (tsdb.BlockStats{}),
+			UploadedAt:      getBlockUploadedAt(t, bkt, userID, b.ULID),
+			NoCompact:       isBlockMarkedForNoCompact(t, bkt, userID, b.ULID),
+
+			ChunkFormatVersion: b.Version,
 		}
 		if meta, ok := parquetBlocks[b.ULID.String()]; ok {
 			block.Parquet = meta
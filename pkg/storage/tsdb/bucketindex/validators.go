@@ -0,0 +1,179 @@
+package bucketindex
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+)
+
+var (
+	ErrIndexBlocksNotSorted                 = errors.New("bucket index blocks not sorted")
+	ErrIndexDeletionMarkBeforeBlockCreation = errors.New("bucket index deletion mark predates the block creation")
+	ErrIndexBlockUnexpectedNumFiles         = errors.New("bucket index block has an unexpected number of files")
+)
+
+// IndexValidator validates a bucket index after it has been read from the storage.
+// A validator can repair the index in place, or return an error if the index is invalid.
+type IndexValidator func(idx *Index) error
+
+// ReadIndexWithValidators reads a bucket index from the bucket like ReadIndex, and then runs
+// the input validators on it, in order. The first validation error is returned.
+func ReadIndexWithValidators(ctx context.Context, bkt objstore.Bucket, userID string, cfgProvider bucket.TenantConfigProvider, logger log.Logger, validators ...IndexValidator) (*Index, error) {
+	idx, err := ReadIndex(ctx, bkt, userID, cfgProvider, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, validate := range validators {
+		if err := validate(idx); err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, nil
+}
+
+// ValidateBlocksOrder returns a validator checking the index blocks are sorted by min time, max time
+// and then ID. If repair is true, unsorted blocks are sorted in place, otherwise ErrIndexBlocksNotSorted
+// is returned.
+func ValidateBlocksOrder(repair bool) IndexValidator {
+	return func(idx *Index) error {
+		if slices.IsSortedFunc(idx.Blocks, compareBlocks) {
+			return nil
+		}
+
+		if !repair {
+			return ErrIndexBlocksNotSorted
+		}
+
+		slices.SortStableFunc(idx.Blocks, compareBlocks)
+		return nil
+	}
+}
+
+// ValidateDeletionMarksTime returns a validator checking the index deletion marks are not dated
+// before the creation of the block they reference, as given by the block ULID. Such marks are the
+// result of clock skew and would cause the block to be deleted earlier than the configured delay.
+// Skewed marks are counted in the input counter, if any. If ignore is true, the skewed marks are
+// removed from the index, otherwise ErrIndexDeletionMarkBeforeBlockCreation is returned.
+func ValidateDeletionMarksTime(ignore bool, skewed prometheus.Counter) IndexValidator {
+	return func(idx *Index) error {
+		valid := make(BlockDeletionMarks, 0, len(idx.BlockDeletionMarks))
+		for _, mark := range idx.BlockDeletionMarks {
+			// The deletion time has seconds precision, while the block ULID has milliseconds one.
+			if mark.DeletionTime < int64(mark.ID.Time()/1000) {
+				continue
+			}
+			valid = append(valid, mark)
+		}
+
+		numSkewed := len(idx.BlockDeletionMarks) - len(valid)
+		if numSkewed == 0 {
+			return nil
+		}
+
+		if skewed != nil {
+			skewed.Add(float64(numSkewed))
+		}
+
+		if !ignore {
+			return ErrIndexDeletionMarkBeforeBlockCreation
+		}
+
+		idx.BlockDeletionMarks = valid
+		return nil
+	}
+}
+
+// ValidateBlocksNumFiles returns a validator checking the number of files of the index blocks matches
+// the files a complete block is made of: the meta.json, the index and the chunks segments, plus up to
+// one deletion mark, no-compact mark and parquet converter mark. Fewer files are a sign of a block
+// whose upload didn't complete, eg. missing chunks segments. Only the blocks whose files have been
+// counted and whose segments format is known are checked.
+//
+// The blocks with an unexpected number of files are counted in the input counter, if any. If strict
+// is true, ErrIndexBlockUnexpectedNumFiles is returned, otherwise the index is left untouched.
+func ValidateBlocksNumFiles(strict bool, unexpected prometheus.Counter) IndexValidator {
+	return func(idx *Index) error {
+		numUnexpected := 0
+		for _, b := range idx.Blocks {
+			minFiles, maxFiles, ok := expectedBlockNumFiles(b)
+			if ok && (b.NumFiles < minFiles || b.NumFiles > maxFiles) {
+				numUnexpected++
+			}
+		}
+
+		if numUnexpected == 0 {
+			return nil
+		}
+
+		if unexpected != nil {
+			unexpected.Add(float64(numUnexpected))
+		}
+
+		if strict {
+			return errors.Wrapf(ErrIndexBlockUnexpectedNumFiles, "%d blocks", numUnexpected)
+		}
+		return nil
+	}
+}
+
+// ValidateEmptyBlocks returns a validator checking the index has no blocks without samples, as
+// reported by their meta.json stats when added to the index. Such blocks are the sign of an ingestion
+// anomaly, and only add overhead to the queries.
+//
+// The empty blocks are counted in the input counter, if any. If exclude is true, they're removed from
+// the index, otherwise the index is left untouched.
+func ValidateEmptyBlocks(exclude bool, empty prometheus.Counter) IndexValidator {
+	return func(idx *Index) error {
+		nonEmpty := make([]*Block, 0, len(idx.Blocks))
+		for _, b := range idx.Blocks {
+			if !b.Empty {
+				nonEmpty = append(nonEmpty, b)
+			}
+		}
+
+		numEmpty := len(idx.Blocks) - len(nonEmpty)
+		if numEmpty == 0 {
+			return nil
+		}
+
+		if empty != nil {
+			empty.Add(float64(numEmpty))
+		}
+
+		if exclude {
+			idx.Blocks = nonEmpty
+		}
+		return nil
+	}
+}
+
+// expectedBlockNumFiles returns the min and max number of files of the input block, and false if
+// they're unknown.
+func expectedBlockNumFiles(b *Block) (int, int, bool) {
+	if b.NumFiles == 0 || b.SegmentsFormat == SegmentsFormatUnknown {
+		return 0, 0, false
+	}
+
+	// The meta.json, the index and the chunks segments, plus the optional markers.
+	minFiles := 2 + b.SegmentsNum
+	return minFiles, minFiles + 3, true
+}
+
+func compareBlocks(a, b *Block) int {
+	if c := cmp.Compare(a.MinTime, b.MinTime); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.MaxTime, b.MaxTime); c != 0 {
+		return c
+	}
+	return a.ID.Compare(b.ID)
+}
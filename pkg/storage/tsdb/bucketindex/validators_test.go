@@ -0,0 +1,210 @@
+package bucketindex
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestReadIndexWithValidators_ValidateBlocksOrder(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	block1 := ulid.MustNew(1, nil)
+	block2 := ulid.MustNew(2, nil)
+	block3 := ulid.MustNew(3, nil)
+
+	sorted := Blocks{
+		{ID: block1, MinTime: 10, MaxTime: 20},
+		{ID: block2, MinTime: 10, MaxTime: 20},
+		{ID: block3, MinTime: 20, MaxTime: 30},
+	}
+	unsorted := Blocks{sorted[2], sorted[1], sorted[0]}
+
+	tests := map[string]struct {
+		blocks         Blocks
+		repair         bool
+		expectedErr    error
+		expectedBlocks Blocks
+	}{
+		"sorted blocks": {
+			blocks:         sorted,
+			expectedBlocks: sorted,
+		},
+		"unsorted blocks without repair": {
+			blocks:      unsorted,
+			expectedErr: ErrIndexBlocksNotSorted,
+		},
+		"unsorted blocks with repair": {
+			blocks:         unsorted,
+			repair:         true,
+			expectedBlocks: sorted,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+			require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, Blocks: testData.blocks}))
+
+			idx, err := ReadIndexWithValidators(ctx, bkt, userID, nil, logger, ValidateBlocksOrder(testData.repair))
+			if testData.expectedErr != nil {
+				require.Equal(t, testData.expectedErr, err)
+				require.Nil(t, idx)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedBlocks, idx.Blocks)
+		})
+	}
+}
+
+func TestReadIndexWithValidators_ValidateDeletionMarksTime(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// Blocks created at 1000s and 2000s, plus some milliseconds.
+	block1 := ulid.MustNew(1000500, nil)
+	block2 := ulid.MustNew(2000500, nil)
+	blocks := Blocks{
+		{ID: block1, MinTime: 10, MaxTime: 20},
+		{ID: block2, MinTime: 20, MaxTime: 30},
+	}
+
+	validMark := &BlockDeletionMark{ID: block1, DeletionTime: 1000}
+	skewedMark := &BlockDeletionMark{ID: block2, DeletionTime: 1999}
+
+	tests := map[string]struct {
+		marks          BlockDeletionMarks
+		ignore         bool
+		expectedErr    error
+		expectedMarks  BlockDeletionMarks
+		expectedSkewed float64
+	}{
+		"no skewed marks": {
+			marks:         BlockDeletionMarks{validMark},
+			expectedMarks: BlockDeletionMarks{validMark},
+		},
+		"skewed marks without ignore": {
+			marks:          BlockDeletionMarks{validMark, skewedMark},
+			expectedErr:    ErrIndexDeletionMarkBeforeBlockCreation,
+			expectedSkewed: 1,
+		},
+		"skewed marks with ignore": {
+			marks:          BlockDeletionMarks{validMark, skewedMark},
+			ignore:         true,
+			expectedMarks:  BlockDeletionMarks{validMark},
+			expectedSkewed: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+			require.NoError(t, WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1, Blocks: blocks, BlockDeletionMarks: testData.marks}))
+
+			skewed := prometheus.NewCounter(prometheus.CounterOpts{Name: "skewed_marks"})
+			idx, err := ReadIndexWithValidators(ctx, bkt, userID, nil, logger, ValidateDeletionMarksTime(testData.ignore, skewed))
+			assert.Equal(t, testData.expectedSkewed, prom_testutil.ToFloat64(skewed))
+
+			if testData.expectedErr != nil {
+				require.Equal(t, testData.expectedErr, err)
+				require.Nil(t, idx)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedMarks, idx.BlockDeletionMarks)
+		})
+	}
+}
+
+func TestReadIndexWithValidators_ShouldReturnReadErrors(t *testing.T) {
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+
+	idx, err := ReadIndexWithValidators(context.Background(), bkt, "user-1", nil, log.NewNopLogger(), ValidateBlocksOrder(true))
+	require.Equal(t, ErrIndexNotFound, err)
+	require.Nil(t, idx)
+}
+
+func TestValidateBlocksNumFiles(t *testing.T) {
+	tests := map[string]struct {
+		block              *Block
+		expectedUnexpected float64
+	}{
+		"complete block": {
+			block: &Block{SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2, NumFiles: 4},
+		},
+		"complete block with markers": {
+			block: &Block{SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2, NumFiles: 7},
+		},
+		"block missing files": {
+			block:              &Block{SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2, NumFiles: 3},
+			expectedUnexpected: 1,
+		},
+		"block with too many files": {
+			block:              &Block{SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2, NumFiles: 8},
+			expectedUnexpected: 1,
+		},
+		"block whose files have not been counted": {
+			block: &Block{SegmentsFormat: SegmentsFormat1Based6Digits, SegmentsNum: 2},
+		},
+		"block with unknown segments format": {
+			block: &Block{NumFiles: 1},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			unexpected := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+			err := ValidateBlocksNumFiles(true, unexpected)(&Index{Blocks: Blocks{testData.block}})
+
+			if testData.expectedUnexpected > 0 {
+				require.ErrorIs(t, err, ErrIndexBlockUnexpectedNumFiles)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedUnexpected, prom_testutil.ToFloat64(unexpected))
+		})
+	}
+}
+
+func TestValidateEmptyBlocks(t *testing.T) {
+	emptyBlock := &Block{ID: ulid.MustNew(1, nil), Empty: true}
+	nonEmptyBlock := &Block{ID: ulid.MustNew(2, nil), NumSamples: 10}
+
+	for _, exclude := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exclude=%t", exclude), func(t *testing.T) {
+			empty := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+			idx := &Index{Blocks: Blocks{emptyBlock, nonEmptyBlock}}
+			require.NoError(t, ValidateEmptyBlocks(exclude, empty)(idx))
+
+			if exclude {
+				assert.Equal(t, Blocks{nonEmptyBlock}, idx.Blocks)
+			} else {
+				assert.Equal(t, Blocks{emptyBlock, nonEmptyBlock}, idx.Blocks)
+			}
+			assert.Equal(t, float64(1), prom_testutil.ToFloat64(empty))
+
+			// An index without empty blocks is left untouched.
+			idx = &Index{Blocks: Blocks{nonEmptyBlock}}
+			require.NoError(t, ValidateEmptyBlocks(exclude, empty)(idx))
+			assert.Equal(t, Blocks{nonEmptyBlock}, idx.Blocks)
+			assert.Equal(t, float64(1), prom_testutil.ToFloat64(empty))
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package bucketindex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+
+	"github.com/cortexproject/cortex/pkg/storage/bucket"
+	"github.com/cortexproject/cortex/pkg/util/multierror"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+var ErrWriteCoalescerStopped = errors.New("bucket index write coalescer is stopped")
+
+// WriteCoalescer delays the bucket index writes by a window and merges the writes of the same
+// tenant requested within the window, so that only the latest index is written. It saves object
+// storage operations when the index of a tenant is updated several times in quick succession,
+// eg. when several blocks are shipped one after another. The pending writes are flushed when
+// the service is stopped.
+type WriteCoalescer struct {
+	services.Service
+
+	bkt         objstore.Bucket
+	cfgProvider bucket.TenantConfigProvider
+	window      time.Duration
+	logger      log.Logger
+
+	mtx     sync.Mutex
+	tenants map[string]*coalescedWrite
+	stopped bool
+
+	// Metrics.
+	writes          prometheus.Counter
+	writeFailures   prometheus.Counter
+	coalescedWrites prometheus.Counter
+}
+
+// coalescedWrite holds the pending write of a tenant's index.
+type coalescedWrite struct {
+	// Serializes the writes of the tenant, so that an older index never overwrites a newer one.
+	writeMtx sync.Mutex
+
+	// The index to write, nil if there's no pending write. Protected by WriteCoalescer.mtx.
+	pending *Index
+	timer   *time.Timer
+}
+
+// NewWriteCoalescer returns a WriteCoalescer delaying the writes by the input window.
+func NewWriteCoalescer(bkt objstore.Bucket, cfgProvider bucket.TenantConfigProvider, window time.Duration, logger log.Logger, reg prometheus.Registerer) *WriteCoalescer {
+	c := &WriteCoalescer{
+		bkt:         bkt,
+		cfgProvider: cfgProvider,
+		window:      window,
+		logger:      logger,
+		tenants:     map[string]*coalescedWrite{},
+
+		writes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_coalescer_writes_total",
+			Help: "Total number of bucket index writes issued by the write coalescer.",
+		}),
+		writeFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_coalescer_write_failures_total",
+			Help: "Total number of bucket index writes issued by the write coalescer which failed.",
+		}),
+		coalescedWrites: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_bucket_index_coalesced_writes_total",
+			Help: "Total number of bucket index writes which have been merged into a later write of the same tenant.",
+		}),
+	}
+
+	c.Service = services.NewIdleService(nil, c.stopping)
+	return c
+}
+
+func (c *WriteCoalescer) stopping(_ error) error {
+	c.mtx.Lock()
+	c.stopped = true
+	c.mtx.Unlock()
+
+	return c.Flush(context.Background())
+}
+
+// Write schedules the write of the tenant's index once the window expires. If a write of the
+// same tenant is already pending, the pending index is replaced by the input one. The write
+// errors are logged and tracked by the metrics, since they happen asynchronously.
+func (c *WriteCoalescer) Write(userID string, idx *Index) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stopped {
+		return ErrWriteCoalescerStopped
+	}
+
+	w := c.tenants[userID]
+	if w == nil {
+		w = &coalescedWrite{}
+		c.tenants[userID] = w
+	}
+
+	if w.pending != nil {
+		c.coalescedWrites.Inc()
+	} else {
+		w.timer = time.AfterFunc(c.window, func() {
+			if err := c.flushTenant(context.Background(), userID, w); err != nil {
+				level.Warn(c.logger).Log("msg", "failed to write coalesced bucket index", "user", userID, "err", err)
+			}
+		})
+	}
+	w.pending = idx
+
+	return nil
+}
+
+// Flush immediately writes all the pending indexes.
+func (c *WriteCoalescer) Flush(ctx context.Context) error {
+	c.mtx.Lock()
+	pending := make(map[string]*coalescedWrite, len(c.tenants))
+	for userID, w := range c.tenants {
+		if w.pending != nil {
+			w.timer.Stop()
+			pending[userID] = w
+		}
+	}
+	c.mtx.Unlock()
+
+	errs := multierror.New()
+	for userID, w := range pending {
+		errs.Add(errors.Wrapf(c.flushTenant(ctx, userID, w), "user %s", userID))
+	}
+	return errs.Err()
+}
+
+// flushTenant writes the pending index of the tenant, if any.
+func (c *WriteCoalescer) flushTenant(ctx context.Context, userID string, w *coalescedWrite) error {
+	w.writeMtx.Lock()
+	defer w.writeMtx.Unlock()
+
+	c.mtx.Lock()
+	idx := w.pending
+	w.pending = nil
+	c.mtx.Unlock()
+
+	if idx == nil {
+		// Already written by a flush.
+		return nil
+	}
+
+	c.writes.Inc()
+	err := WriteIndex(ctx, c.bkt, userID, c.cfgProvider, idx)
+	if err != nil {
+		c.writeFailures.Inc()
+	}
+
+	// Release the tenant, unless a new write has been requested in the meanwhile.
+	c.mtx.Lock()
+	if w.pending == nil && c.tenants[userID] == w {
+		delete(c.tenants, userID)
+	}
+	c.mtx.Unlock()
+
+	return err
+}
@@ -0,0 +1,78 @@
+package bucketindex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+	"github.com/cortexproject/cortex/pkg/util/services"
+)
+
+func TestWriteCoalescer_ShouldMergeRapidSuccessiveWritesIntoOne(t *testing.T) {
+	const userID = "user-1"
+
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	c := NewWriteCoalescer(bkt, nil, 100*time.Millisecond, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, services.StartAndAwaitRunning(ctx, c))
+	t.Cleanup(func() {
+		require.NoError(t, services.StopAndAwaitTerminated(ctx, c))
+	})
+
+	// Simulate a block shipped in quick succession for each update.
+	idx := &Index{Version: IndexVersion1}
+	for i := 1; i <= 10; i++ {
+		idx = &Index{Version: IndexVersion1, Blocks: append(Blocks{{ID: ulid.MustNew(uint64(i), nil)}}, idx.Blocks...)}
+		require.NoError(t, c.Write(userID, idx))
+	}
+
+	require.Eventually(t, func() bool {
+		return prom_testutil.ToFloat64(c.writes) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(9), prom_testutil.ToFloat64(c.coalescedWrites))
+	assert.Equal(t, float64(0), prom_testutil.ToFloat64(c.writeFailures))
+
+	// The latest index has been written.
+	actual, err := ReadIndex(ctx, bkt, userID, nil, log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Len(t, actual.Blocks, 10)
+
+	// A write after the window is not merged with the previous one.
+	require.NoError(t, c.Write(userID, &Index{Version: IndexVersion1}))
+	require.Eventually(t, func() bool {
+		return prom_testutil.ToFloat64(c.writes) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(9), prom_testutil.ToFloat64(c.coalescedWrites))
+}
+
+func TestWriteCoalescer_ShouldFlushThePendingWritesOnStop(t *testing.T) {
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	c := NewWriteCoalescer(bkt, nil, time.Hour, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, services.StartAndAwaitRunning(ctx, c))
+
+	require.NoError(t, c.Write("user-1", &Index{Version: IndexVersion1}))
+	require.NoError(t, c.Write("user-2", &Index{Version: IndexVersion1}))
+
+	_, err := ReadIndex(ctx, bkt, "user-1", nil, log.NewNopLogger())
+	require.ErrorIs(t, err, ErrIndexNotFound)
+
+	require.NoError(t, services.StopAndAwaitTerminated(ctx, c))
+	assert.Equal(t, float64(2), prom_testutil.ToFloat64(c.writes))
+
+	for _, userID := range []string{"user-1", "user-2"} {
+		_, err := ReadIndex(ctx, bkt, userID, nil, log.NewNopLogger())
+		require.NoError(t, err)
+	}
+
+	// No write is accepted once stopped.
+	require.ErrorIs(t, c.Write("user-1", &Index{Version: IndexVersion1}), ErrWriteCoalescerStopped)
+}
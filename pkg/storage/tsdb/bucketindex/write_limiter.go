@@ -0,0 +1,57 @@
+package bucketindex
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WriteLimiter bounds the number of concurrent bucket index writes across all the tenants, so that
+// the object storage isn't overwhelmed with concurrent uploads, and throttles them, when the indexes
+// of many tenants are written at the same time, eg. when they're all regenerated.
+type WriteLimiter struct {
+	slots chan struct{}
+
+	inflight     prometheus.Gauge
+	waitDuration prometheus.Histogram
+}
+
+// NewWriteLimiter returns a WriteLimiter allowing up to limit concurrent writes.
+func NewWriteLimiter(limit int, reg prometheus.Registerer) *WriteLimiter {
+	return &WriteLimiter{
+		slots: make(chan struct{}, limit),
+		inflight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_bucket_index_inflight_writes",
+			Help: "Number of in-flight bucket index writes.",
+		}),
+		waitDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_bucket_index_write_queue_wait_duration_seconds",
+			Help:    "Time spent waiting for the concurrent writes limit before writing a bucket index.",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60},
+		}),
+	}
+}
+
+// Write waits for a free slot and calls fn, which is expected to write a bucket index. The context
+// error is returned without calling fn if the context is done while waiting.
+func (l *WriteLimiter) Write(ctx context.Context, fn func() error) error {
+	start := time.Now()
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		l.waitDuration.Observe(time.Since(start).Seconds())
+		return ctx.Err()
+	}
+	l.waitDuration.Observe(time.Since(start).Seconds())
+
+	l.inflight.Inc()
+	defer func() {
+		l.inflight.Dec()
+		<-l.slots
+	}()
+
+	return fn()
+}
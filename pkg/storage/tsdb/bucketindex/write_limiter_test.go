@@ -0,0 +1,95 @@
+package bucketindex
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	cortex_testutil "github.com/cortexproject/cortex/pkg/storage/tsdb/testutil"
+)
+
+func TestWriteLimiter_ShouldRespectTheLimitUnderABurstOfWrites(t *testing.T) {
+	const (
+		limit      = 3
+		numTenants = 20
+	)
+
+	ctx := context.Background()
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	l := NewWriteLimiter(limit, prometheus.NewPedanticRegistry())
+
+	var (
+		inflight    atomic.Int32
+		maxInflight atomic.Int32
+		writers     sync.WaitGroup
+	)
+
+	writers.Add(numTenants)
+	for i := 0; i < numTenants; i++ {
+		userID := string(rune('a' + i))
+
+		go func() {
+			defer writers.Done()
+
+			err := l.Write(ctx, func() error {
+				current := inflight.Inc()
+				defer inflight.Dec()
+
+				for {
+					prev := maxInflight.Load()
+					if current <= prev || maxInflight.CompareAndSwap(prev, current) {
+						break
+					}
+				}
+
+				// Keep the slot long enough for the other writes to queue up.
+				time.Sleep(10 * time.Millisecond)
+				return WriteIndex(ctx, bkt, userID, nil, &Index{Version: IndexVersion1})
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	writers.Wait()
+
+	assert.Equal(t, int32(limit), maxInflight.Load())
+	assert.Equal(t, float64(0), prom_testutil.ToFloat64(l.inflight))
+
+	// All the indexes have been written.
+	for i := 0; i < numTenants; i++ {
+		_, err := ReadIndex(ctx, bkt, string(rune('a'+i)), nil, log.NewNopLogger())
+		require.NoError(t, err)
+	}
+}
+
+func TestWriteLimiter_ShouldNotWriteIfTheContextIsDoneWhileWaiting(t *testing.T) {
+	l := NewWriteLimiter(1, prometheus.NewPedanticRegistry())
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	go func() {
+		_ = l.Write(context.Background(), func() error {
+			close(started)
+			<-unblock
+			return nil
+		})
+	}()
+	<-started
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := l.Write(ctx, func() error {
+		t.Fatal("the write should not be called")
+		return nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
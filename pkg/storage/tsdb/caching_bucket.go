@@ -23,13 +23,26 @@ import (
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 
 	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/cortexproject/cortex/pkg/util/flagext"
 )
 
 var (
 	supportedBucketCacheBackends = []string{CacheBackendInMemory, CacheBackendMemcached, CacheBackendRedis}
 
+	// Only the remote caches are worth compressing, to save the network bandwidth and their memory.
+	supportedCompressedCacheBackends = []string{CacheBackendMemcached, CacheBackendRedis}
+
 	errUnsupportedBucketCacheBackend = errors.New("unsupported cache backend")
 	errDuplicatedBucketCacheBackend  = errors.New("duplicated cache backend")
+
+	errInvalidMetafileReadRepairMaxPerSecond = errors.New("metafile read repair max per second must be greater than 0")
+	errInvalidMetafileReadRepairTTL          = errors.New("metafile read repair TTL must be greater than 0")
+	errInvalidNegativeCacheTTL               = errors.New("negative cache TTL must be greater than or equal to 0")
+
+	errUnsupportedCacheCompressionCodec    = errors.New("unsupported cache compression codec")
+	errUnsupportedCacheCompressionBackend  = errors.New("unsupported cache compression backend, only the remote cache backends can be compressed")
+	errUnconfiguredCacheCompressionBackend = errors.New("cache compression backend is not one of the configured cache backends")
+	errInvalidCacheCompressionMinSize      = errors.New("cache compression min size must be greater than or equal to 0")
 )
 
 const (
@@ -44,6 +57,8 @@ type BucketCacheBackend struct {
 	Memcached  MemcachedClientConfig       `yaml:"memcached"`
 	Redis      RedisClientConfig           `yaml:"redis"`
 	MultiLevel MultiLevelBucketCacheConfig `yaml:"multilevel"`
+
+	Compression BucketCacheCompressionConfig `yaml:"compression"`
 }
 
 // Validate the config.
@@ -85,6 +100,47 @@ func (cfg *BucketCacheBackend) Validate() error {
 		configuredBackends[backend] = struct{}{}
 	}
 
+	for _, backend := range cfg.Compression.Backends {
+		if _, ok := configuredBackends[backend]; !ok {
+			return errUnconfiguredCacheCompressionBackend
+		}
+	}
+
+	return cfg.Compression.Validate()
+}
+
+// BucketCacheCompressionConfig configures the compression of the values stored to the levels of a
+// bucket cache.
+type BucketCacheCompressionConfig struct {
+	Backends     flagext.StringSliceCSV `yaml:"backends"`
+	Codec        string                 `yaml:"codec"`
+	MinSizeBytes int                    `yaml:"min_size_bytes"`
+}
+
+func (cfg *BucketCacheCompressionConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
+	f.Var(&cfg.Backends, prefix+"backends", fmt.Sprintf("[Experimental] Comma-separated list of the cache backends whose values are compressed before being stored, among (%s). The values stored uncompressed are still read once the compression is enabled, so that it can be enabled on a live cache. Empty to disable the compression.", strings.Join(supportedCompressedCacheBackends, ", ")))
+	f.StringVar(&cfg.Codec, prefix+"codec", CacheCompressionSnappy, fmt.Sprintf("[Experimental] The codec used to compress the cache values. Supported values: %s.", strings.Join(supportedCacheCompressionCodecs, ", ")))
+	f.IntVar(&cfg.MinSizeBytes, prefix+"min-size-bytes", 1024, "[Experimental] The min size in bytes of the cache values to compress. Smaller values are stored uncompressed.")
+}
+
+// Validate the config.
+func (cfg *BucketCacheCompressionConfig) Validate() error {
+	if len(cfg.Backends) == 0 {
+		return nil
+	}
+
+	for _, backend := range cfg.Backends {
+		if !util.StringsContain(supportedCompressedCacheBackends, backend) {
+			return errUnsupportedCacheCompressionBackend
+		}
+	}
+	if !util.StringsContain(supportedCacheCompressionCodecs, cfg.Codec) {
+		return errUnsupportedCacheCompressionCodec
+	}
+	if cfg.MinSizeBytes < 0 {
+		return errInvalidCacheCompressionMinSize
+	}
+
 	return nil
 }
 
@@ -106,6 +162,7 @@ func (cfg *ChunksCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix st
 	cfg.Redis.RegisterFlagsWithPrefix(f, prefix+"redis.")
 	cfg.InMemory.RegisterFlagsWithPrefix(f, prefix+"inmemory.", "chunks")
 	cfg.MultiLevel.RegisterFlagsWithPrefix(f, prefix+"multilevel.")
+	cfg.Compression.RegisterFlagsWithPrefix(f, prefix+"compression.")
 
 	f.Int64Var(&cfg.SubrangeSize, prefix+"subrange-size", 16000, "Size of each subrange that bucket object is split into for better caching.")
 	f.IntVar(&cfg.MaxGetRangeRequests, prefix+"max-get-range-requests", 3, "Maximum number of sub-GetRange requests that a single GetRange request can be split into when fetching chunks. Zero or negative value = unlimited number of sub-requests.")
@@ -158,6 +215,12 @@ type MetadataCacheConfig struct {
 	BucketIndexContentTTL    time.Duration `yaml:"bucket_index_content_ttl"`
 	BucketIndexMaxSize       int           `yaml:"bucket_index_max_size_bytes"`
 	PartitionedGroupsListTTL time.Duration `yaml:"partitioned_groups_list_ttl"`
+
+	MetafileReadRepairEnabled      bool          `yaml:"metafile_read_repair_enabled"`
+	MetafileReadRepairMaxPerSecond float64       `yaml:"metafile_read_repair_max_per_second"`
+	MetafileReadRepairTTL          time.Duration `yaml:"metafile_read_repair_ttl"`
+
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
 }
 
 func (cfg *MetadataCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
@@ -169,6 +232,7 @@ func (cfg *MetadataCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix
 	cfg.Redis.RegisterFlagsWithPrefix(f, prefix+"redis.")
 	cfg.InMemory.RegisterFlagsWithPrefix(f, prefix+"inmemory.", "metadata")
 	cfg.MultiLevel.RegisterFlagsWithPrefix(f, prefix+"multilevel.")
+	cfg.Compression.RegisterFlagsWithPrefix(f, prefix+"compression.")
 
 	f.DurationVar(&cfg.TenantsListTTL, prefix+"tenants-list-ttl", 15*time.Minute, "How long to cache list of tenants in the bucket.")
 	f.DurationVar(&cfg.TenantBlocksListTTL, prefix+"tenant-blocks-list-ttl", 5*time.Minute, "How long to cache list of blocks for each tenant.")
@@ -182,9 +246,22 @@ func (cfg *MetadataCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix
 	f.DurationVar(&cfg.BucketIndexContentTTL, prefix+"bucket-index-content-ttl", 5*time.Minute, "How long to cache content of the bucket index.")
 	f.IntVar(&cfg.BucketIndexMaxSize, prefix+"bucket-index-max-size-bytes", 1*1024*1024, "Maximum size of bucket index content to cache in bytes. Caching will be skipped if the content exceeds this size. This is useful to avoid network round trip for large content if the configured caching backend has an hard limit on cached items size (in this case, you should set this limit to the same limit in the caching backend).")
 	f.DurationVar(&cfg.PartitionedGroupsListTTL, prefix+"partitioned-groups-list-ttl", 0, "How long to cache list of partitioned groups for an user. 0 disables caching")
+	f.BoolVar(&cfg.MetafileReadRepairEnabled, prefix+"metafile-read-repair-enabled", false, "[Experimental] If enabled, a block meta.json missing from the object storage but found in the metadata cache is served from the cache and asynchronously uploaded back to the object storage, unless the block is marked for deletion or its index is missing. This writes to the object storage from the read path.")
+	f.Float64Var(&cfg.MetafileReadRepairMaxPerSecond, prefix+"metafile-read-repair-max-per-second", 1, "Maximum number of block meta.json uploaded back to the object storage per second, when the metafile read repair is enabled.")
+	f.DurationVar(&cfg.MetafileReadRepairTTL, prefix+"metafile-read-repair-ttl", 7*24*time.Hour, "How long to keep in the metadata cache a copy of each block meta.json read from the object storage, when the metafile read repair is enabled. The copy is only looked up once the meta.json content has expired from the cache and the meta.json is missing from the object storage, so it should be longer than the metafile content TTL.")
+	f.DurationVar(&cfg.NegativeCacheTTL, prefix+"negative-cache-ttl", 0, "[Experimental] If greater than 0, the metafiles confirmed missing from the object storage by a get or an exists are cached as missing for this long, and reported as missing without reading the object storage again. A metafile created in the meanwhile by another component may be reported as missing for up to this long. It doesn't apply to the compactor. 0 to disable.")
 }
 
 func (cfg *MetadataCacheConfig) Validate() error {
+	if cfg.MetafileReadRepairEnabled && cfg.MetafileReadRepairMaxPerSecond <= 0 {
+		return errInvalidMetafileReadRepairMaxPerSecond
+	}
+	if cfg.MetafileReadRepairEnabled && cfg.MetafileReadRepairTTL <= 0 {
+		return errInvalidMetafileReadRepairTTL
+	}
+	if cfg.NegativeCacheTTL < 0 {
+		return errInvalidNegativeCacheTTL
+	}
 	return cfg.BucketCacheBackend.Validate()
 }
 
@@ -206,6 +283,7 @@ func (cfg *ParquetLabelsCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, pr
 	cfg.Redis.RegisterFlagsWithPrefix(f, prefix+"redis.")
 	cfg.InMemory.RegisterFlagsWithPrefix(f, prefix+"inmemory.", "parquet-labels")
 	cfg.MultiLevel.RegisterFlagsWithPrefix(f, prefix+"multilevel.")
+	cfg.Compression.RegisterFlagsWithPrefix(f, prefix+"compression.")
 
 	f.Int64Var(&cfg.SubrangeSize, prefix+"subrange-size", 16000, "Size of each subrange that bucket object is split into for better caching.")
 	f.IntVar(&cfg.MaxGetRangeRequests, prefix+"max-get-range-requests", 3, "Maximum number of sub-GetRange requests that a single GetRange request can be split into when fetching parquet labels file. Zero or negative value = unlimited number of sub-requests.")
@@ -220,11 +298,25 @@ func (cfg *ParquetLabelsCacheConfig) Validate() error {
 	return cfg.BucketCacheBackend.Validate()
 }
 
-func CreateCachingBucket(chunksConfig ChunksCacheConfig, metadataConfig MetadataCacheConfig, parquetLabelsConfig ParquetLabelsCacheConfig, matchers Matchers, bkt objstore.InstrumentedBucket, logger log.Logger, reg prometheus.Registerer) (objstore.InstrumentedBucket, error) {
+// CreateCachingBucket wraps the input bucket with the configured chunks, metadata and parquet labels
+// caches. If inMemoryCachesMaxSize is greater than 0, the in-memory caches share a memory budget of
+// that size. If maxConcurrentFetches is greater than 0, the fetches of the remote cache backends of all
+// the caches are bounded by a shared concurrency limit.
+func CreateCachingBucket(chunksConfig ChunksCacheConfig, metadataConfig MetadataCacheConfig, parquetLabelsConfig ParquetLabelsCacheConfig, inMemoryCachesMaxSize uint64, maxConcurrentFetches int, matchers Matchers, bkt objstore.InstrumentedBucket, logger log.Logger, reg prometheus.Registerer) (objstore.InstrumentedBucket, error) {
 	cfg := cache.NewCachingBucketConfig()
 	cachingConfigured := false
 
-	chunksCache, err := createBucketCache("chunks-cache", &chunksConfig.BucketCacheBackend, logger, reg)
+	var budget *memoryBudget
+	if inMemoryCachesMaxSize > 0 {
+		budget = newMemoryBudget(inMemoryCachesMaxSize, reg)
+	}
+
+	var fetchLimit *fetchConcurrencyLimit
+	if maxConcurrentFetches > 0 {
+		fetchLimit = newFetchConcurrencyLimit(maxConcurrentFetches, reg)
+	}
+
+	chunksCache, err := createBucketCache("chunks-cache", &chunksConfig.BucketCacheBackend, 0, budget, fetchLimit, logger, reg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "chunks-cache")
 	}
@@ -235,12 +327,17 @@ func CreateCachingBucket(chunksConfig ChunksCacheConfig, metadataConfig Metadata
 		cfg.CacheGetRange("parquet-chunks", chunksCache, matchers.GetParquetChunksMatcher(), chunksConfig.SubrangeSize, chunksConfig.AttributesTTL, chunksConfig.SubrangeTTL, chunksConfig.MaxGetRangeRequests)
 	}
 
-	metadataCache, err := createBucketCache("metadata-cache", &metadataConfig.BucketCacheBackend, logger, reg)
+	metadataCache, err := createBucketCache("metadata-cache", &metadataConfig.BucketCacheBackend, metadataConfig.NegativeCacheTTL, budget, fetchLimit, logger, reg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "metadata-cache")
 	}
 	if metadataCache != nil {
 		cachingConfigured = true
+
+		// The tracing cache hides the negative cache, so the bucket gets the cache it wraps.
+		if negative, ok := metadataCache.(cacheAbsentFetcher); ok && metadataConfig.NegativeCacheTTL > 0 {
+			bkt = newNegativeCacheBucket(bkt, negative, matchers.GetMetafileMatcher())
+		}
 		metadataCache = cache.NewTracingCache(metadataCache)
 
 		cfg.CacheExists("metafile", metadataCache, matchers.GetMetafileMatcher(), metadataConfig.MetafileExistsTTL, metadataConfig.MetafileDoesntExistTTL)
@@ -253,9 +350,13 @@ func CreateCachingBucket(chunksConfig ChunksCacheConfig, metadataConfig Metadata
 		cfg.CacheIter("tenants-iter", metadataCache, matchers.GetTenantsIterMatcher(), metadataConfig.TenantsListTTL, codec, "")
 		cfg.CacheIter("tenant-blocks-iter", metadataCache, matchers.GetTenantBlocksIterMatcher(), metadataConfig.TenantBlocksListTTL, codec, "")
 		cfg.CacheIter("chunks-iter", metadataCache, matchers.GetChunksIterMatcher(), metadataConfig.ChunksListTTL, codec, "")
+
+		if metadataConfig.MetafileReadRepairEnabled {
+			bkt = newReadRepairBucket(bkt, metadataCache, metadataConfig.MetafileReadRepairMaxPerSecond, metadataConfig.MetafileReadRepairTTL, logger, reg)
+		}
 	}
 
-	parquetLabelsCache, err := createBucketCache("parquet-labels-cache", &parquetLabelsConfig.BucketCacheBackend, logger, reg)
+	parquetLabelsCache, err := createBucketCache("parquet-labels-cache", &parquetLabelsConfig.BucketCacheBackend, 0, budget, fetchLimit, logger, reg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parquet-labels-cache")
 	}
@@ -282,7 +383,7 @@ func CreateCachingBucketForCompactor(metadataConfig MetadataCacheConfig, cleaner
 	cfg := cache.NewCachingBucketConfig()
 	cachingConfigured := false
 
-	metadataCache, err := createBucketCache("metadata-cache", &metadataConfig.BucketCacheBackend, logger, reg)
+	metadataCache, err := createBucketCache("metadata-cache", &metadataConfig.BucketCacheBackend, 0, nil, nil, logger, reg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "metadata-cache")
 	}
@@ -319,7 +420,11 @@ func CreateCachingBucketForCompactor(metadataConfig MetadataCacheConfig, cleaner
 	return storecache.NewCachingBucket(bkt, cfg, logger, reg)
 }
 
-func createBucketCache(cacheName string, cacheBackend *BucketCacheBackend, logger log.Logger, reg prometheus.Registerer) (cache.Cache, error) {
+// createBucketCache creates the cache of the input backends. The in-memory cache shares the input
+// memory budget, if any, and the fetches of the remote backends are bounded by the input concurrency
+// limit, if any. If negativeCacheTTL is greater than 0, each backend can record the keys confirmed
+// missing from the object storage for that long.
+func createBucketCache(cacheName string, cacheBackend *BucketCacheBackend, negativeCacheTTL time.Duration, budget *memoryBudget, fetchLimit *fetchConcurrencyLimit, logger log.Logger, reg prometheus.Registerer) (cache.Cache, error) {
 	if cacheBackend.Backend == "" {
 		// No caching.
 		return nil, nil
@@ -333,6 +438,11 @@ func createBucketCache(cacheName string, cacheBackend *BucketCacheBackend, logge
 	for _, backend := range splitBackends {
 		switch backend {
 		case CacheBackendInMemory:
+			if budget != nil {
+				caches = append(caches, budget.newCache(cacheName, cacheBackend.InMemory.MaxSizeBytes))
+				continue
+			}
+
 			inMemoryCache, err := cache.NewInMemoryCacheWithConfig(cacheName, logger, reg, cacheBackend.InMemory.toInMemoryCacheConfig())
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to create in-memory chunk cache")
@@ -352,9 +462,25 @@ func createBucketCache(cacheName string, cacheBackend *BucketCacheBackend, logge
 			}
 			caches = append(caches, cache.NewRedisCache(cacheName, logger, redisCache, reg))
 		}
+
+		if fetchLimit != nil && (backend == CacheBackendMemcached || backend == CacheBackendRedis) {
+			caches[len(caches)-1] = fetchLimit.newCache(caches[len(caches)-1])
+		}
+
+		if util.StringsContain(cacheBackend.Compression.Backends, backend) {
+			compressing, err := newCompressingCache(caches[len(caches)-1], backend, cacheBackend.Compression.Codec, cacheBackend.Compression.MinSizeBytes, logger, reg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create %s cache compression", backend)
+			}
+			caches[len(caches)-1] = compressing
+		}
+
+		if negativeCacheTTL > 0 {
+			caches[len(caches)-1] = newNegativeCache(caches[len(caches)-1], backend, negativeCacheTTL, reg)
+		}
 	}
 
-	return newMultiLevelBucketCache(cacheName, cacheBackend.MultiLevel, reg, caches...), nil
+	return newMultiLevelBucketCache(cacheName, cacheBackend.MultiLevel, reg, logger, caches...), nil
 }
 
 type Matchers struct {
@@ -482,7 +608,7 @@ func isBlockIndexFile(name string) bool {
 
 func isBucketIndexFiles(name string) bool {
 	// TODO can't reference bucketindex because of a circular dependency. To be fixed.
-	return strings.HasSuffix(name, "/bucket-index.json.gz") || strings.HasSuffix(name, "/bucket-index-sync-status.json")
+	return strings.HasSuffix(name, "/bucket-index.json.gz") || strings.HasSuffix(name, "/bucket-index-sync-status.json") || strings.HasSuffix(name, "/bucket-index-delta.json")
 }
 
 func isTenantsDir(name string) bool {
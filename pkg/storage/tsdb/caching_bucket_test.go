@@ -119,6 +119,60 @@ func Test_BucketCacheBackendValidation(t *testing.T) {
 			},
 			expectedErr: errInvalidMaxBackfillItems,
 		},
+		"valid compressed remote bucket cache": {
+			cfg: BucketCacheBackend{
+				Backend: fmt.Sprintf("%s,%s", CacheBackendInMemory, CacheBackendMemcached),
+				Memcached: MemcachedClientConfig{
+					Addresses: "dns+localhost:11211",
+				},
+				MultiLevel: MultiLevelBucketCacheConfig{
+					MaxAsyncConcurrency: 1,
+					MaxAsyncBufferSize:  1,
+					MaxBackfillItems:    1,
+				},
+				Compression: BucketCacheCompressionConfig{
+					Backends: []string{CacheBackendMemcached},
+					Codec:    CacheCompressionS2,
+				},
+			},
+			expectedErr: nil,
+		},
+		"invalid compressed in-memory bucket cache": {
+			cfg: BucketCacheBackend{
+				Backend: CacheBackendInMemory,
+				Compression: BucketCacheCompressionConfig{
+					Backends: []string{CacheBackendInMemory},
+					Codec:    CacheCompressionSnappy,
+				},
+			},
+			expectedErr: errUnsupportedCacheCompressionBackend,
+		},
+		"invalid compressed bucket cache not configured": {
+			cfg: BucketCacheBackend{
+				Backend: CacheBackendMemcached,
+				Memcached: MemcachedClientConfig{
+					Addresses: "dns+localhost:11211",
+				},
+				Compression: BucketCacheCompressionConfig{
+					Backends: []string{CacheBackendRedis},
+					Codec:    CacheCompressionSnappy,
+				},
+			},
+			expectedErr: errUnconfiguredCacheCompressionBackend,
+		},
+		"invalid bucket cache compression codec": {
+			cfg: BucketCacheBackend{
+				Backend: CacheBackendMemcached,
+				Memcached: MemcachedClientConfig{
+					Addresses: "dns+localhost:11211",
+				},
+				Compression: BucketCacheCompressionConfig{
+					Backends: []string{CacheBackendMemcached},
+					Codec:    "lz4",
+				},
+			},
+			expectedErr: errUnsupportedCacheCompressionCodec,
+		},
 	}
 
 	for name, tc := range tests {
@@ -144,6 +198,7 @@ func TestIsBucketIndexFile(t *testing.T) {
 	assert.False(t, isBucketIndexFiles("test/block/chunks"))
 	assert.True(t, isBucketIndexFiles("test/bucket-index.json.gz"))
 	assert.True(t, isBucketIndexFiles("test/bucket-index-sync-status.json"))
+	assert.True(t, isBucketIndexFiles("test/bucket-index-delta.json"))
 }
 
 func TestIsBlockIndexFile(t *testing.T) {
@@ -0,0 +1,221 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/s2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/cache"
+)
+
+const (
+	CacheCompressionSnappy = "snappy"
+	CacheCompressionS2     = "s2"
+)
+
+var supportedCacheCompressionCodecs = []string{CacheCompressionSnappy, CacheCompressionS2}
+
+// compressedCacheValueMagic prefixes the values stored by the compressingCache, and is followed by a
+// byte identifying the codec the rest of the value is encoded with. The values without it have been
+// stored before the compression was enabled, and are returned as they are.
+var compressedCacheValueMagic = []byte("\x00cortex-cz")
+
+// The codecs identifiers stored in the compressed values header. They must never change.
+const (
+	compressedCacheValueNone byte = iota
+	compressedCacheValueSnappy
+	compressedCacheValueS2
+)
+
+// compressingCache is a cache.Cache compressing the values before storing them to the wrapped cache,
+// and decompressing them once fetched. Only the values of at least minSize bytes are compressed, and
+// the values whose compression doesn't save any byte are stored uncompressed.
+//
+// The compressed values are prefixed with a header, so that the values stored before the compression
+// was enabled are still returned as they are: the compression can be enabled, or disabled by stopping
+// to wrap the cache once the compressed values expired, on a live cache.
+//
+// The compressingCache only implements cache.Cache, so the optional capabilities of the wrapped cache,
+// eg. the deletion of items, are not exposed.
+type compressingCache struct {
+	cache.Cache
+
+	logger  log.Logger
+	codec   byte
+	minSize int
+
+	uncompressedBytes prometheus.Counter
+	compressedBytes   prometheus.Counter
+	skippedValues     prometheus.Counter
+	decodeFailures    prometheus.Counter
+	codecDuration     *prometheus.CounterVec
+}
+
+func newCompressingCache(c cache.Cache, backend, codec string, minSize int, logger log.Logger, reg prometheus.Registerer) (*compressingCache, error) {
+	var codecID byte
+	switch codec {
+	case CacheCompressionSnappy:
+		codecID = compressedCacheValueSnappy
+	case CacheCompressionS2:
+		codecID = compressedCacheValueS2
+	default:
+		return nil, errors.Wrapf(errUnsupportedCacheCompressionCodec, "codec %q", codec)
+	}
+
+	constLabels := prometheus.Labels{"name": c.Name(), "backend": backend}
+
+	cc := &compressingCache{
+		Cache:   c,
+		logger:  log.With(logger, "cache", c.Name(), "backend", backend),
+		codec:   codecID,
+		minSize: minSize,
+		uncompressedBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_compression_uncompressed_bytes_total",
+			Help:        "Total size in bytes of the values compressed before being stored to the cache. Divided by cortex_cache_compression_compressed_bytes_total, it gives the compression ratio.",
+			ConstLabels: constLabels,
+		}),
+		compressedBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_compression_compressed_bytes_total",
+			Help:        "Total size in bytes of the compressed values stored to the cache, including their header.",
+			ConstLabels: constLabels,
+		}),
+		skippedValues: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_compression_skipped_values_total",
+			Help:        "Total number of values stored uncompressed to the cache, because smaller than the min size or not compressible.",
+			ConstLabels: constLabels,
+		}),
+		decodeFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_compression_decode_failures_total",
+			Help:        "Total number of values fetched from the cache which failed to be decompressed, and have been considered a cache miss.",
+			ConstLabels: constLabels,
+		}),
+		codecDuration: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "cortex_cache_compression_duration_seconds_total",
+			Help:        "Total time spent compressing and decompressing the cache values.",
+			ConstLabels: constLabels,
+		}, []string{"operation"}),
+	}
+
+	// Initialise the metrics, so that they're exported even if no value has been compressed yet.
+	cc.codecDuration.WithLabelValues("compress")
+	cc.codecDuration.WithLabelValues("decompress")
+
+	return cc, nil
+}
+
+func (c *compressingCache) Store(data map[string][]byte, ttl time.Duration) {
+	if len(data) == 0 {
+		return
+	}
+
+	start := time.Now()
+	encoded := make(map[string][]byte, len(data))
+	uncompressedBytes, compressedBytes := 0, 0
+
+	for key, value := range data {
+		if len(value) >= c.minSize {
+			if compressed := c.compress(value); len(compressed) < len(value) {
+				encoded[key] = compressed
+				uncompressedBytes += len(value)
+				compressedBytes += len(compressed)
+				continue
+			}
+		}
+
+		c.skippedValues.Inc()
+
+		// A value starting with the magic would be mistaken for a compressed one once fetched.
+		if bytes.HasPrefix(value, compressedCacheValueMagic) {
+			encoded[key] = encodeCompressedCacheValue(compressedCacheValueNone, value)
+			continue
+		}
+		encoded[key] = value
+	}
+
+	c.codecDuration.WithLabelValues("compress").Add(time.Since(start).Seconds())
+	c.uncompressedBytes.Add(float64(uncompressedBytes))
+	c.compressedBytes.Add(float64(compressedBytes))
+
+	c.Cache.Store(encoded, ttl)
+}
+
+func (c *compressingCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	hits := c.Cache.Fetch(ctx, keys)
+
+	start := time.Now()
+	for key, value := range hits {
+		decoded, err := decodeCompressedCacheValue(value)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "failed to decompress cache value", "key", key, "err", err)
+			c.decodeFailures.Inc()
+			delete(hits, key)
+			continue
+		}
+		hits[key] = decoded
+	}
+	c.codecDuration.WithLabelValues("decompress").Add(time.Since(start).Seconds())
+
+	return hits
+}
+
+func (c *compressingCache) compress(value []byte) []byte {
+	header := len(compressedCacheValueMagic) + 1
+
+	switch c.codec {
+	case compressedCacheValueSnappy:
+		dst := make([]byte, header+snappy.MaxEncodedLen(len(value)))
+		n := len(snappy.Encode(dst[header:], value))
+		return fillCompressedCacheValueHeader(dst[:header+n], c.codec)
+	default:
+		dst := make([]byte, header+s2.MaxEncodedLen(len(value)))
+		n := len(s2.Encode(dst[header:], value))
+		return fillCompressedCacheValueHeader(dst[:header+n], c.codec)
+	}
+}
+
+// encodeCompressedCacheValue returns the input payload prefixed with the header of the input codec.
+func encodeCompressedCacheValue(codec byte, payload []byte) []byte {
+	header := len(compressedCacheValueMagic) + 1
+
+	dst := make([]byte, header+len(payload))
+	copy(dst[header:], payload)
+	return fillCompressedCacheValueHeader(dst, codec)
+}
+
+func fillCompressedCacheValueHeader(dst []byte, codec byte) []byte {
+	copy(dst, compressedCacheValueMagic)
+	dst[len(compressedCacheValueMagic)] = codec
+	return dst
+}
+
+// decodeCompressedCacheValue returns the input value decompressed, or as it is if it's not prefixed
+// with the compressed values header.
+func decodeCompressedCacheValue(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressedCacheValueMagic) {
+		return value, nil
+	}
+	if len(value) == len(compressedCacheValueMagic) {
+		return nil, errors.New("missing codec in the compressed value header")
+	}
+
+	codec := value[len(compressedCacheValueMagic)]
+	payload := value[len(compressedCacheValueMagic)+1:]
+
+	switch codec {
+	case compressedCacheValueNone:
+		return payload, nil
+	case compressedCacheValueSnappy:
+		return snappy.Decode(nil, payload)
+	case compressedCacheValueS2:
+		return s2.Decode(nil, payload)
+	default:
+		return nil, errors.Errorf("unknown codec %d in the compressed value header", codec)
+	}
+}
@@ -0,0 +1,115 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CompressingCache_ShouldDecodeValuesStoredAcrossTheRollout(t *testing.T) {
+	for _, codec := range supportedCacheCompressionCodecs {
+		t.Run(codec, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newMemoryBudget(1024*1024, prometheus.NewPedanticRegistry()).newCache("chunks-cache", 1024*1024)
+
+			compressible := bytes.Repeat([]byte("compressible"), 100)
+			incompressible := make([]byte, 2048)
+			_, err := rand.Read(incompressible)
+			require.NoError(t, err)
+
+			// Values stored before the compression was enabled.
+			backend.Store(map[string][]byte{"before": compressible}, time.Hour)
+
+			reg := prometheus.NewPedanticRegistry()
+			c, err := newCompressingCache(backend, CacheBackendMemcached, codec, 64, log.NewNopLogger(), reg)
+			require.NoError(t, err)
+
+			c.Store(map[string][]byte{
+				"compressed":     compressible,
+				"small":          []byte("small"),
+				"incompressible": incompressible,
+				"magic":          append(append([]byte{}, compressedCacheValueMagic...), "value"...),
+			}, time.Hour)
+
+			// Both the values stored before and after the compression was enabled should be decoded.
+			assert.Equal(t, map[string][]byte{
+				"before":         compressible,
+				"compressed":     compressible,
+				"small":          []byte("small"),
+				"incompressible": incompressible,
+				"magic":          append(append([]byte{}, compressedCacheValueMagic...), "value"...),
+			}, c.Fetch(ctx, []string{"before", "compressed", "small", "incompressible", "magic", "missing"}))
+
+			// Only the compressible value should have been compressed.
+			stored := backend.Fetch(ctx, []string{"compressed", "small", "incompressible"})
+			assert.Less(t, len(stored["compressed"]), len(compressible))
+			assert.Equal(t, []byte("small"), stored["small"])
+			assert.Equal(t, incompressible, stored["incompressible"])
+
+			assert.Equal(t, float64(len(compressible)), testutil.ToFloat64(c.uncompressedBytes))
+			assert.Equal(t, float64(len(stored["compressed"])), testutil.ToFloat64(c.compressedBytes))
+			assert.Equal(t, float64(3), testutil.ToFloat64(c.skippedValues))
+
+			// The compressed values should be stored prefixed with their header.
+			assert.True(t, bytes.HasPrefix(backend.Fetch(ctx, []string{"compressed"})["compressed"], compressedCacheValueMagic))
+		})
+	}
+}
+
+func Test_CompressingCache_ShouldConsiderUndecodableValuesAsMisses(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryBudget(1024*1024, prometheus.NewPedanticRegistry()).newCache("chunks-cache", 1024*1024)
+
+	c, err := newCompressingCache(backend, CacheBackendRedis, CacheCompressionSnappy, 0, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, err)
+
+	backend.Store(map[string][]byte{
+		"corrupted":     append(append([]byte{}, compressedCacheValueMagic...), compressedCacheValueSnappy, 0xff, 0xff),
+		"unknown-codec": append(append([]byte{}, compressedCacheValueMagic...), 0xff),
+		"valid":         []byte("valid"),
+	}, time.Hour)
+
+	assert.Equal(t, map[string][]byte{"valid": []byte("valid")}, c.Fetch(ctx, []string{"corrupted", "unknown-codec", "valid"}))
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.decodeFailures))
+}
+
+func Test_CompressingCache_ShouldBeUsableAsMultiLevelCacheLevel(t *testing.T) {
+	ctx := context.Background()
+	l1 := newMockBucketCache("c1", nil)
+	l2 := newMemoryBudget(1024*1024, prometheus.NewPedanticRegistry()).newCache("chunks-cache", 1024*1024)
+
+	reg := prometheus.NewPedanticRegistry()
+	compressed, err := newCompressingCache(l2, CacheBackendMemcached, CacheCompressionS2, 0, log.NewNopLogger(), reg)
+	require.NoError(t, err)
+
+	cfg := MultiLevelBucketCacheConfig{MaxAsyncConcurrency: 1, MaxAsyncBufferSize: 10, MaxBackfillItems: 10}
+	m := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), l1, compressed)
+
+	value := bytes.Repeat([]byte("value"), 100)
+	m.Store(map[string][]byte{"key": value}, time.Hour)
+
+	// The levels are stored asynchronously.
+	require.Eventually(t, func() bool {
+		return len(l1.Fetch(ctx, []string{"key"})) == 1 && len(l2.Fetch(ctx, []string{"key"})) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Less(t, len(l2.Fetch(ctx, []string{"key"})["key"]), len(value))
+	assert.Equal(t, map[string][]byte{"key": value}, compressed.Fetch(ctx, []string{"key"}))
+
+	// Once the item is missing from the first level, it should be served decompressed by the second one.
+	l1.Store(map[string][]byte{}, time.Hour)
+	assert.Equal(t, map[string][]byte{"key": value}, m.Fetch(ctx, []string{"key"}))
+}
+
+func Test_NewCompressingCache_ShouldRejectUnsupportedCodecs(t *testing.T) {
+	_, err := newCompressingCache(newMockBucketCache("c1", nil), CacheBackendMemcached, "lz4", 0, log.NewNopLogger(), nil)
+	require.ErrorIs(t, err, errUnsupportedCacheCompressionCodec)
+}
@@ -29,6 +29,10 @@ const (
 	// set when shipping blocks to the storage.
 	IngesterIDExternalLabel = "__ingester_id__"
 
+	// CompactorShardIDExternalLabel is the external label containing the ID of the
+	// compactor shard which produced the block, if any.
+	CompactorShardIDExternalLabel = "__compactor_shard_id__"
+
 	// How often are open TSDBs checked for being idle and closed.
 	DefaultCloseIdleTSDBInterval = 5 * time.Minute
 
@@ -61,6 +65,8 @@ var (
 	ErrBlockDiscoveryStrategy                           = errors.New("invalid block discovery strategy")
 	ErrInvalidTokenBucketBytesLimiterMode               = errors.New("invalid token bucket bytes limiter mode")
 	ErrInvalidLazyExpandedPostingGroupMaxKeySeriesRatio = errors.New("lazy expanded posting group max key series ratio needs to be equal or greater than 0")
+	ErrInvalidBucketIndexMaxHedges                      = errors.New("bucket index max hedges needs to be greater than 0 when the hedge delay is set")
+	ErrInvalidBucketIndexCircuitBreakerCooldown         = errors.New("bucket index circuit breaker cooldown needs to be greater than 0 when the circuit breaker is enabled")
 )
 
 // BlocksStorageConfig holds the config information for the blocks storage.
@@ -286,6 +292,8 @@ type BucketStoreConfig struct {
 	ChunksCache              ChunksCacheConfig        `yaml:"chunks_cache"`
 	MetadataCache            MetadataCacheConfig      `yaml:"metadata_cache"`
 	ParquetLabelsCache       ParquetLabelsCacheConfig `yaml:"parquet_labels_cache" doc:"hidden"`
+	InMemoryCachesMaxSize    uint64                   `yaml:"inmemory_caches_max_size_bytes"`
+	MaxCacheFetchConcurrency int                      `yaml:"max_cache_fetch_concurrency"`
 	MatchersCacheMaxItems    int                      `yaml:"matchers_cache_max_items"`
 	IgnoreDeletionMarksDelay time.Duration            `yaml:"ignore_deletion_mark_delay"`
 	IgnoreBlocksWithin       time.Duration            `yaml:"ignore_blocks_within"`
@@ -388,6 +396,8 @@ func (cfg *BucketStoreConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Float64Var(&cfg.TokenBucketBytesLimiter.TouchedSeriesTokenFactor, "blocks-storage.bucket-store.token-bucket-bytes-limiter.touched-series-token-factor", 25, "Multiplication factor used for touched series token")
 	f.Float64Var(&cfg.TokenBucketBytesLimiter.FetchedChunksTokenFactor, "blocks-storage.bucket-store.token-bucket-bytes-limiter.fetched-chunks-token-factor", 0, "Multiplication factor used for fetched chunks token")
 	f.Float64Var(&cfg.TokenBucketBytesLimiter.TouchedChunksTokenFactor, "blocks-storage.bucket-store.token-bucket-bytes-limiter.touched-chunks-token-factor", 1, "Multiplication factor used for touched chunks token")
+	f.Uint64Var(&cfg.InMemoryCachesMaxSize, "blocks-storage.bucket-store.inmemory-caches-max-size-bytes", 0, "[Experimental] Maximum combined size in bytes of the in-memory chunks, metadata and parquet labels caches. Once reached, the least recently used items of any of the caches are evicted. Each cache is still bounded by its own max size. 0 to disable the shared limit.")
+	f.IntVar(&cfg.MaxCacheFetchConcurrency, "blocks-storage.bucket-store.max-cache-fetch-concurrency", 0, "[Experimental] Maximum number of concurrent fetches of the memcached and redis backends of the chunks, metadata and parquet labels caches, combined. The fetches exceeding the limit wait for a free slot, or are considered a cache miss if the request is canceled in the meanwhile. 0 to disable the limit.")
 	f.IntVar(&cfg.MatchersCacheMaxItems, "blocks-storage.bucket-store.matchers-cache-max-items", 0, "Maximum number of entries in the regex matchers cache. 0 to disable.")
 }
 
@@ -418,6 +428,12 @@ func (cfg *BucketStoreConfig) Validate() error {
 	if cfg.LazyExpandedPostingGroupMaxKeySeriesRatio < 0 {
 		return ErrInvalidLazyExpandedPostingGroupMaxKeySeriesRatio
 	}
+	if cfg.BucketIndex.HedgeDelay > 0 && cfg.BucketIndex.MaxHedges <= 0 {
+		return ErrInvalidBucketIndexMaxHedges
+	}
+	if cfg.BucketIndex.CircuitBreakerFailures > 0 && cfg.BucketIndex.CircuitBreakerCooldown <= 0 {
+		return ErrInvalidBucketIndexCircuitBreakerCooldown
+	}
 	return nil
 }
 
@@ -426,6 +442,14 @@ type BucketIndexConfig struct {
 	UpdateOnErrorInterval time.Duration `yaml:"update_on_error_interval"`
 	IdleTimeout           time.Duration `yaml:"idle_timeout"`
 	MaxStalePeriod        time.Duration `yaml:"max_stale_period"`
+	CoalesceReads         bool          `yaml:"coalesce_reads"`
+	HedgeDelay            time.Duration `yaml:"hedge_delay"`
+	MaxHedges             int           `yaml:"max_hedges"`
+
+	CircuitBreakerFailures int           `yaml:"circuit_breaker_failures"`
+	CircuitBreakerCooldown time.Duration `yaml:"circuit_breaker_cooldown"`
+
+	ReadTimeout time.Duration `yaml:"read_timeout"`
 }
 
 func (cfg *BucketIndexConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix string) {
@@ -433,6 +457,12 @@ func (cfg *BucketIndexConfig) RegisterFlagsWithPrefix(f *flag.FlagSet, prefix st
 	f.DurationVar(&cfg.UpdateOnErrorInterval, prefix+"update-on-error-interval", time.Minute, "How frequently a bucket index, which previously failed to load, should be tried to load again. This option is used only by querier.")
 	f.DurationVar(&cfg.IdleTimeout, prefix+"idle-timeout", time.Hour, "How long a unused bucket index should be cached. Once this timeout expires, the unused bucket index is removed from the in-memory cache. This option is used only by querier.")
 	f.DurationVar(&cfg.MaxStalePeriod, prefix+"max-stale-period", time.Hour, "The maximum allowed age of a bucket index (last updated) before queries start failing because the bucket index is too old. The bucket index is periodically updated by the compactor, while this check is enforced in the querier (at query time).")
+	f.BoolVar(&cfg.CoalesceReads, prefix+"coalesce-reads", false, "If enabled, concurrent loads of the bucket index of the same tenant are coalesced into a single read from the storage, whose result is shared by all the loads. This option is used only by querier.")
+	f.DurationVar(&cfg.HedgeDelay, prefix+"hedge-delay", 0, "If greater than 0, a read of the bucket index which doesn't complete within this delay is hedged by issuing another concurrent read, and the first completed read is used while the other ones are canceled. It reduces the tail latency of the bucket index loading, at the cost of extra requests to the object storage. 0 to disable. This option is used only by querier.")
+	f.IntVar(&cfg.MaxHedges, prefix+"max-hedges", 1, "The maximum number of hedged reads issued for each bucket index read, one every hedge delay, when hedging is enabled. This option is used only by querier.")
+	f.IntVar(&cfg.CircuitBreakerFailures, prefix+"circuit-breaker-failures", 0, "If greater than 0, the bucket index reads of a tenant fail immediately with the last read error after this number of consecutive read failures, until the circuit breaker cooldown expires, to not waste resources reading an index which keeps failing to load, eg. because corrupted. 0 to disable. This option is used only by querier.")
+	f.DurationVar(&cfg.CircuitBreakerCooldown, prefix+"circuit-breaker-cooldown", 5*time.Minute, "How long the bucket index reads of a tenant fail immediately once its circuit breaker opened, before the index is read again. This option is used only by querier.")
+	f.DurationVar(&cfg.ReadTimeout, prefix+"read-timeout", 0, "If greater than 0, a read of the bucket index which takes longer than this timeout fails, regardless of the query timeout, so that a slow bucket index read doesn't consume the whole query time budget. 0 to disable. This option is used only by querier.")
 }
 
 // BlockDiscoveryStrategy configures how to list block IDs from object storage.
@@ -145,6 +145,26 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			expectedErr: errUnSupportedWALCompressionType,
 		},
+		"should pass on bucket index hedging enabled": {
+			setup: func(cfg *BlocksStorageConfig) {
+				cfg.BucketStore.BucketIndex.HedgeDelay = time.Second
+			},
+			expectedErr: nil,
+		},
+		"should fail on bucket index hedging enabled without hedges": {
+			setup: func(cfg *BlocksStorageConfig) {
+				cfg.BucketStore.BucketIndex.HedgeDelay = time.Second
+				cfg.BucketStore.BucketIndex.MaxHedges = 0
+			},
+			expectedErr: ErrInvalidBucketIndexMaxHedges,
+		},
+		"should fail on bucket index circuit breaker enabled without cooldown": {
+			setup: func(cfg *BlocksStorageConfig) {
+				cfg.BucketStore.BucketIndex.CircuitBreakerFailures = 3
+				cfg.BucketStore.BucketIndex.CircuitBreakerCooldown = 0
+			},
+			expectedErr: ErrInvalidBucketIndexCircuitBreakerCooldown,
+		},
 	}
 
 	for testName, testData := range tests {
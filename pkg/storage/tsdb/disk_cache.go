@@ -0,0 +1,512 @@
+package tsdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lru "github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/cortexproject/cortex/pkg/util/runutil"
+)
+
+const (
+	diskCacheFormatVersion1 = 1
+
+	// diskCacheHeaderSize is the size of the header of each file: the format version, the
+	// expiration time in milliseconds and the key length.
+	diskCacheHeaderSize = 1 + 8 + 4
+
+	diskCacheTempFilePrefix = "tmp-"
+)
+
+var errDiskCacheKeyMismatch = errors.New("disk cache file key mismatch")
+
+// diskCacheEntry is the in-memory reference to an item stored on disk.
+type diskCacheEntry struct {
+	filename  string
+	size      int64
+	expiresAt time.Time
+}
+
+// diskCache is a cache.Cache storing each item in a file of a local directory. The total size of
+// the files is bounded: the least recently used items are evicted once the limit is reached, while
+// items are expired once their TTL is elapsed.
+//
+// The items stored in the directory are loaded back on startup, so that the cache is warm after a
+// restart. The recency of the items is not persisted: after a restart the items are evicted in the
+// order they were written.
+type diskCache struct {
+	name         string
+	logger       log.Logger
+	dir          string
+	maxSizeBytes int64
+
+	mtx  sync.Mutex
+	lru  *lru.LRU[string, diskCacheEntry]
+	size int64
+
+	requests  prometheus.Counter
+	hits      prometheus.Counter
+	evicted   prometheus.Counter
+	items     prometheus.Gauge
+	sizeBytes prometheus.Gauge
+}
+
+// newDiskCache returns a diskCache storing items in dir, loading the items already stored in it.
+func newDiskCache(name string, logger log.Logger, dir string, maxSizeBytes int64, reg prometheus.Registerer) (*diskCache, error) {
+	if maxSizeBytes <= 0 {
+		return nil, errors.Errorf("invalid disk cache max size: %d", maxSizeBytes)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "create disk cache directory")
+	}
+
+	c := &diskCache{
+		name:         name,
+		logger:       log.With(logger, "cache", name),
+		dir:          dir,
+		maxSizeBytes: maxSizeBytes,
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_disk_requests_total",
+			Help:        "Total number of items requested to the disk cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_disk_hits_total",
+			Help:        "Total number of items requested to the disk cache that were a hit.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_disk_items_evicted_total",
+			Help:        "Total number of items evicted from the disk cache because it was full or the items expired.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		items: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name:        "cortex_cache_disk_items",
+			Help:        "Current number of items in the disk cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		sizeBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name:        "cortex_cache_disk_size_bytes",
+			Help:        "Current disk usage of the items in the disk cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "cortex_cache_disk_max_size_bytes",
+		Help:        "Maximum disk usage of the items in the disk cache.",
+		ConstLabels: prometheus.Labels{"name": name},
+	}, func() float64 {
+		return float64(c.maxSizeBytes)
+	})
+
+	// The LRU is given a high size limit since evictions are based on the size of the items. Files
+	// are removed explicitly, since replacing an item must not remove the replaced file.
+	l, err := lru.NewLRU[string, diskCacheEntry](math.MaxInt, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load adds the items stored in the cache directory to the LRU, from the oldest written to the
+// newest, and removes the expired, incomplete and corrupted ones.
+func (c *diskCache) load() error {
+	start := time.Now()
+
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return errors.Wrap(err, "read disk cache directory")
+	}
+
+	type storedItem struct {
+		key     string
+		entry   diskCacheEntry
+		modTime time.Time
+	}
+	items := make([]storedItem, 0, len(dirEntries))
+
+	for _, d := range dirEntries {
+		if d.IsDir() {
+			continue
+		}
+
+		filename := d.Name()
+		if strings.HasPrefix(filename, diskCacheTempFilePrefix) {
+			// A write interrupted by a restart.
+			c.removeFile(filename)
+			continue
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+
+		key, expiresAt, err := c.readHeader(filename)
+		if err != nil || filename != diskCacheFilename(key) || !time.Now().Before(expiresAt) {
+			c.removeFile(filename)
+			continue
+		}
+
+		items = append(items, storedItem{
+			key:     key,
+			entry:   diskCacheEntry{filename: filename, size: info.Size(), expiresAt: expiresAt},
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].modTime.Before(items[j].modTime)
+	})
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, item := range items {
+		c.add(item.key, item.entry)
+	}
+	// The max size may have been reduced since the items were stored.
+	c.ensureFits(0)
+
+	level.Info(c.logger).Log("msg", "loaded disk cache", "items", c.lru.Len(), "size_bytes", c.size, "duration", time.Since(start))
+	return nil
+}
+
+func (c *diskCache) Store(data map[string][]byte, ttl time.Duration) {
+	for key, val := range data {
+		if err := c.set(key, val, ttl); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to store item to disk cache", "key", key, "err", err)
+		}
+	}
+}
+
+func (c *diskCache) set(key string, val []byte, ttl time.Duration) error {
+	size := int64(diskCacheHeaderSize + len(key) + len(val))
+	if size > c.maxSizeBytes {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(ttl)
+
+	// Write to a temporary file first, so that a file is never partially written.
+	tmp, err := os.CreateTemp(c.dir, diskCacheTempFilePrefix)
+	if err != nil {
+		return err
+	}
+	if err := writeDiskCacheItem(tmp, key, val, expiresAt); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	filename := diskCacheFilename(key)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if prev, ok := c.lru.Peek(key); ok {
+		// The previous file is going to be replaced, so it doesn't need to be removed.
+		c.lru.Remove(key)
+		c.untrack(prev)
+	}
+	c.ensureFits(size)
+
+	// The file is renamed while holding the lock, so that the LRU is consistent with the files
+	// even if the same key is stored concurrently.
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, filename)); err != nil {
+		_ = os.Remove(tmp.Name())
+		c.removeFile(filename)
+		return err
+	}
+
+	c.add(key, diskCacheEntry{filename: filename, size: size, expiresAt: expiresAt})
+
+	return nil
+}
+
+// Fetch fetches the input keys, logging any error reading the items and returning the hits.
+func (c *diskCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	hits, _ := c.FetchWithExpired(ctx, keys)
+	return hits
+}
+
+// FetchWithExpired implements cacheExpiryFetcher. The expired items are removed once fetched, so
+// they're only reported as expired by the first fetch.
+func (c *diskCache) FetchWithExpired(_ context.Context, keys []string) (map[string][]byte, []string) {
+	hits := map[string][]byte{}
+	var expired []string
+
+	for _, key := range keys {
+		c.requests.Inc()
+
+		val, ok, isExpired := c.get(key)
+		if isExpired {
+			expired = append(expired, key)
+		}
+		if !ok {
+			continue
+		}
+
+		hits[key] = val
+		c.hits.Inc()
+	}
+
+	return hits, expired
+}
+
+// FetchReaders fetches the input keys like Fetch, but returns readers streaming the values from
+// the files. The caller must close the returned readers. A value being read is not affected by the
+// item being evicted or replaced in the meanwhile, since its file is kept open.
+func (c *diskCache) FetchReaders(_ context.Context, keys []string) map[string]io.ReadCloser {
+	hits := map[string]io.ReadCloser{}
+
+	for _, key := range keys {
+		c.requests.Inc()
+
+		entry, ok, _ := c.lookup(key)
+		if !ok {
+			continue
+		}
+
+		r, err := c.openValue(entry.filename, key)
+		if err != nil {
+			c.handleReadErr(key, err)
+			continue
+		}
+
+		hits[key] = r
+		c.hits.Inc()
+	}
+
+	return hits
+}
+
+// FetchByPrefix implements cachePrefixFetcher.
+func (c *diskCache) FetchByPrefix(ctx context.Context, prefix string) map[string][]byte {
+	c.mtx.Lock()
+	var keys []string
+	for _, key := range c.lru.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.mtx.Unlock()
+
+	return c.Fetch(ctx, keys)
+}
+
+// get returns the value of the input key, if found, and whether it has been found expired.
+func (c *diskCache) get(key string) (_ []byte, found, expired bool) {
+	entry, ok, expired := c.lookup(key)
+	if !ok {
+		return nil, false, expired
+	}
+
+	val, err := c.readValue(entry.filename, key)
+	if err != nil {
+		c.handleReadErr(key, err)
+		return nil, false, false
+	}
+	return val, true, false
+}
+
+// lookup returns the entry of the input key, if found, and whether it has been found expired, in
+// which case it's removed.
+func (c *diskCache) lookup(key string) (_ diskCacheEntry, found, expired bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	entry, ok := c.lru.Get(key)
+	if ok && !time.Now().Before(entry.expiresAt) {
+		c.remove(key, entry)
+		c.evicted.Inc()
+		return diskCacheEntry{}, false, true
+	}
+	return entry, ok, false
+}
+
+// handleReadErr removes the item whose file failed to be read, unless the file doesn't exist
+// anymore because the item has been evicted in the meanwhile.
+func (c *diskCache) handleReadErr(key string, err error) {
+	if !os.IsNotExist(err) {
+		level.Warn(c.logger).Log("msg", "failed to read item from disk cache", "key", key, "err", err)
+		c.Delete(context.Background(), []string{key})
+	}
+}
+
+// Delete removes the input keys from the cache.
+func (c *diskCache) Delete(_ context.Context, keys []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, key := range keys {
+		if entry, ok := c.lru.Peek(key); ok {
+			c.remove(key, entry)
+		}
+	}
+}
+
+func (c *diskCache) Name() string {
+	return c.name
+}
+
+// add adds the entry to the LRU. It must be called while holding the lock.
+func (c *diskCache) add(key string, entry diskCacheEntry) {
+	c.lru.Add(key, entry)
+	c.size += entry.size
+	c.items.Inc()
+	c.sizeBytes.Add(float64(entry.size))
+}
+
+// untrack updates the tracked size for an entry removed from the LRU. It must be called while
+// holding the lock.
+func (c *diskCache) untrack(entry diskCacheEntry) {
+	c.size -= entry.size
+	c.items.Dec()
+	c.sizeBytes.Sub(float64(entry.size))
+}
+
+// remove removes the entry from the LRU and its file from the disk. It must be called while
+// holding the lock.
+func (c *diskCache) remove(key string, entry diskCacheEntry) {
+	c.lru.Remove(key)
+	c.untrack(entry)
+	c.removeFile(entry.filename)
+}
+
+// ensureFits evicts the least recently used items until an item of the input size fits into the
+// cache. It must be called while holding the lock.
+func (c *diskCache) ensureFits(size int64) {
+	for c.size+size > c.maxSizeBytes {
+		key, entry, ok := c.lru.GetOldest()
+		if !ok {
+			return
+		}
+		c.remove(key, entry)
+		c.evicted.Inc()
+	}
+}
+
+func (c *diskCache) removeFile(filename string) {
+	if err := os.Remove(filepath.Join(c.dir, filename)); err != nil && !os.IsNotExist(err) {
+		level.Warn(c.logger).Log("msg", "failed to remove disk cache file", "file", filename, "err", err)
+	}
+}
+
+// readHeader returns the key and the expiration time of the item stored in the input file.
+func (c *diskCache) readHeader(filename string) (string, time.Time, error) {
+	f, err := os.Open(filepath.Join(c.dir, filename))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer runutil.CloseWithLogOnErr(c.logger, f, "close disk cache file")
+
+	return readDiskCacheHeader(bufio.NewReader(f))
+}
+
+// readValue returns the value of the item stored in the input file, checking it belongs to the input key.
+func (c *diskCache) readValue(filename, key string) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(c.dir, filename))
+	if err != nil {
+		return nil, err
+	}
+
+	storedKey, _, err := readDiskCacheHeader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if storedKey != key {
+		return nil, errDiskCacheKeyMismatch
+	}
+
+	return content[diskCacheHeaderSize+len(key):], nil
+}
+
+// openValue returns a reader of the value of the item stored in the input file, checking it belongs
+// to the input key.
+func (c *diskCache) openValue(filename, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(c.dir, filename))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	storedKey, _, err := readDiskCacheHeader(r)
+	if err == nil && storedKey != key {
+		err = errDiskCacheKeyMismatch
+	}
+	if err != nil {
+		runutil.CloseWithLogOnErr(c.logger, f, "close disk cache file")
+		return nil, err
+	}
+
+	return readCloser{Reader: r, Closer: f}, nil
+}
+
+// diskCacheFilename returns the name of the file storing the input key. Keys are hashed since
+// they may contain characters not allowed in filenames or be too long.
+func diskCacheFilename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeDiskCacheItem(w io.Writer, key string, val []byte, expiresAt time.Time) error {
+	header := make([]byte, diskCacheHeaderSize)
+	header[0] = diskCacheFormatVersion1
+	binary.BigEndian.PutUint64(header[1:], uint64(expiresAt.UnixMilli()))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(key)))
+
+	for _, b := range [][]byte{header, []byte(key), val} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDiskCacheHeader(r io.Reader) (string, time.Time, error) {
+	header := make([]byte, diskCacheHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", time.Time{}, err
+	}
+	if header[0] != diskCacheFormatVersion1 {
+		return "", time.Time{}, errors.Errorf("unknown disk cache file version: %d", header[0])
+	}
+
+	expiresAt := time.UnixMilli(int64(binary.BigEndian.Uint64(header[1:])))
+
+	key := make([]byte, binary.BigEndian.Uint32(header[9:]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(key), expiresAt, nil
+}
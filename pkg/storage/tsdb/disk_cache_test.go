@@ -0,0 +1,210 @@
+package tsdb
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// diskCacheItemSize is the size on disk of the items used in the tests: 4 bytes keys and 10 bytes values.
+const diskCacheItemSize = diskCacheHeaderSize + 4 + 10
+
+func Test_DiskCache_StoreAndFetch(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc"), "key2": []byte("value2-abc")}, time.Hour)
+
+	hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-abc"), "key2": []byte("value2-abc")}, hits)
+
+	// Replacing an item should not change the number of items.
+	c.Store(map[string][]byte{"key1": []byte("value1-xyz")}, time.Hour)
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-xyz")}, c.Fetch(context.Background(), []string{"key1"}))
+
+	assert.Equal(t, float64(4), testutil.ToFloat64(c.requests))
+	assert.Equal(t, float64(3), testutil.ToFloat64(c.hits))
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.items))
+	assert.Equal(t, float64(2*diskCacheItemSize), testutil.ToFloat64(c.sizeBytes))
+	assert.Equal(t, float64(0), testutil.ToFloat64(c.evicted))
+
+	// Deleted items should be removed from the disk.
+	c.Delete(context.Background(), []string{"key1"})
+	assert.Empty(t, c.Fetch(context.Background(), []string{"key1"}))
+	assert.NoFileExists(t, filepath.Join(c.dir, diskCacheFilename("key1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.items))
+}
+
+func Test_DiskCache_FetchReaders(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc"), "key2": []byte("value2-abc")}, time.Hour)
+
+	readers := c.FetchReaders(context.Background(), []string{"key1", "key2", "key3"})
+	require.Len(t, readers, 2)
+
+	// A value being read should still be readable once the item is removed.
+	c.Delete(context.Background(), []string{"key1", "key2"})
+
+	for key, expected := range map[string]string{"key1": "value1-abc", "key2": "value2-abc"} {
+		val, err := io.ReadAll(readers[key])
+		require.NoError(t, err)
+		require.NoError(t, readers[key].Close())
+		assert.Equal(t, expected, string(val))
+	}
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(c.requests))
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.hits))
+	assert.Empty(t, c.FetchReaders(context.Background(), []string{"key1", "key2"}))
+}
+
+func Test_DiskCache_FetchByPrefix(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"blk1": []byte("value1-abc"), "blk2": []byte("value2-abc"), "idx1": []byte("value3-abc")}, time.Hour)
+	c.Store(map[string][]byte{"blk3": []byte("value4-abc")}, -time.Second)
+
+	hits := c.FetchByPrefix(context.Background(), "blk")
+	assert.Equal(t, map[string][]byte{"blk1": []byte("value1-abc"), "blk2": []byte("value2-abc")}, hits)
+	assert.Empty(t, c.FetchByPrefix(context.Background(), "chk"))
+}
+
+func Test_DiskCache_ShouldEvictLeastRecentlyUsedItemsWhenFull(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 2*diskCacheItemSize, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, time.Hour)
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+
+	// Fetching key1 makes key2 the least recently used item.
+	require.Len(t, c.Fetch(context.Background(), []string{"key1"}), 1)
+	c.Store(map[string][]byte{"key3": []byte("value3-abc")}, time.Hour)
+
+	hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-abc"), "key3": []byte("value3-abc")}, hits)
+	assert.NoFileExists(t, filepath.Join(c.dir, diskCacheFilename("key2")))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.evicted))
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.items))
+	assert.Equal(t, float64(2*diskCacheItemSize), testutil.ToFloat64(c.sizeBytes))
+
+	// Items bigger than the whole cache should not be stored.
+	c.Store(map[string][]byte{"key4": make([]byte, 2*diskCacheItemSize)}, time.Hour)
+	assert.Empty(t, c.Fetch(context.Background(), []string{"key4"}))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.evicted))
+}
+
+func Test_DiskCache_ShouldExpireItems(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, -time.Second)
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+
+	hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, hits)
+	assert.NoFileExists(t, filepath.Join(c.dir, diskCacheFilename("key1")))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.evicted))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.items))
+}
+
+func Test_DiskCache_FetchWithExpired(t *testing.T) {
+	c, err := newDiskCache("test", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, -time.Second)
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+
+	hits, expired := c.FetchWithExpired(context.Background(), []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, hits)
+	assert.Equal(t, []string{"key1"}, expired)
+
+	// The expired item has been removed once fetched.
+	_, expired = c.FetchWithExpired(context.Background(), []string{"key1"})
+	assert.Empty(t, expired)
+}
+
+func Test_DiskCache_ShouldSurviveRestarts(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := newDiskCache("test", log.NewNopLogger(), dir, 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, time.Hour)
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+	c.Store(map[string][]byte{"key3": []byte("value3-abc")}, -time.Second)
+
+	// Simulate a write interrupted by the restart and a corrupted file.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, diskCacheTempFilePrefix+"123"), []byte("partial"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, diskCacheFilename("key4")), []byte("corrupted"), 0o644))
+
+	restarted, err := newDiskCache("test", log.NewNopLogger(), dir, 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	hits := restarted.Fetch(context.Background(), []string{"key1", "key2", "key3", "key4"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-abc"), "key2": []byte("value2-abc")}, hits)
+	assert.Equal(t, float64(2), testutil.ToFloat64(restarted.items))
+	assert.Equal(t, float64(2*diskCacheItemSize), testutil.ToFloat64(restarted.sizeBytes))
+
+	// The expired, partial and corrupted files should have been removed.
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func Test_DiskCache_ShouldEvictItemsOnRestartWithSmallerMaxSize(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := newDiskCache("test", log.NewNopLogger(), dir, 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, time.Hour)
+	// Make sure the items have a different modification time.
+	require.NoError(t, os.Chtimes(filepath.Join(dir, diskCacheFilename("key1")), time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)))
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+
+	restarted, err := newDiskCache("test", log.NewNopLogger(), dir, diskCacheItemSize, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// The oldest written item should have been evicted.
+	hits := restarted.Fetch(context.Background(), []string{"key1", "key2"})
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, hits)
+	assert.Equal(t, float64(1), testutil.ToFloat64(restarted.evicted))
+}
+
+func Test_DiskCache_WithinMultiLevelCache(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+	reg := prometheus.NewRegistry()
+
+	disk, err := newDiskCache("disk", log.NewNopLogger(), t.TempDir(), 1000, reg)
+	require.NoError(t, err)
+	disk.Store(map[string][]byte{"key1": []byte("value1-abc")}, time.Hour)
+
+	l1 := newMockBucketCache("l1", nil)
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), l1, disk)
+
+	hits := c.Fetch(context.Background(), []string{"key1"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-abc")}, hits)
+
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+	c.(*multiLevelBucketCache).backfillProcessor.Stop()
+
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, disk.Fetch(context.Background(), []string{"key2"}))
+}
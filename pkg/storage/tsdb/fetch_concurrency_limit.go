@@ -0,0 +1,105 @@
+package tsdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/cache"
+)
+
+// fetchConcurrencyLimit bounds the number of concurrent fetches of the remote cache backends, eg.
+// memcached and redis, shared by multiple caches, eg. the levels of the chunks, metadata and parquet
+// labels multilevel caches. It protects the backends, and the connection pools of their clients, from
+// being exhausted when many queries fan out to the caches at the same time.
+type fetchConcurrencyLimit struct {
+	slots chan struct{}
+
+	limit        prometheus.Gauge
+	inflight     prometheus.Gauge
+	waitDuration prometheus.Histogram
+	canceled     *prometheus.CounterVec
+}
+
+func newFetchConcurrencyLimit(limit int, reg prometheus.Registerer) *fetchConcurrencyLimit {
+	l := &fetchConcurrencyLimit{
+		slots: make(chan struct{}, limit),
+		limit: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_bucket_cache_fetch_concurrency_limit",
+			Help: "Maximum number of concurrent fetches of the remote bucket cache backends.",
+		}),
+		inflight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_bucket_cache_fetch_concurrency_inflight",
+			Help: "Number of in-flight fetches of the remote bucket cache backends.",
+		}),
+		waitDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_bucket_cache_fetch_concurrency_wait_duration_seconds",
+			Help:    "Time spent waiting for the concurrency limit before fetching a remote bucket cache backend.",
+			Buckets: []float64{0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+		}),
+		canceled: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_cache_fetch_concurrency_canceled_total",
+			Help: "Total number of fetches of a remote bucket cache backend given up because the request context was done while waiting for the concurrency limit, and considered a cache miss.",
+		}, []string{"name"}),
+	}
+	l.limit.Set(float64(limit))
+
+	return l
+}
+
+// newCache wraps the input cache, so that its fetches are bounded by the limit.
+func (l *fetchConcurrencyLimit) newCache(c cache.Cache) *concurrencyLimitedCache {
+	// Initialise the metrics, so that the canceled fetches can be tracked since the start.
+	l.canceled.WithLabelValues(c.Name())
+
+	return &concurrencyLimitedCache{Cache: c, limit: l}
+}
+
+// acquire waits for a free slot, or returns the context error if the context is done in the meanwhile.
+// The slot must be released once the fetch is done.
+func (l *fetchConcurrencyLimit) acquire(ctx context.Context, name string) error {
+	start := time.Now()
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		// No slot is immediately available, so don't let a canceled request wait for one.
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.waitDuration.Observe(time.Since(start).Seconds())
+			l.canceled.WithLabelValues(name).Inc()
+			return ctx.Err()
+		}
+	}
+
+	l.waitDuration.Observe(time.Since(start).Seconds())
+	l.inflight.Inc()
+	return nil
+}
+
+func (l *fetchConcurrencyLimit) release() {
+	l.inflight.Dec()
+	<-l.slots
+}
+
+// concurrencyLimitedCache is a cache.Cache whose fetches are bounded by a fetchConcurrencyLimit. The
+// fetches given up because the context was done while waiting for the limit return no items.
+//
+// The concurrencyLimitedCache only implements cache.Cache, so the optional capabilities of the wrapped
+// cache, eg. the deletion of items, are not exposed.
+type concurrencyLimitedCache struct {
+	cache.Cache
+
+	limit *fetchConcurrencyLimit
+}
+
+func (c *concurrencyLimitedCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	if err := c.limit.acquire(ctx, c.Name()); err != nil {
+		return map[string][]byte{}
+	}
+	defer c.limit.release()
+
+	return c.Cache.Fetch(ctx, keys)
+}
@@ -0,0 +1,117 @@
+package tsdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+// blockingCache is a cache whose fetches block until unblocked, tracking the max number of concurrent
+// fetches, which can be shared by multiple caches.
+type blockingCache struct {
+	name    string
+	unblock chan struct{}
+
+	inflight    *atomic.Int64
+	maxInflight *atomic.Int64
+}
+
+func newBlockingCache(name string, unblock chan struct{}, inflight, maxInflight *atomic.Int64) *blockingCache {
+	return &blockingCache{name: name, unblock: unblock, inflight: inflight, maxInflight: maxInflight}
+}
+
+func (c *blockingCache) Store(map[string][]byte, time.Duration) {}
+
+func (c *blockingCache) Fetch(_ context.Context, keys []string) map[string][]byte {
+	n := c.inflight.Inc()
+	defer c.inflight.Dec()
+
+	for {
+		curr := c.maxInflight.Load()
+		if n <= curr || c.maxInflight.CompareAndSwap(curr, n) {
+			break
+		}
+	}
+
+	<-c.unblock
+	return map[string][]byte{keys[0]: []byte("value")}
+}
+
+func (c *blockingCache) Name() string {
+	return c.name
+}
+
+func Test_FetchConcurrencyLimit_ShouldBoundTheFetchesOfAllTheCaches(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	limit := newFetchConcurrencyLimit(2, reg)
+
+	unblock := make(chan struct{})
+	inflight, maxInflight := atomic.NewInt64(0), atomic.NewInt64(0)
+	caches := []*concurrencyLimitedCache{
+		limit.newCache(newBlockingCache("chunks-cache", unblock, inflight, maxInflight)),
+		limit.newCache(newBlockingCache("metadata-cache", unblock, inflight, maxInflight)),
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, map[string][]byte{"key": []byte("value")}, caches[i%2].Fetch(context.Background(), []string{"key"}))
+		}()
+	}
+
+	// Wait until the limit is reached, and the other fetches are waiting for it.
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(limit.inflight) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), inflight.Load())
+
+	close(unblock)
+	wg.Wait()
+
+	assert.Equal(t, int64(2), maxInflight.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(limit.inflight))
+	assert.Equal(t, float64(0), testutil.ToFloat64(limit.canceled.WithLabelValues("chunks-cache")))
+}
+
+func Test_FetchConcurrencyLimit_ShouldGiveUpOnceTheContextIsDone(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	limit := newFetchConcurrencyLimit(1, reg)
+
+	maxInflight := atomic.NewInt64(0)
+	backend := newBlockingCache("chunks-cache", make(chan struct{}), atomic.NewInt64(0), maxInflight)
+	c := limit.newCache(backend)
+
+	// Hold the only slot.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Fetch(context.Background(), []string{"key"})
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(limit.inflight) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A fetch whose context is done while waiting for the slot should be considered a miss.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Empty(t, c.Fetch(ctx, []string{"key"}))
+	assert.Equal(t, float64(1), testutil.ToFloat64(limit.canceled.WithLabelValues("chunks-cache")))
+
+	// A fetch whose context is already canceled should be served if a slot is free.
+	close(backend.unblock)
+	<-done
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, map[string][]byte{"key": []byte("value")}, c.Fetch(canceledCtx, []string{"key"}))
+	assert.Equal(t, int64(1), maxInflight.Load())
+}
@@ -0,0 +1,250 @@
+package tsdb
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	budgetEvictionReasonCacheFull  = "cache-full"
+	budgetEvictionReasonBudgetFull = "budget-full"
+	budgetEvictionReasonExpired    = "expired"
+)
+
+// memoryBudget is a memory budget shared by multiple in-memory caches, eg. the chunks, metadata and
+// parquet labels ones, each of them being sized independently. Once the combined size of the caches
+// items reaches the budget limit, the least recently used items of all the caches are evicted, so that
+// the caches can't collectively exceed the memory available to the process.
+type memoryBudget struct {
+	limit uint64
+
+	mtx  sync.Mutex
+	used uint64
+
+	// lru holds the items of all the caches, the least recently used one at the back.
+	lru *list.List
+
+	limitBytes     prometheus.Gauge
+	usedBytes      prometheus.Gauge
+	cacheUsedBytes *prometheus.GaugeVec
+	evictedItems   *prometheus.CounterVec
+}
+
+func newMemoryBudget(limit uint64, reg prometheus.Registerer) *memoryBudget {
+	b := &memoryBudget{
+		limit: limit,
+		lru:   list.New(),
+		limitBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_bucket_cache_memory_budget_limit_bytes",
+			Help: "Maximum combined size in bytes of the items of the in-memory bucket caches.",
+		}),
+		usedBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_bucket_cache_memory_budget_used_bytes",
+			Help: "Combined size in bytes of the items of the in-memory bucket caches.",
+		}),
+		cacheUsedBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_cache_memory_budget_cache_used_bytes",
+			Help: "Size in bytes of the items of an in-memory bucket cache sharing the memory budget.",
+		}, []string{"name"}),
+		evictedItems: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_cache_memory_budget_evicted_items_total",
+			Help: "Total number of items evicted from an in-memory bucket cache sharing the memory budget.",
+		}, []string{"name", "reason"}),
+	}
+	b.limitBytes.Set(float64(limit))
+
+	return b
+}
+
+// newCache registers a new in-memory cache with the budget, holding up to maxSize bytes on its own.
+func (b *memoryBudget) newCache(name string, maxSize uint64) *budgetedCache {
+	// Items bigger than the whole budget or cache can't be stored.
+	maxItemSize := min(uint64(defaultMaxItemSize), maxSize, b.limit)
+
+	c := &budgetedCache{
+		name:        name,
+		budget:      b,
+		maxSize:     maxSize,
+		maxItemSize: maxItemSize,
+		items:       map[string]*budgetedItem{},
+		lru:         list.New(),
+		usedBytes:   b.cacheUsedBytes.WithLabelValues(name),
+	}
+
+	// Initialise the metrics, so that the evictions can be tracked since the start.
+	for _, reason := range []string{budgetEvictionReasonCacheFull, budgetEvictionReasonBudgetFull, budgetEvictionReasonExpired} {
+		b.evictedItems.WithLabelValues(name, reason)
+	}
+
+	return c
+}
+
+// removeLocked removes the input item from its cache, counting it as evicted for the input reason,
+// if any. Must be called with the budget lock held.
+func (b *memoryBudget) removeLocked(item *budgetedItem, reason string) {
+	c := item.cache
+	size := item.size()
+
+	b.lru.Remove(item.budgetElem)
+	c.lru.Remove(item.cacheElem)
+	delete(c.items, item.key)
+
+	b.used -= size
+	c.used -= size
+	b.usedBytes.Set(float64(b.used))
+	c.usedBytes.Set(float64(c.used))
+
+	if reason != "" {
+		b.evictedItems.WithLabelValues(c.name, reason).Inc()
+	}
+}
+
+type budgetedItem struct {
+	cache     *budgetedCache
+	key       string
+	data      []byte
+	expiresAt time.Time
+
+	// The elements of the item in the budget and the cache LRUs.
+	budgetElem *list.Element
+	cacheElem  *list.Element
+}
+
+func (i *budgetedItem) size() uint64 {
+	return uint64(len(i.key) + len(i.data))
+}
+
+// budgetedCache is an in-memory cache.Cache bounded both by its own max size and by the memory budget
+// shared with the other caches registered with it. When the budget is exhausted, storing an item
+// evicts the least recently used items of any of the caches.
+type budgetedCache struct {
+	name        string
+	budget      *memoryBudget
+	maxSize     uint64
+	maxItemSize uint64
+
+	// The following fields are guarded by the budget lock.
+	used  uint64
+	items map[string]*budgetedItem
+
+	// lru holds the items of this cache, the least recently used one at the back.
+	lru *list.List
+
+	usedBytes prometheus.Gauge
+}
+
+func (c *budgetedCache) Store(data map[string][]byte, ttl time.Duration) {
+	b := c.budget
+	expiresAt := time.Now().Add(ttl)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for key, value := range data {
+		item := &budgetedItem{cache: c, key: key, expiresAt: expiresAt}
+
+		// The caller may be passing in a sub-slice of a huge array, so we copy the value to not
+		// retain more memory than accounted.
+		item.data = make([]byte, len(value))
+		copy(item.data, value)
+
+		size := item.size()
+		if size > c.maxItemSize {
+			continue
+		}
+
+		if existing, ok := c.items[key]; ok {
+			b.removeLocked(existing, "")
+		}
+
+		for c.used+size > c.maxSize {
+			b.removeLocked(c.lru.Back().Value.(*budgetedItem), budgetEvictionReasonCacheFull)
+		}
+		for b.used+size > b.limit {
+			b.removeLocked(b.lru.Back().Value.(*budgetedItem), budgetEvictionReasonBudgetFull)
+		}
+
+		item.budgetElem = b.lru.PushFront(item)
+		item.cacheElem = c.lru.PushFront(item)
+		c.items[key] = item
+
+		b.used += size
+		c.used += size
+		b.usedBytes.Set(float64(b.used))
+		c.usedBytes.Set(float64(c.used))
+	}
+}
+
+func (c *budgetedCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	hits, _ := c.FetchWithExpired(ctx, keys)
+	return hits
+}
+
+// FetchWithExpired implements cacheExpiryFetcher. The expired items are removed once fetched, so
+// they're only reported as expired by the first fetch.
+func (c *budgetedCache) FetchWithExpired(_ context.Context, keys []string) (map[string][]byte, []string) {
+	b := c.budget
+	now := time.Now()
+	hits := map[string][]byte{}
+	var expired []string
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, key := range keys {
+		item, ok := c.items[key]
+		if !ok {
+			continue
+		}
+
+		if now.After(item.expiresAt) {
+			b.removeLocked(item, budgetEvictionReasonExpired)
+			expired = append(expired, key)
+			continue
+		}
+
+		b.lru.MoveToFront(item.budgetElem)
+		c.lru.MoveToFront(item.cacheElem)
+		hits[key] = item.data
+	}
+
+	return hits, expired
+}
+
+// FetchByPrefix implements cachePrefixFetcher.
+func (c *budgetedCache) FetchByPrefix(ctx context.Context, prefix string) map[string][]byte {
+	c.budget.mtx.Lock()
+	var keys []string
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.budget.mtx.Unlock()
+
+	return c.Fetch(ctx, keys)
+}
+
+// Delete implements cacheDeleter.
+func (c *budgetedCache) Delete(_ context.Context, keys []string) {
+	b := c.budget
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, key := range keys {
+		if item, ok := c.items[key]; ok {
+			b.removeLocked(item, "")
+		}
+	}
+}
+
+func (c *budgetedCache) Name() string {
+	return c.name
+}
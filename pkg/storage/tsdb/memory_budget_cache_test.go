@@ -0,0 +1,144 @@
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// budgetItemSize is the size accounted for the items used in the tests: 4 bytes keys and 10 bytes values.
+const budgetItemSize = 4 + 10
+
+func Test_MemoryBudget_ShouldEvictAcrossCachesWhenTheBudgetIsExhausted(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+
+	// Each cache could hold 4 items on its own, but the 3 of them can only hold 6 items together.
+	budget := newMemoryBudget(6*budgetItemSize, reg)
+	chunks := budget.newCache("chunks-cache", 4*budgetItemSize)
+	metadata := budget.newCache("metadata-cache", 4*budgetItemSize)
+	labels := budget.newCache("parquet-labels-cache", 4*budgetItemSize)
+
+	chunks.Store(map[string][]byte{"chk1": []byte("value1-abc"), "chk2": []byte("value2-abc")}, time.Hour)
+	metadata.Store(map[string][]byte{"met1": []byte("value1-abc")}, time.Hour)
+	metadata.Store(map[string][]byte{"met2": []byte("value2-abc")}, time.Hour)
+	labels.Store(map[string][]byte{"lbl1": []byte("value1-abc")}, time.Hour)
+	labels.Store(map[string][]byte{"lbl2": []byte("value2-abc")}, time.Hour)
+	assert.Equal(t, float64(6*budgetItemSize), testutil.ToFloat64(budget.usedBytes))
+
+	// Fetching the metadata makes the chunks the least recently used items.
+	require.Len(t, metadata.Fetch(ctx, []string{"met1", "met2"}), 2)
+
+	// Filling the labels cache should evict the chunks, even if the labels cache is not full on its own.
+	labels.Store(map[string][]byte{"lbl3": []byte("value3-abc")}, time.Hour)
+	labels.Store(map[string][]byte{"lbl4": []byte("value4-abc")}, time.Hour)
+
+	assert.Empty(t, chunks.Fetch(ctx, []string{"chk1", "chk2"}))
+	assert.Len(t, metadata.Fetch(ctx, []string{"met1", "met2"}), 2)
+	assert.Len(t, labels.Fetch(ctx, []string{"lbl1", "lbl2", "lbl3", "lbl4"}), 4)
+
+	// Storing beyond the max size of a cache should evict its own items first.
+	labels.Store(map[string][]byte{"lbl5": []byte("value5-abc")}, time.Hour)
+	assert.Len(t, labels.Fetch(ctx, []string{"lbl1", "lbl2", "lbl3", "lbl4", "lbl5"}), 4)
+	assert.Len(t, metadata.Fetch(ctx, []string{"met1", "met2"}), 2)
+
+	assert.Equal(t, float64(6*budgetItemSize), testutil.ToFloat64(budget.usedBytes))
+	assert.Equal(t, float64(0), testutil.ToFloat64(budget.cacheUsedBytes.WithLabelValues("chunks-cache")))
+	assert.Equal(t, float64(2*budgetItemSize), testutil.ToFloat64(budget.cacheUsedBytes.WithLabelValues("metadata-cache")))
+	assert.Equal(t, float64(4*budgetItemSize), testutil.ToFloat64(budget.cacheUsedBytes.WithLabelValues("parquet-labels-cache")))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(budget.evictedItems.WithLabelValues("chunks-cache", budgetEvictionReasonBudgetFull)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(budget.evictedItems.WithLabelValues("metadata-cache", budgetEvictionReasonBudgetFull)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(budget.evictedItems.WithLabelValues("parquet-labels-cache", budgetEvictionReasonCacheFull)))
+}
+
+func Test_MemoryBudget_ShouldKeepTheCombinedSizeUnderTheLimit(t *testing.T) {
+	ctx := context.Background()
+	budget := newMemoryBudget(10*budgetItemSize, prometheus.NewPedanticRegistry())
+
+	caches := []*budgetedCache{
+		budget.newCache("chunks-cache", 8*budgetItemSize),
+		budget.newCache("metadata-cache", 8*budgetItemSize),
+		budget.newCache("parquet-labels-cache", 8*budgetItemSize),
+	}
+
+	for i := 0; i < 100; i++ {
+		c := caches[i%len(caches)]
+		c.Store(map[string][]byte{fmt.Sprintf("k%03d", i): []byte("value-abcd")}, time.Hour)
+
+		assert.LessOrEqual(t, budget.used, budget.limit)
+	}
+
+	// The most recently stored items should be cached.
+	hits := 0
+	for i := 90; i < 100; i++ {
+		hits += len(caches[i%len(caches)].Fetch(ctx, []string{fmt.Sprintf("k%03d", i)}))
+	}
+	assert.Equal(t, 10, hits)
+	assert.Equal(t, 10, budget.lru.Len())
+}
+
+func Test_MemoryBudget_BudgetedCache(t *testing.T) {
+	ctx := context.Background()
+	budget := newMemoryBudget(1000, prometheus.NewPedanticRegistry())
+	c := budget.newCache("chunks-cache", 1000)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc"), "key2": []byte("value2-abc")}, time.Hour)
+	c.Store(map[string][]byte{"key3": []byte("value3-abc")}, -time.Second)
+
+	// Replacing an item should not account it twice.
+	c.Store(map[string][]byte{"key1": []byte("value1-xyz")}, time.Hour)
+
+	hits := c.Fetch(ctx, []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1-xyz"), "key2": []byte("value2-abc")}, hits)
+	assert.Equal(t, float64(2*budgetItemSize), testutil.ToFloat64(budget.usedBytes))
+	assert.Equal(t, float64(1), testutil.ToFloat64(budget.evictedItems.WithLabelValues("chunks-cache", budgetEvictionReasonExpired)))
+
+	c.Delete(ctx, []string{"key1"})
+	assert.Empty(t, c.Fetch(ctx, []string{"key1"}))
+	assert.Equal(t, float64(budgetItemSize), testutil.ToFloat64(budget.usedBytes))
+
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, c.FetchByPrefix(ctx, "key"))
+
+	// Items bigger than the cache should not be stored.
+	c.Store(map[string][]byte{"key4": make([]byte, 1000)}, time.Hour)
+	assert.Empty(t, c.Fetch(ctx, []string{"key4"}))
+}
+
+func Test_MemoryBudget_BudgetedCacheFetchWithExpired(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryBudget(1000, prometheus.NewPedanticRegistry()).newCache("chunks-cache", 1000)
+
+	c.Store(map[string][]byte{"key1": []byte("value1-abc")}, -time.Second)
+	c.Store(map[string][]byte{"key2": []byte("value2-abc")}, time.Hour)
+
+	hits, expired := c.FetchWithExpired(ctx, []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2-abc")}, hits)
+	assert.Equal(t, []string{"key1"}, expired)
+
+	// The expired item has been removed once fetched.
+	_, expired = c.FetchWithExpired(ctx, []string{"key1"})
+	assert.Empty(t, expired)
+}
+
+func Test_CreateBucketCache_ShouldShareTheMemoryBudget(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	budget := newMemoryBudget(1000, reg)
+
+	for _, name := range []string{"chunks-cache", "metadata-cache"} {
+		backend := &BucketCacheBackend{Backend: CacheBackendInMemory, InMemory: InMemoryBucketCacheConfig{MaxSizeBytes: 1000}}
+		c, err := createBucketCache(name, backend, 0, budget, nil, log.NewNopLogger(), reg)
+		require.NoError(t, err)
+
+		c.Store(map[string][]byte{"key1": []byte("value1-abc")}, time.Hour)
+	}
+
+	assert.Equal(t, float64(2*budgetItemSize), testutil.ToFloat64(budget.usedBytes))
+}
@@ -0,0 +1,88 @@
+package tsdb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/cacheutil"
+)
+
+const (
+	mirroringCacheTierPrimary   = "primary"
+	mirroringCacheTierSecondary = "secondary"
+)
+
+// mirroringCache is a cache.Cache which stores items to both a primary and a secondary cache,
+// and fetches items from only one of them. It allows to migrate from a cache to another one
+// live: the new cache is filled as secondary while reads are still served by the old one, and
+// once the new cache is warm enough the reads are switched to it.
+type mirroringCache struct {
+	primary           cache.Cache
+	secondary         cache.Cache
+	readFromSecondary bool
+
+	asyncProcessor *cacheutil.AsyncOperationProcessor
+	writtenItems   *prometheus.CounterVec
+}
+
+// newMirroringCache returns a mirroringCache reading from the primary cache, or from the secondary
+// one if readFromSecondary is true. Items are stored to the primary cache synchronously and to the
+// secondary one asynchronously.
+func newMirroringCache(primary, secondary cache.Cache, readFromSecondary bool, maxAsyncConcurrency, maxAsyncBufferSize int, reg prometheus.Registerer) *mirroringCache {
+	c := &mirroringCache{
+		primary:           primary,
+		secondary:         secondary,
+		readFromSecondary: readFromSecondary,
+		asyncProcessor:    cacheutil.NewAsyncOperationProcessor(maxAsyncBufferSize, maxAsyncConcurrency),
+		writtenItems: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "cortex_cache_mirror_written_items_total",
+			Help:        "Total number of items written to each tier of a mirroring cache, by status. Items failing to be written because the async buffer is full are tracked as failed.",
+			ConstLabels: prometheus.Labels{"name": primary.Name()},
+		}, []string{"tier", "status"}),
+	}
+
+	// Initialise the metrics, so that they're exported even if no item has been written yet.
+	for _, tier := range []string{mirroringCacheTierPrimary, mirroringCacheTierSecondary} {
+		c.writtenItems.WithLabelValues(tier, "success")
+		c.writtenItems.WithLabelValues(tier, "failed")
+	}
+
+	return c
+}
+
+func (c *mirroringCache) Store(data map[string][]byte, ttl time.Duration) {
+	if len(data) == 0 {
+		return
+	}
+
+	c.primary.Store(data, ttl)
+	c.writtenItems.WithLabelValues(mirroringCacheTierPrimary, "success").Add(float64(len(data)))
+
+	if err := c.asyncProcessor.EnqueueAsync(func() {
+		c.secondary.Store(data, ttl)
+		c.writtenItems.WithLabelValues(mirroringCacheTierSecondary, "success").Add(float64(len(data)))
+	}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
+		c.writtenItems.WithLabelValues(mirroringCacheTierSecondary, "failed").Add(float64(len(data)))
+	}
+}
+
+// Fetch fetches the input keys from the tier configured to serve reads.
+func (c *mirroringCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	if c.readFromSecondary {
+		return c.secondary.Fetch(ctx, keys)
+	}
+	return c.primary.Fetch(ctx, keys)
+}
+
+func (c *mirroringCache) Name() string {
+	return c.primary.Name()
+}
+
+// Stop waits until all the pending writes to the secondary cache have been processed.
+func (c *mirroringCache) Stop() {
+	c.asyncProcessor.Stop()
+}
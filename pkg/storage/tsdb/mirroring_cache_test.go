@@ -0,0 +1,90 @@
+package tsdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MirroringCache(t *testing.T) {
+	for testName, readFromSecondary := range map[string]bool{
+		"reads from primary":   false,
+		"reads from secondary": true,
+	} {
+		t.Run(testName, func(t *testing.T) {
+			primary := newMockBucketCache("primary", nil)
+			secondary := newMockBucketCache("secondary", nil)
+			c := newMirroringCache(primary, secondary, readFromSecondary, 10, 100, prometheus.NewRegistry())
+
+			data := map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}
+			c.Store(data, time.Hour)
+			c.Stop()
+
+			// Writes hit both tiers.
+			assert.Equal(t, data, primary.data)
+			assert.Equal(t, data, secondary.data)
+			assert.Equal(t, float64(2), testutil.ToFloat64(c.writtenItems.WithLabelValues(mirroringCacheTierPrimary, "success")))
+			assert.Equal(t, float64(2), testutil.ToFloat64(c.writtenItems.WithLabelValues(mirroringCacheTierSecondary, "success")))
+			assert.Equal(t, float64(0), testutil.ToFloat64(c.writtenItems.WithLabelValues(mirroringCacheTierSecondary, "failed")))
+
+			// Reads hit only the configured tier.
+			hits := c.Fetch(context.Background(), []string{"key1", "key3"})
+			assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+
+			if readFromSecondary {
+				assert.Empty(t, primary.fetchedKeys)
+				assert.Equal(t, []string{"key1", "key3"}, secondary.fetchedKeys)
+			} else {
+				assert.Equal(t, []string{"key1", "key3"}, primary.fetchedKeys)
+				assert.Empty(t, secondary.fetchedKeys)
+			}
+		})
+	}
+}
+
+func Test_MirroringCache_ShouldTrackSecondaryWritesDroppedWhenBufferIsFull(t *testing.T) {
+	primary := newMockBucketCache("primary", nil)
+	secondary := newMockBucketCache("secondary", nil)
+	c := newMirroringCache(primary, secondary, false, 1, 1, prometheus.NewRegistry())
+
+	// Stop the processor, so that the first write to the secondary fills the buffer and the next is dropped.
+	c.Stop()
+	c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+	c.Store(map[string][]byte{"key2": []byte("value2")}, time.Hour)
+
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2")}, primary.data)
+	assert.Empty(t, secondary.data)
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.writtenItems.WithLabelValues(mirroringCacheTierPrimary, "success")))
+	require.Equal(t, float64(1), testutil.ToFloat64(c.writtenItems.WithLabelValues(mirroringCacheTierSecondary, "failed")))
+}
+
+func Test_MirroringCache_WithinMultiLevelCache(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+	reg := prometheus.NewRegistry()
+
+	l1 := newMockBucketCache("l1", nil)
+	primary := newMockBucketCache("primary", map[string][]byte{"key1": []byte("value1")})
+	secondary := newMockBucketCache("secondary", nil)
+	mirror := newMirroringCache(primary, secondary, false, 10, 100, reg)
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), l1, mirror)
+
+	hits := c.Fetch(context.Background(), []string{"key1"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+
+	c.Store(map[string][]byte{"key2": []byte("value2")}, time.Hour)
+	c.(*multiLevelBucketCache).backfillProcessor.Stop()
+	mirror.Stop()
+
+	assert.Equal(t, map[string][]byte{"key2": []byte("value2")}, secondary.data)
+}
@@ -1,29 +1,241 @@
 package tsdb
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/thanos-io/thanos/pkg/cache"
 	"github.com/thanos-io/thanos/pkg/cacheutil"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
 )
 
+var (
+	errInvalidMaxBackfillItemsPerSecond = errors.New("invalid max_backfill_items_per_second, must greater than or equal to 0")
+	errInvalidMaxBackfillBytesPerSecond = errors.New("invalid max_backfill_bytes_per_second, must greater than or equal to 0")
+	errNoCacheLevels                    = errors.New("at least one cache level is required")
+	errInvalidMaxRecentlyStoredItems    = errors.New("invalid max_recently_stored_items, must greater than or equal to 0")
+	errInvalidMaxItemBytes              = errors.New("invalid max_item_bytes, must greater than or equal to 0")
+	errInvalidLatencySensitiveFreshness = errors.New("invalid latency_sensitive_freshness_window, must greater than or equal to 0")
+	errInvalidAdaptiveBackfillDropRatio = errors.New("invalid adaptive_backfill_drop_ratio, must be between 0 and 1")
+	errInvalidAdaptiveFetchOrderWindow  = errors.New("invalid adaptive_fetch_order_stabilization_window, must greater than or equal to 0")
+	errInvalidBackfillLogSampleRate     = errors.New("invalid backfill_log_sample_rate, must greater than or equal to 0")
+
+	// ErrPrefixFetchUnsupported is returned when fetching by prefix from a cache unable to scan its keys.
+	ErrPrefixFetchUnsupported = errors.New("cache doesn't support fetching by prefix")
+
+	// emptyValueSentinel is stored in place of zero-length values when empty values are allowed,
+	// because some cache backends silently drop them.
+	emptyValueSentinel = []byte("\x00cortex-empty-value\x00")
+
+	checksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Reasons of the keys missing from all the levels of a multi level cache.
+const (
+	missReasonCold    = "cold"
+	missReasonExpired = "expired"
+)
+
+// maxInflightBackfills is the maximum number of in-flight backfilled items tracked to de-duplicate
+// the backfills of concurrent fetches. Items exceeding it are backfilled without de-duplication.
+const maxInflightBackfills = 100000
+
+// slowerLevelsBackfillBufferRatio is the ratio of the async buffer usable by the backfills of the
+// levels slower than the fastest one. The rest of the buffer is reserved to the backfills of the
+// fastest level, which are the most impactful for future reads, so that they're preferentially kept
+// when the buffer is under pressure.
+const slowerLevelsBackfillBufferRatio = 0.75
+
+// recentlyStoredItemsTTL is how long an item stored to a cache level is assumed to be still held
+// by the level, when skipping redundant stores is enabled.
+const recentlyStoredItemsTTL = time.Minute
+
+// adaptiveBackfillWindow is how often the adaptive max backfill items is adjusted, based on the
+// ratio of backfills dropped within the window.
+const adaptiveBackfillWindow = 10 * time.Second
+
+// latencySensitiveMinHitRatio is the minimum ratio of the fetched keys found in the fastest level
+// for the level to be considered holding most of the keys, and so for the latency-sensitive fetches
+// to skip the slower levels.
+const latencySensitiveMinHitRatio = 0.5
+
+// maxSampledBackfillsPerSecond is the max number of sampled backfills reported per second, so that a
+// low sample rate doesn't flood the logs.
+const maxSampledBackfillsPerSecond = 10
+
+// maxSampledBackfillKeys is the max number of keys of a sampled backfill which are logged.
+const maxSampledBackfillKeys = 20
+
+// adaptiveFetchOrderEWMAAlpha is the weight of the latest fetch latency of a level in its moving
+// average, when the adaptive fetch order is enabled.
+const adaptiveFetchOrderEWMAAlpha = 0.2
+
+type latencySensitiveFetchCtxKey struct{}
+
+// ContextWithLatencySensitiveFetch returns a context whose multi level cache fetches are
+// latency-sensitive: if the fastest level recently returned most of the fetched keys, the slower
+// levels are not fetched at all and the keys missing from the fastest level are treated as misses.
+// It only applies to the multi level caches with a latency-sensitive freshness window configured.
+func ContextWithLatencySensitiveFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, latencySensitiveFetchCtxKey{}, true)
+}
+
+func isLatencySensitiveFetch(ctx context.Context) bool {
+	latencySensitive, _ := ctx.Value(latencySensitiveFetchCtxKey{}).(bool)
+	return latencySensitive
+}
+
+// levelItem identifies an item in a cache level.
+type levelItem struct {
+	level cache.Cache
+	key   string
+}
+
 type multiLevelBucketCache struct {
 	name   string
-	caches []cache.Cache
+	logger log.Logger
+
+	// The cache levels can be replaced at runtime, so they're protected by the mutex
+	// and each operation works on a snapshot of them.
+	cachesMtx sync.RWMutex
+	caches    []cache.Cache
 
 	backfillProcessor    *cacheutil.AsyncOperationProcessor
+	backfillPanics       prometheus.Counter
 	fetchLatency         *prometheus.HistogramVec
 	backFillLatency      *prometheus.HistogramVec
 	storeDroppedItems    prometheus.Counter
-	backfillDroppedItems prometheus.Counter
+	backfillDroppedItems *prometheus.CounterVec
 	maxBackfillItems     int
 	backfillTTL          time.Duration
+
+	// Number of async operations enqueued and not started yet, used to drop the backfills of the
+	// slower levels once more than maxQueuedSlowerLevelsBackfills are queued.
+	queuedOps                      atomic.Int64
+	maxQueuedSlowerLevelsBackfills int64
+
+	// Optional rate limiters applied to backfilled items. Nil if disabled.
+	backfillItemsLimiter     *rate.Limiter
+	backfillBytesLimiter     *rate.Limiter
+	backfillRateLimitedItems prometheus.Counter
+
+	// Optional controller lowering the max number of items backfilled per async operation while
+	// the backfills are dropped. Nil if disabled.
+	adaptiveBackfill *adaptiveBackfillLimit
+
+	// Optional controller ordering the levels fetches by their recent latency. Nil if disabled, in
+	// which case the levels are fetched in the configured order.
+	adaptiveFetchOrder *adaptiveFetchOrder
+
+	// Optional sampling of the backfills, reporting 1 out of backfillSampleRate backfills to
+	// onSampledBackfill, up to maxSampledBackfillsPerSecond. The limiter is nil if disabled.
+	backfillSampleRate    int64
+	backfills             atomic.Int64
+	backfillSampleLimiter *rate.Limiter
+	onSampledBackfill     func(sourceLevel, targetLevel int, keys []string)
+
+	refreshTTLOnHit bool
+	touchedItems    prometheus.Counter
+
+	invalidatedItems prometheus.Counter
+
+	allowEmptyValues    bool
+	emptyValuesRejected prometheus.Counter
+
+	// Keys missing from all the levels, by reason: expired if a level reported the key as expired,
+	// cold otherwise.
+	missedItems *prometheus.CounterVec
+
+	verifyChecksums bool
+	corruptValues   prometheus.Counter
+
+	maxItemBytes   int
+	oversizedItems prometheus.Counter
+
+	// The slower levels are skipped by the latency-sensitive fetches if the fastest level returned
+	// most of the fetched keys within the freshness window. Disabled if the window is 0.
+	latencySensitiveFreshness     time.Duration
+	fastestLevelConfirmedAt       atomic.Int64
+	latencySensitiveShortCircuits prometheus.Counter
+
+	// Items enqueued to be backfilled and not stored yet, used to de-duplicate the
+	// backfills of concurrent fetches missing the same keys.
+	inflightBackfillsMtx      sync.Mutex
+	inflightBackfills         map[levelItem]struct{}
+	backfillDeduplicatedItems prometheus.Counter
+
+	// Hashes of the values recently stored to each cache level, used to skip storing
+	// the same values again. Nil if disabled.
+	recentlyStored         *expirable.LRU[levelItem, uint64]
+	maxRecentlyStoredItems int
+	skippedStoreItems      prometheus.Counter
+}
+
+// cacheDeleter is implemented by caches supporting the removal of items.
+type cacheDeleter interface {
+	Delete(ctx context.Context, keys []string)
+}
+
+// cacheToucher is implemented by caches able to refresh the TTL of existing items
+// without storing them again.
+type cacheToucher interface {
+	Touch(ctx context.Context, keys []string, ttl time.Duration)
+}
+
+// cacheReaderFetcher is implemented by caches able to return the values as readers streaming them
+// from the backend, instead of loading them in memory. The caller must close the returned readers.
+type cacheReaderFetcher interface {
+	FetchReaders(ctx context.Context, keys []string) map[string]io.ReadCloser
+}
+
+// readCloser is an io.ReadCloser reading from a reader and closing a different closer, eg. a buffered
+// reader on top of a file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cacheExpiryFetcher is implemented by caches able to report which of the keys missing from a fetch
+// were cached but expired, as opposed to never cached or evicted, eg. the in-memory caches tracking
+// the expiration of their items.
+type cacheExpiryFetcher interface {
+	FetchWithExpired(ctx context.Context, keys []string) (hits map[string][]byte, expired []string)
+}
+
+// cachePrefixFetcher is implemented by caches able to scan their keys, and so to return all the items
+// whose key starts with a prefix, eg. the disk cache and the in-memory caches sharing a memory budget.
+type cachePrefixFetcher interface {
+	FetchByPrefix(ctx context.Context, prefix string) map[string][]byte
+}
+
+// cacheAbsentFetcher is implemented by caches able to record the keys confirmed missing from the object
+// storage, eg. the negative cache, and to report them as absent when fetched instead of as misses.
+type cacheAbsentFetcher interface {
+	FetchWithAbsent(ctx context.Context, keys []string) (hits map[string][]byte, absent []string)
+	StoreMissing(keys []string)
+	ForgetMissing(keys []string)
 }
 
 type MultiLevelBucketCacheConfig struct {
@@ -31,6 +243,25 @@ type MultiLevelBucketCacheConfig struct {
 	MaxAsyncBufferSize  int `yaml:"max_async_buffer_size"`
 	MaxBackfillItems    int `yaml:"max_backfill_items"`
 
+	MaxBackfillItemsPerSecond int `yaml:"max_backfill_items_per_second"`
+	MaxBackfillBytesPerSecond int `yaml:"max_backfill_bytes_per_second"`
+
+	RefreshTTLOnHit  bool `yaml:"refresh_ttl_on_hit"`
+	AllowEmptyValues bool `yaml:"allow_empty_values"`
+	VerifyChecksums  bool `yaml:"verify_checksums"`
+
+	MaxRecentlyStoredItems int `yaml:"max_recently_stored_items"`
+
+	MaxItemBytes int `yaml:"max_item_bytes"`
+
+	LatencySensitiveFreshness time.Duration `yaml:"latency_sensitive_freshness_window"`
+
+	AdaptiveBackfillDropRatio float64 `yaml:"adaptive_backfill_drop_ratio"`
+
+	AdaptiveFetchOrderWindow time.Duration `yaml:"adaptive_fetch_order_stabilization_window"`
+
+	BackfillLogSampleRate int `yaml:"backfill_log_sample_rate"`
+
 	BackFillTTL time.Duration `yaml:"-"`
 }
 
@@ -44,6 +275,30 @@ func (cfg *MultiLevelBucketCacheConfig) Validate() error {
 	if cfg.MaxBackfillItems <= 0 {
 		return errInvalidMaxBackfillItems
 	}
+	if cfg.MaxBackfillItemsPerSecond < 0 {
+		return errInvalidMaxBackfillItemsPerSecond
+	}
+	if cfg.MaxBackfillBytesPerSecond < 0 {
+		return errInvalidMaxBackfillBytesPerSecond
+	}
+	if cfg.MaxRecentlyStoredItems < 0 {
+		return errInvalidMaxRecentlyStoredItems
+	}
+	if cfg.MaxItemBytes < 0 {
+		return errInvalidMaxItemBytes
+	}
+	if cfg.LatencySensitiveFreshness < 0 {
+		return errInvalidLatencySensitiveFreshness
+	}
+	if cfg.AdaptiveBackfillDropRatio < 0 || cfg.AdaptiveBackfillDropRatio > 1 {
+		return errInvalidAdaptiveBackfillDropRatio
+	}
+	if cfg.AdaptiveFetchOrderWindow < 0 {
+		return errInvalidAdaptiveFetchOrderWindow
+	}
+	if cfg.BackfillLogSampleRate < 0 {
+		return errInvalidBackfillLogSampleRate
+	}
 	return nil
 }
 
@@ -51,9 +306,20 @@ func (cfg *MultiLevelBucketCacheConfig) RegisterFlagsWithPrefix(f *flag.FlagSet,
 	f.IntVar(&cfg.MaxAsyncConcurrency, prefix+"max-async-concurrency", 3, "The maximum number of concurrent asynchronous operations can occur when backfilling cache items.")
 	f.IntVar(&cfg.MaxAsyncBufferSize, prefix+"max-async-buffer-size", 10000, "The maximum number of enqueued asynchronous operations allowed when backfilling cache items.")
 	f.IntVar(&cfg.MaxBackfillItems, prefix+"max-backfill-items", 10000, "The maximum number of items to backfill per asynchronous operation.")
+	f.IntVar(&cfg.MaxBackfillItemsPerSecond, prefix+"max-backfill-items-per-second", 0, "The maximum number of items per second backfilled across all cache levels. Items exceeding the limit are dropped. 0 to disable.")
+	f.IntVar(&cfg.MaxBackfillBytesPerSecond, prefix+"max-backfill-bytes-per-second", 0, "The maximum number of bytes per second backfilled across all cache levels. Items exceeding the limit are dropped. 0 to disable.")
+	f.BoolVar(&cfg.RefreshTTLOnHit, prefix+"refresh-ttl-on-hit", false, "If enabled, the TTL of items found in the first cache level is refreshed on each hit. Caches not supporting TTL refresh have the items stored again, which may incur extra costs on some backends, unless the cache has no backfill TTL, eg. the metadata cache.")
+	f.BoolVar(&cfg.AllowEmptyValues, prefix+"allow-empty-values", false, "If enabled, zero-length values are stored and returned as hits. If disabled, zero-length values are not stored and are treated as misses when fetched.")
+	f.BoolVar(&cfg.VerifyChecksums, prefix+"verify-checksums", false, "If enabled, a CRC32 checksum is stored along with each value and verified when fetched. Values not matching their checksum are treated as misses. Values stored while enabled are unreadable once disabled, so caches should be flushed when disabling it.")
+	f.IntVar(&cfg.MaxRecentlyStoredItems, prefix+"max-recently-stored-items", 0, "The maximum number of items recently stored to each cache level which are tracked, in order to skip storing the same value again to the same level within 1 minute. An item evicted by a cache level within this time isn't stored again until backfilled. 0 to disable.")
+	f.IntVar(&cfg.MaxItemBytes, prefix+"max-item-bytes", 0, "The maximum size in bytes of an item stored to the cache levels, including its checksum if enabled. Bigger items are not stored, eg. because they would exceed the item size limit of memcached and fail to be stored anyway. 0 to disable.")
+	f.DurationVar(&cfg.LatencySensitiveFreshness, prefix+"latency-sensitive-freshness-window", 0, "If greater than 0, the fetches of latency-sensitive requests only fetch the first cache level if, within this window, the first level returned at least half of the keys of a fetch. The keys missing from the first level are treated as misses without fetching the slower levels, which lowers the latency at the cost of a lower hit rate, and are not backfilled. Requests are not latency-sensitive unless tagged by the caller. 0 to disable.")
+	f.Float64Var(&cfg.AdaptiveBackfillDropRatio, prefix+"adaptive-backfill-drop-ratio", 0, "If greater than 0, the maximum number of items to backfill per asynchronous operation is halved every 10s while the ratio of backfills dropped because the async buffer is full exceeds this ratio, and doubled back up to the max backfill items once it's below. The items exceeding the effective maximum are dropped. 0 to disable.")
+	f.DurationVar(&cfg.AdaptiveFetchOrderWindow, prefix+"adaptive-fetch-order-stabilization-window", 0, "If greater than 0, the cache levels are fetched in the order of their recent fetch latency, tracked as an exponentially weighted moving average, instead of the configured order, so that the empirically fastest level is fetched first. The order is re-evaluated at most once per window, to avoid flapping between levels with a similar latency. The items found in a level are backfilled to the levels fetched before it. 0 to disable.")
+	f.IntVar(&cfg.BackfillLogSampleRate, prefix+"backfill-log-sample-rate", 0, fmt.Sprintf("If greater than 0, 1 out of this number of backfills is logged, along with the level the items have been found in, the level they're backfilled to and up to %d of their keys, eg. to find the frequently backfilled keys which would deserve a longer TTL. At most %d backfills are logged per second. 0 to disable.", maxSampledBackfillKeys, maxSampledBackfillsPerSecond))
 }
 
-func newMultiLevelBucketCache(name string, cfg MultiLevelBucketCacheConfig, reg prometheus.Registerer, c ...cache.Cache) cache.Cache {
+func newMultiLevelBucketCache(name string, cfg MultiLevelBucketCacheConfig, reg prometheus.Registerer, logger log.Logger, c ...cache.Cache) cache.Cache {
 	if len(c) == 1 {
 		return c[0]
 	}
@@ -74,8 +340,9 @@ func newMultiLevelBucketCache(name string, cfg MultiLevelBucketCacheConfig, reg
 		itemName = name
 	}
 
-	return &multiLevelBucketCache{
+	m := &multiLevelBucketCache{
 		name:              name,
+		logger:            log.With(logger, "cache", name),
 		caches:            c,
 		backfillProcessor: cacheutil.NewAsyncOperationProcessor(cfg.MaxAsyncBufferSize, cfg.MaxAsyncConcurrency),
 		fetchLatency: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
@@ -88,72 +355,476 @@ func newMultiLevelBucketCache(name string, cfg MultiLevelBucketCacheConfig, reg
 			Help:    fmt.Sprintf("Histogram to track latency to backfill items from multi level %s", metricHelpText),
 			Buckets: []float64{0.01, 0.1, 0.3, 0.6, 1, 3, 6, 10, 15, 20, 25, 30, 40, 50, 60, 90},
 		}, nil),
+		backfillPanics: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_backfill_panics_total", itemName),
+			Help: fmt.Sprintf("Total number of panics recovered while running the asynchronous operations of multilevel %s", metricHelpText),
+		}),
 		storeDroppedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Name: fmt.Sprintf("cortex_store_multilevel_%s_backfill_dropped_items_total", itemName),
 			Help: fmt.Sprintf("Total number of items dropped due to async buffer full when backfilling multilevel %s", metricHelpText),
 		}),
-		backfillDroppedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		backfillDroppedItems: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: fmt.Sprintf("cortex_store_multilevel_%s_store_dropped_items_total", itemName),
-			Help: fmt.Sprintf("Total number of items dropped due to async buffer full when storing multilevel %s", metricHelpText),
+			Help: fmt.Sprintf("Total number of items dropped due to async buffer full when storing multilevel %s, by backfilled level (1 being the fastest)", metricHelpText),
+		}, []string{"level"}),
+		backfillRateLimitedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_backfill_rate_limited_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items dropped due to the backfill rate limit when backfilling multilevel %s", metricHelpText),
+		}),
+		touchedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_touched_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items whose TTL has been refreshed in multilevel %s", metricHelpText),
+		}),
+		invalidatedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_invalidated_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items invalidated in multilevel %s", metricHelpText),
 		}),
+		emptyValuesRejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_empty_values_rejected_total", itemName),
+			Help: fmt.Sprintf("Total number of zero-length items not stored in multilevel %s", metricHelpText),
+		}),
+		corruptValues: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_corrupt_values_total", itemName),
+			Help: fmt.Sprintf("Total number of fetched items not matching their checksum in multilevel %s", metricHelpText),
+		}),
+		backfillDeduplicatedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_backfill_deduplicated_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items not backfilled because already being backfilled by a concurrent fetch in multilevel %s", metricHelpText),
+		}),
+		skippedStoreItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_skipped_store_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items not stored to a level because recently stored to it with the same value in multilevel %s", metricHelpText),
+		}),
+		latencySensitiveShortCircuits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_latency_sensitive_short_circuits_total", itemName),
+			Help: fmt.Sprintf("Total number of latency-sensitive fetches which skipped the slower levels of multilevel %s", metricHelpText),
+		}),
+		oversizedItems: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_oversized_items_total", itemName),
+			Help: fmt.Sprintf("Total number of items not stored because bigger than the max item size in multilevel %s", metricHelpText),
+		}),
+		missedItems: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_miss_total", itemName),
+			Help: fmt.Sprintf("Total number of keys missing from all levels of multilevel %s, by reason (expired if a level reported the key as cached but expired, cold otherwise)", metricHelpText),
+		}, []string{"reason"}),
 		maxBackfillItems: cfg.MaxBackfillItems,
 		backfillTTL:      cfg.BackFillTTL,
+
+		// At least one slot is usable by the slower levels, otherwise they would never be backfilled with small buffers.
+		maxQueuedSlowerLevelsBackfills: max(1, int64(float64(cfg.MaxAsyncBufferSize)*slowerLevelsBackfillBufferRatio)),
+
+		refreshTTLOnHit:  cfg.RefreshTTLOnHit,
+		allowEmptyValues: cfg.AllowEmptyValues,
+		verifyChecksums:  cfg.VerifyChecksums,
+		maxItemBytes:     cfg.MaxItemBytes,
+
+		latencySensitiveFreshness: cfg.LatencySensitiveFreshness,
+
+		maxRecentlyStoredItems: cfg.MaxRecentlyStoredItems,
+
+		inflightBackfills: map[levelItem]struct{}{},
+	}
+
+	// Initialise the metrics, so that both reasons are exported even if no key has been missed yet.
+	m.missedItems.WithLabelValues(missReasonCold)
+	m.missedItems.WithLabelValues(missReasonExpired)
+
+	if cfg.MaxBackfillItemsPerSecond > 0 {
+		m.backfillItemsLimiter = rate.NewLimiter(rate.Limit(cfg.MaxBackfillItemsPerSecond), cfg.MaxBackfillItemsPerSecond)
+	}
+	if cfg.MaxBackfillBytesPerSecond > 0 {
+		m.backfillBytesLimiter = rate.NewLimiter(rate.Limit(cfg.MaxBackfillBytesPerSecond), cfg.MaxBackfillBytesPerSecond)
+	}
+	if cfg.AdaptiveBackfillDropRatio > 0 {
+		m.adaptiveBackfill = newAdaptiveBackfillLimit(cfg.MaxBackfillItems, cfg.AdaptiveBackfillDropRatio, promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("cortex_store_multilevel_%s_backfill_effective_max_items", itemName),
+			Help: fmt.Sprintf("Current maximum number of items backfilled per asynchronous operation, as adapted to the backfill drops, in multilevel %s", metricHelpText),
+		}))
 	}
+	if cfg.AdaptiveFetchOrderWindow > 0 {
+		m.adaptiveFetchOrder = newAdaptiveFetchOrder(len(c), cfg.AdaptiveFetchOrderWindow,
+			promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+				Name: fmt.Sprintf("cortex_store_multilevel_%s_fetch_order_position", itemName),
+				Help: fmt.Sprintf("Current position of a level in the fetch order of multilevel %s, 1 being fetched first, by level (1 being the fastest as configured)", metricHelpText),
+			}, []string{"level"}),
+			promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+				Name: fmt.Sprintf("cortex_store_multilevel_%s_fetch_latency_ewma_seconds", itemName),
+				Help: fmt.Sprintf("Exponentially weighted moving average of the fetch latency of a level of multilevel %s, by level (1 being the fastest as configured)", metricHelpText),
+			}, []string{"level"}),
+			promauto.With(reg).NewCounter(prometheus.CounterOpts{
+				Name: fmt.Sprintf("cortex_store_multilevel_%s_fetch_reorders_total", itemName),
+				Help: fmt.Sprintf("Total number of times the fetch order of the levels of multilevel %s changed", metricHelpText),
+			}))
+	}
+	if cfg.BackfillLogSampleRate > 0 {
+		m.backfillSampleRate = int64(cfg.BackfillLogSampleRate)
+		m.backfillSampleLimiter = rate.NewLimiter(maxSampledBackfillsPerSecond, maxSampledBackfillsPerSecond)
+		m.onSampledBackfill = m.logSampledBackfill
+	}
+	if cfg.MaxRecentlyStoredItems > 0 {
+		m.recentlyStored = expirable.NewLRU[levelItem, uint64](cfg.MaxRecentlyStoredItems, nil, recentlyStoredItemsTTL)
+	}
+
+	return m
 }
 
+// Store stores the input items in all cache levels. Zero-length values are wrapped in a sentinel
+// if empty values are allowed, otherwise they're not stored.
 func (m *multiLevelBucketCache) Store(data map[string][]byte, ttl time.Duration) {
-	for _, c := range m.caches {
-		if err := m.backfillProcessor.EnqueueAsync(func() {
-			c.Store(data, ttl)
+	data = m.skipOversizedItems(m.encodeChecksums(m.encodeEmptyValues(data)))
+	if len(data) == 0 {
+		return
+	}
+
+	for _, c := range m.getCaches() {
+		levelData := m.skipRecentlyStored(c, data)
+		if len(levelData) == 0 {
+			continue
+		}
+
+		if err := m.enqueueAsync(func() {
+			c.Store(levelData, ttl)
 		}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
 			m.storeDroppedItems.Inc()
+			m.forgetRecentlyStored(c, levelData)
+		}
+	}
+}
+
+// TTLFunc returns the TTL of the input item, eg. based on the recency of the data it holds.
+type TTLFunc func(key string, value []byte) time.Duration
+
+// StoreWithTTLFunc stores the input items like Store, but with the TTL returned by ttlFn for each
+// of them instead of a fixed one. The items sharing the same TTL are stored together.
+func (m *multiLevelBucketCache) StoreWithTTLFunc(data map[string][]byte, ttlFn TTLFunc) {
+	StoreWithTTLFunc(m, data, ttlFn)
+}
+
+// StoreWithTTLFunc stores the input items to the input cache, which may be a single level one, with
+// the TTL returned by ttlFn for each of them. See multiLevelBucketCache.StoreWithTTLFunc.
+func StoreWithTTLFunc(c cache.Cache, data map[string][]byte, ttlFn TTLFunc) {
+	byTTL := map[time.Duration]map[string][]byte{}
+	for k, v := range data {
+		ttl := ttlFn(k, v)
+		if byTTL[ttl] == nil {
+			byTTL[ttl] = map[string][]byte{}
+		}
+		byTTL[ttl][k] = v
+	}
+
+	for ttl, items := range byTTL {
+		c.Store(items, ttl)
+	}
+}
+
+// RecencyTTL returns a TTLFunc giving recentTTL to the items whose data max time, as returned by
+// maxTime (eg. the max time of the block they belong to), is within recentWindow from now, and ttl
+// to the others. Recently created data is queried more often, so it can be kept in the cache longer
+// without a uniform long TTL wasting the cache on cold data. The items whose max time is unknown
+// get ttl.
+func RecencyTTL(maxTime func(key string, value []byte) (time.Time, bool), recentWindow, recentTTL, ttl time.Duration) TTLFunc {
+	return func(key string, value []byte) time.Duration {
+		if t, ok := maxTime(key, value); ok && time.Since(t) <= recentWindow {
+			return recentTTL
 		}
+		return ttl
 	}
 }
 
 func (m *multiLevelBucketCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	hits, ok := m.fetch(ctx, keys, nil, nil, nil)
+	if !ok {
+		return nil
+	}
+	return hits
+}
+
+// FetchWithAbsent fetches the input keys like Fetch, and also returns the keys a level reported as
+// confirmed missing from the object storage. The absent keys are not fetched from the slower levels,
+// and are not backfilled: they're only stored with StoreMissing, with the TTL of the negative cache.
+func (m *multiLevelBucketCache) FetchWithAbsent(ctx context.Context, keys []string) (map[string][]byte, []string) {
+	absent := map[string]struct{}{}
+
+	hits, ok := m.fetch(ctx, keys, nil, nil, absent)
+	if !ok {
+		return nil, nil
+	}
+	return hits, slices.Collect(maps.Keys(absent))
+}
+
+// StoreMissing records the input keys as confirmed missing from the object storage in all the levels
+// supporting it. The other levels are left untouched, so they keep reporting the keys as misses.
+func (m *multiLevelBucketCache) StoreMissing(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	for _, c := range m.getCaches() {
+		af, ok := c.(cacheAbsentFetcher)
+		if !ok {
+			continue
+		}
+
+		if err := m.enqueueAsync(func() {
+			af.StoreMissing(keys)
+		}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
+			m.storeDroppedItems.Inc()
+		}
+	}
+}
+
+// ForgetMissing removes the input keys recorded as missing from all the levels supporting it. Unlike
+// StoreMissing it's synchronous, so that a fetch following it doesn't report the keys as absent.
+func (m *multiLevelBucketCache) ForgetMissing(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	for _, c := range m.getCaches() {
+		if af, ok := c.(cacheAbsentFetcher); ok {
+			af.ForgetMissing(keys)
+		}
+	}
+}
+
+// FetchReaders fetches the input keys like Fetch, but returns the values as readers, so that large
+// values can be streamed to the client without being loaded in memory. Levels supporting streaming
+// reads return readers streaming the values from the level, while the values fetched from the other
+// levels are wrapped in a reader. The caller must close all the returned readers.
+//
+// The values streamed from a level are neither backfilled to the faster levels, since it would require
+// loading them in memory, nor have their TTL refreshed. Streaming is disabled if checksums are enabled,
+// since the checksum of a value can only be verified once the whole value has been read.
+func (m *multiLevelBucketCache) FetchReaders(ctx context.Context, keys []string) map[string]io.ReadCloser {
+	readers := map[string]io.ReadCloser{}
+
+	hits, ok := m.fetch(ctx, keys, nil, readers, nil)
+	if !ok {
+		closeReaders(readers)
+		return nil
+	}
+
+	for k, v := range hits {
+		readers[k] = io.NopCloser(bytes.NewReader(v))
+	}
+	return readers
+}
+
+// FetchStream fetches the input keys like Fetch, but calls fn for each hit as soon as it's returned
+// by a cache level, instead of returning all the hits at the end. fn is called sequentially and at
+// most once per key. The items found are backfilled once all the levels have been fetched.
+func (m *multiLevelBucketCache) FetchStream(ctx context.Context, keys []string, fn func(key string, value []byte)) {
+	m.fetch(ctx, keys, func(_ int, key string, value []byte) {
+		fn(key, value)
+	}, nil, nil)
+}
+
+// FetchWithSources fetches the input keys like Fetch, and also returns the index of the level
+// which served each hit, 0 being the fastest level. It's meant for diagnostics, eg. to analyze
+// the effectiveness of the cache levels by key pattern, and has a slightly higher overhead than
+// Fetch because of the tracking of the levels.
+func (m *multiLevelBucketCache) FetchWithSources(ctx context.Context, keys []string) (map[string][]byte, map[string]int) {
+	sources := map[string]int{}
+
+	hits, ok := m.fetch(ctx, keys, func(level int, key string, _ []byte) {
+		sources[key] = level
+	}, nil, nil)
+	if !ok {
+		return nil, nil
+	}
+	return hits, sources
+}
+
+// FetchOrLoad fetches the input keys like Fetch, then loads the keys missing from all the levels with
+// loader, eg. from the object storage, and returns the hits merged with the loaded items. The loaded
+// items are stored to all the levels with the input TTL asynchronously, like Store. loader is not
+// called if all the keys are found, or if the context has been canceled in the meanwhile.
+func (m *multiLevelBucketCache) FetchOrLoad(ctx context.Context, keys []string, loader func(missing []string) map[string][]byte, ttl time.Duration) map[string][]byte {
+	return FetchOrLoad(ctx, m, keys, loader, ttl)
+}
+
+// FetchOrLoad fetches the input keys from the input cache, loading the missing ones with loader and
+// storing them back to the cache, which may be a single level one. See multiLevelBucketCache.FetchOrLoad.
+func FetchOrLoad(ctx context.Context, c cache.Cache, keys []string, loader func(missing []string) map[string][]byte, ttl time.Duration) map[string][]byte {
+	hits := c.Fetch(ctx, keys)
+	if hits == nil {
+		hits = map[string][]byte{}
+	}
+	if len(hits) == len(keys) || ctx.Err() != nil {
+		return hits
+	}
+
+	missing := withoutHits(keys, hits, nil)
+	loaded := loader(missing)
+	if len(loaded) == 0 {
+		return hits
+	}
+
+	c.Store(loaded, ttl)
+	maps.Copy(hits, loaded)
+	return hits
+}
+
+// FetchByPrefix returns the items whose key starts with the input prefix, eg. to invalidate or warm up
+// all the chunks of a block at once. Only the levels able to scan their keys are fetched, eg. the disk
+// cache and the in-memory caches sharing a memory budget, so the items only stored in the other levels,
+// eg. memcached or redis, are not returned. ErrPrefixFetchUnsupported is returned if no level supports it.
+//
+// A key found in multiple levels gets the value of the fastest one. The items found are neither
+// backfilled nor have their TTL refreshed.
+func (m *multiLevelBucketCache) FetchByPrefix(ctx context.Context, prefix string) (map[string][]byte, error) {
+	hits := map[string][]byte{}
+	supported := false
+
+	for _, c := range m.getCaches() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		data, err := FetchByPrefix(ctx, c, prefix)
+		if errors.Is(err, ErrPrefixFetchUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		supported = true
+
+		for k, d := range data {
+			if _, found := hits[k]; found {
+				continue
+			}
+			d, ok := m.decodeChecksum(d)
+			if !ok {
+				continue
+			}
+			if v, ok := m.decodeEmptyValue(d); ok {
+				hits[k] = v
+			}
+		}
+	}
+
+	if !supported {
+		return nil, ErrPrefixFetchUnsupported
+	}
+	return hits, nil
+}
+
+// FetchByPrefix returns the items of the input cache whose key starts with the input prefix, or
+// ErrPrefixFetchUnsupported if the cache is unable to scan its keys. See multiLevelBucketCache.FetchByPrefix
+// for the multi level caches.
+func FetchByPrefix(ctx context.Context, c cache.Cache, prefix string) (map[string][]byte, error) {
+	switch c := c.(type) {
+	case *multiLevelBucketCache:
+		return c.FetchByPrefix(ctx, prefix)
+	case cachePrefixFetcher:
+		return c.FetchByPrefix(ctx, prefix), nil
+	default:
+		return nil, ErrPrefixFetchUnsupported
+	}
+}
+
+// fetch fetches the input keys from the cache levels, calling the optional fn for each new hit with
+// the index of the level which served it.
+// It returns all the hits, and false if the context has been canceled in the meanwhile. If readers
+// is not nil, the hits of the levels supporting streaming reads are added to it as readers instead,
+// and are not returned nor backfilled. If absent is not nil, the keys a level reported as confirmed missing
+// from the object storage are added to it. They're never fetched from the slower levels.
+func (m *multiLevelBucketCache) fetch(ctx context.Context, keys []string, fn func(level int, key string, value []byte), readers map[string]io.ReadCloser, absent map[string]struct{}) (map[string][]byte, bool) {
 	timer := prometheus.NewTimer(m.fetchLatency.WithLabelValues())
 	defer timer.ObserveDuration()
 
+	caches := m.getCaches()
+	// From now on, the levels are in fetch order, while levels holds the index of each of them in the
+	// configured order. The items found in a level are backfilled to the levels fetched before it.
+	caches, levels := m.fetchOrder(caches)
+
 	missingKeys := keys
 	hits := map[string][]byte{}
-	backfillItems := make([]map[string][]byte, len(m.caches)-1)
+	expired := map[string]struct{}{}
+	if absent == nil {
+		absent = map[string]struct{}{}
+	}
+	backfillItems := make([]map[string][]byte, len(caches)-1)
 
-	for i, c := range m.caches {
-		if i < len(m.caches)-1 {
+	for i, c := range caches {
+		if i < len(caches)-1 {
 			backfillItems[i] = map[string][]byte{}
 		}
 		if ctx.Err() != nil {
-			return nil
+			return nil, false
 		}
-		if data := c.Fetch(ctx, missingKeys); len(data) > 0 {
+
+		fetchStart := time.Now()
+		if rf, ok := c.(cacheReaderFetcher); ok && readers != nil && !m.verifyChecksums {
+			m.fetchLevelReaders(ctx, rf, missingKeys, hits, readers)
+			missingKeys = withoutHits(missingKeys, hits, readers)
+		} else if data := m.fetchLevel(ctx, c, missingKeys, expired, absent); len(data) > 0 {
 			for k, d := range data {
-				hits[k] = d
-			}
+				d, ok := m.decodeChecksum(d)
+				if !ok {
+					continue
+				}
+				v, ok := m.decodeEmptyValue(d)
+				if !ok {
+					continue
+				}
+				// A key may be returned by multiple levels, so keep the first value found.
+				if _, found := hits[k]; found {
+					continue
+				}
+				if _, found := readers[k]; found {
+					continue
+				}
 
-			if i > 0 && len(hits) > 0 {
-				// lets fetch only the mising keys
-				m := missingKeys[:0]
-				for _, key := range missingKeys {
-					if _, ok := hits[key]; !ok {
-						m = append(m, key)
-					}
+				hits[k] = v
+				if fn != nil {
+					fn(i, k, v)
 				}
+			}
+
+			if i == 0 && m.refreshTTLOnHit {
+				m.enqueueTouch(c, data, m.backfillTTL)
+			}
 
-				missingKeys = m
+			if i > 0 && len(hits) > 0 {
+				// lets fetch only the mising keys. A new slice is allocated because
+				// the input keys are owned by the caller and may be shared.
+				missingKeys = withoutHits(missingKeys, hits, readers)
 
 				for k, b := range hits {
 					backfillItems[i-1][k] = b
 				}
 			}
+		}
+
+		m.observeFetchLatency(ctx, levels[i], fetchStart)
 
-			if len(hits) == len(keys) {
-				// fetch done
-				break
+		if len(absent) > 0 {
+			// A key found in a level is a hit, even if another level reported it as absent.
+			for k := range absent {
+				_, found := hits[k]
+				if _, streamed := readers[k]; found || streamed {
+					delete(absent, k)
+				}
 			}
+			missingKeys = withoutAbsent(missingKeys, absent)
+		}
+
+		if i == 0 {
+			m.trackFastestLevelHits(len(hits)+len(readers)+len(absent), len(keys))
+		}
+		if len(hits)+len(readers)+len(absent) == len(keys) {
+			// fetch done
+			break
+		}
+		if i == 0 && m.skipSlowerLevels(ctx) {
+			break
 		}
 	}
 
+	m.trackMisses(keys, hits, readers, expired, absent)
+
 	defer func() {
 		backFillTimer := prometheus.NewTimer(m.backFillLatency.WithLabelValues())
 		defer backFillTimer.ObserveDuration()
@@ -163,15 +834,883 @@ func (m *multiLevelBucketCache) Fetch(ctx context.Context, keys []string) map[st
 				continue
 			}
 
-			if err := m.backfillProcessor.EnqueueAsync(func() {
-				m.caches[i].Store(values, m.backfillTTL)
-			}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
-				m.backfillDroppedItems.Inc()
+			// The slower levels are backfilled last, and not at all if the buffer is under pressure.
+			if i > 0 && m.queuedOps.Load() >= m.maxQueuedSlowerLevelsBackfills {
+				m.backfillDroppedItems.WithLabelValues(levelLabel(levels[i])).Inc()
+				m.observeBackfill(true)
+				continue
+			}
+
+			values = m.applyAdaptiveBackfillLimit(levels[i], m.encodeEmptyValues(values))
+			values = m.skipOversizedItems(m.encodeChecksums(m.applyBackfillRateLimit(values)))
+			values = m.acquireInflightBackfills(caches[i], values)
+			if len(values) == 0 {
+				continue
+			}
+
+			// The backfilled items are missing from the level, so they're never skipped.
+			m.rememberRecentlyStored(caches[i], values)
+
+			err := m.enqueueAsync(func() {
+				caches[i].Store(values, m.backfillTTL)
+				m.releaseInflightBackfills(caches[i], values)
+			})
+			if errors.Is(err, cacheutil.ErrAsyncBufferFull) {
+				m.backfillDroppedItems.WithLabelValues(levelLabel(levels[i])).Inc()
+				m.releaseInflightBackfills(caches[i], values)
+				m.forgetRecentlyStored(caches[i], values)
+			}
+			m.observeBackfill(err != nil)
+			if err == nil {
+				// The items have been found in the level fetched after the backfilled one.
+				m.sampleBackfill(levels[i+1], levels[i], values)
 			}
 		}
 	}()
 
-	return hits
+	return hits, true
+}
+
+// fetchOrder returns the input cache levels in the order they should be fetched, along with the index
+// of each of them in the input levels. The input order is kept unless the adaptive fetch order is enabled.
+func (m *multiLevelBucketCache) fetchOrder(caches []cache.Cache) ([]cache.Cache, []int) {
+	var order []int
+	if m.adaptiveFetchOrder != nil {
+		order = m.adaptiveFetchOrder.get(len(caches))
+	}
+
+	if order == nil {
+		levels := make([]int, len(caches))
+		for i := range levels {
+			levels[i] = i
+		}
+		return caches, levels
+	}
+
+	ordered := make([]cache.Cache, len(caches))
+	for i, level := range order {
+		ordered[i] = caches[level]
+	}
+	return ordered, order
+}
+
+// observeFetchLatency reports the latency of a fetch of the level at the input index started at the
+// input time to the adaptive fetch order, if enabled. The fetches interrupted by the context are not
+// representative of the level latency, so they're ignored.
+func (m *multiLevelBucketCache) observeFetchLatency(ctx context.Context, level int, start time.Time) {
+	if m.adaptiveFetchOrder != nil && ctx.Err() == nil {
+		now := time.Now()
+		m.adaptiveFetchOrder.observe(level, now.Sub(start), now)
+	}
+}
+
+// fetchLevel fetches the input keys from the input cache level. The keys the level reports as expired,
+// if it's able to, are added to expired, and the keys it reports as absent are added to absent.
+func (m *multiLevelBucketCache) fetchLevel(ctx context.Context, c cache.Cache, keys []string, expired, absent map[string]struct{}) map[string][]byte {
+	if af, ok := c.(cacheAbsentFetcher); ok {
+		data, absentKeys := af.FetchWithAbsent(ctx, keys)
+		for _, k := range absentKeys {
+			absent[k] = struct{}{}
+		}
+		return data
+	}
+
+	xf, ok := c.(cacheExpiryFetcher)
+	if !ok {
+		return c.Fetch(ctx, keys)
+	}
+
+	data, expiredKeys := xf.FetchWithExpired(ctx, keys)
+	for _, k := range expiredKeys {
+		expired[k] = struct{}{}
+	}
+	return data
+}
+
+// trackMisses counts the input keys found neither in hits nor readers, nor reported as absent, by reason.
+// A key is an expired miss if any level reported it as expired, and a cold miss otherwise, including when
+// no level is able to tell: cold misses mean the working set doesn't fit in the cache, while expired misses
+// mean the TTL may be too short.
+func (m *multiLevelBucketCache) trackMisses(keys []string, hits map[string][]byte, readers map[string]io.ReadCloser, expired, absent map[string]struct{}) {
+	cold, expiredMisses := 0, 0
+	for _, key := range keys {
+		_, found := hits[key]
+		_, streamed := readers[key]
+		if _, isAbsent := absent[key]; found || streamed || isAbsent {
+			continue
+		}
+
+		if _, ok := expired[key]; ok {
+			expiredMisses++
+		} else {
+			cold++
+		}
+	}
+
+	if cold > 0 {
+		m.missedItems.WithLabelValues(missReasonCold).Add(float64(cold))
+	}
+	if expiredMisses > 0 {
+		m.missedItems.WithLabelValues(missReasonExpired).Add(float64(expiredMisses))
+	}
+}
+
+// trackFastestLevelHits records when the fastest level last returned most of the fetched keys,
+// for the latency-sensitive fetches to trust it within the freshness window.
+func (m *multiLevelBucketCache) trackFastestLevelHits(hits, keys int) {
+	if m.latencySensitiveFreshness > 0 && keys > 0 && float64(hits)/float64(keys) >= latencySensitiveMinHitRatio {
+		m.fastestLevelConfirmedAt.Store(time.Now().UnixNano())
+	}
+}
+
+// skipSlowerLevels returns whether a fetch missing some keys from the fastest level should skip
+// the slower levels, because it's latency-sensitive and the fastest level is trusted.
+func (m *multiLevelBucketCache) skipSlowerLevels(ctx context.Context) bool {
+	if m.latencySensitiveFreshness <= 0 || !isLatencySensitiveFetch(ctx) {
+		return false
+	}
+	if time.Since(time.Unix(0, m.fastestLevelConfirmedAt.Load())) > m.latencySensitiveFreshness {
+		return false
+	}
+
+	m.latencySensitiveShortCircuits.Inc()
+	return true
+}
+
+// fetchLevelReaders fetches the input keys from a level supporting streaming reads, adding the new
+// hits to readers. The readers of the values already found or not considered hits are closed.
+func (m *multiLevelBucketCache) fetchLevelReaders(ctx context.Context, c cacheReaderFetcher, keys []string, hits map[string][]byte, readers map[string]io.ReadCloser) {
+	for k, r := range c.FetchReaders(ctx, keys) {
+		// A key may be returned by multiple levels, so keep the first value found.
+		_, found := hits[k]
+		if _, streamed := readers[k]; found || streamed {
+			_ = r.Close()
+			continue
+		}
+
+		if r, ok := m.decodeEmptyValueReader(r); ok {
+			readers[k] = r
+		}
+	}
+}
+
+// withoutHits returns a new slice with the input keys not found in hits nor readers.
+func withoutHits(keys []string, hits map[string][]byte, readers map[string]io.ReadCloser) []string {
+	missing := make([]string, 0, len(keys))
+	for _, key := range keys {
+		_, found := hits[key]
+		if _, streamed := readers[key]; !found && !streamed {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// withoutAbsent returns a new slice with the input keys not in absent.
+func withoutAbsent(keys []string, absent map[string]struct{}) []string {
+	missing := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := absent[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// fetchReaders fetches the input keys from the input cache as readers, wrapping the values in a
+// reader if the cache doesn't support streaming reads. The caller must close the returned readers.
+func fetchReaders(ctx context.Context, c cache.Cache, keys []string) map[string]io.ReadCloser {
+	if rf, ok := c.(cacheReaderFetcher); ok {
+		return rf.FetchReaders(ctx, keys)
+	}
+
+	readers := map[string]io.ReadCloser{}
+	for k, v := range c.Fetch(ctx, keys) {
+		readers[k] = io.NopCloser(bytes.NewReader(v))
+	}
+	return readers
+}
+
+func closeReaders(readers map[string]io.ReadCloser) {
+	for _, r := range readers {
+		_ = r.Close()
+	}
+}
+
+// enqueueAsync enqueues the input operation to the async processor, tracking the operations
+// enqueued and not started yet.
+func (m *multiLevelBucketCache) enqueueAsync(op func()) error {
+	m.queuedOps.Inc()
+
+	err := m.backfillProcessor.EnqueueAsync(func() {
+		m.queuedOps.Dec()
+		defer m.recoverAsyncOp()
+		op()
+	})
+	if err != nil {
+		m.queuedOps.Dec()
+	}
+	return err
+}
+
+// recoverAsyncOp recovers from the panic of an async operation, eg. caused by a bug of a cache client,
+// so that it doesn't kill the worker running it and, with it, the following backfills and stores.
+func (m *multiLevelBucketCache) recoverAsyncOp() {
+	if e := recover(); e != nil {
+		m.backfillPanics.Inc()
+		level.Error(m.logger).Log("msg", "recovered panic in multi level cache async operation", "err", e, "stacktrace", string(debug.Stack()))
+	}
+}
+
+// levelLabel returns the metrics label of the cache level at the input index.
+func levelLabel(i int) string {
+	return strconv.Itoa(i + 1)
+}
+
+// encodeEmptyValues returns the input items with zero-length values either wrapped in the
+// sentinel, if empty values are allowed, or removed. The input map is never modified.
+func (m *multiLevelBucketCache) encodeEmptyValues(data map[string][]byte) map[string][]byte {
+	empty := 0
+	for _, v := range data {
+		if len(v) == 0 {
+			empty++
+		}
+	}
+	if empty == 0 {
+		return data
+	}
+
+	encoded := make(map[string][]byte, len(data))
+	for k, v := range data {
+		if len(v) > 0 {
+			encoded[k] = v
+		} else if m.allowEmptyValues {
+			encoded[k] = emptyValueSentinel
+		}
+	}
+
+	if !m.allowEmptyValues {
+		m.emptyValuesRejected.Add(float64(empty))
+	}
+	return encoded
+}
+
+// decodeEmptyValue returns the value to return to the caller for a fetched item, and whether the
+// item should be considered a hit. Zero-length values are only hits if stored through the sentinel.
+func (m *multiLevelBucketCache) decodeEmptyValue(v []byte) ([]byte, bool) {
+	if bytes.Equal(v, emptyValueSentinel) {
+		return []byte{}, m.allowEmptyValues
+	}
+	return v, len(v) > 0
+}
+
+// decodeEmptyValueReader is like decodeEmptyValue, but for a value fetched as a reader. Only the
+// beginning of the value is read ahead to detect the sentinel, so that large values are still
+// streamed. The reader is closed if the value isn't considered a hit.
+func (m *multiLevelBucketCache) decodeEmptyValueReader(r io.ReadCloser) (io.ReadCloser, bool) {
+	br := bufio.NewReaderSize(r, len(emptyValueSentinel)+1)
+	prefix, err := br.Peek(len(emptyValueSentinel) + 1)
+	if err == nil {
+		// The value is longer than the sentinel.
+		return readCloser{Reader: br, Closer: r}, true
+	}
+
+	// The value is either unreadable or short enough to be entirely read ahead.
+	defer func() { _ = r.Close() }()
+	if !errors.Is(err, io.EOF) {
+		return nil, false
+	}
+
+	v, ok := m.decodeEmptyValue(bytes.Clone(prefix))
+	if !ok {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(v)), true
+}
+
+// encodeChecksums returns the input items with a checksum prepended to each value, if checksums
+// are enabled. The input map is never modified.
+func (m *multiLevelBucketCache) encodeChecksums(data map[string][]byte) map[string][]byte {
+	if !m.verifyChecksums || len(data) == 0 {
+		return data
+	}
+
+	encoded := make(map[string][]byte, len(data))
+	for k, v := range data {
+		b := make([]byte, crc32.Size+len(v))
+		binary.BigEndian.PutUint32(b, crc32.Checksum(v, checksumTable))
+		copy(b[crc32.Size:], v)
+		encoded[k] = b
+	}
+	return encoded
+}
+
+// skipOversizedItems returns the subset of the input items not bigger than the max item size, if
+// any. The input map is never modified.
+func (m *multiLevelBucketCache) skipOversizedItems(data map[string][]byte) map[string][]byte {
+	if m.maxItemBytes <= 0 {
+		return data
+	}
+
+	var kept map[string][]byte
+	for k, v := range data {
+		if len(v) <= m.maxItemBytes {
+			continue
+		}
+
+		if kept == nil {
+			kept = maps.Clone(data)
+		}
+		delete(kept, k)
+
+		m.oversizedItems.Inc()
+		level.Warn(m.logger).Log("msg", "skipped storing item bigger than the max item size to the multi level cache", "key", k, "size", len(v), "max_item_bytes", m.maxItemBytes)
+	}
+
+	if kept == nil {
+		return data
+	}
+	return kept
+}
+
+// decodeChecksum returns the fetched value without its checksum, if checksums are enabled, and
+// whether the value matches the checksum.
+func (m *multiLevelBucketCache) decodeChecksum(v []byte) ([]byte, bool) {
+	if !m.verifyChecksums {
+		return v, true
+	}
+
+	if len(v) < crc32.Size || binary.BigEndian.Uint32(v) != crc32.Checksum(v[crc32.Size:], checksumTable) {
+		m.corruptValues.Inc()
+		return nil, false
+	}
+	return v[crc32.Size:], true
+}
+
+// acquireInflightBackfills returns the subset of the input items not already being backfilled to
+// the input cache level, and tracks them as in-flight until released.
+func (m *multiLevelBucketCache) acquireInflightBackfills(level cache.Cache, values map[string][]byte) map[string][]byte {
+	if len(values) == 0 {
+		return values
+	}
+
+	m.inflightBackfillsMtx.Lock()
+	defer m.inflightBackfillsMtx.Unlock()
+
+	acquired := make(map[string][]byte, len(values))
+	for k, v := range values {
+		key := levelItem{level: level, key: k}
+		if _, ok := m.inflightBackfills[key]; ok {
+			m.backfillDeduplicatedItems.Inc()
+			continue
+		}
+
+		if len(m.inflightBackfills) < maxInflightBackfills {
+			m.inflightBackfills[key] = struct{}{}
+		}
+		acquired[k] = v
+	}
+	return acquired
+}
+
+// releaseInflightBackfills stops tracking the input items as being backfilled to the input cache level.
+func (m *multiLevelBucketCache) releaseInflightBackfills(level cache.Cache, values map[string][]byte) {
+	m.inflightBackfillsMtx.Lock()
+	defer m.inflightBackfillsMtx.Unlock()
+
+	for k := range values {
+		delete(m.inflightBackfills, levelItem{level: level, key: k})
+	}
+}
+
+// skipRecentlyStored returns the subset of the input items not recently stored to the input cache
+// level with the same value, and remembers them as recently stored. The input map is never modified.
+func (m *multiLevelBucketCache) skipRecentlyStored(level cache.Cache, data map[string][]byte) map[string][]byte {
+	if m.recentlyStored == nil {
+		return data
+	}
+
+	toStore := make(map[string][]byte, len(data))
+	for k, v := range data {
+		item := levelItem{level: level, key: k}
+		hash := xxhash.Sum64(v)
+		if stored, ok := m.recentlyStored.Get(item); ok && stored == hash {
+			m.skippedStoreItems.Inc()
+			continue
+		}
+
+		m.recentlyStored.Add(item, hash)
+		toStore[k] = v
+	}
+	return toStore
+}
+
+// rememberRecentlyStored remembers the input items as recently stored to the input cache level.
+func (m *multiLevelBucketCache) rememberRecentlyStored(level cache.Cache, data map[string][]byte) {
+	if m.recentlyStored == nil {
+		return
+	}
+
+	for k, v := range data {
+		m.recentlyStored.Add(levelItem{level: level, key: k}, xxhash.Sum64(v))
+	}
+}
+
+// forgetRecentlyStored forgets the input items as recently stored to the input cache level,
+// eg. because they've not been stored eventually.
+func (m *multiLevelBucketCache) forgetRecentlyStored(level cache.Cache, data map[string][]byte) {
+	if m.recentlyStored == nil {
+		return
+	}
+
+	for k := range data {
+		m.recentlyStored.Remove(levelItem{level: level, key: k})
+	}
+}
+
+// applyBackfillRateLimit returns the subset of the input items allowed by the backfill rate limits,
+// if any. Items exceeding the limits are dropped.
+func (m *multiLevelBucketCache) applyBackfillRateLimit(values map[string][]byte) map[string][]byte {
+	if len(values) == 0 || (m.backfillItemsLimiter == nil && m.backfillBytesLimiter == nil) {
+		return values
+	}
+
+	now := time.Now()
+	allowed := make(map[string][]byte, len(values))
+	for k, v := range values {
+		if m.backfillItemsLimiter != nil && !m.backfillItemsLimiter.AllowN(now, 1) {
+			continue
+		}
+		if m.backfillBytesLimiter != nil && !m.backfillBytesLimiter.AllowN(now, len(v)) {
+			continue
+		}
+		allowed[k] = v
+	}
+
+	if dropped := len(values) - len(allowed); dropped > 0 {
+		m.backfillRateLimitedItems.Add(float64(dropped))
+	}
+	return allowed
+}
+
+// applyAdaptiveBackfillLimit returns a subset of the input items not exceeding the adaptive max
+// backfill items, if enabled. The items exceeding it are dropped. The input map is never modified.
+func (m *multiLevelBucketCache) applyAdaptiveBackfillLimit(level int, values map[string][]byte) map[string][]byte {
+	if m.adaptiveBackfill == nil {
+		return values
+	}
+
+	limit := m.adaptiveBackfill.limit()
+	if len(values) <= limit {
+		return values
+	}
+
+	allowed := make(map[string][]byte, limit)
+	for k, v := range values {
+		if len(allowed) == limit {
+			break
+		}
+		allowed[k] = v
+	}
+
+	m.backfillDroppedItems.WithLabelValues(levelLabel(level)).Add(float64(len(values) - limit))
+	return allowed
+}
+
+// sampleBackfill reports the keys of the input backfill, from the source level to the target level,
+// if the backfill is sampled. It never blocks: the sampled backfills exceeding the max number of
+// reports per second are skipped.
+func (m *multiLevelBucketCache) sampleBackfill(sourceLevel, targetLevel int, values map[string][]byte) {
+	if m.backfillSampleLimiter == nil || m.backfills.Inc()%m.backfillSampleRate != 0 {
+		return
+	}
+	if !m.backfillSampleLimiter.Allow() {
+		return
+	}
+
+	m.onSampledBackfill(sourceLevel, targetLevel, slices.Sorted(maps.Keys(values)))
+}
+
+// logSampledBackfill logs a sampled backfill, with up to maxSampledBackfillKeys of its keys.
+func (m *multiLevelBucketCache) logSampledBackfill(sourceLevel, targetLevel int, keys []string) {
+	level.Info(m.logger).Log("msg", "sampled multi level cache backfill", "source_level", levelLabel(sourceLevel), "target_level", levelLabel(targetLevel), "num_keys", len(keys), "keys", strings.Join(keys[:min(len(keys), maxSampledBackfillKeys)], ","))
+}
+
+// observeBackfill reports whether a backfill has been dropped to the adaptive max backfill items, if enabled.
+func (m *multiLevelBucketCache) observeBackfill(dropped bool) {
+	if m.adaptiveBackfill != nil {
+		m.adaptiveBackfill.observe(dropped, time.Now())
+	}
+}
+
+// adaptiveBackfillLimit adapts the max number of items backfilled per async operation to the
+// pressure on the async buffer: at the end of each window, the limit is halved if the ratio of
+// backfills dropped within the window exceeded the max drop ratio, and doubled otherwise, without
+// exceeding the configured max backfill items. Under pressure, backfilling large sets of items
+// mostly wastes CPU, since they're likely to be dropped anyway.
+type adaptiveBackfillLimit struct {
+	maxItems     int
+	maxDropRatio float64
+	effective    prometheus.Gauge
+
+	mtx         sync.Mutex
+	current     int
+	windowStart time.Time
+	backfills   int
+	dropped     int
+}
+
+func newAdaptiveBackfillLimit(maxItems int, maxDropRatio float64, effective prometheus.Gauge) *adaptiveBackfillLimit {
+	effective.Set(float64(maxItems))
+
+	return &adaptiveBackfillLimit{
+		maxItems:     maxItems,
+		maxDropRatio: maxDropRatio,
+		effective:    effective,
+		current:      maxItems,
+		windowStart:  time.Now(),
+	}
+}
+
+// limit returns the current max number of items backfilled per async operation.
+func (l *adaptiveBackfillLimit) limit() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.current
+}
+
+// observe records a backfill, and whether it's been dropped, adjusting the limit if the window elapsed.
+func (l *adaptiveBackfillLimit) observe(dropped bool, now time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.windowStart) >= adaptiveBackfillWindow {
+		if float64(l.dropped)/float64(max(1, l.backfills)) > l.maxDropRatio {
+			l.current = max(1, l.current/2)
+		} else {
+			l.current = min(l.maxItems, l.current*2)
+		}
+		l.effective.Set(float64(l.current))
+
+		l.windowStart = now
+		l.backfills = 0
+		l.dropped = 0
+	}
+
+	l.backfills++
+	if dropped {
+		l.dropped++
+	}
+}
+
+// adaptiveFetchOrder orders the levels of a multi level cache by their recent fetch latency, tracked
+// as an exponentially weighted moving average, so that the empirically fastest level is fetched first
+// even if configured as a slower one, eg. a memcached slower than a nearby redis. The order is
+// re-evaluated at most once per stabilization window, so that levels with a similar latency don't flap.
+type adaptiveFetchOrder struct {
+	window time.Duration
+
+	position *prometheus.GaugeVec
+	latency  *prometheus.GaugeVec
+	reorders prometheus.Counter
+
+	mtx sync.Mutex
+
+	// The latency of the levels, by index in the configured order, in seconds. Levels not fetched
+	// yet are not measured.
+	ewma     []float64
+	measured []bool
+
+	// order is the index of the levels in fetch order. It's replaced, never modified in place, so
+	// that it can be shared with the fetches in progress.
+	order       []int
+	evaluatedAt time.Time
+}
+
+func newAdaptiveFetchOrder(levels int, window time.Duration, position, latency *prometheus.GaugeVec, reorders prometheus.Counter) *adaptiveFetchOrder {
+	o := &adaptiveFetchOrder{
+		window:   window,
+		position: position,
+		latency:  latency,
+		reorders: reorders,
+	}
+	o.reset(levels, time.Now())
+
+	return o
+}
+
+// reset restores the configured order of the input number of levels, forgetting their latency.
+func (o *adaptiveFetchOrder) reset(levels int, now time.Time) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	o.ewma = make([]float64, levels)
+	o.measured = make([]bool, levels)
+	o.order = make([]int, levels)
+	for i := range o.order {
+		o.order[i] = i
+	}
+	o.evaluatedAt = now
+
+	o.position.Reset()
+	o.latency.Reset()
+	o.updatePositionsLocked()
+}
+
+// get returns the index of the levels in fetch order, or nil if the number of levels doesn't match
+// the input one, eg. because the levels are being replaced.
+func (o *adaptiveFetchOrder) get(levels int) []int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if len(o.order) != levels {
+		return nil
+	}
+	return o.order
+}
+
+// observe records the latency of a fetch of the level at the input index, re-evaluating the order
+// if the stabilization window elapsed. Levels are ordered by latency, the levels not measured yet
+// being fetched last in the configured order.
+func (o *adaptiveFetchOrder) observe(level int, latency time.Duration, now time.Time) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if level >= len(o.ewma) {
+		return
+	}
+
+	if o.measured[level] {
+		o.ewma[level] += adaptiveFetchOrderEWMAAlpha * (latency.Seconds() - o.ewma[level])
+	} else {
+		o.ewma[level] = latency.Seconds()
+		o.measured[level] = true
+	}
+	o.latency.WithLabelValues(levelLabel(level)).Set(o.ewma[level])
+
+	if now.Sub(o.evaluatedAt) < o.window {
+		return
+	}
+	o.evaluatedAt = now
+
+	order := make([]int, len(o.ewma))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		if o.measured[a] != o.measured[b] {
+			if o.measured[a] {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(o.ewma[a], o.ewma[b])
+	})
+
+	if !slices.Equal(order, o.order) {
+		o.order = order
+		o.reorders.Inc()
+		o.updatePositionsLocked()
+	}
+}
+
+func (o *adaptiveFetchOrder) updatePositionsLocked() {
+	for i, level := range o.order {
+		o.position.WithLabelValues(levelLabel(level)).Set(float64(i + 1))
+	}
+}
+
+// Touch refreshes the TTL of the input keys in all cache levels. The refresh is best-effort: it's done
+// asynchronously, and dropped if the async buffer is full. Levels not supporting TTL refresh have the
+// items found in the level stored again, unless the TTL is 0, since the items would lose their expiry.
+func (m *multiLevelBucketCache) Touch(_ context.Context, keys []string, ttl time.Duration) {
+	// The input keys are owned by the caller, which may reuse them once returned.
+	keys = slices.Clone(keys)
+
+	for _, c := range m.getCaches() {
+		t, ok := c.(cacheToucher)
+		if !ok && ttl <= 0 {
+			continue
+		}
+
+		if err := m.enqueueAsync(func() {
+			if ok {
+				t.Touch(context.Background(), keys, ttl)
+				m.touchedItems.Add(float64(len(keys)))
+			} else if data := c.Fetch(context.Background(), keys); len(data) > 0 {
+				c.Store(data, ttl)
+				m.touchedItems.Add(float64(len(data)))
+			}
+		}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
+			m.storeDroppedItems.Inc()
+		}
+	}
+}
+
+// Invalidate removes the input keys from all cache levels supporting the removal of items.
+func (m *multiLevelBucketCache) Invalidate(ctx context.Context, keys []string) {
+	for _, c := range m.getCaches() {
+		if m.recentlyStored != nil {
+			for _, k := range keys {
+				m.recentlyStored.Remove(levelItem{level: c, key: k})
+			}
+		}
+
+		if d, ok := c.(cacheDeleter); ok {
+			d.Delete(ctx, keys)
+			m.invalidatedItems.Add(float64(len(keys)))
+		}
+	}
+}
+
+// enqueueTouch asynchronously refreshes the TTL of the input items found in the input cache level.
+// Levels not supporting TTL refresh have the items stored again, unless the TTL is 0, eg. in the
+// metadata cache, since the items would lose their expiry.
+func (m *multiLevelBucketCache) enqueueTouch(c cache.Cache, data map[string][]byte, ttl time.Duration) {
+	if _, ok := c.(cacheToucher); !ok && ttl <= 0 {
+		return
+	}
+
+	if err := m.enqueueAsync(func() {
+		if t, ok := c.(cacheToucher); ok {
+			keys := make([]string, 0, len(data))
+			for k := range data {
+				keys = append(keys, k)
+			}
+			t.Touch(context.Background(), keys, ttl)
+		} else {
+			c.Store(data, ttl)
+		}
+		m.touchedItems.Add(float64(len(data)))
+	}); errors.Is(err, cacheutil.ErrAsyncBufferFull) {
+		m.storeDroppedItems.Inc()
+	}
+}
+
+// ReplaceCaches atomically replaces the cache levels, ordered from the fastest to the slowest.
+// Operations in progress complete on the previous levels.
+func (m *multiLevelBucketCache) ReplaceCaches(c ...cache.Cache) error {
+	if len(c) == 0 {
+		return errNoCacheLevels
+	}
+
+	m.cachesMtx.Lock()
+	defer m.cachesMtx.Unlock()
+
+	m.caches = c
+	if m.recentlyStored != nil {
+		// The items recently stored to the previous levels are not relevant anymore.
+		m.recentlyStored.Purge()
+	}
+	if m.adaptiveFetchOrder != nil {
+		// The latency of the previous levels is not relevant anymore.
+		m.adaptiveFetchOrder.reset(len(c), time.Now())
+	}
+	return nil
+}
+
+func (m *multiLevelBucketCache) getCaches() []cache.Cache {
+	m.cachesMtx.RLock()
+	defer m.cachesMtx.RUnlock()
+
+	return m.caches
+}
+
+// CacheDescription describes the effective configuration of a multi level cache.
+type CacheDescription struct {
+	Name   string                  `json:"name"`
+	Levels []CacheLevelDescription `json:"levels"`
+
+	// Items found in a level are backfilled to all the faster levels with BackfillTTL.
+	BackfillTTL               time.Duration `json:"backfill_ttl"`
+	MaxBackfillItems          int           `json:"max_backfill_items"`
+	MaxBackfillItemsPerSecond int           `json:"max_backfill_items_per_second"`
+	MaxBackfillBytesPerSecond int           `json:"max_backfill_bytes_per_second"`
+
+	RefreshTTLOnHit  bool `json:"refresh_ttl_on_hit"`
+	AllowEmptyValues bool `json:"allow_empty_values"`
+	VerifyChecksums  bool `json:"verify_checksums"`
+	MaxItemBytes     int  `json:"max_item_bytes"`
+
+	LatencySensitiveFreshness time.Duration `json:"latency_sensitive_freshness_window"`
+
+	// The max backfill items is lowered while the backfills are dropped, if the ratio is greater than 0.
+	AdaptiveBackfillDropRatio float64 `json:"adaptive_backfill_drop_ratio"`
+
+	MaxRecentlyStoredItems int `json:"max_recently_stored_items"`
+
+	// The levels are fetched in the order of their recent latency, if the window is greater than 0.
+	AdaptiveFetchOrderWindow time.Duration `json:"adaptive_fetch_order_stabilization_window"`
+}
+
+// CacheLevelDescription describes a single level of a multi level cache.
+type CacheLevelDescription struct {
+	Name           string        `json:"name"`
+	Type           string        `json:"type"`
+	TTL            time.Duration `json:"ttl"`
+	SupportsTouch  bool          `json:"supports_touch"`
+	SupportsDelete bool          `json:"supports_delete"`
+
+	// Items can be fetched by key prefix only from the levels able to scan their keys.
+	SupportsPrefixFetch bool `json:"supports_prefix_fetch"`
+}
+
+// Describe returns the configuration currently in use by the cache, including the
+// cache levels, ordered from the fastest to the slowest.
+func (m *multiLevelBucketCache) Describe() CacheDescription {
+	caches := m.getCaches()
+
+	d := CacheDescription{
+		Name:             m.name,
+		Levels:           make([]CacheLevelDescription, 0, len(caches)),
+		BackfillTTL:      m.backfillTTL,
+		MaxBackfillItems: m.maxBackfillItems,
+		RefreshTTLOnHit:  m.refreshTTLOnHit,
+		AllowEmptyValues: m.allowEmptyValues,
+		VerifyChecksums:  m.verifyChecksums,
+		MaxItemBytes:     m.maxItemBytes,
+
+		LatencySensitiveFreshness: m.latencySensitiveFreshness,
+
+		MaxRecentlyStoredItems: m.maxRecentlyStoredItems,
+	}
+	if m.backfillItemsLimiter != nil {
+		d.MaxBackfillItemsPerSecond = int(m.backfillItemsLimiter.Limit())
+	}
+	if m.backfillBytesLimiter != nil {
+		d.MaxBackfillBytesPerSecond = int(m.backfillBytesLimiter.Limit())
+	}
+	if m.adaptiveBackfill != nil {
+		d.AdaptiveBackfillDropRatio = m.adaptiveBackfill.maxDropRatio
+	}
+	if m.adaptiveFetchOrder != nil {
+		d.AdaptiveFetchOrderWindow = m.adaptiveFetchOrder.window
+	}
+
+	for i, c := range caches {
+		_, supportsTouch := c.(cacheToucher)
+		_, supportsDelete := c.(cacheDeleter)
+		_, supportsPrefixFetch := c.(cachePrefixFetcher)
+
+		level := CacheLevelDescription{
+			Name:                c.Name(),
+			Type:                fmt.Sprintf("%T", c),
+			SupportsTouch:       supportsTouch,
+			SupportsDelete:      supportsDelete,
+			SupportsPrefixFetch: supportsPrefixFetch,
+		}
+
+		// The TTL of the items stored in the slowest level is set by the caller,
+		// while the faster levels get the backfill TTL too.
+		if i < len(caches)-1 {
+			level.TTL = m.backfillTTL
+		}
+
+		d.Levels = append(d.Levels, level)
+	}
+
+	return d
 }
 
 func (m *multiLevelBucketCache) Name() string {
@@ -1,13 +1,20 @@
 package tsdb
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/thanos/pkg/cache"
 )
@@ -61,7 +68,7 @@ func Test_MultiLevelBucketCacheStore(t *testing.T) {
 			m1 := newMockBucketCache("m1", tc.m1InitData)
 			m2 := newMockBucketCache("m2", tc.m2InitData)
 			reg := prometheus.NewRegistry()
-			c := newMultiLevelBucketCache("chunks-cache", cfg, reg, m1, m2)
+			c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), m1, m2)
 			c.Store(tc.storeData, ttl)
 
 			mlc := c.(*multiLevelBucketCache)
@@ -96,7 +103,7 @@ func Test_MultiLevelBucketCacheFetchRace(t *testing.T) {
 		"key3": []byte("value3"),
 	}, time.Minute)
 
-	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, inMemory, m1)
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), inMemory, m1)
 
 	hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3", "key4"})
 
@@ -184,7 +191,7 @@ func Test_MultiLevelBucketCacheFetch(t *testing.T) {
 			m1 := newMockBucketCache("m1", tc.m1ExistingData)
 			m2 := newMockBucketCache("m2", tc.m2ExistingData)
 			reg := prometheus.NewRegistry()
-			c := newMultiLevelBucketCache("chunks-cache", cfg, reg, m1, m2)
+			c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), m1, m2)
 			fetchData := c.Fetch(context.Background(), tc.fetchKeys)
 
 			mlc := c.(*multiLevelBucketCache)
@@ -198,12 +205,1389 @@ func Test_MultiLevelBucketCacheFetch(t *testing.T) {
 	}
 }
 
+func Test_MultiLevelBucketCacheFetchStream(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	m1 := newMockBucketCache("m1", map[string][]byte{
+		"key1": []byte("value1"),
+	})
+	m2 := newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1-m2"),
+		"key2": []byte("value2"),
+	})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	var streamedKeys []string
+	streamedData := map[string][]byte{}
+	mlc.FetchStream(context.Background(), []string{"key1", "key2", "key3"}, func(key string, value []byte) {
+		streamedKeys = append(streamedKeys, key)
+		streamedData[key] = value
+	})
+
+	// Wait until async operation finishes.
+	mlc.backfillProcessor.Stop()
+
+	// Each hit is streamed once, with the value found in the fastest level.
+	require.ElementsMatch(t, []string{"key1", "key2"}, streamedKeys)
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, streamedData)
+
+	// The items found in the slower level are backfilled.
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, m1.data)
+}
+
+func Test_MultiLevelBucketCacheFetchWithSources(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	m1 := newMockBucketCache("m1", map[string][]byte{
+		"key1": []byte("value1"),
+	})
+	m2 := newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1-m2"),
+		"key2": []byte("value2"),
+	})
+	m3 := newMockBucketCache("m3", map[string][]byte{
+		"key3": []byte("value3"),
+	})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2, m3)
+	mlc := c.(*multiLevelBucketCache)
+
+	hits, sources := mlc.FetchWithSources(context.Background(), []string{"key1", "key2", "key3", "key4"})
+	mlc.backfillProcessor.Stop()
+
+	// Each hit is sourced from the fastest level holding it, and misses have no source.
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3")}, hits)
+	require.Equal(t, map[string]int{"key1": 0, "key2": 1, "key3": 2}, sources)
+
+	t.Run("should return nil if the context is canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		hits, sources := mlc.FetchWithSources(ctx, []string{"key1"})
+		require.Nil(t, hits)
+		require.Nil(t, sources)
+	})
+}
+
+func Test_MultiLevelBucketCacheFetchReaders(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	readAll := func(t *testing.T, readers map[string]io.ReadCloser) map[string][]byte {
+		values := map[string][]byte{}
+		for k, r := range readers {
+			v, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			values[k] = v
+		}
+		return values
+	}
+
+	t.Run("should stream the values from the levels supporting it without backfilling them", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", map[string][]byte{
+			"key1": []byte("value1"),
+		})
+		m2 := newMockReaderBucketCache("m2", map[string][]byte{
+			"key1": []byte("value1-m2"),
+			"key2": []byte("value2"),
+			"key3": []byte("value3"),
+		})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		readers := mlc.FetchReaders(context.Background(), []string{"key1", "key2", "key3", "key4"})
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3")}, readAll(t, readers))
+		require.Equal(t, 0, m1.storeCalls)
+
+		// The reader of key1 returned by m2 too should have been closed.
+		require.Equal(t, 3, m2.openedReaders)
+		require.Equal(t, 0, m2.openReaders())
+	})
+
+	t.Run("should backfill the values fetched from the levels not supporting streaming", func(t *testing.T) {
+		m1 := newMockReaderBucketCache("m1", map[string][]byte{
+			"key1": []byte("value1"),
+		})
+		m2 := newMockBucketCache("m2", map[string][]byte{
+			"key2": []byte("value2"),
+		})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		readers := mlc.FetchReaders(context.Background(), []string{"key1", "key2"})
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, readAll(t, readers))
+		require.Equal(t, []string{"key2"}, m2.fetchedKeys)
+		require.Equal(t, map[string][]byte{"key2": []byte("value2")}, m1.data)
+	})
+
+	t.Run("should handle empty values", func(t *testing.T) {
+		for _, allowEmptyValues := range []bool{true, false} {
+			cfg := cfg
+			cfg.AllowEmptyValues = allowEmptyValues
+
+			m1 := newMockBucketCache("m1", nil)
+			m2 := newMockReaderBucketCache("m2", map[string][]byte{
+				"key1": emptyValueSentinel,
+				"key2": {},
+				"key3": []byte("value3"),
+			})
+			c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+			mlc := c.(*multiLevelBucketCache)
+
+			readers := mlc.FetchReaders(context.Background(), []string{"key1", "key2", "key3"})
+			mlc.backfillProcessor.Stop()
+
+			expected := map[string][]byte{"key3": []byte("value3")}
+			if allowEmptyValues {
+				expected["key1"] = []byte{}
+			}
+			require.Equal(t, expected, readAll(t, readers))
+			require.Equal(t, 0, m2.openReaders())
+		}
+	})
+
+	t.Run("should not stream the values if checksums are enabled", func(t *testing.T) {
+		cfg := cfg
+		cfg.VerifyChecksums = true
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockReaderBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+		m2.data = mlc.encodeChecksums(map[string][]byte{"key1": []byte("value1")})
+
+		readers := mlc.FetchReaders(context.Background(), []string{"key1"})
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, readAll(t, readers))
+		require.Equal(t, 0, m2.openedReaders)
+		require.Equal(t, m2.data, m1.data)
+	})
+
+	t.Run("should wrap the values of caches not supporting streaming", func(t *testing.T) {
+		m := newMockBucketCache("m", map[string][]byte{"key1": []byte("value1")})
+
+		readers := fetchReaders(context.Background(), m, []string{"key1", "key2"})
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, readAll(t, readers))
+	})
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldRateLimitBackfill(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:       10,
+		MaxAsyncBufferSize:        100000,
+		MaxBackfillItems:          10000,
+		MaxBackfillItemsPerSecond: 2,
+		BackFillTTL:               time.Hour * 24,
+	}
+	reg := prometheus.NewRegistry()
+
+	m1 := newMockBucketCache("m1", nil)
+	m2 := newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": []byte("value2"),
+		"key3": []byte("value3"),
+	})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), m1, m2)
+
+	hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+	require.Len(t, hits, 3)
+
+	mlc := c.(*multiLevelBucketCache)
+	mlc.backfillProcessor.Stop()
+
+	// Only the items allowed by the rate limit should have been backfilled.
+	require.Len(t, m1.data, 2)
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.backfillRateLimitedItems))
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldSampleBackfills(t *testing.T) {
+	type sample struct {
+		sourceLevel, targetLevel int
+		keys                     []string
+	}
+
+	tests := map[string]struct {
+		sampleRate int
+		fetches    int
+		expected   []string
+	}{
+		"should report 1 out of sample rate backfills": {
+			sampleRate: 2,
+			fetches:    5,
+			expected:   []string{"key2", "key4"},
+		},
+		"should not report more than the max sampled backfills per second": {
+			sampleRate: 1,
+			fetches:    maxSampledBackfillsPerSecond + 5,
+			expected:   []string{"key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9", "key10"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			cfg := MultiLevelBucketCacheConfig{
+				MaxAsyncConcurrency:   10,
+				MaxAsyncBufferSize:    100000,
+				MaxBackfillItems:      10000,
+				BackfillLogSampleRate: testData.sampleRate,
+			}
+
+			m1 := newMockBucketCache("m1", nil)
+			m2 := newMockBucketCache("m2", nil)
+			for i := 1; i <= testData.fetches; i++ {
+				m2.data[fmt.Sprintf("key%d", i)] = []byte("value")
+			}
+			c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+			mlc := c.(*multiLevelBucketCache)
+
+			var samples []sample
+			mlc.onSampledBackfill = func(sourceLevel, targetLevel int, keys []string) {
+				samples = append(samples, sample{sourceLevel: sourceLevel, targetLevel: targetLevel, keys: keys})
+			}
+
+			// Each fetch backfills a different key from the second level to the first one.
+			for i := 1; i <= testData.fetches; i++ {
+				require.Len(t, mlc.Fetch(context.Background(), []string{fmt.Sprintf("key%d", i)}), 1)
+			}
+			mlc.backfillProcessor.Stop()
+
+			var sampledKeys []string
+			for _, s := range samples {
+				require.Equal(t, 1, s.sourceLevel)
+				require.Equal(t, 0, s.targetLevel)
+				sampledKeys = append(sampledKeys, s.keys...)
+			}
+			require.Equal(t, testData.expected, sampledKeys)
+		})
+	}
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldDeduplicateConcurrentBackfills(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 1,
+		MaxAsyncBufferSize:  10,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	m1 := &mockBlockingBucketCache{mockBucketCache: newMockBucketCache("m1", nil), unblock: make(chan struct{})}
+	m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	// The first backfill blocks in the store, so it's still in-flight when the next fetches miss the same keys.
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, c.Fetch(context.Background(), []string{"key1"}))
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, c.Fetch(context.Background(), []string{"key1"}))
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, c.Fetch(context.Background(), []string{"key1", "key2"}))
+	require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.backfillDeduplicatedItems))
+
+	close(m1.unblock)
+	require.Eventually(t, func() bool {
+		mlc.inflightBackfillsMtx.Lock()
+		defer mlc.inflightBackfillsMtx.Unlock()
+		return len(mlc.inflightBackfills) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Once the backfill completed, the key is backfilled again by the next fetch missing it.
+	m1.mu.Lock()
+	m1.data = map[string][]byte{}
+	require.Equal(t, 2, m1.storeCalls)
+	m1.mu.Unlock()
+
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, c.Fetch(context.Background(), []string{"key1"}))
+	mlc.backfillProcessor.Stop()
+
+	require.Equal(t, 3, m1.storeCalls)
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+	require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.backfillDeduplicatedItems))
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldPrioritizeFastestLevelBackfills(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 1,
+		MaxAsyncBufferSize:  4,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	m1 := &mockBlockingBucketCache{mockBucketCache: newMockBucketCache("m1", nil), unblock: make(chan struct{})}
+	m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3"), "key4": []byte("value4"), "key5": []byte("value5"), "key6": []byte("value6")})
+	m3 := newMockBucketCache("m3", map[string][]byte{"key7": []byte("value7"), "key8": []byte("value8")})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2, m3)
+	mlc := c.(*multiLevelBucketCache)
+
+	// The first backfill of the fastest level blocks the async processor.
+	c.Fetch(context.Background(), []string{"key1"})
+	require.Eventually(t, func() bool {
+		return mlc.queuedOps.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// The slower level is backfilled while the buffer is not under pressure.
+	c.Fetch(context.Background(), []string{"key7"})
+	require.Equal(t, int64(1), mlc.queuedOps.Load())
+
+	// The backfills of the fastest level can fill the part of the buffer reserved to it.
+	c.Fetch(context.Background(), []string{"key2"})
+	c.Fetch(context.Background(), []string{"key3"})
+	require.Equal(t, int64(3), mlc.queuedOps.Load())
+
+	c.Fetch(context.Background(), []string{"key8"})
+	c.Fetch(context.Background(), []string{"key4"})
+	require.Equal(t, int64(4), mlc.queuedOps.Load())
+
+	// Once the buffer is full, the backfills of the fastest level are dropped too.
+	c.Fetch(context.Background(), []string{"key5"})
+
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.backfillDroppedItems.WithLabelValues("1")))
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.backfillDroppedItems.WithLabelValues("2")))
+
+	close(m1.unblock)
+	mlc.backfillProcessor.Stop()
+	require.Equal(t, int64(0), mlc.queuedOps.Load())
+	require.Equal(t, 4, m1.storeCalls)
+	require.Equal(t, 1, m2.storeCalls)
+}
+
+func Test_MultiLevelBucketCacheConfig_Validate(t *testing.T) {
+	valid := MultiLevelBucketCacheConfig{MaxAsyncConcurrency: 1, MaxAsyncBufferSize: 1, MaxBackfillItems: 1}
+	require.NoError(t, valid.Validate())
+
+	cfg := valid
+	cfg.MaxBackfillItemsPerSecond = -1
+	require.Equal(t, errInvalidMaxBackfillItemsPerSecond, cfg.Validate())
+
+	cfg = valid
+	cfg.MaxBackfillBytesPerSecond = -1
+	require.Equal(t, errInvalidMaxBackfillBytesPerSecond, cfg.Validate())
+
+	cfg = valid
+	cfg.MaxRecentlyStoredItems = -1
+	require.Equal(t, errInvalidMaxRecentlyStoredItems, cfg.Validate())
+
+	cfg = valid
+	cfg.MaxItemBytes = -1
+	require.Equal(t, errInvalidMaxItemBytes, cfg.Validate())
+
+	cfg = valid
+	cfg.LatencySensitiveFreshness = -time.Second
+	require.Equal(t, errInvalidLatencySensitiveFreshness, cfg.Validate())
+
+	cfg = valid
+	cfg.AdaptiveBackfillDropRatio = -0.1
+	require.Equal(t, errInvalidAdaptiveBackfillDropRatio, cfg.Validate())
+
+	cfg = valid
+	cfg.AdaptiveBackfillDropRatio = 1.1
+	require.Equal(t, errInvalidAdaptiveBackfillDropRatio, cfg.Validate())
+
+	cfg = valid
+	cfg.AdaptiveFetchOrderWindow = -time.Second
+	require.Equal(t, errInvalidAdaptiveFetchOrderWindow, cfg.Validate())
+
+	cfg = valid
+	cfg.BackfillLogSampleRate = -1
+	require.Equal(t, errInvalidBackfillLogSampleRate, cfg.Validate())
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldSkipSlowerLevelsForLatencySensitiveFetches(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:       10,
+		MaxAsyncBufferSize:        100000,
+		MaxBackfillItems:          10000,
+		BackFillTTL:               time.Hour * 24,
+		LatencySensitiveFreshness: time.Minute,
+	}
+
+	newCache := func() (*multiLevelBucketCache, *mockBucketCache) {
+		m1 := newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")})
+		m2 := newMockBucketCache("m2", map[string][]byte{"key3": []byte("value3")})
+		return newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2).(*multiLevelBucketCache), m2
+	}
+	latencySensitiveCtx := ContextWithLatencySensitiveFetch(context.Background())
+
+	t.Run("should fetch the slower levels if the fastest level didn't recently return most keys", func(t *testing.T) {
+		c, m2 := newCache()
+
+		hits := c.Fetch(latencySensitiveCtx, []string{"key1", "key3", "key4"})
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key3": []byte("value3")}, hits)
+		require.Equal(t, []string{"key1", "key3", "key4"}, m2.fetchedKeys)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(c.latencySensitiveShortCircuits))
+	})
+
+	t.Run("should skip the slower levels if the fastest level recently returned most keys", func(t *testing.T) {
+		c, m2 := newCache()
+
+		// The fastest level returns all the keys.
+		hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+		require.Len(t, hits, 2)
+
+		hits = c.Fetch(latencySensitiveCtx, []string{"key1", "key3", "key4"})
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+		require.Empty(t, m2.fetchedKeys)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(c.latencySensitiveShortCircuits))
+
+		// Fetches not tagged as latency-sensitive are not affected.
+		hits = c.Fetch(context.Background(), []string{"key3"})
+		require.Equal(t, map[string][]byte{"key3": []byte("value3")}, hits)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(c.latencySensitiveShortCircuits))
+	})
+
+	t.Run("should fetch the slower levels once the freshness window elapsed", func(t *testing.T) {
+		c, m2 := newCache()
+
+		c.Fetch(context.Background(), []string{"key1", "key2"})
+		c.fastestLevelConfirmedAt.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+
+		hits := c.Fetch(latencySensitiveCtx, []string{"key3", "key4"})
+		require.Equal(t, map[string][]byte{"key3": []byte("value3")}, hits)
+		require.Equal(t, []string{"key3", "key4"}, m2.fetchedKeys)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(c.latencySensitiveShortCircuits))
+	})
+}
+
+func Test_MultiLevelBucketCache_ShouldSkipOversizedItems(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+		MaxItemBytes:        6,
+	}
+
+	t.Run("should not store oversized items", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		data := map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2-oversized")}
+		c.Store(data, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.oversizedItems))
+
+		// The input map should not be modified.
+		require.Len(t, data, 2)
+	})
+
+	t.Run("should not backfill oversized items", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2-oversized")})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		// Oversized items are still returned if found.
+		hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, m2.data, hits)
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.oversizedItems))
+	})
+
+	t.Run("should account for the checksum in the item size", func(t *testing.T) {
+		cfg := cfg
+		cfg.VerifyChecksums = true
+		cfg.MaxItemBytes = crc32.Size + 6
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		c.Store(map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2-oversized")}, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		require.Len(t, m1.data, 1)
+		require.Contains(t, m1.data, "key1")
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.oversizedItems))
+	})
+}
+
+func Test_MultiLevelBucketCacheStore_ShouldSkipRecentlyStoredItems(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:    10,
+		MaxAsyncBufferSize:     100000,
+		MaxBackfillItems:       10000,
+		MaxRecentlyStoredItems: 100,
+		BackFillTTL:            time.Hour * 24,
+	}
+
+	t.Run("should skip storing the same value again", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+
+		// A different value is stored.
+		c.Store(map[string][]byte{"key1": []byte("value2")}, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, 2, m1.storeCalls)
+		require.Equal(t, 2, m2.storeCalls)
+		require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.skippedStoreItems))
+	})
+
+	t.Run("should skip storing a value just backfilled", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1")})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		c.Fetch(context.Background(), []string{"key1"})
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		// The value is backfilled to the first level, and stored only to the second one.
+		require.Equal(t, 1, m1.storeCalls)
+		require.Equal(t, 1, m2.storeCalls)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.skippedStoreItems))
+	})
+
+	t.Run("should store again invalidated items", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		mlc.Invalidate(context.Background(), []string{"key1"})
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, 2, m1.storeCalls)
+		require.Equal(t, 2, m2.storeCalls)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(mlc.skippedStoreItems))
+	})
+
+	t.Run("should store every time if disabled", func(t *testing.T) {
+		cfg := cfg
+		cfg.MaxRecentlyStoredItems = 0
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+		mlc := c.(*multiLevelBucketCache)
+
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		c.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, 2, m1.storeCalls)
+		require.Equal(t, 2, m2.storeCalls)
+	})
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldRefreshTTLOnHit(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		RefreshTTLOnHit:     true,
+		BackFillTTL:         time.Hour * 24,
+	}
+	data := map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": []byte("value2"),
+	}
+
+	t.Run("cache supporting touch", func(t *testing.T) {
+		m1 := &mockTouchBucketCache{mockBucketCache: newMockBucketCache("m1", data)}
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		require.Equal(t, data, c.Fetch(context.Background(), []string{"key1", "key2"}))
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		require.ElementsMatch(t, []string{"key1", "key2"}, m1.touchedKeys)
+		require.Equal(t, cfg.BackFillTTL, m1.touchedTTL)
+		require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.touchedItems))
+	})
+
+	t.Run("cache not supporting touch", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")})
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		hits := c.Fetch(context.Background(), []string{"key1"})
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		// The hit items should have been stored again.
+		require.Equal(t, 1, m1.storeCalls)
+		require.Equal(t, hits, m1.data)
+		require.Equal(t, cfg.BackFillTTL, m1.storedTTLs["key1"])
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.touchedItems))
+	})
+
+	t.Run("cache not supporting touch without backfill TTL", func(t *testing.T) {
+		cfg := cfg
+		cfg.BackFillTTL = 0
+
+		m1 := newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")})
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("metadata-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, c.Fetch(context.Background(), []string{"key1"}))
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		// The hit items should not have been stored again, otherwise they would lose their expiry.
+		require.Equal(t, 0, m1.storeCalls)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(mlc.touchedItems))
+	})
+}
+
+func Test_MultiLevelBucketCacheTouch(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+	}
+
+	m1 := &mockTouchBucketCache{mockBucketCache: newMockBucketCache("m1", nil)}
+	m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1")})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+	mlc := c.(*multiLevelBucketCache)
+	mlc.Touch(context.Background(), []string{"key1", "key2"}, time.Hour)
+	mlc.backfillProcessor.Stop()
+
+	require.Equal(t, []string{"key1", "key2"}, m1.touchedKeys)
+	require.Equal(t, time.Hour, m1.touchedTTL)
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+	require.Equal(t, float64(3), promtestutil.ToFloat64(mlc.touchedItems))
+}
+
+func Test_MultiLevelBucketCacheTouch_ShouldStoreAgainTheItemsOfTheLevelsNotSupportingTouch(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+	}
+
+	tests := map[string]struct {
+		ttl                time.Duration
+		expectedStoreCalls int
+		expectedTouched    float64
+	}{
+		"should store again the items found": {
+			ttl:                time.Hour,
+			expectedStoreCalls: 1,
+			expectedTouched:    1,
+		},
+		"should not store again the items without TTL": {
+			ttl:                0,
+			expectedStoreCalls: 0,
+			expectedTouched:    0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			m1 := newMockBucketCache("m1", nil)
+			m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1")})
+			c := newMultiLevelBucketCache("metadata-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+			mlc := c.(*multiLevelBucketCache)
+			mlc.Touch(context.Background(), []string{"key1", "key2"}, testData.ttl)
+			mlc.backfillProcessor.Stop()
+
+			// The level missing all the keys is not stored.
+			require.Equal(t, 0, m1.storeCalls)
+			require.Equal(t, testData.expectedStoreCalls, m2.storeCalls)
+			if testData.expectedStoreCalls > 0 {
+				require.Equal(t, testData.ttl, m2.storedTTLs["key1"])
+			}
+			require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+			require.Equal(t, testData.expectedTouched, promtestutil.ToFloat64(mlc.touchedItems))
+		})
+	}
+}
+
+func Test_MultiLevelBucketCacheInvalidate(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+	}
+
+	m1 := &mockDeleteBucketCache{mockBucketCache: newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")})}
+	m2 := newMockBucketCache("m2", map[string][]byte{"key1": []byte("value1")})
+	c := newMultiLevelBucketCache("metadata-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+	mlc := c.(*multiLevelBucketCache)
+	mlc.Invalidate(context.Background(), []string{"key1"})
+
+	// Levels not supporting the removal of items are left untouched.
+	require.Equal(t, map[string][]byte{"key2": []byte("value2")}, m1.data)
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.invalidatedItems))
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldTrackMissesByReason(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+	}
+
+	// The first level reports expired keys, while the second one can't tell.
+	m1 := &mockExpiryBucketCache{
+		mockBucketCache: newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")}),
+		expired:         map[string]struct{}{"key2": {}, "key3": {}},
+	}
+	m2 := newMockBucketCache("m2", map[string][]byte{"key3": []byte("value3")})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	hits := mlc.Fetch(context.Background(), []string{"key1", "key2", "key3", "key4"})
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key3": []byte("value3")}, hits)
+
+	// The expired key found in a slower level is a hit, and the keys no level reported as expired
+	// are cold misses.
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.missedItems.WithLabelValues(missReasonExpired)))
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.missedItems.WithLabelValues(missReasonCold)))
+}
+
+func Test_MultiLevelBucketCache_EmptyValues(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	t.Run("should not store empty values if not allowed", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		c.Store(map[string][]byte{"key1": []byte("value1"), "key2": {}}, time.Hour)
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.emptyValuesRejected))
+	})
+
+	t.Run("should consider empty values as misses if not allowed", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")})
+		m2 := newMockBucketCache("m2", map[string][]byte{"key2": {}, "key3": emptyValueSentinel})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+		require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+	})
+
+	t.Run("should round-trip empty values if allowed", func(t *testing.T) {
+		cfg := cfg
+		cfg.AllowEmptyValues = true
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		c.Store(map[string][]byte{"key1": []byte("value1"), "key2": {}}, time.Hour)
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		expectedStored := map[string][]byte{"key1": []byte("value1"), "key2": emptyValueSentinel}
+		require.Equal(t, expectedStored, m1.data)
+		require.Equal(t, expectedStored, m2.data)
+
+		hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": {}}, hits)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(mlc.emptyValuesRejected))
+	})
+
+	t.Run("should backfill empty values wrapped in the sentinel if allowed", func(t *testing.T) {
+		cfg := cfg
+		cfg.AllowEmptyValues = true
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", map[string][]byte{"key1": emptyValueSentinel})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		hits := c.Fetch(context.Background(), []string{"key1"})
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": {}}, hits)
+		require.Equal(t, map[string][]byte{"key1": emptyValueSentinel}, m1.data)
+	})
+}
+
+func Test_MultiLevelBucketCache_Checksums(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+		VerifyChecksums:     true,
+	}
+
+	withChecksum := func(v []byte) []byte {
+		b := make([]byte, crc32.Size, crc32.Size+len(v))
+		binary.BigEndian.PutUint32(b, crc32.Checksum(v, checksumTable))
+		return append(b, v...)
+	}
+
+	t.Run("should round-trip values with their checksum", func(t *testing.T) {
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		c.Store(map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, time.Hour)
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		expectedStored := map[string][]byte{"key1": withChecksum([]byte("value1")), "key2": withChecksum([]byte("value2"))}
+		require.Equal(t, expectedStored, m1.data)
+		require.Equal(t, expectedStored, m2.data)
+
+		hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, hits)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(mlc.corruptValues))
+	})
+
+	t.Run("should consider values not matching their checksum as misses", func(t *testing.T) {
+		corrupted := withChecksum([]byte("value1"))
+		corrupted[len(corrupted)-1] ^= 0xff
+
+		m1 := newMockBucketCache("m1", map[string][]byte{"key1": corrupted, "key2": {0x01}, "key3": withChecksum([]byte("value3"))})
+		m2 := newMockBucketCache("m2", map[string][]byte{"key1": withChecksum([]byte("value1"))})
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		// The corrupted value is fetched from the next level and backfilled with a valid checksum.
+		require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key3": []byte("value3")}, hits)
+		require.Equal(t, withChecksum([]byte("value1")), m1.data["key1"])
+		require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.corruptValues))
+	})
+
+	t.Run("should checksum empty values wrapped in the sentinel if allowed", func(t *testing.T) {
+		cfg := cfg
+		cfg.AllowEmptyValues = true
+
+		m1 := newMockBucketCache("m1", nil)
+		m2 := newMockBucketCache("m2", nil)
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+		c.Store(map[string][]byte{"key1": {}}, time.Hour)
+
+		mlc := c.(*multiLevelBucketCache)
+		mlc.backfillProcessor.Stop()
+
+		require.Equal(t, map[string][]byte{"key1": withChecksum(emptyValueSentinel)}, m1.data)
+
+		hits := c.Fetch(context.Background(), []string{"key1"})
+		require.Equal(t, map[string][]byte{"key1": {}}, hits)
+	})
+}
+
+func Test_MultiLevelBucketCache_ConcurrentReplaceCaches(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+		RefreshTTLOnHit:     true,
+	}
+
+	newLevels := func() []cache.Cache {
+		return []cache.Cache{
+			&mockDeleteBucketCache{mockBucketCache: newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")})},
+			&mockTouchBucketCache{mockBucketCache: newMockBucketCache("m2", map[string][]byte{"key2": []byte("value2")})},
+			newMockBucketCache("m3", map[string][]byte{"key3": []byte("value3")}),
+		}
+	}
+
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), newLevels()...)
+	mlc := c.(*multiLevelBucketCache)
+
+	const (
+		workers    = 10
+		iterations = 200
+	)
+
+	// The same keys slice is shared by all the workers, like it could happen
+	// when the cache is shared by multiple subsystems.
+	keys := []string{"key1", "key2", "key3", "key4"}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < iterations; i++ {
+				switch (w + i) % 5 {
+				case 0:
+					c.Fetch(context.Background(), keys)
+				case 1:
+					c.Store(map[string][]byte{"key4": []byte("value4")}, time.Hour)
+				case 2:
+					levels := newLevels()
+					require.NoError(t, mlc.ReplaceCaches(levels[:1+i%len(levels)]...))
+				case 3:
+					mlc.Touch(context.Background(), keys, time.Hour)
+				case 4:
+					mlc.Invalidate(context.Background(), []string{"key1"})
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	mlc.backfillProcessor.Stop()
+
+	require.Equal(t, []string{"key1", "key2", "key3", "key4"}, keys)
+	require.Equal(t, errNoCacheLevels, mlc.ReplaceCaches())
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldAdaptTheMaxBackfillItems(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:       10,
+		MaxAsyncBufferSize:        100000,
+		MaxBackfillItems:          3,
+		AdaptiveBackfillDropRatio: 0.5,
+		BackFillTTL:               time.Hour * 24,
+	}
+
+	m1 := newMockBucketCache("m1", nil)
+	m2 := newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": []byte("value2"),
+		"key3": []byte("value3"),
+	})
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+	require.Equal(t, float64(3), promtestutil.ToFloat64(mlc.adaptiveBackfill.effective))
+
+	// Simulate a window with most of the backfills dropped.
+	start := time.Now()
+	mlc.adaptiveBackfill.observe(true, start)
+	mlc.adaptiveBackfill.observe(true, start)
+	mlc.adaptiveBackfill.observe(false, start)
+	mlc.adaptiveBackfill.observe(false, start.Add(adaptiveBackfillWindow))
+	require.Equal(t, 1, mlc.adaptiveBackfill.limit())
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.adaptiveBackfill.effective))
+
+	// Only the items within the effective max should be backfilled.
+	hits := c.Fetch(context.Background(), []string{"key1", "key2", "key3"})
+	require.Len(t, hits, 3)
+	mlc.backfillProcessor.Stop()
+
+	require.Len(t, m1.data, 1)
+	require.Equal(t, float64(2), promtestutil.ToFloat64(mlc.backfillDroppedItems.WithLabelValues("1")))
+}
+
+func Test_AdaptiveBackfillLimit(t *testing.T) {
+	l := newAdaptiveBackfillLimit(10, 0.2, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}))
+	now := time.Now()
+
+	// observeWindow records the input backfills within a window, and ends it.
+	observeWindow := func(backfills, dropped int) {
+		for i := 0; i < backfills; i++ {
+			l.observe(i < dropped, now)
+		}
+		now = now.Add(adaptiveBackfillWindow)
+		l.observe(false, now)
+	}
+
+	// The limit is not adjusted within a window.
+	l.observe(true, now)
+	l.observe(true, now.Add(adaptiveBackfillWindow/2))
+	require.Equal(t, 10, l.limit())
+
+	// The limit is halved while the drop ratio exceeds the threshold, down to 1 item.
+	now = now.Add(adaptiveBackfillWindow)
+	l.observe(false, now)
+	require.Equal(t, 5, l.limit())
+
+	observeWindow(10, 3)
+	require.Equal(t, 2, l.limit())
+	observeWindow(10, 3)
+	require.Equal(t, 1, l.limit())
+	observeWindow(10, 10)
+	require.Equal(t, 1, l.limit())
+
+	// The limit is restored as the pressure subsides, up to the configured max.
+	observeWindow(10, 2)
+	require.Equal(t, 2, l.limit())
+	observeWindow(0, 0)
+	require.Equal(t, 4, l.limit())
+	observeWindow(10, 0)
+	require.Equal(t, 8, l.limit())
+	observeWindow(10, 0)
+	require.Equal(t, 10, l.limit())
+	require.Equal(t, float64(10), promtestutil.ToFloat64(l.effective))
+}
+
+func Test_MultiLevelBucketCacheFetch_ShouldFetchTheFastestLevelFirst(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:      10,
+		MaxAsyncBufferSize:       100000,
+		MaxBackfillItems:         10000,
+		AdaptiveFetchOrderWindow: time.Minute,
+		BackFillTTL:              time.Hour * 24,
+	}
+
+	m1 := newMockBucketCache("m1", map[string][]byte{"key1": []byte("value1")})
+	m2 := newMockBucketCache("m2", map[string][]byte{"key2": []byte("value2"), "key3": []byte("value3")})
+	reg := prometheus.NewRegistry()
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	// Simulate the second level being measured faster than the first one.
+	now := time.Now()
+	mlc.adaptiveFetchOrder.observe(0, 100*time.Millisecond, now)
+	mlc.adaptiveFetchOrder.observe(1, 10*time.Millisecond, now.Add(cfg.AdaptiveFetchOrderWindow))
+	require.Equal(t, []int{1, 0}, mlc.adaptiveFetchOrder.get(2))
+
+	// The keys found in the second level are not fetched from the first one.
+	hits := c.Fetch(context.Background(), []string{"key2", "key3"})
+	require.Equal(t, map[string][]byte{"key2": []byte("value2"), "key3": []byte("value3")}, hits)
+	require.Empty(t, m1.fetchedKeys)
+
+	// The items found in the first level are backfilled to the second one, which is fetched before it.
+	hits = c.Fetch(context.Background(), []string{"key1", "key2"})
+	require.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, hits)
+	mlc.backfillProcessor.Stop()
+	require.Contains(t, m2.data, "key1")
+	require.Equal(t, 0, m1.storeCalls)
+
+	require.NoError(t, promtestutil.GatherAndCompare(reg, bytes.NewBufferString(`
+		# HELP cortex_store_multilevel_chunks_cache_fetch_order_position Current position of a level in the fetch order of multilevel chunks cache, 1 being fetched first, by level (1 being the fastest as configured)
+		# TYPE cortex_store_multilevel_chunks_cache_fetch_order_position gauge
+		cortex_store_multilevel_chunks_cache_fetch_order_position{level="1"} 2
+		cortex_store_multilevel_chunks_cache_fetch_order_position{level="2"} 1
+		# HELP cortex_store_multilevel_chunks_cache_fetch_reorders_total Total number of times the fetch order of the levels of multilevel chunks cache changed
+		# TYPE cortex_store_multilevel_chunks_cache_fetch_reorders_total counter
+		cortex_store_multilevel_chunks_cache_fetch_reorders_total 1
+	`), "cortex_store_multilevel_chunks_cache_fetch_order_position", "cortex_store_multilevel_chunks_cache_fetch_reorders_total"))
+
+	// Replacing the levels restores the configured order.
+	require.NoError(t, mlc.ReplaceCaches(m1, m2))
+	require.Equal(t, []int{0, 1}, mlc.adaptiveFetchOrder.get(2))
+}
+
+func Test_AdaptiveFetchOrder(t *testing.T) {
+	newGaugeVec := func(name string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, []string{"level"})
+	}
+	o := newAdaptiveFetchOrder(3, time.Minute, newGaugeVec("position"), newGaugeVec("latency"), prometheus.NewCounter(prometheus.CounterOpts{Name: "reorders"}))
+	now := time.Now()
+
+	// The configured order is kept within the stabilization window.
+	o.observe(0, 50*time.Millisecond, now)
+	o.observe(2, 10*time.Millisecond, now.Add(time.Second))
+	require.Equal(t, []int{0, 1, 2}, o.get(3))
+
+	// Once the window elapsed, the levels are ordered by latency, the ones not measured yet last.
+	now = now.Add(time.Minute)
+	o.observe(2, 10*time.Millisecond, now)
+	require.Equal(t, []int{2, 0, 1}, o.get(3))
+	require.Equal(t, float64(1), promtestutil.ToFloat64(o.position.WithLabelValues("3")))
+	require.Equal(t, float64(3), promtestutil.ToFloat64(o.position.WithLabelValues("2")))
+
+	// A single slow fetch is smoothed by the moving average, so it doesn't change the order.
+	now = now.Add(time.Minute)
+	o.observe(2, 100*time.Millisecond, now)
+	require.InDelta(t, 0.028, promtestutil.ToFloat64(o.latency.WithLabelValues("3")), 1e-9)
+	require.Equal(t, []int{2, 0, 1}, o.get(3))
+
+	// The order changes once the level is consistently slower.
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		o.observe(2, 100*time.Millisecond, now)
+	}
+	require.Equal(t, []int{0, 2, 1}, o.get(3))
+	require.Equal(t, float64(2), promtestutil.ToFloat64(o.reorders))
+
+	// The order is not returned for a different number of levels.
+	require.Nil(t, o.get(2))
+}
+
+func Test_MultiLevelBucketCacheShouldRecoverAsyncOperationsPanics(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 1,
+		MaxAsyncBufferSize:  100,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	m1 := newMockBucketCache("m1", nil)
+	m2 := newMockBucketCache("m2", nil)
+	reg := prometheus.NewRegistry()
+	c := newMultiLevelBucketCache("chunks-cache", cfg, reg, log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	// With a single worker, the following operations run on the same worker of the panicking one.
+	require.NoError(t, mlc.enqueueAsync(func() { panic("cache client bug") }))
+	mlc.Store(map[string][]byte{"key1": []byte("value1")}, time.Hour)
+	mlc.backfillProcessor.Stop()
+
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, m2.data)
+	require.Equal(t, float64(1), promtestutil.ToFloat64(mlc.backfillPanics))
+}
+
+func Test_MultiLevelBucketCacheStoreWithTTLFunc(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	now := time.Now()
+	blocksMaxTime := map[string]time.Time{
+		"recent-block": now.Add(-time.Hour),
+		"old-block":    now.Add(-7 * 24 * time.Hour),
+	}
+	maxTime := func(key string, _ []byte) (time.Time, bool) {
+		t, ok := blocksMaxTime[strings.Split(key, ":")[0]]
+		return t, ok
+	}
+
+	m1 := newMockBucketCache("m1", nil)
+	m2 := newMockBucketCache("m2", nil)
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	mlc.StoreWithTTLFunc(map[string][]byte{
+		"recent-block:chunk1": []byte("value1"),
+		"recent-block:chunk2": []byte("value2"),
+		"old-block:chunk1":    []byte("value3"),
+		"unknown-block:chunk": []byte("value4"),
+	}, RecencyTTL(maxTime, 24*time.Hour, 12*time.Hour, time.Hour))
+	mlc.backfillProcessor.Stop()
+
+	expected := map[string]time.Duration{
+		"recent-block:chunk1": 12 * time.Hour,
+		"recent-block:chunk2": 12 * time.Hour,
+		"old-block:chunk1":    time.Hour,
+		"unknown-block:chunk": time.Hour,
+	}
+	for _, m := range []*mockBucketCache{m1, m2} {
+		require.Equal(t, expected, m.storedTTLs)
+
+		// The items sharing the same TTL are stored together.
+		require.Equal(t, 2, m.storeCalls)
+	}
+}
+
+func Test_MultiLevelBucketCacheFetchOrLoad(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	storage := map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2"), "key3": []byte("value3")}
+
+	tests := map[string]struct {
+		m1Data         map[string][]byte
+		m2Data         map[string][]byte
+		expectedLoaded []string
+		expectedStored map[string][]byte
+	}{
+		"full hit": {
+			m1Data: map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")},
+			m2Data: map[string][]byte{"key3": []byte("value3")},
+		},
+		"partial hit": {
+			m2Data:         map[string][]byte{"key1": []byte("value1")},
+			expectedLoaded: []string{"key2", "key3"},
+			expectedStored: map[string][]byte{"key2": []byte("value2"), "key3": []byte("value3")},
+		},
+		"full miss": {
+			expectedLoaded: []string{"key1", "key2", "key3"},
+			expectedStored: storage,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			m1 := newMockBucketCache("m1", testData.m1Data)
+			m2 := newMockBucketCache("m2", testData.m2Data)
+			c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+			mlc := c.(*multiLevelBucketCache)
+
+			var loaded []string
+			hits := mlc.FetchOrLoad(context.Background(), []string{"key1", "key2", "key3"}, func(missing []string) map[string][]byte {
+				loaded = append(loaded, missing...)
+
+				values := map[string][]byte{}
+				for _, k := range missing {
+					values[k] = storage[k]
+				}
+				return values
+			}, time.Hour)
+			mlc.backfillProcessor.Stop()
+
+			require.Equal(t, storage, hits)
+			require.Equal(t, testData.expectedLoaded, loaded)
+
+			// The loaded items are stored to all the levels.
+			if testData.expectedStored != nil {
+				require.Equal(t, testData.expectedStored, m2.data)
+				require.Equal(t, 1, m2.storeCalls)
+			} else {
+				require.Zero(t, m2.storeCalls)
+			}
+		})
+	}
+
+	t.Run("should not load the keys if the context has been canceled", func(t *testing.T) {
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), newMockBucketCache("m1", nil), newMockBucketCache("m2", nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		hits := FetchOrLoad(ctx, c, []string{"key1"}, func([]string) map[string][]byte {
+			t.Fatal("unexpected load")
+			return nil
+		}, time.Hour)
+		require.Empty(t, hits)
+	})
+}
+
+func Test_MultiLevelBucketCacheFetchByPrefix(t *testing.T) {
+	ctx := context.Background()
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		VerifyChecksums:     true,
+		BackFillTTL:         time.Hour * 24,
+	}
+
+	budget := newMemoryBudget(1000, prometheus.NewRegistry())
+	m1 := budget.newCache("m1", 1000)
+	m2 := newMockBucketCache("m2", nil)
+	m3, err := newDiskCache("m3", log.NewNopLogger(), t.TempDir(), 1000, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2, m3)
+	mlc := c.(*multiLevelBucketCache)
+
+	c.Store(map[string][]byte{"block1/chunk1": []byte("value1"), "block1/chunk2": []byte("value2"), "block2/chunk1": []byte("value3")}, time.Hour)
+	mlc.backfillProcessor.Stop()
+
+	// The items found in the faster levels are preferred, while the levels not supporting prefix
+	// fetches are skipped.
+	m1.Delete(ctx, []string{"block1/chunk2"})
+	m3.Store(map[string][]byte{"block1/chunk1": []byte("corrupted")}, time.Hour)
+
+	hits, err := mlc.FetchByPrefix(ctx, "block1/")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"block1/chunk1": []byte("value1"), "block1/chunk2": []byte("value2")}, hits)
+	require.Empty(t, m2.fetchedKeys)
+
+	hits, err = FetchByPrefix(ctx, c, "block3/")
+	require.NoError(t, err)
+	require.Empty(t, hits)
+
+	t.Run("should return an error if no level supports prefix fetches", func(t *testing.T) {
+		c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), newMockBucketCache("m1", nil), newMockBucketCache("m2", nil))
+
+		_, err := FetchByPrefix(ctx, c, "block1/")
+		require.ErrorIs(t, err, ErrPrefixFetchUnsupported)
+
+		_, err = FetchByPrefix(ctx, newMockBucketCache("m1", nil), "block1/")
+		require.ErrorIs(t, err, ErrPrefixFetchUnsupported)
+	})
+}
+
+func Test_MultiLevelBucketCacheDescribe(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency:       10,
+		MaxAsyncBufferSize:        100000,
+		MaxBackfillItems:          10000,
+		MaxBackfillItemsPerSecond: 100,
+		MaxBackfillBytesPerSecond: 1024,
+		RefreshTTLOnHit:           true,
+		BackFillTTL:               time.Hour,
+	}
+
+	m1 := &mockTouchBucketCache{mockBucketCache: newMockBucketCache("m1", nil)}
+	m2 := newMockBucketCache("m2", nil)
+	c := newMultiLevelBucketCache("chunks-cache", cfg, prometheus.NewRegistry(), log.NewNopLogger(), m1, m2)
+
+	mlc := c.(*multiLevelBucketCache)
+	require.Equal(t, CacheDescription{
+		Name: "chunks-cache",
+		Levels: []CacheLevelDescription{
+			{Name: "m1", Type: "*tsdb.mockTouchBucketCache", TTL: time.Hour, SupportsTouch: true},
+			{Name: "m2", Type: "*tsdb.mockBucketCache"},
+		},
+		BackfillTTL:               time.Hour,
+		MaxBackfillItems:          10000,
+		MaxBackfillItemsPerSecond: 100,
+		MaxBackfillBytesPerSecond: 1024,
+		RefreshTTLOnHit:           true,
+	}, mlc.Describe())
+
+	// The description reflects the cache levels replaced at runtime.
+	require.NoError(t, mlc.ReplaceCaches(m2))
+	require.Equal(t, []CacheLevelDescription{{Name: "m2", Type: "*tsdb.mockBucketCache"}}, mlc.Describe().Levels)
+}
+
 type mockBucketCache struct {
 	mu   sync.Mutex
 	name string
 	data map[string][]byte
 
 	fetchedKeys []string
+	storeCalls  int
+	storedTTLs  map[string]time.Duration
 }
 
 func newMockBucketCache(name string, data map[string][]byte) *mockBucketCache {
@@ -217,8 +1601,19 @@ func newMockBucketCache(name string, data map[string][]byte) *mockBucketCache {
 	}
 }
 
-func (m *mockBucketCache) Store(data map[string][]byte, _ time.Duration) {
+func (m *mockBucketCache) Store(data map[string][]byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.data = data
+	m.storeCalls++
+
+	if m.storedTTLs == nil {
+		m.storedTTLs = map[string]time.Duration{}
+	}
+	for k := range data {
+		m.storedTTLs[k] = ttl
+	}
 }
 
 func (m *mockBucketCache) Fetch(_ context.Context, keys []string) map[string][]byte {
@@ -239,3 +1634,107 @@ func (m *mockBucketCache) Fetch(_ context.Context, keys []string) map[string][]b
 func (m *mockBucketCache) Name() string {
 	return m.name
 }
+
+// mockReaderBucketCache supports streaming reads, tracking the readers opened and closed.
+type mockReaderBucketCache struct {
+	*mockBucketCache
+
+	openedReaders int
+	closedReaders int
+}
+
+func newMockReaderBucketCache(name string, data map[string][]byte) *mockReaderBucketCache {
+	return &mockReaderBucketCache{mockBucketCache: newMockBucketCache(name, data)}
+}
+
+func (m *mockReaderBucketCache) FetchReaders(ctx context.Context, keys []string) map[string]io.ReadCloser {
+	readers := map[string]io.ReadCloser{}
+	for k, v := range m.Fetch(ctx, keys) {
+		readers[k] = readCloser{Reader: bytes.NewReader(v), Closer: mockCloser{m}}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.openedReaders += len(readers)
+	return readers
+}
+
+func (m *mockReaderBucketCache) openReaders() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.openedReaders - m.closedReaders
+}
+
+type mockCloser struct {
+	c *mockReaderBucketCache
+}
+
+func (m mockCloser) Close() error {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+
+	m.c.closedReaders++
+	return nil
+}
+
+type mockTouchBucketCache struct {
+	*mockBucketCache
+
+	touchedKeys []string
+	touchedTTL  time.Duration
+}
+
+func (m *mockTouchBucketCache) Touch(_ context.Context, keys []string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.touchedKeys = append(m.touchedKeys, keys...)
+	m.touchedTTL = ttl
+}
+
+// mockBlockingBucketCache blocks the stores until unblock is closed.
+type mockBlockingBucketCache struct {
+	*mockBucketCache
+	unblock chan struct{}
+}
+
+func (m *mockBlockingBucketCache) Store(data map[string][]byte, ttl time.Duration) {
+	<-m.unblock
+	m.mockBucketCache.Store(data, ttl)
+}
+
+type mockDeleteBucketCache struct {
+	*mockBucketCache
+}
+
+func (m *mockDeleteBucketCache) Delete(_ context.Context, keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range keys {
+		delete(m.data, k)
+	}
+}
+
+// mockExpiryBucketCache reports the keys in expired as expired when missing.
+type mockExpiryBucketCache struct {
+	*mockBucketCache
+
+	expired map[string]struct{}
+}
+
+func (m *mockExpiryBucketCache) FetchWithExpired(ctx context.Context, keys []string) (map[string][]byte, []string) {
+	hits := m.Fetch(ctx, keys)
+
+	var expired []string
+	for _, k := range keys {
+		if _, ok := m.expired[k]; ok {
+			if _, found := hits[k]; !found {
+				expired = append(expired, k)
+			}
+		}
+	}
+	return hits, expired
+}
@@ -0,0 +1,162 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/cache"
+)
+
+// negativeCacheSentinel is the value stored for keys which have been confirmed to not exist
+// in the object storage. It's never returned to the caller as a real value.
+var negativeCacheSentinel = []byte("\x00cortex-negative-cache-entry\x00")
+
+// negativeCacheForgottenSentinel overwrites the negative entries of the keys no longer known to be
+// missing, in the caches unable to remove items. It's never returned to the caller either.
+var negativeCacheForgottenSentinel = []byte("\x00cortex-negative-cache-forgotten\x00")
+
+// maxForgottenNegativeEntries is the max number of keys whose negative entry has been removed which are
+// tracked, to not report them as missing if the cache is unable to remove nor overwrite the entries.
+const maxForgottenNegativeEntries = 10000
+
+// negativeCache is a cache.Cache decorator which allows to record keys confirmed to be
+// missing in the object storage, so that subsequent lookups can be answered as "known absent"
+// without hitting the storage again. Negative entries are stored in the wrapped cache with
+// a (short) dedicated TTL.
+type negativeCache struct {
+	cache.Cache
+
+	ttl time.Duration
+
+	// Keys whose negative entry has been removed within the TTL, since some caches, eg. the in-memory
+	// one, silently keep the existing entries when stored again.
+	forgotten *expirable.LRU[string, struct{}]
+
+	negativeHits      prometheus.Counter
+	negativeEntries   prometheus.Counter
+	skippedSentinelKV prometheus.Counter
+}
+
+func newNegativeCache(c cache.Cache, backend string, ttl time.Duration, reg prometheus.Registerer) *negativeCache {
+	constLabels := prometheus.Labels{"name": c.Name(), "backend": backend}
+
+	return &negativeCache{
+		Cache:     c,
+		ttl:       ttl,
+		forgotten: expirable.NewLRU[string, struct{}](maxForgottenNegativeEntries, nil, ttl),
+		negativeHits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_negative_hits_total",
+			Help:        "Total number of keys found in the cache as confirmed missing from the storage.",
+			ConstLabels: constLabels,
+		}),
+		negativeEntries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_negative_entries_stored_total",
+			Help:        "Total number of negative cache entries stored.",
+			ConstLabels: constLabels,
+		}),
+		skippedSentinelKV: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_negative_sentinel_values_skipped_total",
+			Help:        "Total number of values not stored because they collide with the negative cache sentinel.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// StoreMissing records the input keys as confirmed missing from the storage.
+func (c *negativeCache) StoreMissing(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	data := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		data[key] = negativeCacheSentinel
+		c.forgotten.Remove(key)
+	}
+
+	c.Cache.Store(data, c.ttl)
+	c.negativeEntries.Add(float64(len(keys)))
+}
+
+// ForgetMissing removes the negative entries of the input keys, eg. once the objects have been uploaded.
+// Caches unable to remove items have the entries overwritten instead.
+func (c *negativeCache) ForgetMissing(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if d, ok := c.Cache.(cacheDeleter); ok {
+		d.Delete(context.Background(), keys)
+		return
+	}
+
+	data := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		data[key] = negativeCacheForgottenSentinel
+		c.forgotten.Add(key, struct{}{})
+	}
+	c.Cache.Store(data, c.ttl)
+}
+
+func (c *negativeCache) Store(data map[string][]byte, ttl time.Duration) {
+	filtered := data
+
+	// Values colliding with the sentinels would be read back as negative entries, so we don't store them.
+	for key, value := range data {
+		if !isNegativeCacheSentinel(value) && !bytes.Equal(value, negativeCacheForgottenSentinel) {
+			continue
+		}
+
+		if len(filtered) == len(data) {
+			filtered = make(map[string][]byte, len(data))
+			for k, v := range data {
+				filtered[k] = v
+			}
+		}
+		delete(filtered, key)
+		c.skippedSentinelKV.Inc()
+	}
+
+	if len(filtered) > 0 {
+		c.Cache.Store(filtered, ttl)
+	}
+}
+
+// Fetch returns the real values found in the cache. Keys confirmed missing are not
+// returned, as if they were a cache miss.
+func (c *negativeCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	hits, _ := c.FetchWithAbsent(ctx, keys)
+	return hits
+}
+
+// FetchWithAbsent returns the real values found in the cache and the list of keys
+// known to be missing from the storage.
+func (c *negativeCache) FetchWithAbsent(ctx context.Context, keys []string) (map[string][]byte, []string) {
+	hits := c.Cache.Fetch(ctx, keys)
+
+	var absent []string
+	for key, value := range hits {
+		if isNegativeCacheSentinel(value) {
+			delete(hits, key)
+			if !c.forgotten.Contains(key) {
+				absent = append(absent, key)
+			}
+		} else if bytes.Equal(value, negativeCacheForgottenSentinel) {
+			delete(hits, key)
+		}
+	}
+
+	if len(absent) > 0 {
+		c.negativeHits.Add(float64(len(absent)))
+	}
+
+	return hits, absent
+}
+
+func isNegativeCacheSentinel(value []byte) bool {
+	return bytes.Equal(value, negativeCacheSentinel)
+}
@@ -0,0 +1,113 @@
+package tsdb
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// negativeCacheKeyPrefix is the prefix of the negative cache keys of the objects, which differs from
+// the caching bucket ones so that the entries never collide.
+const negativeCacheKeyPrefix = "absent:"
+
+// errObjectAbsent is returned when getting an object the negative cache reports as missing.
+var errObjectAbsent = errors.New("object confirmed missing from the object storage by the negative cache")
+
+// negativeCacheBucket is a bucket wrapping the object storage client, below the caching bucket, which
+// records in the negative cache the objects matching the matcher confirmed missing from the object
+// storage by a get or an exists, and reports them as missing without reading the object storage until
+// the entry expires. The entry of an object uploaded through the bucket is removed.
+type negativeCacheBucket struct {
+	objstore.Bucket
+
+	cache   cacheAbsentFetcher
+	matcher func(name string) bool
+}
+
+func newNegativeCacheBucket(bkt objstore.InstrumentedBucket, c cacheAbsentFetcher, matcher func(name string) bool) *negativeCacheBucket {
+	return &negativeCacheBucket{
+		Bucket:  bkt,
+		cache:   c,
+		matcher: matcher,
+	}
+}
+
+func (b *negativeCacheBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !b.matcher(name) {
+		return b.Bucket.Get(ctx, name)
+	}
+	if b.isAbsent(ctx, name) {
+		return nil, errors.Wrapf(errObjectAbsent, "get %s", name)
+	}
+
+	reader, err := b.Bucket.Get(ctx, name)
+	if err != nil && b.Bucket.IsObjNotFoundErr(err) {
+		b.cache.StoreMissing([]string{negativeCacheKey(name)})
+	}
+	return reader, err
+}
+
+func (b *negativeCacheBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if !b.matcher(name) {
+		return b.Bucket.Exists(ctx, name)
+	}
+	if b.isAbsent(ctx, name) {
+		return false, nil
+	}
+
+	exists, err := b.Bucket.Exists(ctx, name)
+	if err == nil && !exists {
+		b.cache.StoreMissing([]string{negativeCacheKey(name)})
+	}
+	return exists, err
+}
+
+func (b *negativeCacheBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	err := b.Bucket.Upload(ctx, name, r)
+
+	// The object may have been uploaded even if the upload failed, so the entry is removed anyway.
+	if b.matcher(name) {
+		b.cache.ForgetMissing([]string{negativeCacheKey(name)})
+	}
+	return err
+}
+
+func (b *negativeCacheBucket) Delete(ctx context.Context, name string) error {
+	err := b.Bucket.Delete(ctx, name)
+	if err == nil && b.matcher(name) {
+		b.cache.StoreMissing([]string{negativeCacheKey(name)})
+	}
+	return err
+}
+
+func (b *negativeCacheBucket) IsObjNotFoundErr(err error) bool {
+	return errors.Is(err, errObjectAbsent) || b.Bucket.IsObjNotFoundErr(err)
+}
+
+// isAbsent returns whether the negative cache reports the input object as missing.
+func (b *negativeCacheBucket) isAbsent(ctx context.Context, name string) bool {
+	_, absent := b.cache.FetchWithAbsent(ctx, []string{negativeCacheKey(name)})
+	return len(absent) > 0
+}
+
+func (b *negativeCacheBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.Bucket.(objstore.InstrumentedBucket); ok {
+		// Make a copy, but replace bucket with instrumented one.
+		res := &negativeCacheBucket{}
+		*res = *b
+		res.Bucket = ib.WithExpectedErrs(expectedFunc)
+		return res
+	}
+
+	return b
+}
+
+func (b *negativeCacheBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(expectedFunc)
+}
+
+func negativeCacheKey(name string) string {
+	return negativeCacheKeyPrefix + name
+}
@@ -0,0 +1,176 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/cache"
+)
+
+func TestNegativeCacheBucket(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	inMemory, err := cache.NewInMemoryCacheWithConfig("metadata-cache", log.NewNopLogger(), reg, cache.InMemoryCacheConfig{MaxSize: 10 * 1024, MaxItemSize: 1024})
+	require.NoError(t, err)
+
+	inmem := objstore.NewInMemBucket()
+	require.NoError(t, inmem.Upload(ctx, "user-1/existing/meta.json", bytes.NewReader([]byte("content"))))
+
+	matcher := func(name string) bool { return strings.HasSuffix(name, "/meta.json") }
+	bkt := newNegativeCacheBucket(objstore.WithNoopInstr(inmem), newNegativeCache(inMemory, CacheBackendInMemory, time.Minute, reg), matcher)
+
+	// The existing objects are read from the object storage.
+	reader, err := bkt.Get(ctx, "user-1/existing/meta.json")
+	require.NoError(t, err)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), actual)
+
+	exists, err := bkt.Exists(ctx, "user-1/existing/meta.json")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// The objects confirmed missing by a get or an exists are reported as missing until the entry expires,
+	// even if created in the meanwhile by another client.
+	_, err = bkt.Get(ctx, "user-1/got/meta.json")
+	require.True(t, bkt.IsObjNotFoundErr(err))
+	exists, err = bkt.Exists(ctx, "user-1/checked/meta.json")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	for _, name := range []string{"user-1/got/meta.json", "user-1/checked/meta.json"} {
+		require.NoError(t, inmem.Upload(ctx, name, bytes.NewReader([]byte("content"))))
+
+		_, err = bkt.Get(ctx, name)
+		assert.True(t, bkt.IsObjNotFoundErr(err), name)
+		assert.ErrorIs(t, err, errObjectAbsent, name)
+
+		exists, err = bkt.Exists(ctx, name)
+		require.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+
+	// The objects not matching the matcher are never cached as missing.
+	_, err = bkt.Get(ctx, "user-1/bucket-index.json.gz")
+	require.True(t, bkt.IsObjNotFoundErr(err))
+	require.NoError(t, inmem.Upload(ctx, "user-1/bucket-index.json.gz", bytes.NewReader([]byte("content"))))
+
+	exists, err = bkt.Exists(ctx, "user-1/bucket-index.json.gz")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestNegativeCacheBucket_ShouldForgetTheObjectsUploadedAndRememberTheObjectsDeleted(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	inMemory, err := cache.NewInMemoryCacheWithConfig("metadata-cache", log.NewNopLogger(), reg, cache.InMemoryCacheConfig{MaxSize: 10 * 1024, MaxItemSize: 1024})
+	require.NoError(t, err)
+
+	inmem := objstore.NewInMemBucket()
+	bkt := newNegativeCacheBucket(objstore.WithNoopInstr(inmem), newNegativeCache(inMemory, CacheBackendInMemory, time.Minute, reg), func(string) bool { return true })
+
+	_, err = bkt.Get(ctx, "user-1/meta.json")
+	require.True(t, bkt.IsObjNotFoundErr(err))
+
+	// The object uploaded right after the miss is found.
+	require.NoError(t, bkt.Upload(ctx, "user-1/meta.json", bytes.NewReader([]byte("content"))))
+
+	reader, err := bkt.Get(ctx, "user-1/meta.json")
+	require.NoError(t, err)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), actual)
+
+	// The object deleted is known to be missing.
+	require.NoError(t, bkt.Delete(ctx, "user-1/meta.json"))
+	require.NoError(t, inmem.Upload(ctx, "user-1/meta.json", bytes.NewReader([]byte("content"))))
+
+	exists, err := bkt.Exists(ctx, "user-1/meta.json")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestCreateCachingBucket_ShouldOnlyLookUpTheNegativeCacheIfEnabled(t *testing.T) {
+	tests := map[string]struct {
+		negativeCacheTTL time.Duration
+		expectedRequests float64
+	}{
+		"negative cache disabled": {
+			negativeCacheTTL: 0,
+			// The caching bucket only looks up the exists key.
+			expectedRequests: 1,
+		},
+		"negative cache enabled": {
+			negativeCacheTTL: time.Minute,
+			// The negative cache bucket looks up the absent key too, once the caching bucket missed.
+			expectedRequests: 2,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+
+			s, err := miniredis.Run()
+			require.NoError(t, err)
+			t.Cleanup(s.Close)
+
+			// The metadata cache is a multi level one, which is able to report the absent keys on its own.
+			metadataConfig := MetadataCacheConfig{
+				BucketCacheBackend: BucketCacheBackend{
+					Backend:  CacheBackendInMemory + "," + CacheBackendRedis,
+					InMemory: InMemoryBucketCacheConfig{MaxSizeBytes: 10 * 1024},
+					Redis:    RedisClientConfig{Addresses: s.Addr()},
+					MultiLevel: MultiLevelBucketCacheConfig{
+						MaxAsyncConcurrency: 1,
+						MaxAsyncBufferSize:  100,
+						MaxBackfillItems:    100,
+					},
+				},
+				MetafileExistsTTL:      time.Hour,
+				MetafileDoesntExistTTL: time.Hour,
+				NegativeCacheTTL:       testData.negativeCacheTTL,
+			}
+
+			bkt, err := CreateCachingBucket(ChunksCacheConfig{}, metadataConfig, ParquetLabelsCacheConfig{}, 0, 0, NewMatchers(), objstore.WithNoopInstr(objstore.NewInMemBucket()), log.NewNopLogger(), reg)
+			require.NoError(t, err)
+
+			exists, err := bkt.Exists(context.Background(), "user-1/01ARZ3NDEKTSV4RRFFQ69G5FAV/meta.json")
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			assert.NoError(t, promtestutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP thanos_cache_inmemory_requests_total Total number of requests to the inmemory cache.
+				# TYPE thanos_cache_inmemory_requests_total counter
+				thanos_cache_inmemory_requests_total{name="metadata-cache"} %v
+			`, testData.expectedRequests)), "thanos_cache_inmemory_requests_total"))
+		})
+	}
+}
+
+func Test_CreateBucketCache_ShouldWrapTheLevelsInTheNegativeCacheIfEnabled(t *testing.T) {
+	backend := &BucketCacheBackend{Backend: CacheBackendInMemory, InMemory: InMemoryBucketCacheConfig{MaxSizeBytes: 1000}}
+
+	c, err := createBucketCache("metadata-cache", backend, 0, nil, nil, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, err)
+	assert.NotImplements(t, (*cacheAbsentFetcher)(nil), c)
+
+	c, err = createBucketCache("metadata-cache", backend, time.Minute, nil, nil, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, err)
+	require.Implements(t, (*cacheAbsentFetcher)(nil), c)
+	assert.Equal(t, time.Minute, c.(*negativeCache).ttl)
+}
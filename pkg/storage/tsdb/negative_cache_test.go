@@ -0,0 +1,137 @@
+package tsdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/cache"
+)
+
+func Test_NegativeCache(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inMemory, err := cache.NewInMemoryCacheWithConfig("test", log.NewNopLogger(), reg, cache.InMemoryCacheConfig{MaxSize: 10 * 1024, MaxItemSize: 1024})
+	require.NoError(t, err)
+
+	c := newNegativeCache(inMemory, CacheBackendInMemory, time.Minute, reg)
+	c.Store(map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": {},
+	}, time.Hour)
+	c.StoreMissing([]string{"key3"})
+
+	hits, absent := c.FetchWithAbsent(context.Background(), []string{"key1", "key2", "key3", "key4"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1"), "key2": {}}, hits)
+	assert.Equal(t, []string{"key3"}, absent)
+
+	// Negative entries should never be returned as values.
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, c.Fetch(context.Background(), []string{"key1", "key3"}))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.negativeHits))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.negativeEntries))
+}
+
+func Test_NegativeCache_ShouldNotStoreValuesCollidingWithSentinel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMockBucketCache("m1", nil)
+	c := newNegativeCache(m, CacheBackendInMemory, time.Minute, reg)
+
+	c.Store(map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": negativeCacheSentinel,
+	}, time.Hour)
+
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, m.data)
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.skippedSentinelKV))
+}
+
+func Test_NegativeCache_WithinMultiLevelCache(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+	reg := prometheus.NewRegistry()
+
+	m1 := newMockBucketCache("m1", nil)
+	m2 := newNegativeCache(newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": negativeCacheSentinel,
+	}), CacheBackendMemcached, time.Minute, reg)
+
+	c := newMultiLevelBucketCache("metadata-cache", cfg, reg, log.NewNopLogger(), m1, m2)
+	hits := c.Fetch(context.Background(), []string{"key1", "key2"})
+
+	mlc := c.(*multiLevelBucketCache)
+	mlc.backfillProcessor.Stop()
+
+	// The negative entry must not leak to the caller nor be backfilled to other levels.
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, m1.data)
+}
+
+func Test_MultiLevelBucketCache_FetchWithAbsent(t *testing.T) {
+	cfg := MultiLevelBucketCacheConfig{
+		MaxAsyncConcurrency: 10,
+		MaxAsyncBufferSize:  100000,
+		MaxBackfillItems:    10000,
+		BackFillTTL:         time.Hour * 24,
+	}
+	reg := prometheus.NewRegistry()
+
+	m1 := newMockBucketCache("m1", map[string][]byte{
+		"key2": negativeCacheSentinel,
+	})
+	m2 := newMockBucketCache("m2", map[string][]byte{
+		"key1": []byte("value1"),
+		"key2": []byte("value2"),
+	})
+
+	c := newMultiLevelBucketCache("metadata-cache", cfg, reg, log.NewNopLogger(), newNegativeCache(m1, CacheBackendInMemory, time.Minute, reg), m2)
+	mlc := c.(*multiLevelBucketCache)
+
+	hits, absent := mlc.FetchWithAbsent(context.Background(), []string{"key1", "key2", "key3"})
+	assert.Equal(t, map[string][]byte{"key1": []byte("value1")}, hits)
+	assert.Equal(t, []string{"key2"}, absent)
+
+	// The key absent from the fastest level is not fetched from the slower one, nor counted as a miss.
+	assert.Equal(t, []string{"key1", "key3"}, m2.fetchedKeys)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mlc.missedItems.WithLabelValues(missReasonCold)))
+
+	// The missing keys are only stored to the levels supporting it, with the negative cache TTL.
+	mlc.StoreMissing([]string{"key3"})
+	mlc.backfillProcessor.Stop()
+
+	assert.Equal(t, negativeCacheSentinel, m1.data["key3"])
+	assert.Equal(t, time.Minute, m1.storedTTLs["key3"])
+	assert.NotContains(t, m2.data, "key3")
+}
+
+func Test_NegativeCache_ForgetMissing(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	budgeted := newMemoryBudget(10*1024, reg).newCache("test", 10*1024)
+	inMemory, err := cache.NewInMemoryCacheWithConfig("test", log.NewNopLogger(), reg, cache.InMemoryCacheConfig{MaxSize: 10 * 1024, MaxItemSize: 1024})
+	require.NoError(t, err)
+
+	// The first cache supports removing items, while the second one keeps the existing items when stored again.
+	for _, inner := range []cache.Cache{budgeted, inMemory} {
+		c := newNegativeCache(inner, CacheBackendInMemory, time.Minute, prometheus.NewRegistry())
+		c.StoreMissing([]string{"key1", "key2"})
+		c.ForgetMissing([]string{"key1"})
+
+		hits, absent := c.FetchWithAbsent(context.Background(), []string{"key1", "key2"})
+		assert.Empty(t, hits)
+		assert.Equal(t, []string{"key2"}, absent)
+
+		// The keys confirmed missing again are reported as missing.
+		c.StoreMissing([]string{"key1"})
+		_, absent = c.FetchWithAbsent(context.Background(), []string{"key1"})
+		assert.Equal(t, []string{"key1"}, absent)
+	}
+}
@@ -0,0 +1,210 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/cacheutil"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"golang.org/x/time/rate"
+)
+
+const (
+	readRepairMaxAsyncConcurrency = 1
+	readRepairMaxAsyncBufferSize  = 100
+	readRepairTimeout             = time.Minute
+
+	readRepairStatusSuccess = "success"
+	readRepairStatusFailed  = "failed"
+	readRepairStatusSkipped = "skipped"
+
+	// readRepairCopyKeyPrefix is the prefix of the cache keys of the meta.json copies kept for the read
+	// repair, which differs from the caching bucket ones so that the copies are only looked up by it.
+	readRepairCopyKeyPrefix = "read-repair:"
+)
+
+// errReadRepairRefused is returned when a meta.json is not uploaded back because it's unsafe or not needed.
+var errReadRepairRefused = errors.New("read repair refused")
+
+// readRepairBucket is a bucket wrapping the object storage client, below the caching bucket, which
+// uploads back to the object storage the block meta.json files missing from the object storage but
+// still found in the metadata cache. The meta.json content found in the cache is returned to the caller.
+//
+// The caching bucket only reads a meta.json from the object storage once its content has expired from
+// the cache, so the read repair keeps its own copy of each meta.json read from the object storage, with
+// a longer TTL, and looks it up when the meta.json is missing from the object storage.
+//
+// Writing to the object storage from the read path is unusual, so repairs are rate limited and
+// processed asynchronously, and a meta.json is never uploaded back if the block is marked for
+// deletion or its index is missing, since it may have been deleted on purpose.
+type readRepairBucket struct {
+	objstore.Bucket
+
+	logger         log.Logger
+	cache          cache.Cache
+	copyTTL        time.Duration
+	limiter        *rate.Limiter
+	asyncProcessor *cacheutil.AsyncOperationProcessor
+	repairs        *prometheus.CounterVec
+}
+
+func newReadRepairBucket(bkt objstore.InstrumentedBucket, c cache.Cache, maxRepairsPerSecond float64, copyTTL time.Duration, logger log.Logger, reg prometheus.Registerer) *readRepairBucket {
+	b := &readRepairBucket{
+		Bucket:         bkt,
+		logger:         logger,
+		cache:          c,
+		copyTTL:        copyTTL,
+		limiter:        rate.NewLimiter(rate.Limit(maxRepairsPerSecond), 1),
+		asyncProcessor: cacheutil.NewAsyncOperationProcessor(readRepairMaxAsyncBufferSize, readRepairMaxAsyncConcurrency),
+		repairs: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_metafile_read_repairs_total",
+			Help: "Total number of block meta.json files missing from the object storage and found in the metadata cache, which have been uploaded back to the object storage, by status.",
+		}, []string{"status"}),
+	}
+
+	// Initialise the metrics, so that they're exported even if no repair has been done yet.
+	for _, status := range []string{readRepairStatusSuccess, readRepairStatusFailed, readRepairStatusSkipped} {
+		b.repairs.WithLabelValues(status)
+	}
+
+	return b
+}
+
+func (b *readRepairBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) != metadata.MetaFilename {
+		return b.Bucket.Get(ctx, name)
+	}
+
+	reader, err := b.Bucket.Get(ctx, name)
+	if err == nil {
+		return b.keepCopy(name, reader)
+	}
+	if !b.IsObjNotFoundErr(err) {
+		return nil, err
+	}
+
+	copyKey := readRepairCopyKey(name)
+	content := b.cache.Fetch(ctx, []string{copyKey})[copyKey]
+	if content == nil {
+		return nil, err
+	}
+
+	b.enqueueRepair(name, content)
+	return objstore.NopCloserWithSize(bytes.NewReader(content)), nil
+}
+
+// keepCopy reads the input meta.json and stores a copy of it in the cache. The meta.json is small, so
+// it's entirely read, and a reader of its content is returned instead.
+func (b *readRepairBucket) keepCopy(name string, reader io.ReadCloser) (io.ReadCloser, error) {
+	defer runutil.CloseWithLogOnErr(b.logger, reader, "close block meta.json reader")
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+
+	b.cache.Store(map[string][]byte{readRepairCopyKey(name): content}, b.copyTTL)
+	return objstore.NopCloserWithSize(bytes.NewReader(content)), nil
+}
+
+func (b *readRepairBucket) enqueueRepair(name string, content []byte) {
+	if !b.limiter.Allow() {
+		b.repairs.WithLabelValues(readRepairStatusSkipped).Inc()
+		return
+	}
+
+	if err := b.asyncProcessor.EnqueueAsync(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), readRepairTimeout)
+		defer cancel()
+
+		err := b.repair(ctx, name, content)
+		if errors.Is(err, errReadRepairRefused) {
+			level.Info(b.logger).Log("msg", "skipped uploading back block meta.json found in the cache", "file", name, "reason", err)
+			b.repairs.WithLabelValues(readRepairStatusSkipped).Inc()
+			return
+		}
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "failed to upload back block meta.json found in the cache", "file", name, "err", err)
+			b.repairs.WithLabelValues(readRepairStatusFailed).Inc()
+			return
+		}
+		level.Info(b.logger).Log("msg", "uploaded back block meta.json found in the cache", "file", name)
+		b.repairs.WithLabelValues(readRepairStatusSuccess).Inc()
+	}); err != nil {
+		b.repairs.WithLabelValues(readRepairStatusSkipped).Inc()
+	}
+}
+
+// repair uploads the input meta.json content, once checked the block is still there.
+func (b *readRepairBucket) repair(ctx context.Context, name string, content []byte) error {
+	blockDir := path.Dir(name)
+	id, err := ulid.Parse(path.Base(blockDir))
+	if err != nil {
+		return errors.Wrap(errReadRepairRefused, "not a block meta.json")
+	}
+
+	meta := metadata.Meta{}
+	if err := json.Unmarshal(content, &meta); err != nil || meta.ULID != id {
+		return errors.Wrap(errReadRepairRefused, "cached content is not the block meta.json")
+	}
+
+	// The object storage may have recovered in the meanwhile.
+	if exists, err := b.Exists(ctx, name); err != nil {
+		return err
+	} else if exists {
+		return errors.Wrap(errReadRepairRefused, "block meta.json exists")
+	}
+
+	// A block being deleted has its meta.json deleted first, and its deletion mark deleted last.
+	if exists, err := b.Exists(ctx, path.Join(blockDir, metadata.DeletionMarkFilename)); err != nil {
+		return err
+	} else if exists {
+		return errors.Wrap(errReadRepairRefused, "block is marked for deletion")
+	}
+	if exists, err := b.Exists(ctx, path.Join(blockDir, block.IndexFilename)); err != nil {
+		return err
+	} else if !exists {
+		return errors.Wrap(errReadRepairRefused, "block index is missing")
+	}
+
+	return b.Upload(ctx, name, bytes.NewReader(content))
+}
+
+func (b *readRepairBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := b.Bucket.(objstore.InstrumentedBucket); ok {
+		// Make a copy, but replace bucket with instrumented one.
+		res := &readRepairBucket{}
+		*res = *b
+		res.Bucket = ib.WithExpectedErrs(expectedFunc)
+		return res
+	}
+
+	return b
+}
+
+func (b *readRepairBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.WithExpectedErrs(expectedFunc)
+}
+
+func readRepairCopyKey(name string) string {
+	return readRepairCopyKeyPrefix + name
+}
+
+// Stop waits until all the pending repairs have been processed.
+func (b *readRepairBucket) Stop() {
+	b.asyncProcessor.Stop()
+}
@@ -0,0 +1,210 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestReadRepairBucket_Get(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	metaFile := path.Join("user-1", id.String(), metadata.MetaFilename)
+	metaContent := []byte(fmt.Sprintf(`{"ulid":"%s","version":1}`, id))
+	cached := map[string][]byte{readRepairCopyKey(metaFile): metaContent}
+
+	tests := map[string]struct {
+		files            []string
+		cached           map[string][]byte
+		expectedFound    bool
+		expectedRepaired bool
+		expectedStatus   string
+	}{
+		"meta.json missing from the cache": {
+			files:         []string{block.IndexFilename},
+			cached:        nil,
+			expectedFound: false,
+		},
+		"meta.json found in the cache": {
+			files:            []string{block.IndexFilename},
+			cached:           cached,
+			expectedFound:    true,
+			expectedRepaired: true,
+			expectedStatus:   readRepairStatusSuccess,
+		},
+		"meta.json found in the cache of a block marked for deletion": {
+			files:          []string{block.IndexFilename, metadata.DeletionMarkFilename},
+			cached:         cached,
+			expectedFound:  true,
+			expectedStatus: readRepairStatusSkipped,
+		},
+		"meta.json found in the cache of a block without index": {
+			files:          nil,
+			cached:         cached,
+			expectedFound:  true,
+			expectedStatus: readRepairStatusSkipped,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx := context.Background()
+			inmem := objstore.NewInMemBucket()
+			for _, f := range testData.files {
+				require.NoError(t, inmem.Upload(ctx, path.Join("user-1", id.String(), f), bytes.NewReader([]byte("content"))))
+			}
+
+			bkt := newReadRepairBucket(objstore.WithNoopInstr(inmem), newMockBucketCache("metadata-cache", testData.cached), 100, time.Hour, log.NewNopLogger(), prometheus.NewRegistry())
+
+			reader, err := bkt.Get(ctx, metaFile)
+			if !testData.expectedFound {
+				require.True(t, bkt.IsObjNotFoundErr(err))
+			} else {
+				require.NoError(t, err)
+				actual, err := io.ReadAll(reader)
+				require.NoError(t, err)
+				assert.Equal(t, metaContent, actual)
+			}
+			bkt.Stop()
+
+			exists, err := inmem.Exists(ctx, metaFile)
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedRepaired, exists)
+
+			for _, status := range []string{readRepairStatusSuccess, readRepairStatusFailed, readRepairStatusSkipped} {
+				expected := float64(0)
+				if status == testData.expectedStatus {
+					expected = 1
+				}
+				assert.Equal(t, expected, testutil.ToFloat64(bkt.repairs.WithLabelValues(status)), status)
+			}
+		})
+	}
+}
+
+func TestReadRepairBucket_ShouldKeepACopyOfTheMetaFilesReadFromTheStorage(t *testing.T) {
+	ctx := context.Background()
+	id := ulid.MustNew(1, nil)
+	metaFile := path.Join("user-1", id.String(), metadata.MetaFilename)
+	indexFile := path.Join("user-1", id.String(), block.IndexFilename)
+	metaContent := []byte(fmt.Sprintf(`{"ulid":"%s","version":1}`, id))
+
+	inmem := objstore.NewInMemBucket()
+	require.NoError(t, inmem.Upload(ctx, metaFile, bytes.NewReader(metaContent)))
+	require.NoError(t, inmem.Upload(ctx, indexFile, bytes.NewReader([]byte("content"))))
+
+	c := newMockBucketCache("metadata-cache", nil)
+	bkt := newReadRepairBucket(objstore.WithNoopInstr(inmem), c, 100, time.Hour, log.NewNopLogger(), prometheus.NewRegistry())
+	defer bkt.Stop()
+
+	for _, name := range []string{metaFile, indexFile} {
+		reader, err := bkt.Get(ctx, name)
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+	}
+
+	assert.Equal(t, map[string][]byte{readRepairCopyKey(metaFile): metaContent}, c.Fetch(ctx, []string{readRepairCopyKey(metaFile), readRepairCopyKey(indexFile)}))
+}
+
+func TestReadRepairBucket_ShouldRateLimitRepairs(t *testing.T) {
+	ctx := context.Background()
+	inmem := objstore.NewInMemBucket()
+	cached := map[string][]byte{}
+
+	var metaFiles []string
+	for i := 1; i <= 2; i++ {
+		id := ulid.MustNew(uint64(i), nil)
+		metaFile := path.Join("user-1", id.String(), metadata.MetaFilename)
+		metaFiles = append(metaFiles, metaFile)
+
+		require.NoError(t, inmem.Upload(ctx, path.Join("user-1", id.String(), block.IndexFilename), bytes.NewReader([]byte("content"))))
+		cached[readRepairCopyKey(metaFile)] = []byte(fmt.Sprintf(`{"ulid":"%s","version":1}`, id))
+	}
+
+	bkt := newReadRepairBucket(objstore.WithNoopInstr(inmem), newMockBucketCache("metadata-cache", cached), 0.001, time.Hour, log.NewNopLogger(), prometheus.NewRegistry())
+
+	// Both are served from the cache, but only the first one is repaired.
+	for _, metaFile := range metaFiles {
+		_, err := bkt.Get(ctx, metaFile)
+		require.NoError(t, err)
+	}
+	bkt.Stop()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(bkt.repairs.WithLabelValues(readRepairStatusSuccess)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(bkt.repairs.WithLabelValues(readRepairStatusSkipped)))
+}
+
+func TestCreateCachingBucket_ShouldRepairTheMetaFilesExpiredFromTheCache(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	id := ulid.MustNew(1, nil)
+	metaFile := path.Join("user-1", id.String(), metadata.MetaFilename)
+	metaContent := []byte(fmt.Sprintf(`{"ulid":"%s","version":1}`, id))
+
+	inmem := objstore.NewInMemBucket()
+	require.NoError(t, inmem.Upload(ctx, metaFile, bytes.NewReader(metaContent)))
+	require.NoError(t, inmem.Upload(ctx, path.Join("user-1", id.String(), block.IndexFilename), bytes.NewReader([]byte("content"))))
+
+	metadataConfig := MetadataCacheConfig{
+		BucketCacheBackend: BucketCacheBackend{
+			Backend:  CacheBackendInMemory,
+			InMemory: InMemoryBucketCacheConfig{MaxSizeBytes: 10 * 1024},
+		},
+		MetafileMaxSize:                1024,
+		MetafileContentTTL:             100 * time.Millisecond,
+		MetafileExistsTTL:              time.Hour,
+		MetafileDoesntExistTTL:         time.Hour,
+		MetafileReadRepairEnabled:      true,
+		MetafileReadRepairMaxPerSecond: 100,
+		MetafileReadRepairTTL:          time.Hour,
+	}
+
+	bkt, err := CreateCachingBucket(ChunksCacheConfig{}, metadataConfig, ParquetLabelsCacheConfig{}, 0, 0, NewMatchers(), objstore.WithNoopInstr(inmem), log.NewNopLogger(), reg)
+	require.NoError(t, err)
+
+	readMetaFile := func() {
+		reader, err := bkt.Get(ctx, metaFile)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		assert.Equal(t, metaContent, actual)
+	}
+
+	// Read the meta.json from the object storage, then delete it and wait until its content expires from the cache.
+	readMetaFile()
+	require.NoError(t, inmem.Delete(ctx, metaFile))
+	time.Sleep(2 * metadataConfig.MetafileContentTTL)
+
+	// The meta.json is served from the read repair copy and uploaded back to the object storage.
+	readMetaFile()
+	require.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_bucket_metafile_read_repairs_total Total number of block meta.json files missing from the object storage and found in the metadata cache, which have been uploaded back to the object storage, by status.
+			# TYPE cortex_bucket_metafile_read_repairs_total counter
+			cortex_bucket_metafile_read_repairs_total{status="failed"} 0
+			cortex_bucket_metafile_read_repairs_total{status="skipped"} 0
+			cortex_bucket_metafile_read_repairs_total{status="success"} 1
+		`), "cortex_bucket_metafile_read_repairs_total") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	exists, err := inmem.Exists(ctx, metaFile)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
@@ -0,0 +1,134 @@
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/cacheutil"
+)
+
+const (
+	shadowCacheResultMatch       = "match"
+	shadowCacheResultMismatch    = "mismatch"
+	shadowCacheResultPrimaryOnly = "primary-only"
+	shadowCacheResultShadowOnly  = "shadow-only"
+)
+
+// shadowCache is a cache.Cache serving the reads from a primary cache, while asynchronously issuing
+// the same fetches to a shadow cache and comparing their results with the primary ones. It allows to
+// validate a new cache backend with the production traffic before trusting it: the results of the
+// shadow cache are only compared, and never returned.
+//
+// The items are only stored to the primary cache. To fill the shadow cache too, the primary cache can
+// be a mirroringCache writing to both of them.
+type shadowCache struct {
+	primary cache.Cache
+	shadow  cache.Cache
+
+	asyncProcessor *cacheutil.AsyncOperationProcessor
+
+	comparedItems  *prometheus.CounterVec
+	skippedFetches prometheus.Counter
+	latencyDelta   prometheus.Histogram
+}
+
+// newShadowCache returns a shadowCache reading from the primary cache, and shadowing its fetches to
+// the shadow cache. The shadow fetches are processed asynchronously, and are skipped if the async
+// buffer is full.
+func newShadowCache(primary, shadow cache.Cache, maxAsyncConcurrency, maxAsyncBufferSize int, reg prometheus.Registerer) *shadowCache {
+	constLabels := prometheus.Labels{"name": primary.Name()}
+
+	c := &shadowCache{
+		primary:        primary,
+		shadow:         shadow,
+		asyncProcessor: cacheutil.NewAsyncOperationProcessor(maxAsyncBufferSize, maxAsyncConcurrency),
+		comparedItems: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "cortex_cache_shadow_compared_items_total",
+			Help:        "Total number of keys whose fetch from the primary cache has been compared with the fetch from the shadow cache, by result.",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		skippedFetches: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "cortex_cache_shadow_skipped_fetches_total",
+			Help:        "Total number of fetches not shadowed because the async buffer was full.",
+			ConstLabels: constLabels,
+		}),
+		latencyDelta: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:        "cortex_cache_shadow_fetch_latency_delta_seconds",
+			Help:        "Difference between the latency of a fetch from the shadow cache and the latency of the same fetch from the primary cache. Negative values mean the shadow cache was faster.",
+			ConstLabels: constLabels,
+			Buckets:     []float64{-1, -0.1, -0.01, -0.001, 0, 0.001, 0.01, 0.1, 1},
+		}),
+	}
+
+	// Initialise the metrics, so that they're exported even if no fetch has been compared yet.
+	for _, result := range []string{shadowCacheResultMatch, shadowCacheResultMismatch, shadowCacheResultPrimaryOnly, shadowCacheResultShadowOnly} {
+		c.comparedItems.WithLabelValues(result)
+	}
+
+	return c
+}
+
+func (c *shadowCache) Store(data map[string][]byte, ttl time.Duration) {
+	c.primary.Store(data, ttl)
+}
+
+// Fetch fetches the input keys from the primary cache, and enqueues the same fetch to the shadow cache.
+func (c *shadowCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	start := time.Now()
+	hits := c.primary.Fetch(ctx, keys)
+	primaryLatency := time.Since(start)
+
+	// The keys and hits are owned by the caller, which may modify them once returned.
+	shadowKeys := slices.Clone(keys)
+	primaryHits := maps.Clone(hits)
+
+	// The shadow fetch is asynchronous, so it must not be canceled once the request completes.
+	shadowCtx := context.WithoutCancel(ctx)
+
+	if err := c.asyncProcessor.EnqueueAsync(func() {
+		start := time.Now()
+		shadowHits := c.shadow.Fetch(shadowCtx, shadowKeys)
+		c.latencyDelta.Observe((time.Since(start) - primaryLatency).Seconds())
+
+		c.compare(shadowKeys, primaryHits, shadowHits)
+	}); err != nil {
+		c.skippedFetches.Inc()
+	}
+
+	return hits
+}
+
+// compare counts the results of the comparison of the primary and shadow hits of the input keys.
+// The keys missing from both caches are not counted.
+func (c *shadowCache) compare(keys []string, primaryHits, shadowHits map[string][]byte) {
+	for _, key := range keys {
+		primaryValue, inPrimary := primaryHits[key]
+		shadowValue, inShadow := shadowHits[key]
+
+		switch {
+		case inPrimary && inShadow && bytes.Equal(primaryValue, shadowValue):
+			c.comparedItems.WithLabelValues(shadowCacheResultMatch).Inc()
+		case inPrimary && inShadow:
+			c.comparedItems.WithLabelValues(shadowCacheResultMismatch).Inc()
+		case inPrimary:
+			c.comparedItems.WithLabelValues(shadowCacheResultPrimaryOnly).Inc()
+		case inShadow:
+			c.comparedItems.WithLabelValues(shadowCacheResultShadowOnly).Inc()
+		}
+	}
+}
+
+func (c *shadowCache) Name() string {
+	return c.primary.Name()
+}
+
+// Stop waits until all the pending shadow fetches have been processed.
+func (c *shadowCache) Stop() {
+	c.asyncProcessor.Stop()
+}
@@ -0,0 +1,71 @@
+package tsdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ShadowCache(t *testing.T) {
+	primary := newMockBucketCache("primary", map[string][]byte{
+		"match":        []byte("value"),
+		"mismatch":     []byte("primary-value"),
+		"primary-only": []byte("value"),
+	})
+	shadow := newMockBucketCache("shadow", map[string][]byte{
+		"match":       []byte("value"),
+		"mismatch":    []byte("shadow-value"),
+		"shadow-only": []byte("value"),
+	})
+	c := newShadowCache(primary, shadow, 10, 100, prometheus.NewPedanticRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := []string{"match", "mismatch", "primary-only", "shadow-only", "missing"}
+	hits := c.Fetch(ctx, keys)
+
+	// The request completing, and modifying the hits, should not affect the shadow fetch.
+	cancel()
+	hits["match"] = []byte("modified")
+	c.Stop()
+
+	// The hits are always served by the primary.
+	assert.Equal(t, map[string][]byte{
+		"match":        []byte("modified"),
+		"mismatch":     []byte("primary-value"),
+		"primary-only": []byte("value"),
+	}, hits)
+	assert.Equal(t, keys, primary.fetchedKeys)
+	assert.Equal(t, keys, shadow.fetchedKeys)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.comparedItems.WithLabelValues(shadowCacheResultMatch)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.comparedItems.WithLabelValues(shadowCacheResultMismatch)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.comparedItems.WithLabelValues(shadowCacheResultPrimaryOnly)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(c.comparedItems.WithLabelValues(shadowCacheResultShadowOnly)))
+	assert.Equal(t, 1, testutil.CollectAndCount(c.latencyDelta))
+
+	// The items are stored to the primary only.
+	c.Store(map[string][]byte{"new": []byte("value")}, time.Hour)
+	assert.Equal(t, map[string][]byte{"new": []byte("value")}, primary.data)
+	assert.NotContains(t, shadow.data, "new")
+}
+
+func Test_ShadowCache_ShouldTrackFetchesSkippedWhenBufferIsFull(t *testing.T) {
+	primary := newMockBucketCache("primary", map[string][]byte{"key": []byte("value")})
+	shadow := newMockBucketCache("shadow", map[string][]byte{"key": []byte("other-value")})
+	c := newShadowCache(primary, shadow, 1, 1, prometheus.NewPedanticRegistry())
+
+	// Stop the processor, so that the first shadow fetch fills the buffer and the next is skipped.
+	c.Stop()
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, map[string][]byte{"key": []byte("value")}, c.Fetch(context.Background(), []string{"key"}))
+	}
+
+	assert.Empty(t, shadow.fetchedKeys)
+	require.Equal(t, float64(1), testutil.ToFloat64(c.skippedFetches))
+	assert.Equal(t, float64(0), testutil.ToFloat64(c.comparedItems.WithLabelValues(shadowCacheResultMismatch)))
+}
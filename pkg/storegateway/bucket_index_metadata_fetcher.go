@@ -32,6 +32,9 @@ type BucketIndexMetadataFetcher struct {
 	logger      log.Logger
 	filters     []block.MetadataFilter
 	metrics     *block.FetcherMetrics
+
+	// Optional registry tracking the stats of the fetched bucket index.
+	indexStats *bucketindex.StatsRegistry
 }
 
 func NewBucketIndexMetadataFetcher(
@@ -54,12 +57,20 @@ func NewBucketIndexMetadataFetcher(
 	}
 }
 
+// WithIndexStats configures the registry updated with the stats of the bucket index on each fetch. The
+// stats are removed once the user doesn't belong to the shard anymore or its bucket index is deleted.
+func (f *BucketIndexMetadataFetcher) WithIndexStats(stats *bucketindex.StatsRegistry) *BucketIndexMetadataFetcher {
+	f.indexStats = stats
+	return f
+}
+
 // Fetch implements block.MetadataFetcher. Not goroutine-safe.
 func (f *BucketIndexMetadataFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error) {
 	f.metrics.ResetTx()
 
 	// Check whether the user belongs to the shard.
 	if len(f.strategy.FilterUsers(ctx, []string{f.userID})) != 1 {
+		f.removeIndexStats()
 		f.metrics.Submit()
 		return nil, nil, nil
 	}
@@ -80,6 +91,7 @@ func (f *BucketIndexMetadataFetcher) Fetch(ctx context.Context) (metas map[ulid.
 		// This is a legit case happening when the first blocks of a tenant have recently been uploaded by ingesters
 		// and their bucket index has not been created yet.
 		f.metrics.Synced.WithLabelValues(noBucketIndex).Set(1)
+		f.removeIndexStats()
 		f.metrics.Submit()
 
 		return nil, nil, nil
@@ -112,6 +124,10 @@ func (f *BucketIndexMetadataFetcher) Fetch(ctx context.Context) (metas map[ulid.
 		return nil, nil, errors.Wrapf(err, "read bucket index")
 	}
 
+	if f.indexStats != nil {
+		f.indexStats.Update(f.userID, idx)
+	}
+
 	// Build block metas out of the index.
 	metas = make(map[ulid.ULID]*metadata.Meta, len(idx.Blocks))
 	for _, b := range idx.Blocks {
@@ -143,3 +159,9 @@ func (f *BucketIndexMetadataFetcher) UpdateOnChange(callback func([]metadata.Met
 	// Unused by the store-gateway.
 	callback(nil, errors.New("UpdateOnChange is unsupported"))
 }
+
+func (f *BucketIndexMetadataFetcher) removeIndexStats() {
+	if f.indexStats != nil {
+		f.indexStats.Remove(f.userID)
+	}
+}
@@ -147,6 +147,39 @@ func TestBucketIndexMetadataFetcher_Fetch_KeyPermissionDenied(t *testing.T) {
 	))
 }
 
+func TestBucketIndexMetadataFetcher_Fetch_ShouldTrackIndexStats(t *testing.T) {
+	t.Parallel()
+	const userID = "user-1"
+
+	bkt, _ := cortex_testutil.PrepareFilesystemBucket(t)
+	ctx := context.Background()
+	now := time.Now()
+	logger := log.NewNopLogger()
+
+	require.NoError(t, bucketindex.WriteIndex(ctx, bkt, userID, nil, &bucketindex.Index{
+		Version: bucketindex.IndexVersion1,
+		Blocks: bucketindex.Blocks{
+			{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20, SizeBytes: 100},
+			{ID: ulid.MustNew(2, nil), MinTime: 20, MaxTime: 30, SizeBytes: 200},
+		},
+		UpdatedAt: now.Unix(),
+	}))
+
+	stats := bucketindex.NewStatsRegistry()
+	fetcher := NewBucketIndexMetadataFetcher(userID, bkt, NewNoShardingStrategy(logger, nil), nil, logger, nil, nil).WithIndexStats(stats)
+	_, _, err := fetcher.Fetch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bucketindex.IndexStats{
+		userID: {Blocks: 2, MinTime: 10, MaxTime: 30, SizeBytes: 300, UpdatedAt: now.Unix()},
+	}, stats.AllIndexSummaries())
+
+	// The stats are removed once the bucket index is deleted.
+	require.NoError(t, bucketindex.DeleteIndex(ctx, bkt, userID, nil))
+	_, _, err = fetcher.Fetch(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, stats.AllIndexSummaries())
+}
+
 func TestBucketIndexMetadataFetcher_Fetch_NoBucketIndex(t *testing.T) {
 	t.Parallel()
 	const userID = "user-1"
@@ -35,6 +35,7 @@ import (
 
 	"github.com/cortexproject/cortex/pkg/storage/bucket"
 	"github.com/cortexproject/cortex/pkg/storage/tsdb"
+	"github.com/cortexproject/cortex/pkg/storage/tsdb/bucketindex"
 	"github.com/cortexproject/cortex/pkg/storage/tsdb/users"
 	"github.com/cortexproject/cortex/pkg/util"
 	"github.com/cortexproject/cortex/pkg/util/backoff"
@@ -74,6 +75,9 @@ type BucketStores struct {
 	storesMu sync.RWMutex
 	stores   map[string]*store.BucketStore
 
+	// Keeps the stats of the bucket index of each tenant, if the bucket index is enabled.
+	indexStats *bucketindex.StatsRegistry
+
 	// Keeps the last sync error for the  bucket store for each tenant.
 	storesErrorsMu sync.RWMutex
 	storesErrors   map[string]error
@@ -101,7 +105,7 @@ var ErrTooManyInflightRequests = status.Error(codes.ResourceExhausted, "too many
 // NewBucketStores makes a new BucketStores.
 func NewBucketStores(cfg tsdb.BlocksStorageConfig, shardingStrategy ShardingStrategy, bucketClient objstore.InstrumentedBucket, limits *validation.Overrides, logLevel logging.Level, logger log.Logger, reg prometheus.Registerer) (*BucketStores, error) {
 	matchers := tsdb.NewMatchers()
-	cachingBucket, err := tsdb.CreateCachingBucket(cfg.BucketStore.ChunksCache, cfg.BucketStore.MetadataCache, tsdb.ParquetLabelsCacheConfig{}, matchers, bucketClient, logger, reg)
+	cachingBucket, err := tsdb.CreateCachingBucket(cfg.BucketStore.ChunksCache, cfg.BucketStore.MetadataCache, tsdb.ParquetLabelsCacheConfig{}, cfg.BucketStore.InMemoryCachesMaxSize, cfg.BucketStore.MaxCacheFetchConcurrency, matchers, bucketClient, logger, reg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "create caching bucket")
 	}
@@ -122,6 +126,7 @@ func NewBucketStores(cfg tsdb.BlocksStorageConfig, shardingStrategy ShardingStra
 		shardingStrategy:   shardingStrategy,
 		stores:             map[string]*store.BucketStore{},
 		storesErrors:       map[string]error{},
+		indexStats:         bucketindex.NewStatsRegistry(),
 		logLevel:           logLevel,
 		bucketStoreMetrics: NewBucketStoreMetrics(),
 		metaFetcherMetrics: NewMetadataFetcherMetrics(),
@@ -494,6 +499,12 @@ var (
 	errBucketStoreNotFound = errors.New("bucket store not found")
 )
 
+// AllIndexSummaries returns a snapshot of the stats of the bucket index of each tenant loaded by the
+// store-gateway, as of their last sync. It's empty if the bucket index is disabled.
+func (u *BucketStores) AllIndexSummaries() map[string]bucketindex.IndexStats {
+	return u.indexStats.AllIndexSummaries()
+}
+
 // closeEmptyBucketStore closes bucket store for given user, if it is empty,
 // and removes it from bucket stores map and metrics.
 // If bucket store doesn't exist, returns errBucketStoreNotFound.
@@ -527,6 +538,7 @@ func (u *BucketStores) closeEmptyBucketStore(userID string) error {
 		u.userTokenBucketsMu.Unlock()
 	}
 
+	u.indexStats.Remove(userID)
 	u.metaFetcherMetrics.RemoveUserRegistry(userID)
 	u.bucketStoreMetrics.RemoveUserRegistry(userID)
 	return bs.Close()
@@ -608,7 +620,7 @@ func (u *BucketStores) getOrCreateStore(userID string) (*store.BucketStore, erro
 			u.limits,
 			u.logger,
 			fetcherReg,
-			filters)
+			filters).WithIndexStats(u.indexStats)
 	} else {
 		// Wrap the bucket reader to skip iterating the bucket at all if the user doesn't
 		// belong to the store-gateway shard. We need to run the BucketStore syncing anyway